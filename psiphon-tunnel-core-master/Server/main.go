@@ -43,6 +43,7 @@ var loadedConfigJSON []byte
 func main() {
 
 	var configFilename string
+	var configOverrideFilenames stringListFlag
 	var generateServerIPaddress string
 	var generateServerNetworkInterface string
 	var generateProtocolPorts stringListFlag
@@ -52,6 +53,7 @@ func main() {
 	var generateOSLConfigFilename string
 	var generateTacticsConfigFilename string
 	var generateServerEntryFilename string
+	var generateListenerAcceptorCount int
 
 	flag.StringVar(
 		&configFilename,
@@ -59,6 +61,11 @@ func main() {
 		server.SERVER_CONFIG_FILENAME,
 		"run or generate with this config `filename`")
 
+	flag.Var(
+		&configOverrideFilenames,
+		"configOverride",
+		"run or validate with this config override `filename` merged into the config; flag may be repeated, with later files taking precedence")
+
 	flag.StringVar(
 		&generateServerIPaddress,
 		"ipaddress",
@@ -112,12 +119,21 @@ func main() {
 		server.SERVER_ENTRY_FILENAME,
 		"generate with this server entry `filename`")
 
+	flag.IntVar(
+		&generateListenerAcceptorCount,
+		"acceptors",
+		0,
+		"generate with this `count` of acceptors per TCP listener; 0 for a single acceptor")
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
 			"Usage:\n\n"+
 				"%s <flags> generate    generates configuration files\n"+
+				"%s <flags> validate    validates configuration files\n"+
+				"%s <flags> rules <attributes>\n"+
+				"                        describes the traffic rules for the client attributes JSON\n"+
 				"%s <flags> run         runs configured services\n\n",
-			os.Args[0], os.Args[0])
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -178,6 +194,7 @@ func main() {
 					TrafficRulesConfigFilename: generateTrafficRulesConfigFilename,
 					OSLConfigFilename:          generateOSLConfigFilename,
 					TacticsConfigFilename:      generateTacticsConfigFilename,
+					ListenerAcceptorCount:      generateListenerAcceptorCount,
 				})
 		if err != nil {
 			fmt.Printf("generate failed: %s\n", err)
@@ -214,9 +231,65 @@ func main() {
 			os.Exit(1)
 		}
 
+	} else if args[0] == "validate" {
+
+		configJSON, err := loadConfigJSON(configFilename, configOverrideFilenames)
+		if err != nil {
+			fmt.Printf("error loading configuration file: %s\n", err)
+			os.Exit(1)
+		}
+
+		err = server.ValidateServerConfig(configJSON)
+		if err != nil {
+			fmt.Printf("validate failed: %s\n", err)
+			os.Exit(1)
+		}
+
+	} else if args[0] == "rules" {
+
+		if len(args) < 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		var attributes server.TrafficRulesClientAttributes
+		attributes.GeoIPData = server.NewGeoIPData()
+		err := json.Unmarshal([]byte(args[1]), &attributes)
+		if err != nil {
+			fmt.Printf("error parsing client attributes: %s\n", err)
+			os.Exit(1)
+		}
+
+		configJSON, err := loadConfigJSON(configFilename, configOverrideFilenames)
+		if err != nil {
+			fmt.Printf("error loading configuration file: %s\n", err)
+			os.Exit(1)
+		}
+
+		config, err := server.LoadConfig(configJSON)
+		if err != nil {
+			fmt.Printf("error parsing configuration file: %s\n", err)
+			os.Exit(1)
+		}
+
+		trafficRulesSet, err := server.NewTrafficRulesSet(config.TrafficRulesFilename)
+		if err != nil {
+			fmt.Printf("error loading traffic rules: %s\n", err)
+			os.Exit(1)
+		}
+
+		description, err := json.MarshalIndent(
+			trafficRulesSet.DescribeTrafficRulesFor(&attributes), "", "    ")
+		if err != nil {
+			fmt.Printf("error formatting traffic rules: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println(string(description))
+
 	} else if args[0] == "run" {
 
-		configJSON, err := ioutil.ReadFile(configFilename)
+		configJSON, err := loadConfigJSON(configFilename, configOverrideFilenames)
 		if err != nil {
 			fmt.Printf("error loading configuration file: %s\n", err)
 			os.Exit(1)
@@ -263,6 +336,31 @@ func main() {
 	}
 }
 
+// loadConfigJSON reads the config file and merges in any config override
+// files.
+func loadConfigJSON(configFilename string, configOverrideFilenames []string) ([]byte, error) {
+
+	configJSON, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(configOverrideFilenames) == 0 {
+		return configJSON, nil
+	}
+
+	configJSONs := [][]byte{configJSON}
+	for _, configOverrideFilename := range configOverrideFilenames {
+		configOverrideJSON, err := ioutil.ReadFile(configOverrideFilename)
+		if err != nil {
+			return nil, err
+		}
+		configJSONs = append(configJSONs, configOverrideJSON)
+	}
+
+	return server.MergeConfigJSON(configJSONs...)
+}
+
 type stringListFlag []string
 
 func (list *stringListFlag) String() string {
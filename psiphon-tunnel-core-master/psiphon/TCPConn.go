@@ -33,7 +33,8 @@ import (
 
 // TCPConn is a customized TCP connection that supports the Closer interface
 // and which may be created using options in DialConfig, including
-// UpstreamProxyURL, DeviceBinder, IPv6Synthesizer, and ResolvedIPCallback.
+// UpstreamProxyURL, DeviceBinder, IPv6Synthesizer, ResolvedIPCallback, and
+// CustomDialer.
 // DeviceBinder is implemented using SO_BINDTODEVICE/IP_BOUND_IF, which
 // requires syscall-level socket code.
 type TCPConn struct {
@@ -59,6 +60,35 @@ func NewTCPDialer(config *DialConfig) Dialer {
 func DialTCP(
 	ctx context.Context, addr string, config *DialConfig) (net.Conn, error) {
 
+	if config.CustomDialer != "" {
+
+		factory, ok := getCustomDialer(config.CustomDialer)
+		if !ok {
+			return nil, common.ContextError(
+				fmt.Errorf("unknown custom dialer: %s", config.CustomDialer))
+		}
+
+		underlying := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if network != "tcp" {
+				return nil, common.ContextError(fmt.Errorf("%s unsupported", network))
+			}
+			return dialTCP(ctx, addr, config)
+		}
+
+		conn, err := factory(underlying)(ctx, "tcp", addr)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		return conn, nil
+	}
+
+	return dialTCP(ctx, addr, config)
+}
+
+func dialTCP(
+	ctx context.Context, addr string, config *DialConfig) (net.Conn, error) {
+
 	var conn net.Conn
 	var err error
 
@@ -220,6 +220,12 @@ type VerificationKeyRing struct {
 
 // ValidateVerificationKeyRing checks that a verification key ring is
 // correctly configured.
+//
+// A key ring may contain multiple keys, including multiple keys for the
+// same access type; for example, during a key rotation transition period,
+// both the previous and the new verification key are present. Key IDs
+// should be unique within the key ring, but duplicates are not rejected;
+// see GetDuplicateVerificationKeyIDs.
 func ValidateVerificationKeyRing(keyRing *VerificationKeyRing) error {
 	for _, key := range keyRing.Keys {
 		if len(key.ID) != keyIDLength ||
@@ -231,6 +237,21 @@ func ValidateVerificationKeyRing(keyRing *VerificationKeyRing) error {
 	return nil
 }
 
+// GetDuplicateVerificationKeyIDs returns the key IDs that appear more than
+// once in the key ring. When key IDs are duplicated, authorizations are
+// verified with the first key in the key ring with the signing key ID.
+func GetDuplicateVerificationKeyIDs(keyRing *VerificationKeyRing) [][]byte {
+	var duplicateKeyIDs [][]byte
+	keyIDCounts := make(map[string]int)
+	for _, key := range keyRing.Keys {
+		keyIDCounts[string(key.ID)]++
+		if keyIDCounts[string(key.ID)] == 2 {
+			duplicateKeyIDs = append(duplicateKeyIDs, key.ID)
+		}
+	}
+	return duplicateKeyIDs
+}
+
 // VerifyAuthorization verifies the signed authorization and, when
 // verified, returns the embedded Authorization struct with the
 // access control information.
@@ -241,29 +262,50 @@ func VerifyAuthorization(
 	keyRing *VerificationKeyRing,
 	encodedSignedAuthorization string) (*Authorization, error) {
 
-	err := ValidateVerificationKeyRing(keyRing)
+	auth, _, err := VerifyAuthorizationWithKeyID(keyRing, encodedSignedAuthorization)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
+	return auth, nil
+}
+
+// VerifyAuthorizationWithKeyID is VerifyAuthorization, and additionally
+// returns the ID of the key ring verification key that verified the
+// authorization. The key ID may be used to track the progress of a key
+// rotation.
+//
+// Only the single verification key referenced by the signed authorization
+// is used to check the signature; the signature check is not repeated for
+// every key in the key ring. Once a key is removed from the key ring,
+// authorizations signed by the corresponding signing key no longer verify.
+func VerifyAuthorizationWithKeyID(
+	keyRing *VerificationKeyRing,
+	encodedSignedAuthorization string) (*Authorization, []byte, error) {
+
+	err := ValidateVerificationKeyRing(keyRing)
+	if err != nil {
+		return nil, nil, common.ContextError(err)
+	}
+
 	signedAuthorizationJSON, err := base64.StdEncoding.DecodeString(
 		encodedSignedAuthorization)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, nil, common.ContextError(err)
 	}
 
 	var signedAuth signedAuthorization
 	err = json.Unmarshal(signedAuthorizationJSON, &signedAuth)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, nil, common.ContextError(err)
 	}
 
 	if len(signedAuth.SigningKeyID) != keyIDLength {
-		return nil, common.ContextError(errors.New("invalid key ID length"))
+		return nil, nil, common.ContextError(errors.New("invalid key ID length"))
 	}
 
 	if len(signedAuth.Signature) != ed25519.SignatureSize {
-		return nil, common.ContextError(errors.New("invalid signature length"))
+		return nil, nil, common.ContextError(errors.New("invalid signature length"))
 	}
 
 	var verificationKey *VerificationKey
@@ -271,40 +313,41 @@ func VerifyAuthorization(
 	for _, key := range keyRing.Keys {
 		if subtle.ConstantTimeCompare(signedAuth.SigningKeyID, key.ID) == 1 {
 			verificationKey = key
+			break
 		}
 	}
 
 	if verificationKey == nil {
-		return nil, common.ContextError(errors.New("invalid key ID"))
+		return nil, nil, common.ContextError(errors.New("invalid key ID"))
 	}
 
 	if !ed25519.Verify(
 		verificationKey.PublicKey, signedAuth.Authorization, signedAuth.Signature) {
-		return nil, common.ContextError(errors.New("invalid signature"))
+		return nil, nil, common.ContextError(errors.New("invalid signature"))
 	}
 
 	var auth Authorization
 
 	err = json.Unmarshal(signedAuth.Authorization, &auth)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, nil, common.ContextError(err)
 	}
 
 	if len(auth.ID) == 0 {
-		return nil, common.ContextError(errors.New("invalid authentication ID"))
+		return nil, nil, common.ContextError(errors.New("invalid authentication ID"))
 	}
 
 	if auth.AccessType != verificationKey.AccessType {
-		return nil, common.ContextError(errors.New("invalid access type"))
+		return nil, nil, common.ContextError(errors.New("invalid access type"))
 	}
 
 	if auth.Expires.IsZero() {
-		return nil, common.ContextError(errors.New("invalid expiry"))
+		return nil, nil, common.ContextError(errors.New("invalid expiry"))
 	}
 
 	if auth.Expires.Before(time.Now().UTC()) {
-		return nil, common.ContextError(errors.New("expired authentication"))
+		return nil, nil, common.ContextError(errors.New("expired authentication"))
 	}
 
-	return &auth, nil
+	return &auth, verificationKey.ID, nil
 }
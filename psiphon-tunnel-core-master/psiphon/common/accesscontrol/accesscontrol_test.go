@@ -20,6 +20,7 @@
 package accesscontrol
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -183,3 +184,103 @@ func TestAuthorization(t *testing.T) {
 		t.Fatalf("VerifyAuthorization unexpected success")
 	}
 }
+
+func TestKeyRotation(t *testing.T) {
+
+	accessType := "access1"
+
+	previousSigningKey, previousVerificationKey, err := NewKeyPair(accessType)
+	if err != nil {
+		t.Fatalf("NewKeyPair failed: %s", err)
+	}
+
+	newSigningKey, newVerificationKey, err := NewKeyPair(accessType)
+	if err != nil {
+		t.Fatalf("NewKeyPair failed: %s", err)
+	}
+
+	keyRing := &VerificationKeyRing{
+		Keys: []*VerificationKey{previousVerificationKey, newVerificationKey},
+	}
+
+	id := []byte("0000000000000001")
+
+	expires := time.Now().Add(10 * time.Second)
+
+	previousAuth, err := IssueAuthorization(previousSigningKey, id, expires)
+	if err != nil {
+		t.Fatalf("IssueAuthorization failed: %s", err)
+	}
+
+	newAuth, err := IssueAuthorization(newSigningKey, id, expires)
+	if err != nil {
+		t.Fatalf("IssueAuthorization failed: %s", err)
+	}
+
+	// Test: authorizations signed with either key verify, and the verifying
+	// key ID is reported
+
+	_, keyID, err := VerifyAuthorizationWithKeyID(keyRing, previousAuth)
+	if err != nil {
+		t.Fatalf("VerifyAuthorizationWithKeyID failed: %s", err)
+	}
+
+	if !bytes.Equal(keyID, previousVerificationKey.ID) {
+		t.Fatalf("unexpected key ID")
+	}
+
+	_, keyID, err = VerifyAuthorizationWithKeyID(keyRing, newAuth)
+	if err != nil {
+		t.Fatalf("VerifyAuthorizationWithKeyID failed: %s", err)
+	}
+
+	if !bytes.Equal(keyID, newVerificationKey.ID) {
+		t.Fatalf("unexpected key ID")
+	}
+
+	if len(GetDuplicateVerificationKeyIDs(keyRing)) != 0 {
+		t.Fatalf("unexpected duplicate key IDs")
+	}
+
+	// Test: duplicate key IDs are reported, but not rejected
+
+	duplicateKeyRing := &VerificationKeyRing{
+		Keys: []*VerificationKey{
+			previousVerificationKey, newVerificationKey, previousVerificationKey},
+	}
+
+	err = ValidateVerificationKeyRing(duplicateKeyRing)
+	if err != nil {
+		t.Fatalf("ValidateVerificationKeyRing failed: %s", err)
+	}
+
+	duplicateKeyIDs := GetDuplicateVerificationKeyIDs(duplicateKeyRing)
+	if len(duplicateKeyIDs) != 1 ||
+		!bytes.Equal(duplicateKeyIDs[0], previousVerificationKey.ID) {
+		t.Fatalf("unexpected duplicate key IDs")
+	}
+
+	_, keyID, err = VerifyAuthorizationWithKeyID(duplicateKeyRing, previousAuth)
+	if err != nil {
+		t.Fatalf("VerifyAuthorizationWithKeyID failed: %s", err)
+	}
+
+	if !bytes.Equal(keyID, previousVerificationKey.ID) {
+		t.Fatalf("unexpected key ID")
+	}
+
+	// Test: once the previous key is removed, its authorizations no longer
+	// verify
+
+	keyRing.Keys = []*VerificationKey{newVerificationKey}
+
+	_, err = VerifyAuthorization(keyRing, previousAuth)
+	if err == nil {
+		t.Fatalf("VerifyAuthorization unexpected success")
+	}
+
+	_, err = VerifyAuthorization(keyRing, newAuth)
+	if err != nil {
+		t.Fatalf("VerifyAuthorization failed: %s", err)
+	}
+}
@@ -94,8 +94,6 @@ func newConfig(
 		maxDelay = parameters.FragmentorDownstreamMaxDelay
 	}
 
-	tunnelProtocols := p.TunnelProtocols(limitProtocols)
-
 	// When maxTotalBytes is 0 or the protocol is not a candidate for
 	// fragmentation, it's a certainty that no fragmentation will be
 	// performed.
@@ -107,7 +105,7 @@ func newConfig(
 	// TODO: when "seed" is not nil, the coin flip/range could be done here.
 
 	if p.Int(maxTotalBytes) == 0 ||
-		(len(tunnelProtocols) > 0 && !common.Contains(tunnelProtocols, tunnelProtocol)) {
+		!p.IsProtocolLimited(limitProtocols, tunnelProtocol) {
 
 		return nil
 	}
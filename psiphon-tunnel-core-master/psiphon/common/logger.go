@@ -19,6 +19,10 @@
 
 package common
 
+import (
+	"sort"
+)
+
 // Logger exposes a logging interface that's compatible with
 // psiphon/server.ContextLogger. This interface allows packages
 // to implement logging that will integrate with psiphon/server
@@ -50,3 +54,43 @@ type MetricsSource interface {
 	// metrics from the MetricsSource
 	GetMetrics() LogFields
 }
+
+// CombineMetricsSources returns a MetricsSource whose GetMetrics
+// returns the union of the metrics from all of the specified
+// sources. When sources provide the same metric name, the value
+// from the last such source is used. nil sources are skipped.
+func CombineMetricsSources(sources ...MetricsSource) MetricsSource {
+	return MetricsSources(sources)
+}
+
+// MetricsSources is a MetricsSource which combines the metrics
+// of a list of sources. See CombineMetricsSources.
+type MetricsSources []MetricsSource
+
+// GetMetrics implements the MetricsSource interface.
+func (sources MetricsSources) GetMetrics() LogFields {
+	metrics, _ := sources.MergeMetrics()
+	return metrics
+}
+
+// MergeMetrics returns the combined metrics, as GetMetrics does,
+// along with a sorted list of any metric names provided by more
+// than one source. Callers may log these collisions, which
+// indicate that a metric value from one source was overwritten.
+func (sources MetricsSources) MergeMetrics() (LogFields, []string) {
+	metrics := make(LogFields)
+	var collisions []string
+	for _, source := range sources {
+		if source == nil {
+			continue
+		}
+		for name, value := range source.GetMetrics() {
+			if _, ok := metrics[name]; ok && !Contains(collisions, name) {
+				collisions = append(collisions, name)
+			}
+			metrics[name] = value
+		}
+	}
+	sort.Strings(collisions)
+	return metrics, collisions
+}
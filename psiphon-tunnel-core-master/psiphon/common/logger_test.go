@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testMetricsSource LogFields
+
+func (source testMetricsSource) GetMetrics() LogFields {
+	return LogFields(source)
+}
+
+func TestMetricsSources(t *testing.T) {
+
+	testCases := []struct {
+		description        string
+		sources            MetricsSources
+		expectedMetrics    LogFields
+		expectedCollisions []string
+	}{
+		{
+			"no sources",
+			MetricsSources{},
+			LogFields{},
+			nil,
+		},
+		{
+			"nil sources",
+			MetricsSources{nil, testMetricsSource{"a": 1}, nil},
+			LogFields{"a": 1},
+			nil,
+		},
+		{
+			"distinct metrics",
+			MetricsSources{
+				testMetricsSource{"a": 1, "b": 2},
+				testMetricsSource{"c": 3},
+			},
+			LogFields{"a": 1, "b": 2, "c": 3},
+			nil,
+		},
+		{
+			"collisions",
+			MetricsSources{
+				testMetricsSource{"a": 1, "b": 2, "c": 3},
+				testMetricsSource{"b": 4},
+				testMetricsSource{"b": 5, "a": 6, "d": 7},
+			},
+			LogFields{"a": 6, "b": 5, "c": 3, "d": 7},
+			[]string{"a", "b"},
+		},
+		{
+			"collision with same value",
+			MetricsSources{
+				testMetricsSource{"a": 1},
+				testMetricsSource{"a": 1},
+			},
+			LogFields{"a": 1},
+			[]string{"a"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			metrics, collisions := testCase.sources.MergeMetrics()
+
+			if !reflect.DeepEqual(metrics, testCase.expectedMetrics) {
+				t.Fatalf("unexpected metrics: %+v", metrics)
+			}
+
+			if !reflect.DeepEqual(collisions, testCase.expectedCollisions) {
+				t.Fatalf("unexpected collisions: %+v", collisions)
+			}
+
+			metrics = testCase.sources.GetMetrics()
+
+			if !reflect.DeepEqual(metrics, testCase.expectedMetrics) {
+				t.Fatalf("unexpected GetMetrics metrics: %+v", metrics)
+			}
+
+			metrics = CombineMetricsSources(testCase.sources...).GetMetrics()
+
+			if !reflect.DeepEqual(metrics, testCase.expectedMetrics) {
+				t.Fatalf("unexpected CombineMetricsSources metrics: %+v", metrics)
+			}
+		})
+	}
+}
@@ -240,6 +240,7 @@ type ActivityMonitoredConn struct {
 	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
 	monotonicStartTime   int64
 	lastReadActivityTime int64
+	lastActivityTime     int64
 	realStartTime        time.Time
 	net.Conn
 	inactivityTimeout time.Duration
@@ -279,6 +280,7 @@ func NewActivityMonitoredConn(
 		realStartTime:        time.Now(),
 		monotonicStartTime:   now,
 		lastReadActivityTime: now,
+		lastActivityTime:     now,
 		activityUpdater:      activityUpdater,
 		lruEntry:             lruEntry,
 	}, nil
@@ -302,6 +304,13 @@ func (conn *ActivityMonitoredConn) GetLastActivityMonotime() monotime.Time {
 	return monotime.Time(atomic.LoadInt64(&conn.lastReadActivityTime))
 }
 
+// GetIdleDuration returns the time elapsed since the last activity which
+// extended the inactivity timeout: the last Read or, when activeOnWrite is
+// set, the last Write.
+func (conn *ActivityMonitoredConn) GetIdleDuration() time.Duration {
+	return time.Duration(int64(monotime.Now()) - atomic.LoadInt64(&conn.lastActivityTime))
+}
+
 func (conn *ActivityMonitoredConn) Read(buffer []byte) (int, error) {
 	n, err := conn.Conn.Read(buffer)
 	if err == nil {
@@ -325,6 +334,7 @@ func (conn *ActivityMonitoredConn) Read(buffer []byte) (int, error) {
 		}
 
 		atomic.StoreInt64(&conn.lastReadActivityTime, readActivityTime)
+		atomic.StoreInt64(&conn.lastActivityTime, readActivityTime)
 
 	}
 	// Note: no context error to preserve error type
@@ -346,6 +356,8 @@ func (conn *ActivityMonitoredConn) Write(buffer []byte) (int, error) {
 			conn.activityUpdater.UpdateProgress(0, int64(n), 0)
 		}
 
+		atomic.StoreInt64(&conn.lastActivityTime, int64(monotime.Now()))
+
 		if conn.lruEntry != nil {
 			conn.lruEntry.Touch()
 		}
@@ -364,3 +376,64 @@ func (conn *ActivityMonitoredConn) IsClosed() bool {
 	}
 	return closer.IsClosed()
 }
+
+// CountingConn wraps a net.Conn and tallies the number of bytes read from
+// and written to the conn. The counts are updated atomically and may be
+// read concurrently with I/O.
+type CountingConn struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesRead    int64
+	bytesWritten int64
+	net.Conn
+}
+
+// NewCountingConn creates a new CountingConn.
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{
+		Conn: conn,
+	}
+}
+
+func (conn *CountingConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	atomic.AddInt64(&conn.bytesRead, int64(n))
+	// Note: no context error to preserve error type
+	return n, err
+}
+
+func (conn *CountingConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	atomic.AddInt64(&conn.bytesWritten, int64(n))
+	// Note: no context error to preserve error type
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the conn.
+func (conn *CountingConn) BytesRead() int64 {
+	return atomic.LoadInt64(&conn.bytesRead)
+}
+
+// BytesWritten returns the number of bytes written to the conn.
+func (conn *CountingConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&conn.bytesWritten)
+}
+
+// GetMetrics implements the MetricsSource interface.
+func (conn *CountingConn) GetMetrics() LogFields {
+	return LogFields{
+		"bytes_read":    conn.BytesRead(),
+		"bytes_written": conn.BytesWritten(),
+	}
+}
+
+// IsClosed implements the Closer iterface. The return value
+// indicates whether the underlying conn has been closed.
+func (conn *CountingConn) IsClosed() bool {
+	closer, ok := conn.Conn.(Closer)
+	if !ok {
+		return false
+	}
+	return closer.IsClosed()
+}
@@ -21,6 +21,7 @@ package common
 
 import (
 	"net"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"testing/iotest"
@@ -176,6 +177,12 @@ func TestActivityMonitoredConn(t *testing.T) {
 	if diff > (1 * time.Millisecond).Nanoseconds() {
 		t.Fatalf("unexpected GetActiveDuration")
 	}
+
+	// With activeOnWrite, the last Write is the last activity.
+	idleDuration := conn.GetIdleDuration()
+	if idleDuration < 300*time.Millisecond || idleDuration > 1*time.Second {
+		t.Fatalf("unexpected GetIdleDuration")
+	}
 }
 
 func TestActivityMonitoredLRUConns(t *testing.T) {
@@ -273,3 +280,63 @@ func TestLRUConns(t *testing.T) {
 		t.Fatalf("unexpected IsClosed state")
 	}
 }
+
+func TestCountingConn(t *testing.T) {
+
+	conn := NewCountingConn(&dummyConn{t: t})
+
+	var metricsSource MetricsSource = conn
+
+	// Concurrent readers and writers, with reads of the counts, must
+	// result in exact totals.
+
+	workers := 10
+	iterations := 1000
+
+	var expectedRead, expectedWritten int64
+
+	waitGroup := new(sync.WaitGroup)
+	for i := 0; i < workers; i++ {
+		waitGroup.Add(2)
+		go func(size int) {
+			defer waitGroup.Done()
+			buffer := make([]byte, size)
+			for j := 0; j < iterations; j++ {
+				conn.Read(buffer)
+				_ = conn.BytesRead()
+			}
+			atomic.AddInt64(&expectedRead, int64(size*iterations))
+		}(i + 1)
+		go func(size int) {
+			defer waitGroup.Done()
+			buffer := make([]byte, size)
+			for j := 0; j < iterations; j++ {
+				conn.Write(buffer)
+				_ = metricsSource.GetMetrics()
+			}
+			atomic.AddInt64(&expectedWritten, int64(size*iterations))
+		}(2 * (i + 1))
+	}
+	waitGroup.Wait()
+
+	if conn.BytesRead() != expectedRead {
+		t.Fatalf("unexpected bytes read: %d != %d", conn.BytesRead(), expectedRead)
+	}
+
+	if conn.BytesWritten() != expectedWritten {
+		t.Fatalf("unexpected bytes written: %d != %d", conn.BytesWritten(), expectedWritten)
+	}
+
+	metrics := metricsSource.GetMetrics()
+
+	if metrics["bytes_read"] != expectedRead ||
+		metrics["bytes_written"] != expectedWritten {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	conn.Close()
+
+	if !conn.IsClosed() {
+		t.Fatalf("unexpected !IsClosed")
+	}
+}
@@ -30,43 +30,82 @@ import (
 // is returned.
 func GetInterfaceIPAddresses(interfaceName string) (net.IP, net.IP, error) {
 
-	var IPv4Address, IPv6Address net.IP
+	IPv4Address, IPv6Address, _, err := GetInterfaceIPAddressesWithPreference(
+		interfaceName, false)
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	return IPv4Address, IPv6Address, nil
+}
+
+// GetInterfaceIPAddressesWithPreference takes an interface name, such as
+// "eth0", and returns the first IPv4 and IPv6 addresses associated with it,
+// as GetInterfaceIPAddresses does, along with a list of all of its IPv4 and
+// IPv6 addresses. The list is ordered with addresses of the preferred family,
+// IPv6 when preferIPv6 is set and otherwise IPv4, first; within each family,
+// addresses are in the order reported by the interface.
+//
+// When the interface has addresses of only one family, the address for the
+// other family is nil and the list contains only the addresses of the
+// available family, regardless of preference. If neither type of address is
+// found, an error is returned.
+func GetInterfaceIPAddressesWithPreference(
+	interfaceName string, preferIPv6 bool) (net.IP, net.IP, []net.IP, error) {
 
 	availableInterfaces, err := net.InterfaceByName(interfaceName)
 	if err != nil {
-		return nil, nil, ContextError(err)
+		return nil, nil, nil, ContextError(err)
 	}
 
 	addrs, err := availableInterfaces.Addrs()
 	if err != nil {
-		return nil, nil, ContextError(err)
+		return nil, nil, nil, ContextError(err)
+	}
+
+	IPv4Address, IPv6Address, IPAddresses := getIPAddressesWithPreference(addrs, preferIPv6)
+
+	if IPv4Address == nil && IPv6Address == nil {
+		return nil, nil, nil, ContextError(
+			fmt.Errorf("Could not find any IP address for interface %s", interfaceName))
 	}
 
+	return IPv4Address, IPv6Address, IPAddresses, nil
+}
+
+func getIPAddressesWithPreference(
+	addrs []net.Addr, preferIPv6 bool) (net.IP, net.IP, []net.IP) {
+
+	var IPv4Addresses, IPv6Addresses []net.IP
+
 	for _, addr := range addrs {
 
-		ipNet := addr.(*net.IPNet)
-		if ipNet == nil {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet == nil {
 			continue
 		}
 
 		if ipNet.IP.To4() != nil {
-			if IPv4Address == nil {
-				IPv4Address = ipNet.IP
-			}
-		} else {
-			if IPv6Address == nil {
-				IPv6Address = ipNet.IP
-			}
+			IPv4Addresses = append(IPv4Addresses, ipNet.IP)
+		} else if ipNet.IP.To16() != nil {
+			IPv6Addresses = append(IPv6Addresses, ipNet.IP)
 		}
+	}
 
-		if IPv4Address != nil && IPv6Address != nil {
-			break
-		}
+	var IPv4Address, IPv6Address net.IP
+	if len(IPv4Addresses) > 0 {
+		IPv4Address = IPv4Addresses[0]
+	}
+	if len(IPv6Addresses) > 0 {
+		IPv6Address = IPv6Addresses[0]
 	}
 
-	if IPv4Address != nil || IPv6Address != nil {
-		return IPv4Address, IPv6Address, nil
+	var IPAddresses []net.IP
+	if preferIPv6 {
+		IPAddresses = append(IPv6Addresses, IPv4Addresses...)
+	} else {
+		IPAddresses = append(IPv4Addresses, IPv6Addresses...)
 	}
 
-	return nil, nil, ContextError(fmt.Errorf("Could not find any IP address for interface %s", interfaceName))
+	return IPv4Address, IPv6Address, IPAddresses
 }
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestGetIPAddressesWithPreference(t *testing.T) {
+
+	ipNet := func(address string) net.Addr {
+		return &net.IPNet{IP: net.ParseIP(address), Mask: net.CIDRMask(8, 32)}
+	}
+
+	ips := func(addresses ...string) []net.IP {
+		var result []net.IP
+		for _, address := range addresses {
+			result = append(result, net.ParseIP(address))
+		}
+		return result
+	}
+
+	dualStackAddrs := []net.Addr{
+		ipNet("fe80::1"),
+		ipNet("192.168.0.1"),
+		&net.IPAddr{IP: net.ParseIP("10.0.0.1")},
+		ipNet("2001:db8::1"),
+		ipNet("192.168.0.2"),
+	}
+
+	testCases := []struct {
+		description         string
+		addrs               []net.Addr
+		preferIPv6          bool
+		expectedIPv4Address net.IP
+		expectedIPv6Address net.IP
+		expectedIPAddresses []net.IP
+	}{
+		{
+			"dual stack prefer IPv4",
+			dualStackAddrs,
+			false,
+			net.ParseIP("192.168.0.1"),
+			net.ParseIP("fe80::1"),
+			ips("192.168.0.1", "192.168.0.2", "fe80::1", "2001:db8::1"),
+		},
+		{
+			"dual stack prefer IPv6",
+			dualStackAddrs,
+			true,
+			net.ParseIP("192.168.0.1"),
+			net.ParseIP("fe80::1"),
+			ips("fe80::1", "2001:db8::1", "192.168.0.1", "192.168.0.2"),
+		},
+		{
+			"IPv4 only prefer IPv6",
+			[]net.Addr{ipNet("192.168.0.1")},
+			true,
+			net.ParseIP("192.168.0.1"),
+			nil,
+			ips("192.168.0.1"),
+		},
+		{
+			"IPv6 only prefer IPv4",
+			[]net.Addr{ipNet("2001:db8::1")},
+			false,
+			nil,
+			net.ParseIP("2001:db8::1"),
+			ips("2001:db8::1"),
+		},
+		{
+			"no addresses",
+			[]net.Addr{&net.IPAddr{IP: net.ParseIP("10.0.0.1")}},
+			false,
+			nil,
+			nil,
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			IPv4Address, IPv6Address, IPAddresses := getIPAddressesWithPreference(
+				testCase.addrs, testCase.preferIPv6)
+
+			if !IPv4Address.Equal(testCase.expectedIPv4Address) {
+				t.Fatalf("unexpected IPv4 address: %s", IPv4Address)
+			}
+
+			if !IPv6Address.Equal(testCase.expectedIPv6Address) {
+				t.Fatalf("unexpected IPv6 address: %s", IPv6Address)
+			}
+
+			if len(IPAddresses) != len(testCase.expectedIPAddresses) {
+				t.Fatalf("unexpected IP addresses: %v", IPAddresses)
+			}
+			for i, IPAddress := range IPAddresses {
+				if !IPAddress.Equal(testCase.expectedIPAddresses[i]) {
+					t.Fatalf("unexpected IP addresses: %v", IPAddresses)
+				}
+			}
+		})
+	}
+}
+
+func TestGetInterfaceIPAddressesWithPreference(t *testing.T) {
+
+	// Find a loopback interface with at least one address.
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Interfaces failed: %s", err)
+	}
+
+	interfaceName := ""
+	for _, networkInterface := range interfaces {
+		if networkInterface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addrs, err := networkInterface.Addrs()
+		if err == nil && len(addrs) > 0 {
+			interfaceName = networkInterface.Name
+			break
+		}
+	}
+	if interfaceName == "" {
+		t.Skip("no loopback interface with addresses")
+	}
+
+	IPv4Address, IPv6Address, err := GetInterfaceIPAddresses(interfaceName)
+	if err != nil {
+		t.Fatalf("GetInterfaceIPAddresses failed: %s", err)
+	}
+
+	for _, preferIPv6 := range []bool{false, true} {
+
+		preferredIPv4Address, preferredIPv6Address, IPAddresses, err :=
+			GetInterfaceIPAddressesWithPreference(interfaceName, preferIPv6)
+		if err != nil {
+			t.Fatalf("GetInterfaceIPAddressesWithPreference failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(IPv4Address, preferredIPv4Address) ||
+			!reflect.DeepEqual(IPv6Address, preferredIPv6Address) {
+			t.Fatalf("unexpected addresses: %s, %s",
+				preferredIPv4Address, preferredIPv6Address)
+		}
+
+		if len(IPAddresses) == 0 {
+			t.Fatalf("missing IP addresses")
+		}
+
+		expectedFirstAddress := IPv4Address
+		if preferIPv6 && IPv6Address != nil || IPv4Address == nil {
+			expectedFirstAddress = IPv6Address
+		}
+		if !IPAddresses[0].Equal(expectedFirstAddress) {
+			t.Fatalf("unexpected first IP address: %s", IPAddresses[0])
+		}
+	}
+
+	_, _, _, err = GetInterfaceIPAddressesWithPreference("invalid-interface-name", false)
+	if err == nil {
+		t.Fatalf("GetInterfaceIPAddressesWithPreference unexpectedly succeeded")
+	}
+}
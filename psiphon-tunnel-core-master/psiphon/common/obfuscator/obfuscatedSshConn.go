@@ -122,19 +122,40 @@ func NewObfuscatedSSHConn(
 	obfuscationPaddingPRNGSeed *prng.Seed,
 	minPadding, maxPadding *int) (*ObfuscatedSSHConn, error) {
 
+	return newObfuscatedSSHConn(
+		mode,
+		conn,
+		&ObfuscatorConfig{
+			Keyword:         obfuscationKeyword,
+			PaddingPRNGSeed: obfuscationPaddingPRNGSeed,
+			MinPadding:      minPadding,
+			MaxPadding:      maxPadding,
+		})
+}
+
+// NewServerObfuscatedSSHConn creates a new ObfuscatedSSHConn in
+// OBFUSCATION_CONN_MODE_SERVER mode, using the specified obfuscator config.
+// This allows for server obfuscator options, such as AlternateKeywords and
+// SeedReadTimeout, which NewObfuscatedSSHConn doesn't set. As with NewObfuscatedSSHConn,
+// NewServerObfuscatedSSHConn blocks on reading the client seed message.
+func NewServerObfuscatedSSHConn(
+	conn net.Conn, config *ObfuscatorConfig) (*ObfuscatedSSHConn, error) {
+
+	return newObfuscatedSSHConn(OBFUSCATION_CONN_MODE_SERVER, conn, config)
+}
+
+func newObfuscatedSSHConn(
+	mode ObfuscatedSSHConnMode,
+	conn net.Conn,
+	config *ObfuscatorConfig) (*ObfuscatedSSHConn, error) {
+
 	var err error
 	var obfuscator *Obfuscator
 	var readDeobfuscate, writeObfuscate func([]byte)
 	var writeState ObfuscatedSSHWriteState
 
 	if mode == OBFUSCATION_CONN_MODE_CLIENT {
-		obfuscator, err = NewClientObfuscator(
-			&ObfuscatorConfig{
-				Keyword:         obfuscationKeyword,
-				PaddingPRNGSeed: obfuscationPaddingPRNGSeed,
-				MinPadding:      minPadding,
-				MaxPadding:      maxPadding,
-			})
+		obfuscator, err = NewClientObfuscator(config)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -143,10 +164,7 @@ func NewObfuscatedSSHConn(
 		writeState = OBFUSCATION_WRITE_STATE_CLIENT_SEND_SEED_MESSAGE
 	} else {
 		// NewServerObfuscator reads a seed message from conn
-		obfuscator, err = NewServerObfuscator(
-			conn, &ObfuscatorConfig{
-				Keyword: obfuscationKeyword,
-			})
+		obfuscator, err = NewServerObfuscator(conn, config)
 		if err != nil {
 			// TODO: readForver() equivalent
 			return nil, common.ContextError(err)
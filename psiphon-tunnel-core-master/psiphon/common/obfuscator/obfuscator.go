@@ -26,6 +26,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"net"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
@@ -64,6 +66,33 @@ type ObfuscatorConfig struct {
 	PaddingPRNGSeed *prng.Seed
 	MinPadding      *int
 	MaxPadding      *int
+
+	// AlternateKeywords is a list of additional keywords which
+	// NewServerObfuscator will accept, after first trying Keyword. This
+	// allows a server to accept clients using either an old or new keyword
+	// during keyword rotation. Each additional keyword adds the cost of a
+	// key derivation when processing seed messages which don't match
+	// earlier keywords, including all invalid seed messages.
+	// AlternateKeywords is not used by NewClientObfuscator.
+	AlternateKeywords []string
+
+	// SeedReadTimeout, when > 0 and the NewServerObfuscator clientReader is
+	// a net.Conn, bounds the time allowed to read the complete seed message.
+	// This ensures that a client sending a partial seed message doesn't
+	// tie up the server until the underlying conn times out.
+	//
+	// The seed message read deadline is not cleared once the seed message is
+	// read, as that would also clear any deadline managed by the conn, and
+	// the caller must clear or re-arm the read deadline. A conn which sets
+	// its own deadline after each read, such as
+	// common.ActivityMonitoredConn, re-arms it on the final seed message
+	// read.
+	SeedReadTimeout time.Duration
+
+	// obfuscatorSeed, when set, is used by NewClientObfuscator in place of
+	// a random obfuscator seed, making the seed message reproducible. This
+	// is for testing only and is set via a helper in the package tests.
+	obfuscatorSeed []byte
 }
 
 // NewClientObfuscator creates a new Obfuscator, staging a seed message to be
@@ -82,12 +111,15 @@ func NewClientObfuscator(
 
 	paddingPRNG := prng.NewPRNGWithSeed(config.PaddingPRNGSeed)
 
-	obfuscatorSeed, err := common.MakeSecureRandomBytes(OBFUSCATE_SEED_LENGTH)
-	if err != nil {
-		return nil, common.ContextError(err)
+	obfuscatorSeed := config.obfuscatorSeed
+	if obfuscatorSeed == nil {
+		obfuscatorSeed, err = common.MakeSecureRandomBytes(OBFUSCATE_SEED_LENGTH)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 	}
 
-	clientToServerCipher, serverToClientCipher, err := initObfuscatorCiphers(obfuscatorSeed, config)
+	clientToServerCipher, serverToClientCipher, err := initObfuscatorCiphers(obfuscatorSeed, config.Keyword)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -135,6 +167,12 @@ func NewClientObfuscator(
 // ObfuscatorConfig.PaddingPRNGSeed is not used, as the server obtains a PRNG
 // seed from the client's initial obfuscator message; this scheme allows for
 // optional replay of the downstream obfuscator padding.
+//
+// TODO: NewServerObfuscator does not record seed messages, so replayed seed
+// messages are not detected. A seed history should be bounded in size and
+// time window, configurable and reloadable by the server, report entries,
+// evictions, and replays blocked as metrics, and explicitly fail open or
+// closed when saturated.
 func NewServerObfuscator(
 	clientReader io.Reader, config *ObfuscatorConfig) (obfuscator *Obfuscator, err error) {
 
@@ -170,6 +208,26 @@ func (obfuscator *Obfuscator) GetPaddingLength() int {
 	return obfuscator.paddingLength
 }
 
+// GetSeedMessageStats returns statistics for the seed message, including the
+// obfuscation stream cipher and, for NewClientObfuscator, the realized
+// random padding length. This allows the padding distribution to be
+// observed when tuning MinPadding and MaxPadding.
+func (obfuscator *Obfuscator) GetSeedMessageStats() common.LogFields {
+	stats := common.LogFields{
+		"seed_message_cipher": "RC4",
+	}
+	if obfuscator.paddingLength != -1 {
+		stats["seed_message_padding_length"] = obfuscator.paddingLength
+	}
+	return stats
+}
+
+// GetMetrics implements the common.MetricsSource interface, returning
+// GetSeedMessageStats.
+func (obfuscator *Obfuscator) GetMetrics() common.LogFields {
+	return obfuscator.GetSeedMessageStats()
+}
+
 // SendSeedMessage returns the seed message created in NewObfuscatorClient,
 // removing the reference so that it may be garbage collected.
 func (obfuscator *Obfuscator) SendSeedMessage() []byte {
@@ -189,14 +247,14 @@ func (obfuscator *Obfuscator) ObfuscateServerToClient(buffer []byte) {
 }
 
 func initObfuscatorCiphers(
-	obfuscatorSeed []byte, config *ObfuscatorConfig) (*rc4.Cipher, *rc4.Cipher, error) {
+	obfuscatorSeed []byte, keyword string) (*rc4.Cipher, *rc4.Cipher, error) {
 
-	clientToServerKey, err := deriveKey(obfuscatorSeed, []byte(config.Keyword), []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
+	clientToServerKey, err := deriveKey(obfuscatorSeed, []byte(keyword), []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
 
-	serverToClientKey, err := deriveKey(obfuscatorSeed, []byte(config.Keyword), []byte(OBFUSCATE_SERVER_TO_CLIENT_IV))
+	serverToClientKey, err := deriveKey(obfuscatorSeed, []byte(keyword), []byte(OBFUSCATE_SERVER_TO_CLIENT_IV))
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
@@ -214,16 +272,22 @@ func initObfuscatorCiphers(
 	return clientToServerCipher, serverToClientCipher, nil
 }
 
+// deriveKey computes the obfuscation key. The random obfuscatorSeed is the
+// first input to the initial hash, so every one of the
+// OBFUSCATE_HASH_ITERATIONS rounds depends on the seed and no part of the
+// derivation can be precomputed or cached per keyword without changing the
+// protocol. Instead, the rounds reuse a single digest buffer to avoid
+// per-round allocations.
 func deriveKey(obfuscatorSeed, keyword, iv []byte) ([]byte, error) {
 	h := sha1.New()
 	h.Write(obfuscatorSeed)
 	h.Write(keyword)
 	h.Write(iv)
-	digest := h.Sum(nil)
+	digest := h.Sum(make([]byte, 0, sha1.Size))
 	for i := 0; i < OBFUSCATE_HASH_ITERATIONS; i++ {
 		h.Reset()
 		h.Write(digest)
-		digest = h.Sum(nil)
+		digest = h.Sum(digest[:0])
 	}
 	if len(digest) < OBFUSCATE_KEY_LENGTH {
 		return nil, common.ContextError(errors.New("insufficient bytes for obfuscation key"))
@@ -263,43 +327,73 @@ func makeSeedMessage(
 func readSeedMessage(
 	clientReader io.Reader, config *ObfuscatorConfig) (*rc4.Cipher, *rc4.Cipher, *prng.Seed, error) {
 
-	seed := make([]byte, OBFUSCATE_SEED_LENGTH)
-	_, err := io.ReadFull(clientReader, seed)
-	if err != nil {
-		return nil, nil, nil, common.ContextError(err)
+	if config.SeedReadTimeout > 0 {
+		if conn, ok := clientReader.(net.Conn); ok {
+			clientReader = &seedDeadlineReader{
+				conn:     conn,
+				deadline: time.Now().Add(config.SeedReadTimeout),
+			}
+		}
 	}
 
-	clientToServerCipher, serverToClientCipher, err := initObfuscatorCiphers(seed, config)
+	seed := make([]byte, OBFUSCATE_SEED_LENGTH)
+	err := readSeedMessageField(clientReader, seed)
 	if err != nil {
 		return nil, nil, nil, common.ContextError(err)
 	}
 
-	fixedLengthFields := make([]byte, 8) // 4 bytes each for magic value and padding length
-	_, err = io.ReadFull(clientReader, fixedLengthFields)
+	obfuscatedFixedLengthFields := make([]byte, 8) // 4 bytes each for magic value and padding length
+	err = readSeedMessageField(clientReader, obfuscatedFixedLengthFields)
 	if err != nil {
 		return nil, nil, nil, common.ContextError(err)
 	}
 
-	clientToServerCipher.XORKeyStream(fixedLengthFields, fixedLengthFields)
-
-	buffer := bytes.NewReader(fixedLengthFields)
-
+	// Try config.Keyword and then each of config.AlternateKeywords, using
+	// the first keyword for which the deobfuscated magic value is valid.
+	// Each attempt deobfuscates a copy of the fixed length fields, as the
+	// original is required for any subsequent attempt.
+	//
 	// The magic value must be validated before acting on paddingLength as
 	// paddingLength validation is vulnerable to a chosen ciphertext probing
 	// attack: only a fixed number of any possible byte value for each
 	// paddingLength is valid.
 
-	var magicValue, paddingLength int32
-	err = binary.Read(buffer, binary.BigEndian, &magicValue)
-	if err != nil {
-		return nil, nil, nil, common.ContextError(err)
-	}
-	err = binary.Read(buffer, binary.BigEndian, &paddingLength)
-	if err != nil {
-		return nil, nil, nil, common.ContextError(err)
+	keywords := append([]string{config.Keyword}, config.AlternateKeywords...)
+
+	var clientToServerCipher, serverToClientCipher *rc4.Cipher
+	var paddingLength int32
+
+	validKeyword := false
+	for _, keyword := range keywords {
+
+		clientToServerCipher, serverToClientCipher, err = initObfuscatorCiphers(seed, keyword)
+		if err != nil {
+			return nil, nil, nil, common.ContextError(err)
+		}
+
+		fixedLengthFields := append([]byte(nil), obfuscatedFixedLengthFields...)
+
+		clientToServerCipher.XORKeyStream(fixedLengthFields, fixedLengthFields)
+
+		buffer := bytes.NewReader(fixedLengthFields)
+
+		var magicValue int32
+		err = binary.Read(buffer, binary.BigEndian, &magicValue)
+		if err != nil {
+			return nil, nil, nil, common.ContextError(err)
+		}
+		err = binary.Read(buffer, binary.BigEndian, &paddingLength)
+		if err != nil {
+			return nil, nil, nil, common.ContextError(err)
+		}
+
+		if magicValue == OBFUSCATE_MAGIC_VALUE {
+			validKeyword = true
+			break
+		}
 	}
 
-	if magicValue != OBFUSCATE_MAGIC_VALUE {
+	if !validKeyword {
 		return nil, nil, nil, common.ContextError(errors.New("invalid magic value"))
 	}
 
@@ -308,7 +402,7 @@ func readSeedMessage(
 	}
 
 	padding := make([]byte, paddingLength)
-	_, err = io.ReadFull(clientReader, padding)
+	err = readSeedMessageField(clientReader, padding)
 	if err != nil {
 		return nil, nil, nil, common.ContextError(err)
 	}
@@ -336,3 +430,35 @@ func readSeedMessage(
 
 	return clientToServerCipher, serverToClientCipher, paddingPRNGSeed, nil
 }
+
+// seedDeadlineReader applies a fixed read deadline to each read of the seed
+// message. The deadline is set before every read, and not only once, since
+// conn may be a wrapper, such as common.ActivityMonitoredConn, which resets
+// the deadline after each read.
+type seedDeadlineReader struct {
+	conn     net.Conn
+	deadline time.Time
+}
+
+func (reader *seedDeadlineReader) Read(buffer []byte) (int, error) {
+	err := reader.conn.SetReadDeadline(reader.deadline)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	// Note: no context error to preserve error type
+	return reader.conn.Read(buffer)
+}
+
+// readSeedMessageField reads len(field) bytes of the seed message. A read
+// deadline timeout, as set for SeedReadTimeout, is reported with a distinct
+// error message.
+func readSeedMessageField(clientReader io.Reader, field []byte) error {
+	_, err := io.ReadFull(clientReader, field)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return common.ContextError(errors.New("seed message read timed out"))
+		}
+		return common.ContextError(err)
+	}
+	return nil
+}
@@ -23,11 +23,16 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 )
@@ -82,6 +87,424 @@ func TestObfuscator(t *testing.T) {
 	}
 }
 
+func TestObfuscatorSeedMessageStats(t *testing.T) {
+
+	paddingPRNGSeed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("prng.NewSeed failed: %s", err)
+	}
+
+	for _, maxPadding := range []int{prng.SEED_LENGTH, 256, OBFUSCATE_MAX_PADDING} {
+		t.Run(fmt.Sprintf("max padding %d", maxPadding), func(t *testing.T) {
+
+			config := &ObfuscatorConfig{
+				Keyword:         prng.HexString(32),
+				MaxPadding:      &maxPadding,
+				PaddingPRNGSeed: paddingPRNGSeed,
+			}
+
+			client, err := NewClientObfuscator(config)
+			if err != nil {
+				t.Fatalf("NewClientObfuscator failed: %s", err)
+			}
+
+			var metricsSource common.MetricsSource = client
+			stats := metricsSource.GetMetrics()
+
+			paddingLength, ok := stats["seed_message_padding_length"].(int)
+			if !ok || paddingLength != client.GetPaddingLength() {
+				t.Fatalf("unexpected padding length: %+v", stats)
+			}
+
+			if paddingLength < prng.SEED_LENGTH || paddingLength > maxPadding {
+				t.Fatalf("unexpected padding length: %d", paddingLength)
+			}
+
+			// The seed message consists of the seed, the magic value and
+			// padding length fields, and the padding.
+			seedMessage := client.SendSeedMessage()
+			if len(seedMessage) != OBFUSCATE_SEED_LENGTH+8+paddingLength {
+				t.Fatalf("unexpected seed message length: %d", len(seedMessage))
+			}
+
+			if stats["seed_message_cipher"] != "RC4" {
+				t.Fatalf("unexpected cipher: %+v", stats)
+			}
+
+			server, err := NewServerObfuscator(bytes.NewReader(seedMessage), config)
+			if err != nil {
+				t.Fatalf("NewServerObfuscator failed: %s", err)
+			}
+
+			stats = server.GetSeedMessageStats()
+			if _, ok := stats["seed_message_padding_length"]; ok {
+				t.Fatalf("unexpected server padding length: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestObfuscatorSeedReadTimeout(t *testing.T) {
+
+	maxPadding := 256
+
+	paddingPRNGSeed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("prng.NewSeed failed: %s", err)
+	}
+
+	seedReadTimeout := 200 * time.Millisecond
+
+	config := &ObfuscatorConfig{
+		Keyword:         prng.HexString(32),
+		MaxPadding:      &maxPadding,
+		PaddingPRNGSeed: paddingPRNGSeed,
+		SeedReadTimeout: seedReadTimeout,
+	}
+
+	client, err := NewClientObfuscator(config)
+	if err != nil {
+		t.Fatalf("NewClientObfuscator failed: %s", err)
+	}
+
+	seedMessage := client.SendSeedMessage()
+
+	testCases := []struct {
+		description    string
+		seedMessage    []byte
+		chunkSize      int
+		stall          bool
+		resetDeadlines bool
+		expectedError  string
+	}{
+		{"complete seed message", seedMessage, len(seedMessage), false, false, ""},
+		{"slow seed message", seedMessage, 8, false, false, ""},
+		{"partial seed message", seedMessage[:OBFUSCATE_SEED_LENGTH/2], 8, true, false, "seed message read timed out"},
+		{"partial fixed length fields", seedMessage[:OBFUSCATE_SEED_LENGTH+4], 8, true, false, "seed message read timed out"},
+		{"partial seed message, deadline resetting conn", seedMessage[:OBFUSCATE_SEED_LENGTH/2], 8, true, true, "seed message read timed out"},
+		{"invalid magic value", prng.Bytes(len(seedMessage)), len(seedMessage), false, false, "invalid magic value"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			// The slow reader writes the seed message in small chunks, with a
+			// delay between each chunk, and optionally then stalls without
+			// sending the remainder of the seed message.
+
+			go func() {
+				message := testCase.seedMessage
+				for len(message) > 0 {
+					n := testCase.chunkSize
+					if n > len(message) {
+						n = len(message)
+					}
+					_, err := clientConn.Write(message[:n])
+					if err != nil {
+						return
+					}
+					message = message[n:]
+					time.Sleep(time.Millisecond)
+				}
+			}()
+
+			// The deadline resetting conn, like common.ActivityMonitoredConn,
+			// extends the read deadline after each read.
+
+			var conn net.Conn = serverConn
+			if testCase.resetDeadlines {
+				conn = &deadlineResettingConn{Conn: serverConn}
+			}
+
+			startTime := time.Now()
+
+			_, err := NewServerObfuscator(conn, config)
+
+			elapsedTime := time.Since(startTime)
+
+			if testCase.expectedError == "" {
+				if err != nil {
+					t.Fatalf("NewServerObfuscator failed: %s", err)
+				}
+			} else {
+				if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+					t.Fatalf("unexpected NewServerObfuscator result: %v", err)
+				}
+			}
+
+			if testCase.stall && elapsedTime > 5*seedReadTimeout {
+				t.Fatalf("unexpected seed read time: %s", elapsedTime)
+			}
+
+			if err != nil {
+				return
+			}
+
+			// Test: the seed message read deadline is left in place after the
+			// seed message is read, unless re-armed by the conn
+
+			time.Sleep(2 * seedReadTimeout)
+
+			go clientConn.Write([]byte{0})
+
+			_, err = serverConn.Read(make([]byte, 1))
+			if testCase.resetDeadlines {
+				if err != nil {
+					t.Fatalf("Read failed: %s", err)
+				}
+			} else {
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					t.Fatalf("unexpected Read result: %v", err)
+				}
+			}
+		})
+	}
+}
+
+type deadlineResettingConn struct {
+	net.Conn
+}
+
+func (conn *deadlineResettingConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if err == nil {
+		conn.Conn.SetReadDeadline(time.Now().Add(time.Hour))
+	}
+	return n, err
+}
+
+func TestObfuscatorAlternateKeywords(t *testing.T) {
+
+	newKeyword := prng.HexString(32)
+	oldKeyword := prng.HexString(32)
+
+	serverConfig := &ObfuscatorConfig{
+		Keyword:           newKeyword,
+		AlternateKeywords: []string{oldKeyword},
+	}
+
+	testCases := []struct {
+		description   string
+		keyword       string
+		expectSuccess bool
+	}{
+		{"keyword", newKeyword, true},
+		{"alternate keyword", oldKeyword, true},
+		{"unknown keyword", prng.HexString(32), false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			paddingPRNGSeed, err := prng.NewSeed()
+			if err != nil {
+				t.Fatalf("prng.NewSeed failed: %s", err)
+			}
+
+			client, err := NewClientObfuscator(
+				&ObfuscatorConfig{
+					Keyword:         testCase.keyword,
+					PaddingPRNGSeed: paddingPRNGSeed,
+				})
+			if err != nil {
+				t.Fatalf("NewClientObfuscator failed: %s", err)
+			}
+
+			server, err := NewServerObfuscator(
+				bytes.NewReader(client.SendSeedMessage()), serverConfig)
+
+			if !testCase.expectSuccess {
+				if err == nil || !strings.Contains(err.Error(), "invalid magic value") {
+					t.Fatalf("unexpected NewServerObfuscator result: %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewServerObfuscator failed: %s", err)
+			}
+
+			clientMessage := []byte("client hello")
+
+			b := append([]byte(nil), clientMessage...)
+			client.ObfuscateClientToServer(b)
+			server.ObfuscateClientToServer(b)
+
+			if !bytes.Equal(clientMessage, b) {
+				t.Fatalf("unexpected client message")
+			}
+
+			serverMessage := []byte("server hello")
+
+			b = append([]byte(nil), serverMessage...)
+			server.ObfuscateServerToClient(b)
+			client.ObfuscateServerToClient(b)
+
+			if !bytes.Equal(serverMessage, b) {
+				t.Fatalf("unexpected server message")
+			}
+		})
+	}
+}
+
+func TestObfuscatorInjectedSeed(t *testing.T) {
+
+	keyword := prng.HexString(32)
+
+	paddingPRNGSeed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("prng.NewSeed failed: %s", err)
+	}
+
+	obfuscatorSeed := prng.Bytes(OBFUSCATE_SEED_LENGTH)
+
+	makeSeedMessage := func(obfuscatorSeed []byte) []byte {
+
+		config := &ObfuscatorConfig{
+			Keyword:         keyword,
+			PaddingPRNGSeed: paddingPRNGSeed,
+		}
+		if obfuscatorSeed != nil {
+			setTestObfuscatorSeed(config, obfuscatorSeed)
+		}
+
+		client, err := NewClientObfuscator(config)
+		if err != nil {
+			t.Fatalf("NewClientObfuscator failed: %s", err)
+		}
+
+		return client.SendSeedMessage()
+	}
+
+	seedMessage := makeSeedMessage(obfuscatorSeed)
+
+	if !bytes.Equal(seedMessage[:OBFUSCATE_SEED_LENGTH], obfuscatorSeed) {
+		t.Fatalf("unexpected obfuscator seed")
+	}
+
+	if !bytes.Equal(seedMessage, makeSeedMessage(obfuscatorSeed)) {
+		t.Fatalf("unexpected seed message with same injected seed")
+	}
+
+	if bytes.Equal(seedMessage, makeSeedMessage(prng.Bytes(OBFUSCATE_SEED_LENGTH))) {
+		t.Fatalf("unexpected seed message with different injected seed")
+	}
+
+	if bytes.Equal(seedMessage, makeSeedMessage(nil)) {
+		t.Fatalf("unexpected seed message with random seed")
+	}
+}
+
+// setTestObfuscatorSeed sets a fixed obfuscator seed for NewClientObfuscator.
+func setTestObfuscatorSeed(config *ObfuscatorConfig, obfuscatorSeed []byte) {
+	config.obfuscatorSeed = obfuscatorSeed
+}
+
+func TestDeriveKey(t *testing.T) {
+
+	// referenceDeriveKey is the straightforward form of the key derivation,
+	// allocating a new digest in each round.
+	referenceDeriveKey := func(obfuscatorSeed, keyword, iv []byte) []byte {
+		h := sha1.New()
+		h.Write(obfuscatorSeed)
+		h.Write(keyword)
+		h.Write(iv)
+		digest := h.Sum(nil)
+		for i := 0; i < OBFUSCATE_HASH_ITERATIONS; i++ {
+			h.Reset()
+			h.Write(digest)
+			digest = h.Sum(nil)
+		}
+		return digest[0:OBFUSCATE_KEY_LENGTH]
+	}
+
+	for i := 0; i < 10; i++ {
+
+		obfuscatorSeed := prng.Bytes(OBFUSCATE_SEED_LENGTH)
+		keyword := []byte(prng.HexString(32))
+
+		for _, iv := range []string{
+			OBFUSCATE_CLIENT_TO_SERVER_IV, OBFUSCATE_SERVER_TO_CLIENT_IV} {
+
+			key, err := deriveKey(obfuscatorSeed, keyword, []byte(iv))
+			if err != nil {
+				t.Fatalf("deriveKey failed: %s", err)
+			}
+
+			if !bytes.Equal(key, referenceDeriveKey(obfuscatorSeed, keyword, []byte(iv))) {
+				t.Fatalf("unexpected key")
+			}
+		}
+	}
+
+	// Known answer, ensuring the derivation remains compatible with
+	// existing peers.
+
+	key, err := deriveKey(
+		make([]byte, OBFUSCATE_SEED_LENGTH),
+		[]byte("keyword"),
+		[]byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
+	if err != nil {
+		t.Fatalf("deriveKey failed: %s", err)
+	}
+
+	if hex.EncodeToString(key) != "d037cd4f5d41d59df06b491511490f39" {
+		t.Fatalf("unexpected key: %x", key)
+	}
+}
+
+func BenchmarkDeriveKey(b *testing.B) {
+
+	obfuscatorSeed := prng.Bytes(OBFUSCATE_SEED_LENGTH)
+	keyword := []byte(prng.HexString(32))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := deriveKey(
+			obfuscatorSeed, keyword, []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
+		if err != nil {
+			b.Fatalf("deriveKey failed: %s", err)
+		}
+	}
+}
+
+// BenchmarkObfuscator measures a client and server obfuscator round trip,
+// which is dominated by the OBFUSCATE_HASH_ITERATIONS key derivations.
+func BenchmarkObfuscator(b *testing.B) {
+
+	paddingPRNGSeed, err := prng.NewSeed()
+	if err != nil {
+		b.Fatalf("prng.NewSeed failed: %s", err)
+	}
+
+	config := &ObfuscatorConfig{
+		Keyword:         prng.HexString(32),
+		PaddingPRNGSeed: paddingPRNGSeed,
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+
+		client, err := NewClientObfuscator(config)
+		if err != nil {
+			b.Fatalf("NewClientObfuscator failed: %s", err)
+		}
+
+		_, err = NewServerObfuscator(
+			bytes.NewReader(client.SendSeedMessage()), config)
+		if err != nil {
+			b.Fatalf("NewServerObfuscator failed: %s", err)
+		}
+	}
+}
+
 func TestObfuscatedSSHConn(t *testing.T) {
 
 	keyword := prng.HexString(32)
@@ -179,3 +602,165 @@ func TestObfuscatedSSHConn(t *testing.T) {
 		t.Fatalf("obfuscated SSH handshake failed: %s", err)
 	}
 }
+
+func TestServerObfuscatedSSHConnSeedReadTimeout(t *testing.T) {
+
+	keyword := prng.HexString(32)
+
+	paddingPRNGSeed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("prng.NewSeed failed: %s", err)
+	}
+
+	client, err := NewClientObfuscator(
+		&ObfuscatorConfig{Keyword: keyword, PaddingPRNGSeed: paddingPRNGSeed})
+	if err != nil {
+		t.Fatalf("NewClientObfuscator failed: %s", err)
+	}
+
+	seedMessage := client.SendSeedMessage()
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// Send a partial seed message and then stall.
+
+	go clientConn.Write(seedMessage[:OBFUSCATE_SEED_LENGTH/2])
+
+	seedReadTimeout := 100 * time.Millisecond
+
+	startTime := time.Now()
+
+	_, err = NewServerObfuscatedSSHConn(
+		serverConn,
+		&ObfuscatorConfig{Keyword: keyword, SeedReadTimeout: seedReadTimeout})
+
+	if err == nil || !strings.Contains(err.Error(), "seed message read timed out") {
+		t.Fatalf("unexpected NewServerObfuscatedSSHConn result: %v", err)
+	}
+
+	if time.Since(startTime) > 5*seedReadTimeout {
+		t.Fatalf("unexpected seed read time: %s", time.Since(startTime))
+	}
+}
+
+func TestServerObfuscatedSSHConnInactivityDeadline(t *testing.T) {
+
+	keyword := prng.HexString(32)
+
+	paddingPRNGSeed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("prng.NewSeed failed: %s", err)
+	}
+
+	client, err := NewClientObfuscator(
+		&ObfuscatorConfig{Keyword: keyword, PaddingPRNGSeed: paddingPRNGSeed})
+	if err != nil {
+		t.Fatalf("NewClientObfuscator failed: %s", err)
+	}
+
+	seedMessage := client.SendSeedMessage()
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	seedReadTimeout := 100 * time.Millisecond
+	inactivityTimeout := 500 * time.Millisecond
+
+	// As in the server, the ActivityMonitoredConn sets an inactivity read
+	// deadline after each read.
+
+	activityConn, err := common.NewActivityMonitoredConn(
+		serverConn, inactivityTimeout, false, nil, nil)
+	if err != nil {
+		t.Fatalf("NewActivityMonitoredConn failed: %s", err)
+	}
+
+	go clientConn.Write(seedMessage)
+
+	_, err = NewServerObfuscatedSSHConn(
+		activityConn,
+		&ObfuscatorConfig{Keyword: keyword, SeedReadTimeout: seedReadTimeout})
+	if err != nil {
+		t.Fatalf("NewServerObfuscatedSSHConn failed: %s", err)
+	}
+
+	// Test: when the client stalls after the seed message, the inactivity
+	// deadline, and not the seed message read deadline, applies
+
+	// Unblock the Read, with a non-timeout error, if no deadline is set.
+	closeTimer := time.AfterFunc(5*inactivityTimeout, func() { serverConn.Close() })
+	defer closeTimer.Stop()
+
+	startTime := time.Now()
+
+	_, err = activityConn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("unexpected Read result: %v", err)
+	}
+
+	elapsedTime := time.Since(startTime)
+	if elapsedTime < inactivityTimeout/2 || elapsedTime > 2*inactivityTimeout {
+		t.Fatalf("unexpected inactivity timeout: %s", elapsedTime)
+	}
+}
+
+func TestServerObfuscatedSSHConnAlternateKeywords(t *testing.T) {
+
+	keyword := prng.HexString(32)
+	alternateKeyword := prng.HexString(32)
+
+	testCases := []struct {
+		description   string
+		clientKeyword string
+		expectSuccess bool
+	}{
+		{"keyword", keyword, true},
+		{"alternate keyword", alternateKeyword, true},
+		{"unknown keyword", prng.HexString(32), false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			paddingPRNGSeed, err := prng.NewSeed()
+			if err != nil {
+				t.Fatalf("prng.NewSeed failed: %s", err)
+			}
+
+			obfuscatedClientConn, err := NewObfuscatedSSHConn(
+				OBFUSCATION_CONN_MODE_CLIENT,
+				clientConn,
+				testCase.clientKeyword,
+				paddingPRNGSeed,
+				nil, nil)
+			if err != nil {
+				t.Fatalf("NewObfuscatedSSHConn failed: %s", err)
+			}
+
+			// The client sends its seed message on the first write.
+
+			go obfuscatedClientConn.Write([]byte("SSH-2.0-Test\r\n"))
+
+			_, err = NewServerObfuscatedSSHConn(
+				serverConn,
+				&ObfuscatorConfig{
+					Keyword:           keyword,
+					AlternateKeywords: []string{alternateKeyword},
+				})
+
+			if testCase.expectSuccess && err != nil {
+				t.Fatalf("NewServerObfuscatedSSHConn failed: %s", err)
+			}
+			if !testCase.expectSuccess && err == nil {
+				t.Fatalf("NewServerObfuscatedSSHConn unexpectedly succeeded")
+			}
+		})
+	}
+}
@@ -57,6 +57,7 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -74,6 +75,7 @@ const (
 	TacticsTimeout                                   = "TacticsTimeout"
 	ConnectionWorkerPoolSize                         = "ConnectionWorkerPoolSize"
 	TunnelConnectTimeout                             = "TunnelConnectTimeout"
+	TunnelConnectTimeouts                            = "TunnelConnectTimeouts"
 	EstablishTunnelTimeout                           = "EstablishTunnelTimeout"
 	EstablishTunnelWorkTime                          = "EstablishTunnelWorkTime"
 	EstablishTunnelPausePeriod                       = "EstablishTunnelPausePeriod"
@@ -91,8 +93,10 @@ const (
 	InitialLimitTunnelProtocolsCandidateCount        = "InitialLimitTunnelProtocolsCandidateCount"
 	LimitTunnelProtocolsProbability                  = "LimitTunnelProtocolsProbability"
 	LimitTunnelProtocols                             = "LimitTunnelProtocols"
+	TunnelProtocolSelectionWeights                   = "TunnelProtocolSelectionWeights"
 	LimitTLSProfilesProbability                      = "LimitTLSProfilesProbability"
 	LimitTLSProfiles                                 = "LimitTLSProfiles"
+	TLSProfileSelectionWeights                       = "TLSProfileSelectionWeights"
 	LimitQUICVersionsProbability                     = "LimitQUICVersionsProbability"
 	LimitQUICVersions                                = "LimitQUICVersions"
 	FragmentorProbability                            = "FragmentorProbability"
@@ -151,6 +155,8 @@ const (
 	SplitTunnelRoutesURLFormat                       = "SplitTunnelRoutesURLFormat"
 	SplitTunnelRoutesSignaturePublicKey              = "SplitTunnelRoutesSignaturePublicKey"
 	SplitTunnelDNSServer                             = "SplitTunnelDNSServer"
+	ResolveIPTimeout                                 = "ResolveIPTimeout"
+	ResolveIPRetryCount                              = "ResolveIPRetryCount"
 	FetchUpgradeTimeout                              = "FetchUpgradeTimeout"
 	FetchUpgradeRetryPeriod                          = "FetchUpgradeRetryPeriod"
 	FetchUpgradeStalePeriod                          = "FetchUpgradeStalePeriod"
@@ -206,6 +212,10 @@ const (
 	PersistentStatsMaxSendBytes                      = "PersistentStatsMaxSendBytes"
 	RecordRemoteServerListPersistentStatsProbability = "RecordRemoteServerListPersistentStatsProbability"
 	RecordFailedTunnelPersistentStatsProbability     = "RecordFailedTunnelPersistentStatsProbability"
+	ServerEntryImportGCThreshold                     = "ServerEntryImportGCThreshold"
+	ServerEntryImportBatchSize                       = "ServerEntryImportBatchSize"
+	ServerEntryCacheSize                             = "ServerEntryCacheSize"
+	ServerEntryShuffleTopPercent                     = "ServerEntryShuffleTopPercent"
 )
 
 const (
@@ -213,6 +223,11 @@ const (
 	serverSideOnly              = 2
 )
 
+// networkLatencyMultiplierMaximum is the maximum NetworkLatencyMultiplier
+// applied to duration parameters. Larger multipliers, which may be received
+// in tactics, are clamped to this value so that timeouts remain bounded.
+const networkLatencyMultiplierMaximum = 10.0
+
 // defaultClientParameters specifies the type, default value, and minimum
 // value for all dynamically configurable client parameters.
 //
@@ -228,7 +243,10 @@ var defaultClientParameters = map[string]struct {
 	flags   int32
 }{
 	// NetworkLatencyMultiplier defaults to 0, meaning off. But when set, it
-	// must be a multiplier >= 1.
+	// must be a multiplier >= 1. The multiplier is applied, clamped to
+	// networkLatencyMultiplierMaximum, only to duration parameters with the
+	// useNetworkLatencyMultiplier flag; parameters without the flag, such as
+	// pause periods, are exempt from scaling.
 
 	NetworkLatencyMultiplier: {value: 0.0, minimum: 1.0},
 
@@ -239,6 +257,7 @@ var defaultClientParameters = map[string]struct {
 
 	ConnectionWorkerPoolSize:                 {value: 10, minimum: 1},
 	TunnelConnectTimeout:                     {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	TunnelConnectTimeouts:                    {value: TunnelProtocolDurations{}, flags: useNetworkLatencyMultiplier},
 	EstablishTunnelTimeout:                   {value: 300 * time.Second, minimum: time.Duration(0)},
 	EstablishTunnelWorkTime:                  {value: 60 * time.Second, minimum: 1 * time.Second},
 	EstablishTunnelPausePeriod:               {value: 5 * time.Second, minimum: 1 * time.Millisecond},
@@ -265,9 +284,13 @@ var defaultClientParameters = map[string]struct {
 	LimitTunnelProtocolsProbability: {value: 1.0, minimum: 0.0},
 	LimitTunnelProtocols:            {value: protocol.TunnelProtocols{}},
 
+	TunnelProtocolSelectionWeights: {value: TunnelProtocolWeights{}},
+
 	LimitTLSProfilesProbability: {value: 1.0, minimum: 0.0},
 	LimitTLSProfiles:            {value: protocol.TLSProfiles{}},
 
+	TLSProfileSelectionWeights: {value: TLSProfileWeights{}},
+
 	LimitQUICVersionsProbability: {value: 1.0, minimum: 0.0},
 	LimitQUICVersions:            {value: protocol.QUICVersions{}},
 
@@ -352,6 +375,8 @@ var defaultClientParameters = map[string]struct {
 	SplitTunnelRoutesURLFormat:          {value: ""},
 	SplitTunnelRoutesSignaturePublicKey: {value: ""},
 	SplitTunnelDNSServer:                {value: ""},
+	ResolveIPTimeout:                    {value: 5 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+	ResolveIPRetryCount:                 {value: 2, minimum: 0},
 
 	FetchUpgradeTimeout:                {value: 60 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	FetchUpgradeRetryPeriod:            {value: 30 * time.Second, minimum: 1 * time.Millisecond},
@@ -420,6 +445,28 @@ var defaultClientParameters = map[string]struct {
 	PersistentStatsMaxSendBytes:                      {value: 65536, minimum: 1},
 	RecordRemoteServerListPersistentStatsProbability: {value: 1.0, minimum: 0.0},
 	RecordFailedTunnelPersistentStatsProbability:     {value: 0.0, minimum: 0.0},
+
+	ServerEntryImportGCThreshold: {value: 20, minimum: 1},
+	ServerEntryImportBatchSize:   {value: 100, minimum: 1},
+	ServerEntryCacheSize:         {value: 0, minimum: 0},
+	ServerEntryShuffleTopPercent: {value: 0, minimum: 0},
+}
+
+// rangeClientParameters specifies pairs of client parameters, of the same
+// type, which specify a range. Set rejects, or skips when skipOnError is set,
+// values which result in a range minimum greater than its maximum.
+var rangeClientParameters = []struct {
+	minimum string
+	maximum string
+}{
+	{FragmentorMinTotalBytes, FragmentorMaxTotalBytes},
+	{FragmentorMinWriteBytes, FragmentorMaxWriteBytes},
+	{FragmentorMinDelay, FragmentorMaxDelay},
+	{FragmentorDownstreamMinTotalBytes, FragmentorDownstreamMaxTotalBytes},
+	{FragmentorDownstreamMinWriteBytes, FragmentorDownstreamMaxWriteBytes},
+	{FragmentorDownstreamMinDelay, FragmentorDownstreamMaxDelay},
+	{LivenessTestMinUpstreamBytes, LivenessTestMaxUpstreamBytes},
+	{LivenessTestMinDownstreamBytes, LivenessTestMaxDownstreamBytes},
 }
 
 // IsServerSideOnly indicates if the parameter specified by name is used
@@ -430,9 +477,10 @@ func IsServerSideOnly(name string) bool {
 }
 
 // ClientParameters is a set of client parameters. To use the parameters, call
-// Get. To apply new values to the parameters, call Set.
+// Get. To apply new values to the parameters, call Set or SetMerge.
 type ClientParameters struct {
 	getValueLogger func(error)
+	setMutex       sync.Mutex
 	snapshot       atomic.Value
 }
 
@@ -482,7 +530,11 @@ func makeDefaultParameters() (map[string]interface{}, error) {
 			return nil, common.ContextError(fmt.Errorf("default parameter value and minimum type mismatch: %s", name))
 		}
 
-		_, isDuration := defaults.value.(time.Duration)
+		isDuration := false
+		switch defaults.value.(type) {
+		case time.Duration, TunnelProtocolDurations:
+			isDuration = true
+		}
 		if defaults.flags&useNetworkLatencyMultiplier != 0 && !isDuration {
 			return nil, common.ContextError(fmt.Errorf("default non-duration parameter uses multipler: %s", name))
 		}
@@ -512,17 +564,73 @@ func makeDefaultParameters() (map[string]interface{}, error) {
 func (p *ClientParameters) Set(
 	tag string, skipOnError bool, applyParameters ...map[string]interface{}) ([]int, error) {
 
-	var counts []int
+	p.setMutex.Lock()
+	defer p.setMutex.Unlock()
 
 	parameters, err := makeDefaultParameters()
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
+	counts, err := p.apply(tag, skipOnError, parameters, applyParameters)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return counts, nil
+}
+
+// SetMerge applies applyParameters on top of the current parameters. Unlike
+// Set, parameters previously applied by Set or SetMerge, and not specified in
+// applyParameters, are retained. The new parameters are tagged with tag.
+//
+// skipOnError, validation, and the returned count are as in Set. When an
+// error is returned, the previous parameters remain completely unmodified.
+func (p *ClientParameters) SetMerge(
+	tag string, skipOnError bool, applyParameters map[string]interface{}) (int, error) {
+
+	p.setMutex.Lock()
+	defer p.setMutex.Unlock()
+
+	// Values in the current snapshot are treated as read-only and are not
+	// modified by apply, so a shallow copy suffices.
+	parameters := make(map[string]interface{})
+	for name, value := range p.Get().parameters {
+		parameters[name] = value
+	}
+
+	counts, err := p.apply(
+		tag, skipOnError, parameters, []map[string]interface{}{applyParameters})
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return counts[0], nil
+}
+
+// apply applies each applyParameters to parameters, in turn, and then stores
+// the result as the current snapshot. The caller must hold setMutex.
+func (p *ClientParameters) apply(
+	tag string,
+	skipOnError bool,
+	parameters map[string]interface{},
+	applyParameters []map[string]interface{}) ([]int, error) {
+
+	var counts []int
+
 	for i := 0; i < len(applyParameters); i++ {
 
 		count := 0
 
+		// Record the current values of range parameters, which are restored
+		// when a range is invalid after applying this set of parameters.
+		previousRangeValues := make(map[string]interface{})
+		for _, rangeParameter := range rangeClientParameters {
+			previousRangeValues[rangeParameter.minimum] = parameters[rangeParameter.minimum]
+			previousRangeValues[rangeParameter.maximum] = parameters[rangeParameter.maximum]
+		}
+		appliedParameters := make(map[string]bool)
+
 		for name, value := range applyParameters[i] {
 
 			existingValue, ok := parameters[name]
@@ -590,6 +698,33 @@ func (p *ClientParameters) Set(
 						return nil, common.ContextError(err)
 					}
 				}
+			case TunnelProtocolWeights:
+				if skipOnError {
+					newValue = v.PruneInvalid()
+				} else {
+					err := v.Validate()
+					if err != nil {
+						return nil, common.ContextError(err)
+					}
+				}
+			case TunnelProtocolDurations:
+				if skipOnError {
+					newValue = v.PruneInvalid()
+				} else {
+					err := v.Validate()
+					if err != nil {
+						return nil, common.ContextError(err)
+					}
+				}
+			case TLSProfileWeights:
+				if skipOnError {
+					newValue = v.PruneInvalid()
+				} else {
+					err := v.Validate()
+					if err != nil {
+						return nil, common.ContextError(err)
+					}
+				}
 			case protocol.TLSProfiles:
 				if skipOnError {
 					newValue = v.PruneInvalid()
@@ -645,10 +780,38 @@ func (p *ClientParameters) Set(
 			}
 
 			parameters[name] = newValue
+			appliedParameters[name] = true
 
 			count++
 		}
 
+		// Validate ranges once all parameters in this set are applied, as a
+		// new range may set both the minimum and the maximum. When skipping,
+		// both values of an invalid range are restored; the previous values
+		// were either defaults or validated when applied.
+		for _, rangeParameter := range rangeClientParameters {
+			valid, err := isValidRange(
+				parameters[rangeParameter.minimum], parameters[rangeParameter.maximum])
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			if valid {
+				continue
+			}
+			if !skipOnError {
+				return nil, common.ContextError(
+					fmt.Errorf("parameter %s exceeds %s",
+						rangeParameter.minimum, rangeParameter.maximum))
+			}
+			for _, name := range []string{rangeParameter.minimum, rangeParameter.maximum} {
+				if appliedParameters[name] {
+					parameters[name] = previousRangeValues[name]
+					delete(appliedParameters, name)
+					count--
+				}
+			}
+		}
+
 		counts = append(counts, count)
 	}
 
@@ -663,6 +826,23 @@ func (p *ClientParameters) Set(
 	return counts, nil
 }
 
+// isValidRange returns true when minimum <= maximum. minimum and maximum
+// must have the same type, either int or time.Duration.
+func isValidRange(minimum, maximum interface{}) (bool, error) {
+	switch m := minimum.(type) {
+	case int:
+		if n, ok := maximum.(int); ok {
+			return m <= n, nil
+		}
+	case time.Duration:
+		if n, ok := maximum.(time.Duration); ok {
+			return m <= n, nil
+		}
+	}
+	return false, common.ContextError(
+		fmt.Errorf("unexpected range parameter types: %T, %T", minimum, maximum))
+}
+
 // Get returns the current parameters. Values read from the current parameters
 // are not deep copies and must be treated read-only.
 func (p *ClientParameters) Get() *ClientParametersSnapshot {
@@ -766,16 +946,28 @@ func (p *ClientParametersSnapshot) WeightedCoinFlip(name string) bool {
 
 // Duration returns a time.Duration parameter value. When the duration
 // parameter has the useNetworkLatencyMultiplier flag, the
-// NetworkLatencyMultiplier is applied to the returned value.
+// NetworkLatencyMultiplier, clamped to networkLatencyMultiplierMaximum, is
+// applied to the returned value.
 func (p *ClientParametersSnapshot) Duration(name string) time.Duration {
 	value := time.Duration(0)
 	p.getValue(name, &value)
+	return p.applyNetworkLatencyMultiplier(name, value)
+}
+
+// applyNetworkLatencyMultiplier applies the NetworkLatencyMultiplier to a
+// duration value of the named parameter, when that parameter has the
+// useNetworkLatencyMultiplier flag.
+func (p *ClientParametersSnapshot) applyNetworkLatencyMultiplier(
+	name string, value time.Duration) time.Duration {
 
 	defaultParameter, ok := defaultClientParameters[name]
 	if value > 0 && ok && defaultParameter.flags&useNetworkLatencyMultiplier != 0 {
 
 		multiplier := float64(0.0)
 		p.getValue(NetworkLatencyMultiplier, &multiplier)
+		if multiplier > networkLatencyMultiplierMaximum {
+			multiplier = networkLatencyMultiplierMaximum
+		}
 		if multiplier > 0.0 {
 			value = time.Duration(float64(value) * multiplier)
 		}
@@ -785,6 +977,33 @@ func (p *ClientParametersSnapshot) Duration(name string) time.Duration {
 	return value
 }
 
+// TunnelProtocolDurations returns a TunnelProtocolDurations parameter value.
+// The returned durations are the configured values, without any
+// NetworkLatencyMultiplier applied; use TunnelProtocolDuration to get an
+// adjusted duration.
+func (p *ClientParametersSnapshot) TunnelProtocolDurations(name string) TunnelProtocolDurations {
+	value := TunnelProtocolDurations{}
+	p.getValue(name, &value)
+	return value
+}
+
+// TunnelProtocolDuration returns the duration for tunnelProtocol from the
+// named TunnelProtocolDurations parameter. When there is no entry for
+// tunnelProtocol, the value of the fallbackName duration parameter is
+// returned. In both cases, the NetworkLatencyMultiplier is applied as in
+// Duration.
+func (p *ClientParametersSnapshot) TunnelProtocolDuration(
+	name, tunnelProtocol, fallbackName string) time.Duration {
+
+	durations := TunnelProtocolDurations{}
+	p.getValue(name, &durations)
+	value, ok := durations[tunnelProtocol]
+	if !ok {
+		return p.Duration(fallbackName)
+	}
+	return p.applyNetworkLatencyMultiplier(name, value)
+}
+
 // TunnelProtocols returns a protocol.TunnelProtocols parameter value.
 // If there is a corresponding Probability value, a weighted coin flip
 // will be performed and, depending on the result, the value or the
@@ -814,6 +1033,32 @@ func (p *ClientParametersSnapshot) TunnelProtocols(name string) protocol.TunnelP
 	return value
 }
 
+// IsProtocolLimited returns true when the specified tunnel protocol is
+// permitted by the named protocol.TunnelProtocols limit parameter value, as
+// returned by TunnelProtocols, including its weighted coin flip. An empty
+// limit value is no limit, and permits all tunnel protocols.
+//
+// Each call performs a new coin flip; callers which must apply the same limit
+// to multiple protocols should call TunnelProtocols once instead.
+func (p *ClientParametersSnapshot) IsProtocolLimited(name string, tunnelProtocol string) bool {
+	limitProtocols := p.TunnelProtocols(name)
+	return len(limitProtocols) == 0 || common.Contains(limitProtocols, tunnelProtocol)
+}
+
+// TunnelProtocolWeights returns a TunnelProtocolWeights parameter value.
+func (p *ClientParametersSnapshot) TunnelProtocolWeights(name string) TunnelProtocolWeights {
+	value := TunnelProtocolWeights{}
+	p.getValue(name, &value)
+	return value
+}
+
+// TLSProfileWeights returns a TLSProfileWeights parameter value.
+func (p *ClientParametersSnapshot) TLSProfileWeights(name string) TLSProfileWeights {
+	value := TLSProfileWeights{}
+	p.getValue(name, &value)
+	return value
+}
+
 // TLSProfiles returns a protocol.TLSProfiles parameter value.
 // If there is a corresponding Probability value, a weighted coin flip
 // will be performed and, depending on the result, the value or the
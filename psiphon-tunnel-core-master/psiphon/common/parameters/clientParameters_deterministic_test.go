@@ -0,0 +1,100 @@
+// +build PRNG_DETERMINISTIC
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// TestDeterministicIsProtocolLimited is an exact variant of the probability
+// check in TestIsProtocolLimited: with a fixed global PRNG seed, each limit
+// coin flip outcome is known in advance.
+func TestDeterministicIsProtocolLimited(t *testing.T) {
+
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	applyParameters := map[string]interface{}{
+		"LimitTunnelProtocolsProbability": 0.5,
+		"LimitTunnelProtocols":            protocol.TunnelProtocols{"OSSH", "SSH"},
+	}
+
+	_, err = p.Set("", false, applyParameters)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	seed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("NewSeed failed: %s", err)
+	}
+
+	iterations := 1000
+
+	prng.SetGlobalSeed(seed)
+	expectedLimited := make([]bool, iterations)
+	for i := 0; i < iterations; i++ {
+		expectedLimited[i] = prng.FlipWeightedCoin(0.5)
+	}
+
+	prng.SetGlobalSeed(seed)
+	for i := 0; i < iterations; i++ {
+		limited := !p.Get().IsProtocolLimited(LimitTunnelProtocols, "QUIC-OSSH")
+		if limited != expectedLimited[i] {
+			t.Fatalf("unexpected limit result at %d: %v", i, limited)
+		}
+	}
+}
+
+// TestDeterministicTunnelProtocolWeights checks that weighted selection is
+// reproducible with a fixed global PRNG seed.
+func TestDeterministicTunnelProtocolWeights(t *testing.T) {
+
+	weights := TunnelProtocolWeights{"OSSH": 3.0, "SSH": 1.0}
+	candidates := []string{"OSSH", "SSH", "QUIC-OSSH"}
+
+	seed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("NewSeed failed: %s", err)
+	}
+
+	iterations := 1000
+
+	prng.SetGlobalSeed(seed)
+	selections := make([]string, iterations)
+	for i := 0; i < iterations; i++ {
+		selections[i] = weights.Select(candidates)
+	}
+
+	prng.SetGlobalSeed(seed)
+	for i := 0; i < iterations; i++ {
+		selection := weights.Select(candidates)
+		if selection != selections[i] {
+			t.Fatalf("unexpected selection at %d: %s", i, selection)
+		}
+	}
+}
@@ -78,6 +78,21 @@ func TestGetDefaultParameters(t *testing.T) {
 			if !reflect.DeepEqual(v, g) {
 				t.Fatalf("QUICVersions returned %+v expected %+v", v, g)
 			}
+		case TunnelProtocolWeights:
+			g := p.Get().TunnelProtocolWeights(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("TunnelProtocolWeights returned %+v expected %+v", v, g)
+			}
+		case TunnelProtocolDurations:
+			g := p.Get().TunnelProtocolDurations(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("TunnelProtocolDurations returned %+v expected %+v", v, g)
+			}
+		case TLSProfileWeights:
+			g := p.Get().TLSProfileWeights(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("TLSProfileWeights returned %+v expected %+v", v, g)
+			}
 		case DownloadURLs:
 			g := p.Get().DownloadURLs(name)
 			if !reflect.DeepEqual(v, g) {
@@ -183,6 +198,210 @@ func TestOverrides(t *testing.T) {
 	}
 }
 
+func TestRangeOverrides(t *testing.T) {
+
+	tag := "tag"
+	applyParameters := make(map[string]interface{})
+
+	// Minimum greater than maximum, should not apply
+	defaultFragmentorMinWriteBytes := defaultClientParameters[FragmentorMinWriteBytes].value.(int)
+	defaultFragmentorMaxWriteBytes := defaultClientParameters[FragmentorMaxWriteBytes].value.(int)
+	applyParameters[FragmentorMinWriteBytes] = 200
+	applyParameters[FragmentorMaxWriteBytes] = 100
+
+	// Minimum greater than default maximum, should not apply
+	defaultFragmentorMinDelay := defaultClientParameters[FragmentorMinDelay].value.(time.Duration)
+	applyParameters[FragmentorMinDelay] = "1s"
+
+	// Valid ranges, should apply
+	applyParameters[FragmentorMinTotalBytes] = 1000
+	applyParameters[FragmentorMaxTotalBytes] = 2000
+	applyParameters[LivenessTestMinUpstreamBytes] = 100
+	applyParameters[LivenessTestMaxUpstreamBytes] = 100
+
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	// No skip on error; should fail and not apply any changes
+
+	_, err = p.Set(tag, false, applyParameters)
+	if err == nil {
+		t.Fatalf("Set succeeded unexpectedly")
+	}
+
+	if p.Get().Tag() != "" {
+		t.Fatalf("GetTag returned unexpected value")
+	}
+
+	v := p.Get().Int(FragmentorMinTotalBytes)
+	if v != 0 {
+		t.Fatalf("GetInt returned unexpected FragmentorMinTotalBytes: %d", v)
+	}
+
+	// Skip on error; should skip invalid ranges and apply valid ranges
+
+	counts, err := p.Set(tag, true, applyParameters)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	if counts[0] != 4 {
+		t.Fatalf("Apply returned unexpected count: %d", counts[0])
+	}
+
+	v = p.Get().Int(FragmentorMinWriteBytes)
+	if v != defaultFragmentorMinWriteBytes {
+		t.Fatalf("GetInt returned unexpected FragmentorMinWriteBytes: %d", v)
+	}
+
+	v = p.Get().Int(FragmentorMaxWriteBytes)
+	if v != defaultFragmentorMaxWriteBytes {
+		t.Fatalf("GetInt returned unexpected FragmentorMaxWriteBytes: %d", v)
+	}
+
+	d := p.Get().Duration(FragmentorMinDelay)
+	if d != defaultFragmentorMinDelay {
+		t.Fatalf("GetDuration returned unexpected FragmentorMinDelay: %s", d)
+	}
+
+	v = p.Get().Int(FragmentorMinTotalBytes)
+	if v != 1000 {
+		t.Fatalf("GetInt returned unexpected FragmentorMinTotalBytes: %d", v)
+	}
+
+	v = p.Get().Int(FragmentorMaxTotalBytes)
+	if v != 2000 {
+		t.Fatalf("GetInt returned unexpected FragmentorMaxTotalBytes: %d", v)
+	}
+
+	v = p.Get().Int(LivenessTestMaxUpstreamBytes)
+	if v != 100 {
+		t.Fatalf("GetInt returned unexpected LivenessTestMaxUpstreamBytes: %d", v)
+	}
+
+	// Ranges are validated against values applied in earlier parameter sets;
+	// a later set with a minimum greater than an earlier maximum is skipped
+
+	counts, err = p.Set(
+		tag,
+		true,
+		map[string]interface{}{FragmentorMaxTotalBytes: 3000},
+		map[string]interface{}{FragmentorMinTotalBytes: 4000})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	if counts[0] != 1 || counts[1] != 0 {
+		t.Fatalf("Apply returned unexpected counts: %+v", counts)
+	}
+
+	v = p.Get().Int(FragmentorMinTotalBytes)
+	if v != 0 {
+		t.Fatalf("GetInt returned unexpected FragmentorMinTotalBytes: %d", v)
+	}
+}
+
+func TestSetMerge(t *testing.T) {
+
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	defaultConnectionWorkerPoolSize := defaultClientParameters[ConnectionWorkerPoolSize].value.(int)
+
+	// Successive SetMerge calls accumulate distinct parameters
+
+	count, err := p.SetMerge("tag1", false, map[string]interface{}{
+		ConnectionWorkerPoolSize:        defaultConnectionWorkerPoolSize + 1,
+		LimitIntensiveConnectionWorkers: 2,
+	})
+	if err != nil {
+		t.Fatalf("SetMerge failed: %s", err)
+	}
+
+	if count != 2 {
+		t.Fatalf("SetMerge returned unexpected count: %d", count)
+	}
+
+	count, err = p.SetMerge("tag2", false, map[string]interface{}{
+		TunnelConnectTimeout: "1m",
+	})
+	if err != nil {
+		t.Fatalf("SetMerge failed: %s", err)
+	}
+
+	if count != 1 {
+		t.Fatalf("SetMerge returned unexpected count: %d", count)
+	}
+
+	if p.Get().Tag() != "tag2" {
+		t.Fatalf("GetTag returned unexpected value")
+	}
+
+	v := p.Get().Int(ConnectionWorkerPoolSize)
+	if v != defaultConnectionWorkerPoolSize+1 {
+		t.Fatalf("GetInt returned unexpected ConnectionWorkerPoolSize: %d", v)
+	}
+
+	v = p.Get().Int(LimitIntensiveConnectionWorkers)
+	if v != 2 {
+		t.Fatalf("GetInt returned unexpected LimitIntensiveConnectionWorkers: %d", v)
+	}
+
+	d := p.Get().Duration(TunnelConnectTimeout)
+	if d != 1*time.Minute {
+		t.Fatalf("GetDuration returned unexpected TunnelConnectTimeout: %s", d)
+	}
+
+	// A later SetMerge overrides an earlier value
+
+	_, err = p.SetMerge("tag3", false, map[string]interface{}{
+		LimitIntensiveConnectionWorkers: 3,
+	})
+	if err != nil {
+		t.Fatalf("SetMerge failed: %s", err)
+	}
+
+	v = p.Get().Int(LimitIntensiveConnectionWorkers)
+	if v != 3 {
+		t.Fatalf("GetInt returned unexpected LimitIntensiveConnectionWorkers: %d", v)
+	}
+
+	v = p.Get().Int(ConnectionWorkerPoolSize)
+	if v != defaultConnectionWorkerPoolSize+1 {
+		t.Fatalf("GetInt returned unexpected ConnectionWorkerPoolSize: %d", v)
+	}
+
+	// A failed SetMerge leaves the parameters unmodified
+
+	_, err = p.SetMerge("tag4", false, map[string]interface{}{
+		LimitIntensiveConnectionWorkers: 4,
+		"UnknownParameter":              1,
+	})
+	if err == nil {
+		t.Fatalf("SetMerge succeeded unexpectedly")
+	}
+
+	if p.Get().Tag() != "tag3" || p.Get().Int(LimitIntensiveConnectionWorkers) != 3 {
+		t.Fatalf("unexpected parameters after failed SetMerge")
+	}
+
+	// Set replaces all merged parameters
+
+	_, err = p.Set("", false)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	v = p.Get().Int(ConnectionWorkerPoolSize)
+	if v != defaultConnectionWorkerPoolSize {
+		t.Fatalf("GetInt returned unexpected ConnectionWorkerPoolSize: %d", v)
+	}
+}
+
 func TestNetworkLatencyMultiplier(t *testing.T) {
 	p, err := NewClientParameters(nil)
 	if err != nil {
@@ -203,6 +422,31 @@ func TestNetworkLatencyMultiplier(t *testing.T) {
 	if 2*timeout1 != timeout2 {
 		t.Fatalf("Unexpected timeouts: 2 * %s != %s", timeout1, timeout2)
 	}
+
+	// Parameters without the useNetworkLatencyMultiplier flag are not scaled
+
+	pausePeriod := p.Get().Duration(EstablishTunnelPausePeriod)
+	defaultPausePeriod := defaultClientParameters[EstablishTunnelPausePeriod].value.(time.Duration)
+
+	if pausePeriod != defaultPausePeriod {
+		t.Fatalf("Unexpected pause period: %s != %s", pausePeriod, defaultPausePeriod)
+	}
+
+	// Multipliers above networkLatencyMultiplierMaximum are clamped
+
+	applyParameters = map[string]interface{}{"NetworkLatencyMultiplier": 1000000.0}
+
+	_, err = p.Set("", false, applyParameters)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	timeout3 := p.Get().Duration(TunnelConnectTimeout)
+
+	if time.Duration(networkLatencyMultiplierMaximum*float64(timeout1)) != timeout3 {
+		t.Fatalf("Unexpected timeouts: %f * %s != %s",
+			networkLatencyMultiplierMaximum, timeout1, timeout3)
+	}
 }
 
 func TestLimitTunnelProtocolProbability(t *testing.T) {
@@ -260,3 +504,66 @@ func TestLimitTunnelProtocolProbability(t *testing.T) {
 		t.Fatalf("Unexpected probability result: %d", matchCount)
 	}
 }
+
+func TestIsProtocolLimited(t *testing.T) {
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	// Default empty limit should permit all protocols
+
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+		if !p.Get().IsProtocolLimited(LimitTunnelProtocols, tunnelProtocol) {
+			t.Fatalf("unexpected limited protocol: %s", tunnelProtocol)
+		}
+	}
+
+	// Default probability should be 1.0 and always apply the limit
+
+	applyParameters := map[string]interface{}{
+		"LimitTunnelProtocols": protocol.TunnelProtocols{"OSSH", "SSH"},
+	}
+
+	_, err = p.Set("", false, applyParameters)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !p.Get().IsProtocolLimited(LimitTunnelProtocols, "OSSH") {
+			t.Fatalf("unexpected OSSH not limited")
+		}
+		if p.Get().IsProtocolLimited(LimitTunnelProtocols, "QUIC-OSSH") {
+			t.Fatalf("unexpected QUIC-OSSH limited")
+		}
+	}
+
+	// With probability set to 0.5, should apply the limit ~50%; otherwise,
+	// the default empty limit permits all protocols
+
+	applyParameters = map[string]interface{}{
+		"LimitTunnelProtocolsProbability": 0.5,
+		"LimitTunnelProtocols":            protocol.TunnelProtocols{"OSSH", "SSH"},
+	}
+
+	_, err = p.Set("", false, applyParameters)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	matchCount := 0
+
+	for i := 0; i < 1000; i++ {
+		if !p.Get().IsProtocolLimited(LimitTunnelProtocols, "OSSH") {
+			t.Fatalf("unexpected OSSH not limited")
+		}
+		if !p.Get().IsProtocolLimited(LimitTunnelProtocols, "QUIC-OSSH") {
+			matchCount += 1
+		}
+	}
+
+	if matchCount < 250 || matchCount > 750 {
+		t.Fatalf("Unexpected probability result: %d", matchCount)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// TunnelProtocolWeights maps tunnel protocols to relative selection weights.
+// When selecting among candidate tunnel protocols, each candidate is chosen
+// with probability proportional to its weight. Candidates not in the map
+// have a weight of 1.0, so an empty map is a uniform selection.
+type TunnelProtocolWeights map[string]float64
+
+// Validate checks that all tunnel protocols are supported and all weights
+// are non-negative.
+func (w TunnelProtocolWeights) Validate() error {
+	return selectionWeights(w).validate(
+		protocol.SupportedTunnelProtocols, "tunnel protocol")
+}
+
+// PruneInvalid returns a copy of the weights with any entries that fail
+// Validate removed.
+func (w TunnelProtocolWeights) PruneInvalid() TunnelProtocolWeights {
+	return TunnelProtocolWeights(
+		selectionWeights(w).pruneInvalid(protocol.SupportedTunnelProtocols))
+}
+
+// Select chooses a tunnel protocol from candidateProtocols according to the
+// weights. Select returns "" when there are no candidates.
+func (w TunnelProtocolWeights) Select(candidateProtocols []string) string {
+	return selectionWeights(w).selectCandidate(candidateProtocols)
+}
+
+// TLSProfileWeights maps TLS profiles to relative selection weights, with
+// the same semantics as TunnelProtocolWeights.
+type TLSProfileWeights map[string]float64
+
+// Validate checks that all TLS profiles are supported and all weights are
+// non-negative.
+func (w TLSProfileWeights) Validate() error {
+	return selectionWeights(w).validate(
+		protocol.SupportedTLSProfiles, "TLS profile")
+}
+
+// PruneInvalid returns a copy of the weights with any entries that fail
+// Validate removed.
+func (w TLSProfileWeights) PruneInvalid() TLSProfileWeights {
+	return TLSProfileWeights(
+		selectionWeights(w).pruneInvalid(protocol.SupportedTLSProfiles))
+}
+
+// Select chooses a TLS profile from candidateTLSProfiles according to the
+// weights. Select returns "" when there are no candidates.
+func (w TLSProfileWeights) Select(candidateTLSProfiles []string) string {
+	return selectionWeights(w).selectCandidate(candidateTLSProfiles)
+}
+
+// selectionWeights is the common implementation of the weighted selection
+// parameter types, which differ only in the set of valid names.
+type selectionWeights map[string]float64
+
+func (w selectionWeights) validate(validNames []string, nameType string) error {
+	for name, weight := range w {
+		err := validateWeight(validNames, nameType, name, weight)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+	return nil
+}
+
+func (w selectionWeights) pruneInvalid(validNames []string) selectionWeights {
+	u := make(selectionWeights)
+	for name, weight := range w {
+		if validateWeight(validNames, "", name, weight) == nil {
+			u[name] = weight
+		}
+	}
+	return u
+}
+
+func validateWeight(validNames []string, nameType, name string, weight float64) error {
+	if !common.Contains(validNames, name) {
+		return fmt.Errorf("invalid %s: %s", nameType, name)
+	}
+	if weight < 0.0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		return fmt.Errorf("invalid weight for %s: %f", name, weight)
+	}
+	return nil
+}
+
+// selectCandidate chooses one of candidates with probability proportional
+// to its weight. When all candidates have a weight of 0.0, the selection
+// falls back to uniform, as weights bias but do not limit the selection.
+func (w selectionWeights) selectCandidate(candidates []string) string {
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	weights := make([]float64, len(candidates))
+	totalWeight := 0.0
+	for i, candidate := range candidates {
+		weight, ok := w[candidate]
+		if !ok {
+			weight = 1.0
+		}
+		weights[i] = weight
+		totalWeight += weight
+	}
+
+	if totalWeight <= 0.0 {
+		return candidates[prng.Intn(len(candidates))]
+	}
+
+	target := totalWeight * float64(prng.Int63()) / float64(math.MaxInt64)
+	for i, weight := range weights {
+		target -= weight
+		if target < 0.0 {
+			return candidates[i]
+		}
+	}
+
+	// Floating point rounding may leave a small residual target; select the
+	// last candidate with a non-zero weight.
+	for i := len(weights) - 1; i >= 0; i-- {
+		if weights[i] > 0.0 {
+			return candidates[i]
+		}
+	}
+
+	return candidates[len(candidates)-1]
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestSelectionWeights(t *testing.T) {
+
+	candidateProtocols := []string{
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		protocol.TUNNEL_PROTOCOL_SSH,
+		protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+	}
+
+	candidateTLSProfiles := []string{
+		protocol.TLS_PROFILE_CHROME_58,
+		protocol.TLS_PROFILE_FIREFOX_56,
+		protocol.TLS_PROFILE_RANDOMIZED,
+	}
+
+	testCases := []struct {
+		description         string
+		parameterName       string
+		weights             interface{}
+		expectedValid       bool
+		expectedProportions []float64
+	}{
+		{
+			"default uniform",
+			TunnelProtocolSelectionWeights,
+			TunnelProtocolWeights{},
+			true,
+			[]float64{1.0 / 3.0, 1.0 / 3.0, 1.0 / 3.0},
+		},
+		{
+			"weighted",
+			TunnelProtocolSelectionWeights,
+			TunnelProtocolWeights{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 6.0,
+				protocol.TUNNEL_PROTOCOL_SSH:            3.0,
+			},
+			true,
+			[]float64{0.6, 0.3, 0.1},
+		},
+		{
+			"zero weight",
+			TunnelProtocolSelectionWeights,
+			TunnelProtocolWeights{
+				protocol.TUNNEL_PROTOCOL_SSH: 0.0,
+			},
+			true,
+			[]float64{0.5, 0.0, 0.5},
+		},
+		{
+			"all zero weights",
+			TunnelProtocolSelectionWeights,
+			TunnelProtocolWeights{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 0.0,
+				protocol.TUNNEL_PROTOCOL_SSH:            0.0,
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:   0.0,
+			},
+			true,
+			[]float64{1.0 / 3.0, 1.0 / 3.0, 1.0 / 3.0},
+		},
+		{
+			"invalid tunnel protocol",
+			TunnelProtocolSelectionWeights,
+			TunnelProtocolWeights{"invalid": 1.0},
+			false,
+			nil,
+		},
+		{
+			"negative tunnel protocol weight",
+			TunnelProtocolSelectionWeights,
+			TunnelProtocolWeights{protocol.TUNNEL_PROTOCOL_SSH: -1.0},
+			false,
+			nil,
+		},
+		{
+			"weighted TLS profiles",
+			TLSProfileSelectionWeights,
+			TLSProfileWeights{
+				protocol.TLS_PROFILE_CHROME_58:  8,
+				protocol.TLS_PROFILE_FIREFOX_56: 1,
+			},
+			true,
+			[]float64{0.8, 0.1, 0.1},
+		},
+		{
+			"invalid TLS profile",
+			TLSProfileSelectionWeights,
+			TLSProfileWeights{"invalid": 1},
+			false,
+			nil,
+		},
+		{
+			"negative TLS profile weight",
+			TLSProfileSelectionWeights,
+			TLSProfileWeights{protocol.TLS_PROFILE_CHROME_58: -1},
+			false,
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			p, err := NewClientParameters(nil)
+			if err != nil {
+				t.Fatalf("NewClientParameters failed: %s", err)
+			}
+
+			_, err = p.Set(
+				"",
+				false,
+				map[string]interface{}{testCase.parameterName: testCase.weights})
+			if (err == nil) != testCase.expectedValid {
+				t.Fatalf("unexpected Set result: %v", err)
+			}
+
+			if !testCase.expectedValid {
+
+				// With skipOnError, invalid entries are pruned.
+
+				_, err = p.Set(
+					"",
+					true,
+					map[string]interface{}{testCase.parameterName: testCase.weights})
+				if err != nil {
+					t.Fatalf("Set failed: %s", err)
+				}
+			}
+
+			var candidates []string
+			var selectCandidate func() string
+			var weightCount int
+
+			switch testCase.parameterName {
+			case TunnelProtocolSelectionWeights:
+				weights := p.Get().TunnelProtocolWeights(testCase.parameterName)
+				candidates = candidateProtocols
+				selectCandidate = func() string { return weights.Select(candidates) }
+				weightCount = len(weights)
+			case TLSProfileSelectionWeights:
+				weights := p.Get().TLSProfileWeights(testCase.parameterName)
+				candidates = candidateTLSProfiles
+				selectCandidate = func() string { return weights.Select(candidates) }
+				weightCount = len(weights)
+			}
+
+			if !testCase.expectedValid {
+				if weightCount != 0 {
+					t.Fatalf("unexpected weight count: %d", weightCount)
+				}
+				return
+			}
+
+			iterations := 10000
+			counts := make(map[string]int)
+			for i := 0; i < iterations; i++ {
+				counts[selectCandidate()] += 1
+			}
+
+			for i, candidate := range candidates {
+				proportion := float64(counts[candidate]) / float64(iterations)
+				expectedProportion := testCase.expectedProportions[i]
+				if proportion < expectedProportion-0.05 ||
+					proportion > expectedProportion+0.05 ||
+					(expectedProportion == 0.0 && counts[candidate] > 0) {
+					t.Fatalf("unexpected proportion for %s: %f",
+						candidate, proportion)
+				}
+			}
+		})
+	}
+
+	if TunnelProtocolWeights(nil).Select(nil) != "" ||
+		TLSProfileWeights(nil).Select(nil) != "" {
+		t.Fatalf("unexpected selection with no candidates")
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// TunnelProtocolDurations maps tunnel protocols to durations. This type is
+// used to override a global duration parameter, such as
+// TunnelConnectTimeout, for specific tunnel protocols. Protocols not in the
+// map use the global value.
+type TunnelProtocolDurations map[string]time.Duration
+
+// UnmarshalJSON accepts durations as either strings, such as "1m", or
+// integer nanoseconds, the default JSON encoding of time.Duration.
+func (d *TunnelProtocolDurations) UnmarshalJSON(data []byte) error {
+
+	var values map[string]interface{}
+	err := json.Unmarshal(data, &values)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	durations := make(TunnelProtocolDurations)
+	for tunnelProtocol, value := range values {
+		switch v := value.(type) {
+		case string:
+			duration, err := time.ParseDuration(v)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			durations[tunnelProtocol] = duration
+		case float64:
+			durations[tunnelProtocol] = time.Duration(v)
+		default:
+			return common.ContextError(
+				fmt.Errorf("invalid duration for %s: %v", tunnelProtocol, value))
+		}
+	}
+
+	*d = durations
+	return nil
+}
+
+// Validate checks that all tunnel protocols are supported and all durations
+// are positive.
+func (d TunnelProtocolDurations) Validate() error {
+	for tunnelProtocol, duration := range d {
+		err := validateTunnelProtocolDuration(tunnelProtocol, duration)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+	return nil
+}
+
+// PruneInvalid returns a copy of the durations with any entries that fail
+// Validate removed.
+func (d TunnelProtocolDurations) PruneInvalid() TunnelProtocolDurations {
+	u := make(TunnelProtocolDurations)
+	for tunnelProtocol, duration := range d {
+		if validateTunnelProtocolDuration(tunnelProtocol, duration) == nil {
+			u[tunnelProtocol] = duration
+		}
+	}
+	return u
+}
+
+func validateTunnelProtocolDuration(tunnelProtocol string, duration time.Duration) error {
+	if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+		return fmt.Errorf("invalid tunnel protocol: %s", tunnelProtocol)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("invalid duration for %s: %s", tunnelProtocol, duration)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestTunnelProtocolDurations(t *testing.T) {
+
+	defaultTimeout := defaultClientParameters[TunnelConnectTimeout].value.(time.Duration)
+
+	testCases := []struct {
+		description     string
+		timeouts        interface{}
+		multiplier      float64
+		expectedValid   bool
+		expectedTimeout map[string]time.Duration
+	}{
+		{
+			"no overrides",
+			TunnelProtocolDurations{},
+			0.0,
+			true,
+			map[string]time.Duration{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: defaultTimeout,
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:   defaultTimeout,
+			},
+		},
+		{
+			"override",
+			TunnelProtocolDurations{
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK: 1 * time.Minute,
+			},
+			0.0,
+			true,
+			map[string]time.Duration{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: defaultTimeout,
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:   1 * time.Minute,
+			},
+		},
+		{
+			"override with string duration",
+			map[string]interface{}{
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK: "90s",
+			},
+			0.0,
+			true,
+			map[string]time.Duration{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: defaultTimeout,
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:   90 * time.Second,
+			},
+		},
+		{
+			"override with network latency multiplier",
+			TunnelProtocolDurations{
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK: 1 * time.Minute,
+			},
+			2.0,
+			true,
+			map[string]time.Duration{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 2 * defaultTimeout,
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:   2 * time.Minute,
+			},
+		},
+		{
+			"invalid tunnel protocol",
+			TunnelProtocolDurations{"invalid": 1 * time.Minute},
+			0.0,
+			false,
+			nil,
+		},
+		{
+			"invalid duration",
+			TunnelProtocolDurations{protocol.TUNNEL_PROTOCOL_FRONTED_MEEK: 0},
+			0.0,
+			false,
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			p, err := NewClientParameters(nil)
+			if err != nil {
+				t.Fatalf("NewClientParameters failed: %s", err)
+			}
+
+			applyParameters := map[string]interface{}{
+				TunnelConnectTimeouts: testCase.timeouts,
+			}
+			if testCase.multiplier > 0.0 {
+				applyParameters[NetworkLatencyMultiplier] = testCase.multiplier
+			}
+
+			_, err = p.Set("", false, applyParameters)
+			if (err == nil) != testCase.expectedValid {
+				t.Fatalf("unexpected Set result: %v", err)
+			}
+
+			if !testCase.expectedValid {
+
+				// With skipOnError, invalid entries are pruned.
+
+				_, err = p.Set("", true, applyParameters)
+				if err != nil {
+					t.Fatalf("Set failed: %s", err)
+				}
+
+				timeouts := p.Get().TunnelProtocolDurations(TunnelConnectTimeouts)
+				if len(timeouts) != 0 {
+					t.Fatalf("unexpected timeouts: %+v", timeouts)
+				}
+				return
+			}
+
+			for tunnelProtocol, expectedTimeout := range testCase.expectedTimeout {
+				timeout := p.Get().TunnelProtocolDuration(
+					TunnelConnectTimeouts, tunnelProtocol, TunnelConnectTimeout)
+				if timeout != expectedTimeout {
+					t.Fatalf("unexpected timeout for %s: %s", tunnelProtocol, timeout)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+// +build PRNG_DETERMINISTIC
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package prng
+
+// SetGlobalSeed replaces the global PRNG, used by the package-level
+// functions such as Intn, Perm, and FlipWeightedCoin, with a PRNG
+// initialized with the specified seed. This makes shuffles and probability
+// decisions made via the global PRNG reproducible, allowing tests to make
+// exact assertions.
+//
+// SetGlobalSeed is available only in builds with the PRNG_DETERMINISTIC
+// build tag, which is intended for testing only and must not be used for
+// production builds. SetGlobalSeed must not be called concurrently with any
+// use of the global PRNG.
+func SetGlobalSeed(seed *Seed) {
+	p = NewPRNGWithSeed(seed)
+}
@@ -0,0 +1,66 @@
+// +build PRNG_DETERMINISTIC
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package prng
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetGlobalSeed(t *testing.T) {
+
+	seed, err := NewSeed()
+	if err != nil {
+		t.Fatalf("NewSeed failed: %s", err)
+	}
+
+	sample := func() []int {
+		values := Perm(10)
+		values = append(values, Intn(1000), Range(10, 20))
+		if FlipWeightedCoin(0.5) {
+			values = append(values, 1)
+		}
+		return values
+	}
+
+	SetGlobalSeed(seed)
+	values1 := sample()
+
+	SetGlobalSeed(seed)
+	values2 := sample()
+
+	if !reflect.DeepEqual(values1, values2) {
+		t.Fatalf("unexpected values: %+v != %+v", values1, values2)
+	}
+
+	otherSeed, err := NewSeed()
+	if err != nil {
+		t.Fatalf("NewSeed failed: %s", err)
+	}
+
+	SetGlobalSeed(otherSeed)
+	values3 := sample()
+
+	if reflect.DeepEqual(values1, values3) {
+		t.Fatalf("unexpected identical values")
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
@@ -56,6 +57,7 @@ const (
 	PSIPHON_API_CONNECTED_REQUEST_NAME = "psiphon-connected"
 	PSIPHON_API_STATUS_REQUEST_NAME    = "psiphon-status"
 	PSIPHON_API_OSL_REQUEST_NAME       = "psiphon-osl"
+	PSIPHON_API_EXHAUSTED_REQUEST_NAME = "psiphon-exhausted"
 
 	// PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME may still be used by older Android clients
 	PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME = "psiphon-client-verification"
@@ -69,6 +71,13 @@ const (
 	RANDOM_STREAM_CHANNEL_TYPE = "random@psiphon.ca"
 
 	PSIPHON_API_HANDSHAKE_AUTHORIZATIONS = "authorizations"
+
+	CLIENT_PLATFORM_ANDROID = "Android"
+	CLIENT_PLATFORM_WINDOWS = "Windows"
+	CLIENT_PLATFORM_IOS     = "iOS"
+
+	CLIENT_PLATFORM_FORM_FACTOR_MOBILE  = "mobile"
+	CLIENT_PLATFORM_FORM_FACTOR_DESKTOP = "desktop"
 )
 
 type TunnelProtocols []string
@@ -293,6 +302,9 @@ type HandshakeResponse struct {
 	ActiveAuthorizationIDs []string            `json:"active_authorization_ids"`
 	TacticsPayload         json.RawMessage     `json:"tactics_payload"`
 	Padding                string              `json:"padding"`
+
+	ReadUnthrottledBytesRemaining  int64 `json:"read_unthrottled_bytes_remaining"`
+	WriteUnthrottledBytesRemaining int64 `json:"write_unthrottled_bytes_remaining"`
 }
 
 type ConnectedResponse struct {
@@ -305,6 +317,10 @@ type OSLRequest struct {
 	SeedPayload     *osl.SeedPayload `json:"seed_payload"`
 }
 
+type ExhaustedRequest struct {
+	GraceMilliseconds int64 `json:"grace_milliseconds"`
+}
+
 type SSHPasswordPayload struct {
 	SessionId          string   `json:"SessionId"`
 	SshPassword        string   `json:"SshPassword"`
@@ -322,6 +338,33 @@ type RandomStreamRequest struct {
 	DownstreamBytes int `json:"d"`
 }
 
+// NormalizeClientPlatform classifies a reported client platform string as
+// one of CLIENT_PLATFORM_ANDROID, CLIENT_PLATFORM_IOS, or
+// CLIENT_PLATFORM_WINDOWS, and returns that OS along with the form factor,
+// CLIENT_PLATFORM_FORM_FACTOR_MOBILE or CLIENT_PLATFORM_FORM_FACTOR_DESKTOP.
+//
+// Clients report more than the OS in the platform string. Android clients,
+// for example, report "Android_<OS version>_<package name>", with optional
+// app-specified prefix and suffix, and iOS clients report
+// "iOS_<OS version>_<jailbroken status>_<bundle identifier>", where the
+// system name may also be "iPadOS". Any unrecognized platform string is
+// classified as CLIENT_PLATFORM_WINDOWS, following legacy server behavior.
+func NormalizeClientPlatform(clientPlatform string) (string, string) {
+
+	if strings.Contains(
+		strings.ToLower(clientPlatform), strings.ToLower(CLIENT_PLATFORM_ANDROID)) {
+
+		return CLIENT_PLATFORM_ANDROID, CLIENT_PLATFORM_FORM_FACTOR_MOBILE
+
+	} else if strings.HasPrefix(clientPlatform, CLIENT_PLATFORM_IOS) ||
+		strings.HasPrefix(clientPlatform, "iPadOS") {
+
+		return CLIENT_PLATFORM_IOS, CLIENT_PLATFORM_FORM_FACTOR_MOBILE
+	}
+
+	return CLIENT_PLATFORM_WINDOWS, CLIENT_PLATFORM_FORM_FACTOR_DESKTOP
+}
+
 func DeriveSSHServerKEXPRNGSeed(obfuscatedKey string) (*prng.Seed, error) {
 	// By convention, the obfuscatedKey will often be a hex-encoded 32 byte value,
 	// but this isn't strictly required or validated, so we use SHA256 to map the
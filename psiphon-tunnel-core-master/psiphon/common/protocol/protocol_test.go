@@ -78,3 +78,34 @@ func TestTLSProfileValidation(t *testing.T) {
 		t.Errorf("unexpected %+v != %+v", prunedProfiles, SupportedTLSProfiles)
 	}
 }
+
+func TestNormalizeClientPlatform(t *testing.T) {
+
+	testCases := []struct {
+		clientPlatform     string
+		expectedOS         string
+		expectedFormFactor string
+	}{
+		{"Windows", CLIENT_PLATFORM_WINDOWS, CLIENT_PLATFORM_FORM_FACTOR_DESKTOP},
+		{"Windows_10.0.17134", CLIENT_PLATFORM_WINDOWS, CLIENT_PLATFORM_FORM_FACTOR_DESKTOP},
+		{"", CLIENT_PLATFORM_WINDOWS, CLIENT_PLATFORM_FORM_FACTOR_DESKTOP},
+		{"Android_9_com.psiphon3", CLIENT_PLATFORM_ANDROID, CLIENT_PLATFORM_FORM_FACTOR_MOBILE},
+		{"Android_4.4.2_com.psiphon3_rooted", CLIENT_PLATFORM_ANDROID, CLIENT_PLATFORM_FORM_FACTOR_MOBILE},
+		{"PsiphonPro_Android_8.1.0_com.psiphon3.subscription_playstore", CLIENT_PLATFORM_ANDROID, CLIENT_PLATFORM_FORM_FACTOR_MOBILE},
+		{"android", CLIENT_PLATFORM_ANDROID, CLIENT_PLATFORM_FORM_FACTOR_MOBILE},
+		{"iOS_12.1_unjailbroken_ca.psiphon.Psiphon", CLIENT_PLATFORM_IOS, CLIENT_PLATFORM_FORM_FACTOR_MOBILE},
+		{"iOS_11.4_jailbroken_ca.psiphon.Psiphon", CLIENT_PLATFORM_IOS, CLIENT_PLATFORM_FORM_FACTOR_MOBILE},
+		{"iPadOS_13.1_unjailbroken_ca.psiphon.Psiphon", CLIENT_PLATFORM_IOS, CLIENT_PLATFORM_FORM_FACTOR_MOBILE},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.clientPlatform, func(t *testing.T) {
+
+			os, formFactor := NormalizeClientPlatform(testCase.clientPlatform)
+
+			if os != testCase.expectedOS || formFactor != testCase.expectedFormFactor {
+				t.Errorf("unexpected classification: %s, %s", os, formFactor)
+			}
+		})
+	}
+}
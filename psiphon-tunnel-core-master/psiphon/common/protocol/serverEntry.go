@@ -22,6 +22,8 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -29,8 +31,10 @@ import (
 	"io"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ed25519"
 )
 
 // ServerEntry represents a Psiphon server. It contains information
@@ -65,6 +69,7 @@ type ServerEntry struct {
 	TacticsRequestObfuscatedKey   string   `json:"tacticsRequestObfuscatedKey"`
 	MarionetteFormat              string   `json:"marionetteFormat"`
 	ConfigurationVersion          int      `json:"configurationVersion"`
+	Signature                     string   `json:"signature"`
 
 	// These local fields are not expected to be present in downloaded server
 	// entries. They are added by the client to record and report stats about
@@ -102,21 +107,174 @@ func (fields ServerEntryFields) GetConfigurationVersion() int {
 	if !ok {
 		return 0
 	}
-	configurationVersionInt, ok := configurationVersion.(int)
-	if !ok {
-		return 0
+	// Server entry fields decoded from JSON hold numbers as float64.
+	switch value := configurationVersion.(type) {
+	case int:
+		return value
+	case float64:
+		return int(value)
 	}
-	return configurationVersionInt
+	return 0
 }
 
 func (fields ServerEntryFields) SetLocalSource(source string) {
 	fields["localSource"] = source
 }
 
+func (fields ServerEntryFields) GetLocalSource() string {
+	source, ok := fields["localSource"].(string)
+	if !ok {
+		return ""
+	}
+	return source
+}
+
 func (fields ServerEntryFields) SetLocalTimestamp(timestamp string) {
 	fields["localTimestamp"] = timestamp
 }
 
+func (fields ServerEntryFields) GetLocalTimestamp() time.Time {
+	timestamp, ok := fields["localTimestamp"].(string)
+	if !ok {
+		return time.Time{}
+	}
+	return ParseServerEntryTimestamp(timestamp)
+}
+
+// NewServerEntrySignatureKeyPair generates a new Ed25519 key pair for signing
+// and verifying server entries. The keys are base64 encoded.
+func NewServerEntrySignatureKeyPair() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", common.ContextError(err)
+	}
+	return base64.StdEncoding.EncodeToString(publicKey),
+		base64.StdEncoding.EncodeToString(privateKey),
+		nil
+}
+
+// AddSignature signs the server entry fields with the base64 encoded
+// Ed25519 privateKey and stores the signature in the "signature" field.
+func (fields ServerEntryFields) AddSignature(privateKey string) error {
+
+	decodedPrivateKey, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if len(decodedPrivateKey) != ed25519.PrivateKeySize {
+		return common.ContextError(errors.New("invalid private key"))
+	}
+
+	message, err := fields.getSignedData()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	signature := ed25519.Sign(decodedPrivateKey, message)
+
+	fields["signature"] = base64.StdEncoding.EncodeToString(signature)
+
+	return nil
+}
+
+// ValidateServerEntrySignaturePublicKey checks that publicKey is a base64
+// encoded Ed25519 public key.
+func ValidateServerEntrySignaturePublicKey(publicKey string) error {
+	_, err := decodeServerEntrySignaturePublicKey(publicKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+func decodeServerEntrySignaturePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	decodedPublicKey, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if len(decodedPublicKey) != ed25519.PublicKeySize {
+		return nil, common.ContextError(errors.New("invalid public key"))
+	}
+	return decodedPublicKey, nil
+}
+
+// VerifySignature checks that the server entry fields have a valid signature
+// made with the private key corresponding to the base64 encoded Ed25519
+// publicKey. An error is returned for an unsigned or tampered server entry.
+func (fields ServerEntryFields) VerifySignature(publicKey string) error {
+
+	decodedPublicKey, err := decodeServerEntrySignaturePublicKey(publicKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	signatureField, _ := fields["signature"].(string)
+	if signatureField == "" {
+		return common.ContextError(errors.New("missing signature"))
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(signatureField)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	message, err := fields.getSignedData()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if !ed25519.Verify(decodedPublicKey, message, signature) {
+		return common.ContextError(errors.New("invalid signature"))
+	}
+
+	return nil
+}
+
+// getSignedData returns the data covered by a server entry signature: the
+// JSON encoding of all fields except for the signature and the local fields,
+// which are added by the client. json.Marshal sorts map keys, so the
+// encoding doesn't depend on field order.
+func (fields ServerEntryFields) getSignedData() ([]byte, error) {
+
+	signedFields := make(map[string]interface{})
+	for name, value := range fields {
+		if name == "signature" || name == "localSource" || name == "localTimestamp" {
+			continue
+		}
+		signedFields[name] = value
+	}
+
+	data, err := json.Marshal(signedFields)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return data, nil
+}
+
+// GetLocalTimestamp returns the parsed LocalTimestamp. See
+// ParseServerEntryTimestamp.
+func (serverEntry *ServerEntry) GetLocalTimestamp() time.Time {
+	return ParseServerEntryTimestamp(serverEntry.LocalTimestamp)
+}
+
+// ParseServerEntryTimestamp parses an RFC 3339 server entry timestamp, such
+// as LocalTimestamp. A missing or malformed timestamp is parsed as the zero
+// time.Time, so such server entries are always considered the oldest.
+func ParseServerEntryTimestamp(timestamp string) time.Time {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// FormatServerEntryTimestamp formats a time as a server entry timestamp,
+// using the same format as common.GetCurrentTimestamp.
+func FormatServerEntryTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
 // GetCapability returns the server capability corresponding
 // to the tunnel protocol.
 func GetCapability(protocol string) string {
@@ -143,10 +301,45 @@ func (serverEntry *ServerEntry) GetSupportedProtocols(
 	limitTunnelProtocols []string,
 	excludeIntensive bool) []string {
 
+	return serverEntry.getProtocols(
+		useUpstreamProxy, limitTunnelProtocols, excludeIntensive, nil)
+}
+
+// GetUsableProtocols returns a list of tunnel protocols which are supported
+// by the ServerEntry's capabilities, permitted by useUpstreamProxy,
+// limitTunnelProtocols, and excludeIntensive, as in GetSupportedProtocols,
+// and supported by the client build.
+//
+// buildCapabilities lists the capabilities, as returned by GetCapability,
+// corresponding to the tunnel protocols supported by the client build; for
+// example, a build without Marionette support omits the Marionette
+// capability. When buildCapabilities is empty, no build constraint is
+// applied.
+func (serverEntry *ServerEntry) GetUsableProtocols(
+	useUpstreamProxy bool,
+	limitTunnelProtocols []string,
+	excludeIntensive bool,
+	buildCapabilities []string) []string {
+
+	return serverEntry.getProtocols(
+		useUpstreamProxy, limitTunnelProtocols, excludeIntensive, buildCapabilities)
+}
+
+func (serverEntry *ServerEntry) getProtocols(
+	useUpstreamProxy bool,
+	limitTunnelProtocols []string,
+	excludeIntensive bool,
+	buildCapabilities []string) []string {
+
 	supportedProtocols := make([]string, 0)
 
 	for _, protocol := range SupportedTunnelProtocols {
 
+		if len(buildCapabilities) > 0 &&
+			!common.Contains(buildCapabilities, GetCapability(protocol)) {
+			continue
+		}
+
 		// TODO: Marionette UDP formats are incompatible with
 		// useUpstreamProxy, but not currently supported
 		if useUpstreamProxy && TunnelProtocolUsesQUIC(protocol) {
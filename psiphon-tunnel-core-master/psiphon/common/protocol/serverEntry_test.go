@@ -22,7 +22,10 @@ package protocol
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -152,3 +155,243 @@ func TestDecodeServerEntryStruct(t *testing.T) {
 		t.Errorf("unexpected IP address in decoded server entry: %s", serverEntry.IpAddress)
 	}
 }
+
+func TestGetUsableProtocols(t *testing.T) {
+
+	serverEntry := &ServerEntry{
+		Capabilities: []string{
+			GetCapability(TUNNEL_PROTOCOL_OBFUSCATED_SSH),
+			GetCapability(TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH),
+			GetCapability(TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH),
+		},
+	}
+
+	testCases := []struct {
+		description       string
+		useUpstreamProxy  bool
+		limitProtocols    []string
+		buildCapabilities []string
+		expectedProtocols []string
+	}{
+		{
+			"no constraints",
+			false,
+			nil,
+			nil,
+			[]string{TUNNEL_PROTOCOL_OBFUSCATED_SSH, TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH},
+		},
+		{
+			"upstream proxy",
+			true,
+			nil,
+			nil,
+			[]string{TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+		},
+		{
+			"enabled protocol supported by build",
+			false,
+			[]string{TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH},
+			[]string{
+				GetCapability(TUNNEL_PROTOCOL_OBFUSCATED_SSH),
+				GetCapability(TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH),
+			},
+			[]string{TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH},
+		},
+		{
+			"enabled protocol not supported by build",
+			false,
+			[]string{TUNNEL_PROTOCOL_OBFUSCATED_SSH, TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH},
+			[]string{
+				GetCapability(TUNNEL_PROTOCOL_OBFUSCATED_SSH),
+				GetCapability(TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH),
+			},
+			[]string{TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+		},
+		{
+			"server protocol not supported by build",
+			false,
+			nil,
+			[]string{GetCapability(TUNNEL_PROTOCOL_OBFUSCATED_SSH)},
+			[]string{TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+		},
+		{
+			"no usable protocols",
+			false,
+			[]string{TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH},
+			[]string{GetCapability(TUNNEL_PROTOCOL_OBFUSCATED_SSH)},
+			[]string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			protocols := serverEntry.GetUsableProtocols(
+				testCase.useUpstreamProxy,
+				testCase.limitProtocols,
+				false,
+				testCase.buildCapabilities)
+
+			if !reflect.DeepEqual(protocols, testCase.expectedProtocols) {
+				t.Fatalf("unexpected protocols: %+v", protocols)
+			}
+		})
+	}
+}
+
+func TestServerEntryTimestamps(t *testing.T) {
+
+	testCases := []struct {
+		description       string
+		timestamp         string
+		expectedTimestamp time.Time
+	}{
+		{"UTC", "2019-01-02T03:04:05Z", time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"offset", "2019-01-02T03:04:05-05:00", time.Date(2019, 1, 2, 8, 4, 5, 0, time.UTC)},
+		{"empty", "", time.Time{}},
+		{"malformed", "2019-01-02 03:04:05", time.Time{}},
+		{"truncated", "2019-01-02", time.Time{}},
+		{"invalid", "<timestamp>", time.Time{}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			timestamp := ParseServerEntryTimestamp(testCase.timestamp)
+			if !timestamp.Equal(testCase.expectedTimestamp) {
+				t.Fatalf("unexpected timestamp: %s", timestamp)
+			}
+
+			serverEntry := &ServerEntry{LocalTimestamp: testCase.timestamp}
+			if !serverEntry.GetLocalTimestamp().Equal(testCase.expectedTimestamp) {
+				t.Fatalf("unexpected server entry timestamp: %s",
+					serverEntry.GetLocalTimestamp())
+			}
+
+			fields := make(ServerEntryFields)
+			fields.SetLocalTimestamp(testCase.timestamp)
+			if !fields.GetLocalTimestamp().Equal(testCase.expectedTimestamp) {
+				t.Fatalf("unexpected server entry fields timestamp: %s",
+					fields.GetLocalTimestamp())
+			}
+
+			// Malformed timestamps are the oldest.
+			if testCase.expectedTimestamp.IsZero() &&
+				!timestamp.Before(ParseServerEntryTimestamp(common.GetCurrentTimestamp())) {
+				t.Fatalf("malformed timestamp is not oldest")
+			}
+
+			if !testCase.expectedTimestamp.IsZero() &&
+				FormatServerEntryTimestamp(timestamp) !=
+					testCase.expectedTimestamp.Format(time.RFC3339) {
+				t.Fatalf("unexpected formatted timestamp: %s",
+					FormatServerEntryTimestamp(timestamp))
+			}
+		})
+	}
+
+	fields := make(ServerEntryFields)
+	if !fields.GetLocalTimestamp().IsZero() {
+		t.Fatalf("unexpected missing timestamp")
+	}
+	fields["localTimestamp"] = 1
+	if !fields.GetLocalTimestamp().IsZero() {
+		t.Fatalf("unexpected non-string timestamp")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	if !ParseServerEntryTimestamp(FormatServerEntryTimestamp(now)).Equal(now) {
+		t.Fatalf("format/parse round trip failed")
+	}
+}
+
+func TestServerEntrySignature(t *testing.T) {
+
+	publicKey, privateKey, err := NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	otherPublicKey, _, err := NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	encodedServerEntry, err := EncodeServerEntry(
+		&ServerEntry{
+			IpAddress:            "192.168.0.1",
+			WebServerPort:        "8000",
+			ConfigurationVersion: 1,
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	decodeFields := func() ServerEntryFields {
+		fields, err := DecodeServerEntryFields(
+			encodedServerEntry, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		return fields
+	}
+
+	// Test: unsigned server entry
+
+	fields := decodeFields()
+
+	if fields.VerifySignature(publicKey) == nil {
+		t.Fatalf("unexpected unsigned server entry verification")
+	}
+
+	// Test: signed server entry, including after an encoding round trip
+	// which changes numeric field types and local fields
+
+	err = fields.AddSignature(privateKey)
+	if err != nil {
+		t.Fatalf("AddSignature failed: %s", err)
+	}
+
+	err = fields.VerifySignature(publicKey)
+	if err != nil {
+		t.Fatalf("VerifySignature failed: %s", err)
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	var roundTripFields ServerEntryFields
+	err = json.Unmarshal(data, &roundTripFields)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	roundTripFields.SetLocalSource(SERVER_ENTRY_SOURCE_DISCOVERY)
+
+	err = roundTripFields.VerifySignature(publicKey)
+	if err != nil {
+		t.Fatalf("VerifySignature failed: %s", err)
+	}
+
+	// Test: wrong public key
+
+	if fields.VerifySignature(otherPublicKey) == nil {
+		t.Fatalf("unexpected wrong key verification")
+	}
+
+	// Test: tampered server entry
+
+	fields["ipAddress"] = "192.168.0.2"
+
+	if fields.VerifySignature(publicKey) == nil {
+		t.Fatalf("unexpected tampered server entry verification")
+	}
+
+	fields = decodeFields()
+	fields["newField"] = "value"
+	fields["signature"] = roundTripFields["signature"]
+
+	if fields.VerifySignature(publicKey) == nil {
+		t.Fatalf("unexpected tampered server entry verification")
+	}
+}
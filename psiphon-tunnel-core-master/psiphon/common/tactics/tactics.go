@@ -1578,6 +1578,51 @@ func getSpeedTestSamples(
 	return speedTestSamples, nil
 }
 
+// CountSpeedTestSamples returns the number of speed test samples stored for
+// the specified network ID.
+func CountSpeedTestSamples(storer Storer, networkID string) (int, error) {
+
+	speedTestSamples, err := getSpeedTestSamples(storer, networkID)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return len(speedTestSamples), nil
+}
+
+// TrimSpeedTestSamples removes the oldest speed test samples stored for the
+// specified network ID, retaining at most maxCount of the most recent
+// samples. The stored record is not rewritten when no samples are removed.
+func TrimSpeedTestSamples(storer Storer, networkID string, maxCount int) error {
+
+	if maxCount < 0 {
+		return common.ContextError(fmt.Errorf("invalid max count: %d", maxCount))
+	}
+
+	speedTestSamples, err := getSpeedTestSamples(storer, networkID)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if len(speedTestSamples) <= maxCount {
+		return nil
+	}
+
+	speedTestSamples = speedTestSamples[len(speedTestSamples)-maxCount:]
+
+	record, err := json.Marshal(speedTestSamples)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = storer.SetSpeedTestSamplesRecord(networkID, record)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 func getStoredTacticsRecord(
 	storer Storer, networkID string) (*Record, error) {
 
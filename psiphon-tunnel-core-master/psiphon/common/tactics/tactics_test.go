@@ -22,6 +22,7 @@ package tactics
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -809,6 +810,78 @@ func TestTactics(t *testing.T) {
 	// TODO: test Server.Validate with invalid tactics configurations
 }
 
+func TestSpeedTestSampleCountAndTrim(t *testing.T) {
+
+	storer := newTestStorer()
+	networkID := "NETWORK1"
+
+	count, err := CountSpeedTestSamples(storer, networkID)
+	if err != nil {
+		t.Fatalf("CountSpeedTestSamples failed: %s", err)
+	}
+	if count != 0 {
+		t.Fatalf("unexpected speed test samples count: %d", count)
+	}
+
+	sampleCount := 10
+
+	speedTestSamples := make([]SpeedTestSample, sampleCount)
+	for i := 0; i < sampleCount; i++ {
+		speedTestSamples[i] = SpeedTestSample{RTTMilliseconds: i}
+	}
+	record, err := json.Marshal(speedTestSamples)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	err = storer.SetSpeedTestSamplesRecord(networkID, record)
+	if err != nil {
+		t.Fatalf("SetSpeedTestSamplesRecord failed: %s", err)
+	}
+
+	testCases := []struct {
+		description   string
+		maxCount      int
+		expectedValid bool
+		expectedCount int
+	}{
+		{"max exceeds count", 20, true, 10},
+		{"max equals count", 10, true, 10},
+		{"trim", 4, true, 4},
+		{"invalid max", -1, false, 4},
+		{"trim all", 0, true, 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			err := TrimSpeedTestSamples(storer, networkID, testCase.maxCount)
+			if (err == nil) != testCase.expectedValid {
+				t.Fatalf("unexpected TrimSpeedTestSamples result: %v", err)
+			}
+
+			count, err := CountSpeedTestSamples(storer, networkID)
+			if err != nil {
+				t.Fatalf("CountSpeedTestSamples failed: %s", err)
+			}
+			if count != testCase.expectedCount {
+				t.Fatalf("unexpected speed test samples count: %d", count)
+			}
+
+			// The most recent samples are retained.
+
+			samples, err := getSpeedTestSamples(storer, networkID)
+			if err != nil {
+				t.Fatalf("getSpeedTestSamples failed: %s", err)
+			}
+			for i, sample := range samples {
+				if sample.RTTMilliseconds != sampleCount-count+i {
+					t.Fatalf("unexpected speed test sample: %+v", sample)
+				}
+			}
+		})
+	}
+}
+
 type testStorer struct {
 	tacticsRecords         map[string][]byte
 	speedTestSampleRecords map[string][]byte
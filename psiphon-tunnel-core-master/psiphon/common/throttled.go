@@ -22,10 +22,13 @@ package common
 import (
 	"errors"
 	"io"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/juju/ratelimit"
 )
 
@@ -53,6 +56,16 @@ type RateLimits struct {
 	// write unthrottled bytes have been exhausted. In this
 	// case, throttling is never applied.
 	CloseAfterExhausted bool
+
+	// CloseAfterExhaustedGraceMilliseconds specifies a grace
+	// period, starting when the unthrottled bytes are first
+	// exhausted, during which I/O continues unthrottled before
+	// the underlying net.Conn is closed. This allows in-flight
+	// requests to complete. The grace period is bounded: the
+	// net.Conn is closed when it expires even if no further
+	// I/O is attempted. Ignored when CloseAfterExhausted is
+	// not set. The default, 0, is an immediate close.
+	CloseAfterExhaustedGraceMilliseconds int64
 }
 
 // ThrottledConn wraps a net.Conn with read and write rate limiters.
@@ -66,15 +79,23 @@ type ThrottledConn struct {
 	// Note: 64-bit ints used with atomic operations are placed
 	// at the start of struct to ensure 64-bit alignment.
 	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
-	readUnthrottledBytes  int64
-	readBytesPerSecond    int64
-	writeUnthrottledBytes int64
-	writeBytesPerSecond   int64
-	closeAfterExhausted   int32
-	readLock              sync.Mutex
-	throttledReader       io.Reader
-	writeLock             sync.Mutex
-	throttledWriter       io.Writer
+	readUnthrottledBytes                 int64
+	readBytesPerSecond                   int64
+	bytesRead                            int64
+	bytesWritten                         int64
+	writeUnthrottledBytes                int64
+	writeBytesPerSecond                  int64
+	closeAfterExhaustedGraceMilliseconds int64
+	closeAfterExhausted                  int32
+	readLock                             sync.Mutex
+	throttledReader                      io.Reader
+	writeLock                            sync.Mutex
+	throttledWriter                      io.Writer
+	exhaustedMutex                       sync.Mutex
+	exhaustedGraceDeadline               monotime.Time
+	exhaustedGraceTimer                  *time.Timer
+	exhaustedCallback                    func(inGracePeriod bool, bytesRead, bytesWritten int64)
+	exhaustedClosed                      bool
 	net.Conn
 }
 
@@ -120,6 +141,120 @@ func (conn *ThrottledConn) SetLimits(limits RateLimits) {
 		closeAfterExhausted = 1
 	}
 	atomic.StoreInt32(&conn.closeAfterExhausted, closeAfterExhausted)
+
+	grace := limits.CloseAfterExhaustedGraceMilliseconds
+	if grace < 0 {
+		grace = 0
+	}
+	atomic.StoreInt64(&conn.closeAfterExhaustedGraceMilliseconds, grace)
+
+	// Any grace period in progress is cancelled, as the new limits
+	// may include a new unthrottled bytes budget.
+	conn.exhaustedMutex.Lock()
+	if conn.exhaustedGraceTimer != nil {
+		conn.exhaustedGraceTimer.Stop()
+		conn.exhaustedGraceTimer = nil
+	}
+	conn.exhaustedGraceDeadline = 0
+	conn.exhaustedMutex.Unlock()
+}
+
+// SetExhaustedCallback sets a callback which is invoked when the
+// ThrottledConn is exhausted and CloseAfterExhausted is set. When a grace
+// period is configured, the callback is invoked, with inGracePeriod set,
+// once at the start of the grace period. The callback is invoked, with
+// inGracePeriod not set, once immediately before the net.Conn is closed,
+// either immediately upon exhaustion or when the grace period expires.
+// bytesRead and bytesWritten are the total bytes transferred through the
+// ThrottledConn at the time of the callback.
+//
+// The callback may be invoked synchronously within Read or Write and must
+// not block. SetExhaustedCallback must be called before any Read or Write.
+func (conn *ThrottledConn) SetExhaustedCallback(
+	callback func(inGracePeriod bool, bytesRead, bytesWritten int64)) {
+
+	conn.exhaustedCallback = callback
+}
+
+// closeExhausted closes the underlying net.Conn when CloseAfterExhausted
+// applies, invoking any exhausted callback the first time.
+func (conn *ThrottledConn) closeExhausted() {
+
+	conn.exhaustedMutex.Lock()
+	invokeCallback := !conn.exhaustedClosed && conn.exhaustedCallback != nil
+	conn.exhaustedClosed = true
+	conn.exhaustedMutex.Unlock()
+
+	if invokeCallback {
+		conn.exhaustedCallback(
+			false,
+			atomic.LoadInt64(&conn.bytesRead),
+			atomic.LoadInt64(&conn.bytesWritten))
+	}
+
+	conn.Conn.Close()
+}
+
+// inExhaustedGracePeriod is called when the unthrottled bytes are exhausted
+// and CloseAfterExhausted is set. It starts the grace period, if configured
+// and not already started, and returns true while the grace period has not
+// expired.
+func (conn *ThrottledConn) inExhaustedGracePeriod() bool {
+
+	conn.exhaustedMutex.Lock()
+
+	if conn.exhaustedGraceDeadline != 0 {
+		inGracePeriod := monotime.Now().Before(conn.exhaustedGraceDeadline)
+		conn.exhaustedMutex.Unlock()
+		return inGracePeriod
+	}
+
+	grace := time.Duration(
+		atomic.LoadInt64(&conn.closeAfterExhaustedGraceMilliseconds)) * time.Millisecond
+
+	if grace <= 0 {
+		conn.exhaustedMutex.Unlock()
+		return false
+	}
+
+	conn.exhaustedGraceDeadline = monotime.Now().Add(grace)
+
+	// The timer bounds the grace period in the case where a Read or
+	// Write is blocked or no further I/O is attempted.
+	conn.exhaustedGraceTimer = time.AfterFunc(grace, conn.closeExhausted)
+
+	conn.exhaustedMutex.Unlock()
+
+	// As in closeExhausted, the callback is invoked without holding
+	// exhaustedMutex, as the callback may acquire locks held by callers
+	// of SetLimits.
+	if conn.exhaustedCallback != nil {
+		conn.exhaustedCallback(
+			true,
+			atomic.LoadInt64(&conn.bytesRead),
+			atomic.LoadInt64(&conn.bytesWritten))
+	}
+
+	return true
+}
+
+// GetUnthrottledBytesRemaining returns the approximate number of
+// ReadUnthrottledBytes and WriteUnthrottledBytes remaining before rate
+// limiting, or CloseAfterExhausted, takes effect. The remaining counts are
+// reset by SetLimits.
+func (conn *ThrottledConn) GetUnthrottledBytesRemaining() (int64, int64) {
+
+	readRemaining := atomic.LoadInt64(&conn.readUnthrottledBytes)
+	if readRemaining < 0 {
+		readRemaining = 0
+	}
+
+	writeRemaining := atomic.LoadInt64(&conn.writeUnthrottledBytes)
+	if writeRemaining < 0 {
+		writeRemaining = 0
+	}
+
+	return readRemaining, writeRemaining
 }
 
 func (conn *ThrottledConn) Read(buffer []byte) (int, error) {
@@ -138,11 +273,17 @@ func (conn *ThrottledConn) Read(buffer []byte) (int, error) {
 	if atomic.LoadInt64(&conn.readUnthrottledBytes) > 0 {
 		n, err := conn.Conn.Read(buffer)
 		atomic.AddInt64(&conn.readUnthrottledBytes, -int64(n))
+		atomic.AddInt64(&conn.bytesRead, int64(n))
 		return n, err
 	}
 
 	if atomic.LoadInt32(&conn.closeAfterExhausted) == 1 {
-		conn.Conn.Close()
+		if conn.inExhaustedGracePeriod() {
+			n, err := conn.Conn.Read(buffer)
+			atomic.AddInt64(&conn.bytesRead, int64(n))
+			return n, err
+		}
+		conn.closeExhausted()
 		return 0, errors.New("throttled conn exhausted")
 	}
 
@@ -164,7 +305,9 @@ func (conn *ThrottledConn) Read(buffer []byte) (int, error) {
 		}
 	}
 
-	return conn.throttledReader.Read(buffer)
+	n, err := conn.throttledReader.Read(buffer)
+	atomic.AddInt64(&conn.bytesRead, int64(n))
+	return n, err
 }
 
 func (conn *ThrottledConn) Write(buffer []byte) (int, error) {
@@ -177,11 +320,17 @@ func (conn *ThrottledConn) Write(buffer []byte) (int, error) {
 	if atomic.LoadInt64(&conn.writeUnthrottledBytes) > 0 {
 		n, err := conn.Conn.Write(buffer)
 		atomic.AddInt64(&conn.writeUnthrottledBytes, -int64(n))
+		atomic.AddInt64(&conn.bytesWritten, int64(n))
 		return n, err
 	}
 
 	if atomic.LoadInt32(&conn.closeAfterExhausted) == 1 {
-		conn.Conn.Close()
+		if conn.inExhaustedGracePeriod() {
+			n, err := conn.Conn.Write(buffer)
+			atomic.AddInt64(&conn.bytesWritten, int64(n))
+			return n, err
+		}
+		conn.closeExhausted()
 		return 0, errors.New("throttled conn exhausted")
 	}
 
@@ -197,5 +346,144 @@ func (conn *ThrottledConn) Write(buffer []byte) (int, error) {
 		}
 	}
 
-	return conn.throttledWriter.Write(buffer)
+	n, err := conn.throttledWriter.Write(buffer)
+	atomic.AddInt64(&conn.bytesWritten, int64(n))
+	return n, err
+}
+
+// RateLimitedCopy copies from src to dst, as io.CopyBuffer, applying the
+// ReadBytesPerSecond and WriteBytesPerSecond rate limits to reads from src
+// and writes to dst, respectively. As in ThrottledConn, rate limiting for
+// each direction starts after the corresponding unthrottled bytes count,
+// ReadUnthrottledBytes or WriteUnthrottledBytes, is exhausted; and a rate
+// of 0 is no limit. CloseAfterExhausted and its grace period are ignored.
+//
+// buf is used for copying, as in io.CopyBuffer; when nil, a buffer is
+// allocated. RateLimitedCopy returns the number of bytes copied and the
+// first error encountered, if any; reaching EOF on src is not an error.
+func RateLimitedCopy(
+	dst io.Writer, src io.Reader, limits RateLimits, buf []byte) (int64, error) {
+
+	readRate := limits.ReadBytesPerSecond
+	readUnthrottledBytes := limits.ReadUnthrottledBytes
+	if readRate <= 0 {
+		readRate = 0
+		readUnthrottledBytes = math.MaxInt64
+	} else if readUnthrottledBytes < 0 {
+		readUnthrottledBytes = 0
+	}
+
+	writeRate := limits.WriteBytesPerSecond
+	writeUnthrottledBytes := limits.WriteUnthrottledBytes
+	if writeRate <= 0 {
+		writeRate = 0
+		writeUnthrottledBytes = math.MaxInt64
+	} else if writeUnthrottledBytes < 0 {
+		writeUnthrottledBytes = 0
+	}
+
+	if readRate == 0 && writeRate == 0 {
+		return io.CopyBuffer(dst, src, buf)
+	}
+
+	if buf == nil {
+		buf = make([]byte, 32*1024)
+	}
+
+	// Every byte read from src is written to dst, so the shorter of the
+	// unthrottled prefixes is copied with no rate limiting at all.
+
+	unthrottledBytes := readUnthrottledBytes
+	if writeUnthrottledBytes < unthrottledBytes {
+		unthrottledBytes = writeUnthrottledBytes
+	}
+
+	var written int64
+
+	if unthrottledBytes > 0 {
+		n, err := CopyNBuffer(dst, src, unthrottledBytes, buf)
+		written += n
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, ContextError(err)
+		}
+	}
+
+	// Throttle the remainder of the copy. The direction with the longer
+	// unthrottled prefix, if any, remains unthrottled for the rest of its
+	// prefix.
+
+	if readRate > 0 {
+		src = &rateLimitedReader{
+			reader:           src,
+			unthrottledBytes: readUnthrottledBytes - unthrottledBytes,
+			throttledReader: ratelimit.Reader(
+				src, ratelimit.NewBucketWithRate(float64(readRate), readRate)),
+		}
+	}
+
+	if writeRate > 0 {
+		dst = &rateLimitedWriter{
+			writer:           dst,
+			unthrottledBytes: writeUnthrottledBytes - unthrottledBytes,
+			throttledWriter: ratelimit.Writer(
+				dst, ratelimit.NewBucketWithRate(float64(writeRate), writeRate)),
+		}
+	}
+
+	n, err := io.CopyBuffer(dst, src, buf)
+	written += n
+	if err != nil {
+		return written, ContextError(err)
+	}
+
+	return written, nil
+}
+
+// rateLimitedReader reads unthrottledBytes from reader before switching to
+// throttledReader. Unlike ThrottledConn, the unthrottled count is exact,
+// and rateLimitedReader is not safe for concurrent use.
+type rateLimitedReader struct {
+	reader           io.Reader
+	unthrottledBytes int64
+	throttledReader  io.Reader
+}
+
+func (r *rateLimitedReader) Read(buffer []byte) (int, error) {
+	if r.unthrottledBytes > 0 {
+		if int64(len(buffer)) > r.unthrottledBytes {
+			buffer = buffer[:r.unthrottledBytes]
+		}
+		n, err := r.reader.Read(buffer)
+		r.unthrottledBytes -= int64(n)
+		return n, err
+	}
+	return r.throttledReader.Read(buffer)
+}
+
+// rateLimitedWriter is the io.Writer counterpart of rateLimitedReader.
+type rateLimitedWriter struct {
+	writer           io.Writer
+	unthrottledBytes int64
+	throttledWriter  io.Writer
+}
+
+func (w *rateLimitedWriter) Write(buffer []byte) (int, error) {
+	if w.unthrottledBytes > 0 {
+		if int64(len(buffer)) <= w.unthrottledBytes {
+			n, err := w.writer.Write(buffer)
+			w.unthrottledBytes -= int64(n)
+			return n, err
+		}
+		n, err := w.writer.Write(buffer[:w.unthrottledBytes])
+		w.unthrottledBytes -= int64(n)
+		if err != nil {
+			return n, err
+		}
+		m, err := w.throttledWriter.Write(buffer[n:])
+		return n + m, err
+	}
+	return w.throttledWriter.Write(buffer)
 }
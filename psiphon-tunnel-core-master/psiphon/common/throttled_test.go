@@ -22,10 +22,12 @@ package common
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -195,3 +197,428 @@ func checkElapsedTime(t *testing.T, dataSize int, rateLimit int64, duration time
 		t.Errorf("unexpected duration: %s > %s", duration, ceilingElapsedTime)
 	}
 }
+
+func TestThrottledConnUnthrottledBytesRemaining(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	unthrottledBytes := int64(1000)
+	dataSize := 400
+
+	throttledConn := NewThrottledConn(serverConn, RateLimits{
+		ReadUnthrottledBytes:  unthrottledBytes,
+		WriteUnthrottledBytes: unthrottledBytes,
+	})
+
+	readRemaining, writeRemaining := throttledConn.GetUnthrottledBytesRemaining()
+	if readRemaining != unthrottledBytes || writeRemaining != unthrottledBytes {
+		t.Fatalf("unexpected remaining: %d, %d", readRemaining, writeRemaining)
+	}
+
+	// Test: remaining read budget decreases while write budget is unchanged
+
+	go func() {
+		clientConn.Write(make([]byte, dataSize))
+	}()
+
+	_, err := io.ReadFull(throttledConn, make([]byte, dataSize))
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	readRemaining, writeRemaining = throttledConn.GetUnthrottledBytesRemaining()
+	if readRemaining != unthrottledBytes-int64(dataSize) || writeRemaining != unthrottledBytes {
+		t.Fatalf("unexpected remaining: %d, %d", readRemaining, writeRemaining)
+	}
+
+	// Test: remaining budget doesn't go negative once exhausted
+
+	for i := 0; i < 3; i++ {
+		go func() {
+			io.ReadFull(clientConn, make([]byte, dataSize))
+		}()
+
+		_, err = throttledConn.Write(make([]byte, dataSize))
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+
+	readRemaining, writeRemaining = throttledConn.GetUnthrottledBytesRemaining()
+	if readRemaining != unthrottledBytes-int64(dataSize) || writeRemaining != 0 {
+		t.Fatalf("unexpected remaining: %d, %d", readRemaining, writeRemaining)
+	}
+
+	// Test: SetLimits resets the remaining budget
+
+	throttledConn.SetLimits(RateLimits{
+		ReadUnthrottledBytes:  unthrottledBytes,
+		WriteUnthrottledBytes: unthrottledBytes,
+	})
+
+	readRemaining, writeRemaining = throttledConn.GetUnthrottledBytesRemaining()
+	if readRemaining != unthrottledBytes || writeRemaining != unthrottledBytes {
+		t.Fatalf("unexpected remaining: %d, %d", readRemaining, writeRemaining)
+	}
+}
+
+func TestThrottledConnCloseAfterExhausted(t *testing.T) {
+
+	for _, graceMilliseconds := range []int64{0, 500} {
+
+		clientConn, serverConn := net.Pipe()
+
+		go func() {
+			io.Copy(ioutil.Discard, clientConn)
+		}()
+
+		throttledConn := NewThrottledConn(serverConn, RateLimits{
+			WriteUnthrottledBytes:                100,
+			CloseAfterExhausted:                  true,
+			CloseAfterExhaustedGraceMilliseconds: graceMilliseconds,
+		})
+
+		// The callback may be invoked by the grace period timer goroutine.
+		var mutex sync.Mutex
+		callbackCount := 0
+		callbackInGracePeriod := false
+		throttledConn.SetExhaustedCallback(func(inGracePeriod bool, _, _ int64) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			callbackCount++
+			callbackInGracePeriod = inGracePeriod
+		})
+
+		checkCallback := func(expectedCount int, expectedInGracePeriod bool) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if callbackCount != expectedCount ||
+				callbackInGracePeriod != expectedInGracePeriod {
+
+				t.Fatalf("unexpected callback state")
+			}
+		}
+
+		_, err := throttledConn.Write(make([]byte, 100))
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		checkCallback(0, false)
+
+		_, err = throttledConn.Write(make([]byte, 100))
+
+		if graceMilliseconds == 0 {
+
+			// Test: immediate close
+
+			if err == nil {
+				t.Fatalf("unexpected Write success")
+			}
+
+			checkCallback(1, false)
+
+		} else {
+
+			// Test: I/O continues during the grace period
+
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+
+			_, err = throttledConn.Write(make([]byte, 100))
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+
+			checkCallback(1, true)
+
+			// Test: the grace period is bounded, even without further I/O,
+			// and the callback is invoked again when the net.Conn is closed
+
+			time.Sleep(time.Duration(graceMilliseconds)*time.Millisecond + 100*time.Millisecond)
+
+			_, err = serverConn.Write(make([]byte, 100))
+			if err == nil {
+				t.Fatalf("unexpected Write success")
+			}
+
+			_, err = throttledConn.Write(make([]byte, 100))
+			if err == nil {
+				t.Fatalf("unexpected Write success")
+			}
+
+			checkCallback(2, false)
+		}
+
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestThrottledConnExhaustedCallbackClose(t *testing.T) {
+
+	testCases := []struct {
+		description          string
+		closeAfterExhausted  bool
+		graceMilliseconds    int64
+		expectedCallback     bool
+		expectedBytesWritten int64
+	}{
+		{"immediate close", true, 0, true, 100},
+		{"close after grace period", true, 200, true, 300},
+		{"no close after exhausted", false, 0, false, 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			go func() {
+				io.Copy(ioutil.Discard, clientConn)
+			}()
+
+			throttledConn := NewThrottledConn(serverConn, RateLimits{
+				WriteUnthrottledBytes:                100,
+				CloseAfterExhausted:                  testCase.closeAfterExhausted,
+				CloseAfterExhaustedGraceMilliseconds: testCase.graceMilliseconds,
+			})
+
+			var mutex sync.Mutex
+			closeCount := 0
+			closeBytesRead := int64(0)
+			closeBytesWritten := int64(0)
+			throttledConn.SetExhaustedCallback(
+				func(inGracePeriod bool, bytesRead, bytesWritten int64) {
+					if inGracePeriod {
+						return
+					}
+					mutex.Lock()
+					defer mutex.Unlock()
+					closeCount++
+					closeBytesRead = bytesRead
+					closeBytesWritten = bytesWritten
+				})
+
+			// Exhaust the unthrottled bytes, write during any grace period,
+			// wait for any grace period to expire, and then attempt further
+			// writes, which must not invoke the callback again. The caller
+			// tallies the bytes written, as reported by Write.
+
+			bytesWritten := int64(0)
+			write := func() {
+				n, _ := throttledConn.Write(make([]byte, 100))
+				bytesWritten += int64(n)
+			}
+
+			for i := 0; i < 3; i++ {
+				write()
+			}
+
+			time.Sleep(time.Duration(testCase.graceMilliseconds)*time.Millisecond + 100*time.Millisecond)
+
+			for i := 0; i < 3; i++ {
+				write()
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if !testCase.expectedCallback {
+				if closeCount != 0 {
+					t.Fatalf("unexpected callback")
+				}
+				return
+			}
+
+			if closeCount != 1 {
+				t.Fatalf("unexpected callback count: %d", closeCount)
+			}
+
+			if closeBytesRead != 0 ||
+				closeBytesWritten != testCase.expectedBytesWritten ||
+				closeBytesWritten != bytesWritten {
+
+				t.Fatalf("unexpected bytes transferred: %d, %d, %d",
+					closeBytesRead, closeBytesWritten, bytesWritten)
+			}
+		})
+	}
+}
+
+func TestThrottledConnExhaustedCallbackSetLimits(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		io.Copy(ioutil.Discard, clientConn)
+	}()
+
+	limits := RateLimits{
+		WriteUnthrottledBytes:                100,
+		CloseAfterExhausted:                  true,
+		CloseAfterExhaustedGraceMilliseconds: 500,
+	}
+
+	throttledConn := NewThrottledConn(serverConn, limits)
+
+	// The callback acquires callerMutex, as the server's exhausted callback
+	// acquires the sshClient lock. The test holds callerMutex while calling
+	// SetLimits, as the server does when updating traffic rules.
+
+	var callerMutex sync.Mutex
+	callbackStarted := make(chan struct{})
+	throttledConn.SetExhaustedCallback(func(inGracePeriod bool, _, _ int64) {
+		if inGracePeriod {
+			close(callbackStarted)
+		}
+		callerMutex.Lock()
+		callerMutex.Unlock()
+	})
+
+	_, err := throttledConn.Write(make([]byte, 100))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	callerMutex.Lock()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := throttledConn.Write(make([]byte, 100))
+		writeErr <- err
+	}()
+
+	<-callbackStarted
+
+	// Test: SetLimits doesn't block while the grace period callback is
+	// waiting on a lock held by the SetLimits caller
+
+	setLimitsDone := make(chan struct{})
+	go func() {
+		throttledConn.SetLimits(limits)
+		close(setLimitsDone)
+	}()
+
+	select {
+	case <-setLimitsDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SetLimits blocked")
+	}
+
+	callerMutex.Unlock()
+
+	err = <-writeErr
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+}
+
+func TestRateLimitedCopy(t *testing.T) {
+
+	const rate = 2 * 1024 * 1024
+
+	testCases := []struct {
+		description string
+		limits      RateLimits
+		dataSize    int64
+	}{
+		{
+			"unlimited",
+			RateLimits{},
+			3 * rate,
+		},
+		{
+			"read limited",
+			RateLimits{ReadBytesPerSecond: rate},
+			2 * rate,
+		},
+		{
+			"write limited",
+			RateLimits{WriteBytesPerSecond: rate},
+			2 * rate,
+		},
+		{
+			"read and write limited with unthrottled bytes",
+			RateLimits{
+				ReadUnthrottledBytes:  rate,
+				ReadBytesPerSecond:    rate,
+				WriteUnthrottledBytes: 2 * rate,
+				WriteBytesPerSecond:   rate,
+			},
+			3 * rate,
+		},
+		{
+			"within unthrottled bytes",
+			RateLimits{
+				ReadUnthrottledBytes: 3 * rate,
+				ReadBytesPerSecond:   1024,
+			},
+			3 * rate,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testData, err := MakeSecureRandomBytes(int(testCase.dataSize))
+			if err != nil {
+				t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+			}
+
+			var output bytes.Buffer
+
+			startTime := monotime.Now()
+
+			n, err := RateLimitedCopy(
+				&output, bytes.NewReader(testData), testCase.limits, make([]byte, 32*1024))
+			if err != nil {
+				t.Fatalf("RateLimitedCopy failed: %s", err)
+			}
+
+			elapsed := monotime.Since(startTime)
+
+			if n != testCase.dataSize || !bytes.Equal(output.Bytes(), testData) {
+				t.Fatalf("unexpected copy result: %d bytes", n)
+			}
+
+			// The throttled bytes are those after the longest unthrottled
+			// prefix of the limited directions. Each rate limiter allows an
+			// initial burst of one second's worth of bytes, so copying
+			// throttledBytes takes at least (throttledBytes - rate) / rate.
+
+			throttledBytes := int64(0)
+			rates := []struct{ unthrottled, rate int64 }{
+				{testCase.limits.ReadUnthrottledBytes, testCase.limits.ReadBytesPerSecond},
+				{testCase.limits.WriteUnthrottledBytes, testCase.limits.WriteBytesPerSecond},
+			}
+			var minElapsed time.Duration
+			for _, r := range rates {
+				if r.rate <= 0 || r.unthrottled >= testCase.dataSize {
+					continue
+				}
+				throttledBytes = testCase.dataSize - r.unthrottled
+				d := time.Duration(float64(throttledBytes-r.rate) / float64(r.rate) * float64(time.Second))
+				if d > minElapsed {
+					minElapsed = d
+				}
+			}
+
+			// Allow some tolerance for timer granularity.
+			if elapsed < minElapsed*9/10 {
+				t.Fatalf("copy exceeded rate limit: %s < %s", elapsed, minElapsed)
+			}
+
+			if throttledBytes == 0 && elapsed > 1*time.Second {
+				t.Fatalf("unthrottled copy was throttled: %s", elapsed)
+			}
+		})
+	}
+}
@@ -71,6 +71,18 @@ func ContainsAny(list, targets []string) bool {
 	return false
 }
 
+// ContainsAnyWildcard returns true if any string in
+// targets matches any of the patterns. Patterns may
+// contain the '*' wildcard.
+func ContainsAnyWildcard(patterns, targets []string) bool {
+	for _, target := range targets {
+		if ContainsWildcard(patterns, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // ContainsInt returns true if the target int is
 // in the list.
 func ContainsInt(list []int, target int) bool {
@@ -174,7 +186,7 @@ func ContextErrorMsg(err error, message string) error {
 // Compress returns zlib compressed data
 func Compress(data []byte) []byte {
 	var compressedData bytes.Buffer
-	writer := zlib.NewWriter(&compressedData)
+	writer := CompressStream(&compressedData)
 	writer.Write(data)
 	writer.Close()
 	return compressedData.Bytes()
@@ -182,7 +194,7 @@ func Compress(data []byte) []byte {
 
 // Decompress returns zlib decompressed data
 func Decompress(data []byte) ([]byte, error) {
-	reader, err := zlib.NewReader(bytes.NewReader(data))
+	reader, err := DecompressStream(bytes.NewReader(data))
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -194,8 +206,30 @@ func Decompress(data []byte) ([]byte, error) {
 	return uncompressedData, nil
 }
 
+// CompressStream returns a writer which zlib compresses data written to it
+// and writes the compressed data to w. The output is the same as Compress.
+// The writer must be closed to flush all compressed data to w; closing the
+// writer doesn't close w.
+func CompressStream(w io.Writer) io.WriteCloser {
+	return zlib.NewWriter(w)
+}
+
+// DecompressStream returns a reader which reads zlib compressed data from r
+// and returns the decompressed data. DecompressStream reads the zlib header
+// from r, and fails if the header is invalid. Closing the reader doesn't
+// close r.
+func DecompressStream(r io.Reader) (io.ReadCloser, error) {
+	reader, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return reader, nil
+}
+
 // FormatByteCount returns a string representation of the specified
-// byte count in conventional, human-readable format.
+// byte count in conventional, human-readable format. FormatByteCount uses
+// binary, 1024-based, units; for example, "1.0K" is 1024 bytes. See also
+// FormatByteCountSI.
 func FormatByteCount(bytes uint64) string {
 	// Based on: https://bitbucket.org/psiphon/psiphon-circumvention-system/src/b2884b0d0a491e55420ed1888aea20d00fefdb45/Android/app/src/main/java/com/psiphon3/psiphonlibrary/Utils.java?at=default#Utils.java-646
 	base := uint64(1024)
@@ -207,6 +241,24 @@ func FormatByteCount(bytes uint64) string {
 		"%.1f%c", float64(bytes)/math.Pow(float64(base), float64(exp)), "KMGTPEZ"[exp-1])
 }
 
+// FormatByteCountSI returns a string representation of the specified byte
+// count using SI, 1000-based, units; for example, "1.0kB" is 1000 bytes.
+func FormatByteCountSI(bytes uint64) string {
+	base := uint64(1000)
+	if bytes < base {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	// Use integer division, rather than math.Log, to select the unit, to
+	// avoid floating point error at exact powers of the base.
+	divisor, exp := base, 0
+	for n := bytes / base; n >= base; n /= base {
+		divisor *= base
+		exp++
+	}
+	return fmt.Sprintf(
+		"%.1f%cB", float64(bytes)/float64(divisor), "kMGTPE"[exp])
+}
+
 func CopyNBuffer(dst io.Writer, src io.Reader, n int64, buf []byte) (written int64, err error) {
 	// Based on io.CopyN:
 	// https://github.com/golang/go/blob/release-branch.go1.11/src/io/io.go#L339
@@ -22,8 +22,13 @@ package common
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 func TestGetStringSlice(t *testing.T) {
@@ -52,6 +57,36 @@ func TestGetStringSlice(t *testing.T) {
 	}
 }
 
+func TestContainsAnyWildcard(t *testing.T) {
+
+	testCases := []struct {
+		description string
+		patterns    []string
+		targets     []string
+		expected    bool
+	}{
+		{"exact match", []string{"a", "b"}, []string{"c", "b"}, true},
+		{"no match", []string{"a", "b"}, []string{"c", "d"}, false},
+		{"prefix wildcard", []string{"*.example.com"}, []string{"x", "www.example.com"}, true},
+		{"suffix wildcard", []string{"example.*"}, []string{"example.org"}, true},
+		{"wildcard no match", []string{"*.example.com"}, []string{"example.org"}, false},
+		{"match all", []string{"*"}, []string{"x"}, true},
+		{"match all empty target", []string{"*"}, []string{""}, true},
+		{"empty patterns", []string{}, []string{"a"}, false},
+		{"empty targets", []string{"*"}, []string{}, false},
+		{"nil patterns and targets", nil, nil, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			result := ContainsAnyWildcard(testCase.patterns, testCase.targets)
+			if result != testCase.expected {
+				t.Fatalf("unexpected result: %v", result)
+			}
+		})
+	}
+}
+
 func TestCompress(t *testing.T) {
 
 	originalData := []byte("test data")
@@ -68,6 +103,70 @@ func TestCompress(t *testing.T) {
 	}
 }
 
+func TestCompressStream(t *testing.T) {
+
+	var buffer bytes.Buffer
+	for i := 0; buffer.Len() < 1024*1024; i++ {
+		fmt.Fprintf(&buffer, "server entry %d\n", i)
+	}
+	originalData := buffer.Bytes()
+
+	// Test: streaming compression, with small writes, produces the same
+	// output as Compress
+
+	var compressedData bytes.Buffer
+	writer := CompressStream(&compressedData)
+	_, err := io.CopyBuffer(
+		writer, iotest.OneByteReader(bytes.NewReader(originalData[:1000])), make([]byte, 1))
+	if err != nil {
+		t.Fatalf("CopyBuffer failed: %s", err)
+	}
+	_, err = io.CopyBuffer(
+		writer, bytes.NewReader(originalData[1000:]), make([]byte, 4096))
+	if err != nil {
+		t.Fatalf("CopyBuffer failed: %s", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	if !bytes.Equal(compressedData.Bytes(), Compress(originalData)) {
+		t.Fatalf("streaming compressed data doesn't match compressed data")
+	}
+
+	// Test: streaming decompression, with small reads, produces the same
+	// output as Decompress
+
+	reader, err := DecompressStream(
+		iotest.OneByteReader(bytes.NewReader(compressedData.Bytes())))
+	if err != nil {
+		t.Fatalf("DecompressStream failed: %s", err)
+	}
+	decompressedData, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+	reader.Close()
+
+	expectedData, err := Decompress(compressedData.Bytes())
+	if err != nil {
+		t.Fatalf("Decompress failed: %s", err)
+	}
+
+	if !bytes.Equal(decompressedData, expectedData) ||
+		!bytes.Equal(decompressedData, originalData) {
+		t.Fatalf("streaming decompressed data doesn't match original data")
+	}
+
+	// Test: invalid header fails
+
+	_, err = DecompressStream(bytes.NewReader([]byte("invalid")))
+	if err == nil {
+		t.Fatalf("DecompressStream unexpectedly succeeded")
+	}
+}
+
 func TestFormatByteCount(t *testing.T) {
 
 	testCases := []struct {
@@ -75,6 +174,9 @@ func TestFormatByteCount(t *testing.T) {
 		expectedOutput string
 	}{
 		{500, "500B"},
+		{999, "999B"},
+		{1000, "1000B"},
+		{1023, "1023B"},
 		{1024, "1.0K"},
 		{10000, "9.8K"},
 		{1024*1024 + 1, "1.0M"},
@@ -90,3 +192,31 @@ func TestFormatByteCount(t *testing.T) {
 		})
 	}
 }
+
+func TestFormatByteCountSI(t *testing.T) {
+
+	testCases := []struct {
+		n              uint64
+		expectedOutput string
+	}{
+		{500, "500B"},
+		{999, "999B"},
+		{1000, "1.0kB"},
+		{1023, "1.0kB"},
+		{1024, "1.0kB"},
+		{10000, "10.0kB"},
+		{1000 * 1000, "1.0MB"},
+		{1000*1000*1000*1000 + 1, "1.0TB"},
+		{100*1000*1000 + 99999, "100.1MB"},
+		{math.MaxUint64, "18.4EB"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.expectedOutput, func(t *testing.T) {
+			output := FormatByteCountSI(testCase.n)
+			if output != testCase.expectedOutput {
+				t.Errorf("unexpected output: %s", output)
+			}
+		})
+	}
+}
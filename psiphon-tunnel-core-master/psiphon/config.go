@@ -24,6 +24,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -58,6 +59,17 @@ type Config struct {
 	// and continue running.
 	DataStoreDirectory string
 
+	// DataStoreMemoryBudgetBytes is a hint, in bytes, limiting the memory
+	// used by large datastore operations, including server entry imports,
+	// server entry iteration, and the start up persistent stats reset. Under
+	// a budget, these operations use smaller batches and trigger garbage
+	// collection more frequently, trading off speed for lower peak memory
+	// use. The budget is an estimate and not a hard limit. For the default,
+	// 0, no budget is applied. See GetDataStorePeakMemoryEstimate.
+	//
+	// This parameter is intended for use on low-RAM devices.
+	DataStoreMemoryBudgetBytes int
+
 	// PropagationChannelId is a string identifier which indicates how the
 	// Psiphon client was distributed. This parameter is required. This value
 	// is supplied by and depends on the Psiphon Network, and is typically
@@ -96,6 +108,12 @@ type Config struct {
 	// in any country is selected.
 	EgressRegion string
 
+	// ExcludeServerIPs is a list of server IP addresses to skip when
+	// iterating over candidate server entries. Excluded server entries are
+	// not deleted from the datastore. This is intended for testing failover.
+	// The list may be changed at runtime with SetExcludedServerIPs.
+	ExcludeServerIPs []string
+
 	// ListenInterface specifies which interface to listen on.  If no
 	// interface is provided then listen on 127.0.0.1. If 'any' is provided
 	// then use 0.0.0.0. If there are multiple IP addresses on an interface
@@ -225,6 +243,21 @@ type Config struct {
 	// parameter is ignored.
 	UpstreamProxyCustomHeaders http.Header
 
+	// CustomDialer is the name of a custom dialer, registered with
+	// RegisterCustomDialer, through which tunnel protocol TCP dials are
+	// made. The custom dialer is layered on top of the standard TCP dial,
+	// including any UpstreamProxyURL. CustomDialer does not apply to UDP
+	// tunnel protocols, or to non-tunnel dials such as remote server list
+	// fetches. The default, "", uses no custom dialer.
+	//
+	// This parameter is only applicable to library deployments.
+	CustomDialer string
+
+	// CustomDialerTunnelProtocols limits CustomDialer to the specified tunnel
+	// protocols. Tunnel protocols not listed dial normally. For the default,
+	// an empty list, CustomDialer applies to all tunnel protocols.
+	CustomDialerTunnelProtocols []string
+
 	// NetworkConnectivityChecker is an interface that enables tunnel-core to
 	// call into the host application to check for network connectivity. See:
 	// NetworkConnectivityChecker doc.
@@ -296,6 +329,15 @@ type Config struct {
 	// speed test samples.
 	TargetApiProtocol string
 
+	// DisableInitialLimitTunnelProtocols skips the InitialLimitTunnelProtocols
+	// phase of establishment, as if InitialLimitTunnelProtocolsCandidateCount
+	// were 0. LimitTunnelProtocols still applies. Use
+	// Controller.CountCandidateServers to compare the number of initial and
+	// general candidates.
+	//
+	// This parameter is intended for testing and debugging only.
+	DisableInitialLimitTunnelProtocols bool
+
 	// RemoteServerListUrl is a URL which specifies a location to fetch out-
 	// of-band server entries. This facility is used when a tunnel cannot be
 	// established to known servers. This value is supplied by and depends on
@@ -325,6 +367,14 @@ type Config struct {
 	// client binary.
 	RemoteServerListSignaturePublicKey string
 
+	// ServerEntrySignaturePublicKey, when set, is a base64 encoded Ed25519
+	// public key used to verify server entry signatures before server
+	// entries are stored. Server entries from any source other than
+	// embedded server lists and TargetServerEntry must have a valid
+	// signature; unsigned and tampered server entries are skipped. See
+	// protocol.ServerEntryFields.VerifySignature.
+	ServerEntrySignaturePublicKey string
+
 	// DisableRemoteServerListFetcher disables fetching remote server lists.
 	// This is used for special case temporary tunnels.
 	DisableRemoteServerListFetcher bool
@@ -421,6 +471,14 @@ type Config struct {
 	// bytes sent and received.
 	EmitBytesTransferred bool
 
+	// EmitPeriodicMetricsPeriodMilliseconds, when > 0, enables periodic
+	// PeriodicMetrics notices, emitted at the specified period. Each notice
+	// is a sample of tunnel performance over the preceding period, including
+	// the number of active tunnels, the tunneled bytes transferred, and the
+	// number of tunnel handshakes completed, allowing the app to record a
+	// time series. The default, 0, emits no PeriodicMetrics notices.
+	EmitPeriodicMetricsPeriodMilliseconds int
+
 	// TrustedCACertificatesFilename specifies a file containing trusted CA
 	// certs. When set, this toggles use of the trusted CA certs, specified in
 	// TrustedCACertificatesFilename, for tunneled TLS connections that expect
@@ -522,6 +580,7 @@ type Config struct {
 	dynamicConfigMutex sync.Mutex
 	sponsorID          string
 	authorizations     []string
+	excludedServerIPs  map[string]bool
 
 	deviceBinder    DeviceBinder
 	networkIDGetter NetworkIDGetter
@@ -627,6 +686,49 @@ func (config *Config) Commit() error {
 			errors.New("invalid TargetApiProtocol"))
 	}
 
+	if config.CustomDialer != "" {
+		if _, ok := getCustomDialer(config.CustomDialer); !ok {
+			return common.ContextError(errors.New("unknown CustomDialer"))
+		}
+	}
+
+	if len(config.CustomDialerTunnelProtocols) > 0 {
+		if config.CustomDialer == "" {
+			return common.ContextError(
+				errors.New("CustomDialerTunnelProtocols requires CustomDialer"))
+		}
+		err := protocol.TunnelProtocols(config.CustomDialerTunnelProtocols).Validate()
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	if config.ServerEntrySignaturePublicKey != "" {
+		err := protocol.ValidateServerEntrySignaturePublicKey(
+			config.ServerEntrySignaturePublicKey)
+		if err != nil {
+			return common.ContextError(
+				fmt.Errorf("invalid ServerEntrySignaturePublicKey: %s", err))
+		}
+	}
+
+	for _, ipAddress := range config.ExcludeServerIPs {
+		if net.ParseIP(ipAddress) == nil {
+			return common.ContextError(
+				fmt.Errorf("invalid ExcludeServerIPs address: %s", ipAddress))
+		}
+	}
+
+	if config.DataStoreMemoryBudgetBytes < 0 {
+		return common.ContextError(
+			errors.New("invalid DataStoreMemoryBudgetBytes"))
+	}
+
+	if config.EmitPeriodicMetricsPeriodMilliseconds < 0 {
+		return common.ContextError(
+			errors.New("invalid EmitPeriodicMetricsPeriodMilliseconds"))
+	}
+
 	if !config.DisableRemoteServerListFetcher {
 
 		if config.RemoteServerListURLs != nil {
@@ -714,6 +816,7 @@ func (config *Config) Commit() error {
 	// Set defaults for dynamic config fields.
 
 	config.SetDynamicConfig(config.SponsorId, config.Authorizations)
+	config.SetExcludedServerIPs(config.ExcludeServerIPs)
 
 	// Initialize config.deviceBinder and config.config.networkIDGetter. These
 	// wrap config.DeviceBinder and config.NetworkIDGetter/NetworkID with
@@ -817,12 +920,43 @@ func (config *Config) GetAuthorizations() []string {
 	return config.authorizations
 }
 
+// SetExcludedServerIPs sets the current list of server IP addresses to skip
+// when iterating over candidate server entries, replacing any previous list.
+// The new list applies to subsequent ServerEntryIterator.Next calls.
+func (config *Config) SetExcludedServerIPs(ipAddresses []string) {
+	excludedServerIPs := make(map[string]bool)
+	for _, ipAddress := range ipAddresses {
+		excludedServerIPs[ipAddress] = true
+	}
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	config.excludedServerIPs = excludedServerIPs
+}
+
+// IsExcludedServerIP indicates if the specified server IP address is in the
+// current list of excluded server IP addresses.
+func (config *Config) IsExcludedServerIP(ipAddress string) bool {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	return config.excludedServerIPs[ipAddress]
+}
+
 // UseUpstreamProxy indicates if an upstream proxy has been
 // configured.
 func (config *Config) UseUpstreamProxy() bool {
 	return config.UpstreamProxyURL != ""
 }
 
+// UseCustomDialer indicates if the configured CustomDialer applies to the
+// specified tunnel protocol.
+func (config *Config) UseCustomDialer(tunnelProtocol string) bool {
+	if config.CustomDialer == "" {
+		return false
+	}
+	return len(config.CustomDialerTunnelProtocols) == 0 ||
+		common.Contains(config.CustomDialerTunnelProtocols, tunnelProtocol)
+}
+
 // GetNetworkID returns the current network ID. When NetworkIDGetter
 // is set, this calls into the host application; otherwise, a default
 // value is returned.
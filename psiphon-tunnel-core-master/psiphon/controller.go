@@ -30,6 +30,7 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Psiphon-Labs/goarista/monotime"
@@ -45,6 +46,12 @@ import (
 // connect to; establishes and monitors tunnels; and runs local proxies which
 // route traffic through the tunnels.
 type Controller struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	periodicMetricsBytesSent                int64
+	periodicMetricsBytesReceived            int64
+	periodicMetricsHandshakes               int64
 	config                                  *Config
 	runCtx                                  context.Context
 	stopRunning                             context.CancelFunc
@@ -231,6 +238,12 @@ func (controller *Controller) Run(ctx context.Context) {
 		go controller.upgradeDownloader()
 	}
 
+	if controller.config.EmitPeriodicMetricsPeriodMilliseconds > 0 {
+		controller.runWaitGroup.Add(1)
+		go controller.periodicMetricsReporter(
+			time.Duration(controller.config.EmitPeriodicMetricsPeriodMilliseconds) * time.Millisecond)
+	}
+
 	/// Note: the connected reporter isn't started until a tunnel is
 	// established
 
@@ -281,6 +294,13 @@ func (controller *Controller) SetDynamicConfig(sponsorID string, authorizations
 	controller.config.SetDynamicConfig(sponsorID, authorizations)
 }
 
+// SetExcludedServerIPs sets the list of server IP addresses that are skipped
+// when selecting candidate servers. The new list applies to subsequent
+// candidate server selection, and doesn't affect any established tunnel.
+func (controller *Controller) SetExcludedServerIPs(ipAddresses []string) {
+	controller.config.SetExcludedServerIPs(ipAddresses)
+}
+
 // TerminateNextActiveTunnel terminates the active tunnel, which will initiate
 // establishment of a new tunnel.
 func (controller *Controller) TerminateNextActiveTunnel() {
@@ -642,6 +662,8 @@ loop:
 						connectedTunnel.dialParams.ServerEntry.IpAddress, err)
 					discardTunnel = true
 				} else {
+					atomic.AddInt64(&controller.periodicMetricsHandshakes, 1)
+
 					// It's unlikely that registerTunnel will fail, since only this goroutine
 					// calls registerTunnel -- and after checking numTunnels; so failure is not
 					// expected.
@@ -781,6 +803,46 @@ func (controller *Controller) SignalTunnelFailure(tunnel *Tunnel) {
 	}
 }
 
+// SignalBytesTransferred implements the TunnelOwner interface. This function
+// is called by Tunnel.operateTunnel to report recent tunneled bytes
+// transferred, which are accumulated for PeriodicMetrics notices.
+func (controller *Controller) SignalBytesTransferred(sent, received int64) {
+	atomic.AddInt64(&controller.periodicMetricsBytesSent, sent)
+	atomic.AddInt64(&controller.periodicMetricsBytesReceived, received)
+}
+
+// periodicMetricsReporter emits a PeriodicMetrics notice at the specified
+// period, reporting the bytes transferred and handshakes completed since
+// the previous notice.
+func (controller *Controller) periodicMetricsReporter(period time.Duration) {
+	defer controller.runWaitGroup.Done()
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	lastTime := monotime.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-controller.runCtx.Done():
+			return
+		}
+
+		now := monotime.Now()
+		activeTunnels, _ := controller.numTunnels()
+
+		NoticePeriodicMetrics(
+			now.Sub(lastTime),
+			activeTunnels,
+			atomic.SwapInt64(&controller.periodicMetricsBytesSent, 0),
+			atomic.SwapInt64(&controller.periodicMetricsBytesReceived, 0),
+			atomic.SwapInt64(&controller.periodicMetricsHandshakes, 0))
+
+		lastTime = now
+	}
+}
+
 // discardTunnel disposes of a successful connection that is no longer required.
 func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 	NoticeInfo("discard tunnel: %s", tunnel.dialParams.ServerEntry.IpAddress)
@@ -814,6 +876,8 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	controller.tunnels = append(controller.tunnels, tunnel)
 	NoticeTunnels(len(controller.tunnels))
 
+	recordServerEntrySourceStat(tunnel.dialParams.ServerEntry.LocalSource)
+
 	// Promote this successful tunnel to first rank so it's one
 	// of the first candidates next time establish runs.
 	// Connecting to a TargetServerEntry does not change the
@@ -825,6 +889,35 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	return true
 }
 
+var serverEntrySourceStatsMutex sync.Mutex
+var serverEntrySourceStats = make(map[string]int)
+
+// recordServerEntrySourceStat increments the established tunnel count for
+// the specified server entry source. Server entries with no recorded local
+// source, such as entries stored by older clients, are not counted.
+func recordServerEntrySourceStat(source string) {
+	if source == "" {
+		return
+	}
+	serverEntrySourceStatsMutex.Lock()
+	defer serverEntrySourceStatsMutex.Unlock()
+	serverEntrySourceStats[source] += 1
+}
+
+// GetServerEntrySourceStats returns the number of tunnels established, since
+// the process started, keyed by the local source of the tunnel's server
+// entry; for example, protocol.SERVER_ENTRY_SOURCE_EMBEDDED. The returned map
+// is a copy and may be modified by the caller.
+func GetServerEntrySourceStats() map[string]int {
+	serverEntrySourceStatsMutex.Lock()
+	defer serverEntrySourceStatsMutex.Unlock()
+	stats := make(map[string]int)
+	for source, count := range serverEntrySourceStats {
+		stats[source] = count
+	}
+	return stats
+}
+
 // hasEstablishedOnce indicates if at least one active tunnel has
 // been established up to this point. This is regardeless of how many
 // tunnels are presently active.
@@ -1012,7 +1105,9 @@ type protocolSelectionConstraints struct {
 	initialLimitProtocols               protocol.TunnelProtocols
 	initialLimitProtocolsCandidateCount int
 	limitProtocols                      protocol.TunnelProtocols
+	protocolWeights                     parameters.TunnelProtocolWeights
 	replayCandidateCount                int
+	buildCapabilities                   []string
 }
 
 func (p *protocolSelectionConstraints) hasInitialProtocols() bool {
@@ -1024,7 +1119,8 @@ func (p *protocolSelectionConstraints) isInitialCandidate(
 	serverEntry *protocol.ServerEntry) bool {
 
 	return p.hasInitialProtocols() &&
-		len(serverEntry.GetSupportedProtocols(p.useUpstreamProxy, p.initialLimitProtocols, excludeIntensive)) > 0
+		len(serverEntry.GetUsableProtocols(
+			p.useUpstreamProxy, p.initialLimitProtocols, excludeIntensive, p.buildCapabilities)) > 0
 }
 
 func (p *protocolSelectionConstraints) isCandidate(
@@ -1032,7 +1128,8 @@ func (p *protocolSelectionConstraints) isCandidate(
 	serverEntry *protocol.ServerEntry) bool {
 
 	return len(p.limitProtocols) == 0 ||
-		len(serverEntry.GetSupportedProtocols(p.useUpstreamProxy, p.limitProtocols, excludeIntensive)) > 0
+		len(serverEntry.GetUsableProtocols(
+			p.useUpstreamProxy, p.limitProtocols, excludeIntensive, p.buildCapabilities)) > 0
 }
 
 func (p *protocolSelectionConstraints) canReplay(
@@ -1061,10 +1158,11 @@ func (p *protocolSelectionConstraints) supportedProtocols(
 		limitProtocols = p.initialLimitProtocols
 	}
 
-	return serverEntry.GetSupportedProtocols(
+	return serverEntry.GetUsableProtocols(
 		p.useUpstreamProxy,
 		limitProtocols,
-		excludeIntensive)
+		excludeIntensive,
+		p.buildCapabilities)
 }
 
 func (p *protocolSelectionConstraints) selectProtocol(
@@ -1078,15 +1176,14 @@ func (p *protocolSelectionConstraints) selectProtocol(
 		return "", false
 	}
 
-	// Pick at random from the supported protocols. This ensures that we'll
-	// eventually try all possible protocols. Depending on network
-	// configuration, it may be the case that some protocol is only available
-	// through multi-capability servers, and a simpler ranked preference of
-	// protocols could lead to that protocol never being selected.
+	// Pick at random from the supported protocols, biased by any configured
+	// TunnelProtocolSelectionWeights. This ensures that we'll eventually try all
+	// possible protocols. Depending on network configuration, it may be the
+	// case that some protocol is only available through multi-capability
+	// servers, and a simpler ranked preference of protocols could lead to
+	// that protocol never being selected.
 
-	index := prng.Intn(len(candidateProtocols))
-
-	return candidateProtocols[index], true
+	return p.protocolWeights.Select(candidateProtocols), true
 
 }
 
@@ -1096,6 +1193,40 @@ type candidateServerEntry struct {
 	adjustedEstablishStartTime monotime.Time
 }
 
+// newProtocolSelectionConstraints initializes protocol selection constraints
+// from the current client parameters.
+func (controller *Controller) newProtocolSelectionConstraints() *protocolSelectionConstraints {
+
+	p := controller.config.clientParameters.Get()
+
+	return &protocolSelectionConstraints{
+		useUpstreamProxy:                    controller.config.UseUpstreamProxy(),
+		initialLimitProtocols:               p.TunnelProtocols(parameters.InitialLimitTunnelProtocols),
+		initialLimitProtocolsCandidateCount: p.Int(parameters.InitialLimitTunnelProtocolsCandidateCount),
+		limitProtocols:                      p.TunnelProtocols(parameters.LimitTunnelProtocols),
+		protocolWeights:                     p.TunnelProtocolWeights(parameters.TunnelProtocolSelectionWeights),
+		replayCandidateCount:                p.Int(parameters.ReplayCandidateCount),
+		buildCapabilities:                   GetBuildCapabilities(),
+	}
+}
+
+// CountCandidateServers returns, for the current client parameters and
+// stored server entries, the number of candidate servers for the
+// InitialLimitTunnelProtocols phase of establishment and the number of
+// general candidate servers, for the configured EgressRegion.
+//
+// This is a diagnostic facility for cases where InitialLimitTunnelProtocols
+// leaves too few candidates; the counts are those that would apply to a new
+// establishment, and DisableInitialLimitTunnelProtocols is not reflected.
+// Note that the initial and general limits may be subject to probability
+// parameters, in which case each call may apply a different limit.
+func (controller *Controller) CountCandidateServers() (int, int) {
+	return CountServerEntriesWithConstraints(
+		controller.config.UseUpstreamProxy(),
+		controller.config.EgressRegion,
+		controller.newProtocolSelectionConstraints())
+}
+
 // startEstablishing creates a pool of worker goroutines which will
 // attempt to establish tunnels to candidate servers. The candidates
 // are generated by another goroutine.
@@ -1207,14 +1338,13 @@ func (controller *Controller) launchEstablishing() {
 	// establishLimitTunnelProtocolsState field must be read-only after this
 	// point, allowing concurrent reads by establishment workers.
 
-	p := controller.config.clientParameters.Get()
+	controller.protocolSelectionConstraints = controller.newProtocolSelectionConstraints()
 
-	controller.protocolSelectionConstraints = &protocolSelectionConstraints{
-		useUpstreamProxy:                    controller.config.UseUpstreamProxy(),
-		initialLimitProtocols:               p.TunnelProtocols(parameters.InitialLimitTunnelProtocols),
-		initialLimitProtocolsCandidateCount: p.Int(parameters.InitialLimitTunnelProtocolsCandidateCount),
-		limitProtocols:                      p.TunnelProtocols(parameters.LimitTunnelProtocols),
-		replayCandidateCount:                p.Int(parameters.ReplayCandidateCount),
+	if controller.config.DisableInitialLimitTunnelProtocols &&
+		controller.protocolSelectionConstraints.initialLimitProtocolsCandidateCount > 0 {
+
+		NoticeInfo("initial limit tunnel protocols disabled")
+		controller.protocolSelectionConstraints.initialLimitProtocolsCandidateCount = 0
 	}
 
 	workerPoolSize := controller.config.clientParameters.Get().Int(
@@ -1229,8 +1359,6 @@ func (controller *Controller) launchEstablishing() {
 		workerPoolSize = 1
 	}
 
-	p = nil
-
 	// If InitialLimitTunnelProtocols is configured but cannot be satisfied,
 	// skip the initial phase in this establishment. This avoids spinning,
 	// unable to connect, in this case. InitialLimitTunnelProtocols is
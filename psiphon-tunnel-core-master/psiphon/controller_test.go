@@ -40,6 +40,7 @@ import (
 
 	socks "github.com/Psiphon-Labs/goptlib"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/elazarl/goproxy"
 )
@@ -1073,3 +1074,118 @@ func initUpstreamProxy() {
 
 	// TODO: wait until listener is active?
 }
+
+func TestServerEntrySourceStats(t *testing.T) {
+
+	// Skip PromoteServerEntry, which requires an open datastore, by
+	// configuring a TargetServerEntry.
+	controller := &Controller{
+		config: &Config{
+			TunnelPoolSize:    4,
+			TargetServerEntry: "target",
+		},
+	}
+
+	initialStats := GetServerEntrySourceStats()
+
+	sources := []string{
+		protocol.SERVER_ENTRY_SOURCE_TARGET,
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED,
+		protocol.SERVER_ENTRY_SOURCE_TARGET,
+		"",
+	}
+
+	for i, source := range sources {
+		tunnel := &Tunnel{
+			dialParams: &DialParameters{
+				ServerEntry: &protocol.ServerEntry{
+					IpAddress:   fmt.Sprintf("192.0.2.%d", i+1),
+					LocalSource: source,
+				},
+			},
+		}
+		if !controller.registerTunnel(tunnel) {
+			t.Fatalf("registerTunnel failed")
+		}
+	}
+
+	stats := GetServerEntrySourceStats()
+
+	expectedIncrements := map[string]int{
+		protocol.SERVER_ENTRY_SOURCE_TARGET:    2,
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED:  1,
+		protocol.SERVER_ENTRY_SOURCE_DISCOVERY: 0,
+		protocol.SERVER_ENTRY_SOURCE_REMOTE:    0,
+		"":                                     0,
+	}
+
+	for source, increment := range expectedIncrements {
+		if stats[source] != initialStats[source]+increment {
+			t.Fatalf("unexpected count for source '%s': %d", source, stats[source])
+		}
+	}
+
+	// The returned map is a copy.
+	stats[protocol.SERVER_ENTRY_SOURCE_TARGET] = 0
+	if GetServerEntrySourceStats()[protocol.SERVER_ENTRY_SOURCE_TARGET] !=
+		initialStats[protocol.SERVER_ENTRY_SOURCE_TARGET]+2 {
+		t.Fatalf("unexpected shared stats map")
+	}
+}
+
+func TestProtocolSelectionConstraintsBuildCapabilities(t *testing.T) {
+
+	if marionette.Enabled() {
+		t.Skip("Marionette is enabled in this build")
+	}
+
+	marionetteServerEntry := &protocol.ServerEntry{
+		Capabilities: []string{
+			protocol.GetCapability(protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH),
+		},
+	}
+
+	osshServerEntry := &protocol.ServerEntry{
+		Capabilities: []string{
+			protocol.GetCapability(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH),
+		},
+	}
+
+	constraints := &protocolSelectionConstraints{
+		limitProtocols: protocol.TunnelProtocols{
+			protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
+			protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		},
+		buildCapabilities: GetBuildCapabilities(),
+	}
+
+	// Test: a server entry supporting only a protocol this build can't dial
+	// isn't a candidate
+
+	if constraints.isCandidate(false, marionetteServerEntry) {
+		t.Fatalf("unexpected candidate")
+	}
+
+	_, ok := constraints.selectProtocol(0, false, marionetteServerEntry)
+	if ok {
+		t.Fatalf("unexpected protocol selection")
+	}
+
+	if !constraints.isCandidate(false, osshServerEntry) {
+		t.Fatalf("expected candidate")
+	}
+
+	selectedProtocol, ok := constraints.selectProtocol(0, false, osshServerEntry)
+	if !ok || selectedProtocol != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+		t.Fatalf("unexpected protocol selection: %s", selectedProtocol)
+	}
+
+	// Test: with no LimitTunnelProtocols, every server entry remains a
+	// candidate
+
+	constraints.limitProtocols = nil
+
+	if !constraints.isCandidate(false, marionetteServerEntry) {
+		t.Fatalf("expected candidate")
+	}
+}
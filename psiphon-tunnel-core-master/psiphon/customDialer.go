@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// CustomDialerFactory creates a Dialer that dials through a custom transport.
+//
+// The factory is called once per dial and is passed the underlying Dialer,
+// which performs the standard TCP dial, including any upstream proxy, device
+// binding, and fragmentation specified in the DialConfig. The returned Dialer
+// is typically a wrapper that calls the underlying Dialer and layers a custom
+// transport, such as an obfuscation layer, on top of the resulting conn.
+// A custom transport may also ignore the underlying Dialer and dial the
+// destination by other means.
+//
+// The returned Dialer is invoked with the dial context, the network, which
+// is always "tcp", and the destination address, "host:port", to which the
+// tunnel protocol expects to connect. The Dialer must honor context
+// cancellation, must return a non-nil conn if and only if the error is nil,
+// and the returned conn must carry the tunnel protocol's bytes unmodified
+// end-to-end, as the tunnel protocol is layered on top of it.
+type CustomDialerFactory func(underlying Dialer) Dialer
+
+var customDialersMutex sync.Mutex
+var customDialers = make(map[string]CustomDialerFactory)
+
+// RegisterCustomDialer registers a named custom dialer. Tunnel dials are
+// directed through a registered custom dialer by setting Config.CustomDialer
+// to its name, and, optionally, Config.CustomDialerTunnelProtocols.
+//
+// Custom dialers must be registered before Config.Commit is called. Names
+// must be unique; registering a name that's already in use fails.
+func RegisterCustomDialer(name string, factory CustomDialerFactory) error {
+
+	if name == "" || factory == nil {
+		return common.ContextError(errors.New("invalid custom dialer"))
+	}
+
+	customDialersMutex.Lock()
+	defer customDialersMutex.Unlock()
+
+	if _, ok := customDialers[name]; ok {
+		return common.ContextError(
+			fmt.Errorf("custom dialer already registered: %s", name))
+	}
+
+	customDialers[name] = factory
+
+	return nil
+}
+
+// UnregisterCustomDialer removes a custom dialer registered with
+// RegisterCustomDialer. Unregistering an unknown name is a no-op.
+func UnregisterCustomDialer(name string) {
+
+	customDialersMutex.Lock()
+	defer customDialersMutex.Unlock()
+
+	delete(customDialers, name)
+}
+
+func getCustomDialer(name string) (CustomDialerFactory, bool) {
+
+	customDialersMutex.Lock()
+	defer customDialersMutex.Unlock()
+
+	factory, ok := customDialers[name]
+	return factory, ok
+}
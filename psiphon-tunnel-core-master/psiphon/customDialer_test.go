@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestCustomDialer(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	// The test server echoes the raw bytes it receives. Through the XOR
+	// custom transport, the client reads back what it wrote.
+
+	receivedBytes := make(chan []byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffer := make([]byte, 5)
+		_, err = io.ReadFull(conn, buffer)
+		if err != nil {
+			return
+		}
+		receivedBytes <- append([]byte(nil), buffer...)
+		conn.Write(buffer)
+	}()
+
+	var underlyingDialCount int32
+
+	err = RegisterCustomDialer(
+		"test-xor",
+		func(underlying Dialer) Dialer {
+			return func(ctx context.Context, network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&underlyingDialCount, 1)
+				conn, err := underlying(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &xorConn{Conn: conn}, nil
+			}
+		})
+	if err != nil {
+		t.Fatalf("RegisterCustomDialer failed: %s", err)
+	}
+	defer UnregisterCustomDialer("test-xor")
+
+	err = RegisterCustomDialer("test-xor", func(underlying Dialer) Dialer { return underlying })
+	if err == nil {
+		t.Fatalf("unexpected duplicate RegisterCustomDialer success")
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	_, err = DialTCP(ctx, listener.Addr().String(), &DialConfig{CustomDialer: "unknown"})
+	if err == nil {
+		t.Fatalf("unexpected unknown custom dialer success")
+	}
+
+	conn, err := DialTCP(ctx, listener.Addr().String(), &DialConfig{CustomDialer: "test-xor"})
+	if err != nil {
+		t.Fatalf("DialTCP failed: %s", err)
+	}
+	defer conn.Close()
+
+	if atomic.LoadInt32(&underlyingDialCount) != 1 {
+		t.Fatalf("unexpected underlying dial count: %d", underlyingDialCount)
+	}
+
+	message := []byte("hello")
+
+	_, err = conn.Write(message)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	if bytes.Equal(<-receivedBytes, message) {
+		t.Fatalf("unexpected untransformed bytes")
+	}
+
+	echo := make([]byte, len(message))
+	_, err = io.ReadFull(conn, echo)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	if !bytes.Equal(echo, message) {
+		t.Fatalf("unexpected echo: %s", echo)
+	}
+}
+
+func TestUseCustomDialer(t *testing.T) {
+
+	config := &Config{}
+
+	if config.UseCustomDialer(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH) {
+		t.Fatalf("unexpected UseCustomDialer with no CustomDialer")
+	}
+
+	config.CustomDialer = "test"
+
+	if !config.UseCustomDialer(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH) {
+		t.Fatalf("unexpected !UseCustomDialer with all protocols")
+	}
+
+	config.CustomDialerTunnelProtocols = []string{protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK}
+
+	if config.UseCustomDialer(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH) {
+		t.Fatalf("unexpected UseCustomDialer with unlisted protocol")
+	}
+
+	if !config.UseCustomDialer(protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK) {
+		t.Fatalf("unexpected !UseCustomDialer with listed protocol")
+	}
+}
+
+type xorConn struct {
+	net.Conn
+}
+
+func (conn *xorConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	for i := 0; i < n; i++ {
+		buffer[i] ^= 0xFF
+	}
+	return n, err
+}
+
+func (conn *xorConn) Write(buffer []byte) (int, error) {
+	transformed := make([]byte, len(buffer))
+	for i, b := range buffer {
+		transformed[i] = b ^ 0xFF
+	}
+	return conn.Conn.Write(transformed)
+}
@@ -21,19 +21,28 @@ package psiphon
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+	"github.com/hashicorp/golang-lru/simplelru"
 )
 
 var (
 	datastoreServerEntriesBucket                = []byte("serverEntries")
+	datastoreServerEntriesStagingBucket         = []byte("serverEntriesStaging")
 	datastoreSplitTunnelRouteETagsBucket        = []byte("splitTunnelRouteETags")
 	datastoreSplitTunnelRouteDataBucket         = []byte("splitTunnelRouteData")
 	datastoreUrlETagsBucket                     = []byte("urlETags")
@@ -51,10 +60,228 @@ var (
 	datastorePersistentStatTypeFailedTunnel     = string(datastoreFailedTunnelStatsBucket)
 	datastoreServerEntryFetchGCThreshold        = 20
 
+	datastoreServerEntryImportCheckpointKeyPrefix = "serverEntryImportCheckpoint:"
+
+	datastoreSchemaVersionKey = []byte("schemaVersion")
+
 	datastoreMutex    sync.RWMutex
 	activeDatastoreDB *datastoreDB
+
+	datastoreMemoryBudget       int64
+	datastorePeakMemoryEstimate int64
+
+	datastoreServerEntryCache serverEntryCache
+
+	datastoreServerEntrySignaturePublicKey atomic.Value
+
+	datastoreMalformedServerEntryIDsMutex sync.Mutex
+	datastoreMalformedServerEntryIDs      map[string]bool
+	datastoreMalformedPersistentStatCount int64
 )
 
+// Estimated in-memory sizes, including decoding overhead, of items processed
+// by datastore operations. These estimates are used to size batches under a
+// memory budget; see datastoreBatchSize.
+const (
+	datastoreEstimatedServerEntrySize    = 4096
+	datastoreEstimatedPersistentStatSize = 512
+)
+
+// datastoreBatchSize returns the number of items, each of the estimated size
+// itemSize, that a datastore operation should process per transaction or
+// between garbage collections. When no memory budget is set, defaultSize is
+// returned and operations retain their default behavior. Under a memory
+// budget, the result is reduced so that a batch fits within the budget, with
+// a minimum of 1.
+func datastoreBatchSize(defaultSize, itemSize int) int {
+	budget := atomic.LoadInt64(&datastoreMemoryBudget)
+	if budget <= 0 {
+		return defaultSize
+	}
+	budgetSize := budget / int64(itemSize)
+	if budgetSize < 1 {
+		return 1
+	}
+	if budgetSize < int64(defaultSize) {
+		return int(budgetSize)
+	}
+	return defaultSize
+}
+
+// recordDatastoreMemoryEstimate records the estimated memory used by a
+// datastore operation, updating the peak estimate. Each new peak is reported
+// in a diagnostic notice.
+func recordDatastoreMemoryEstimate(estimate int64) {
+	for {
+		peak := atomic.LoadInt64(&datastorePeakMemoryEstimate)
+		if estimate <= peak {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&datastorePeakMemoryEstimate, peak, estimate) {
+			NoticeDatastorePeakMemoryEstimate(estimate)
+			return
+		}
+	}
+}
+
+// GetDataStorePeakMemoryEstimate returns the peak estimated memory, in
+// bytes, used by batched datastore operations, including server entry
+// imports, server entry iteration, and the persistent stats reset, since the
+// process started. The estimate counts the items held in memory in a single
+// batch, and excludes fixed overhead. This metric may be used to tune
+// Config.DataStoreMemoryBudgetBytes.
+func GetDataStorePeakMemoryEstimate() int64 {
+	return atomic.LoadInt64(&datastorePeakMemoryEstimate)
+}
+
+// serverEntryCache is an optional, bounded LRU cache of unmarshalled server
+// entries, keyed by server entry ID. The cache is used by
+// ServerEntryIterator.Next to skip a datastore transaction and JSON unmarshal
+// per candidate. The cache size is set by the ServerEntryCacheSize client
+// parameter; when 0, the cache is disabled.
+//
+// Cached server entries are invalidated after any server entry update is
+// committed. To avoid caching a stale entry read concurrently with an update,
+// each invalidation increments generation, and entries are added only when
+// the generation is unchanged since before the datastore read.
+type serverEntryCache struct {
+	mutex      sync.Mutex
+	cache      *simplelru.LRU
+	size       int
+	generation int64
+}
+
+// configure sets the maximum number of cached server entries. A change of
+// size discards all cached entries.
+func (c *serverEntryCache) configure(size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if size == c.size {
+		return
+	}
+
+	c.size = size
+	c.cache = nil
+	c.generation += 1
+
+	if size <= 0 {
+		return
+	}
+
+	cache, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		NoticeAlert("serverEntryCache.configure: %s", common.ContextError(err))
+		return
+	}
+	c.cache = cache
+}
+
+// get returns a copy of the cached server entry for serverEntryID, or nil
+// when not cached, along with the current generation to pass to add.
+func (c *serverEntryCache) get(serverEntryID []byte) (*protocol.ServerEntry, int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cache == nil {
+		return nil, c.generation
+	}
+
+	value, ok := c.cache.Get(string(serverEntryID))
+	if !ok {
+		return nil, c.generation
+	}
+
+	// Return a copy, as the caller may modify the server entry; for example,
+	// in MakeCompatibleServerEntry.
+	serverEntry := *value.(*protocol.ServerEntry)
+	return &serverEntry, c.generation
+}
+
+// add caches a copy of serverEntry, unless the cache was invalidated since
+// generation was obtained from get.
+func (c *serverEntryCache) add(
+	serverEntryID []byte, serverEntry *protocol.ServerEntry, generation int64) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cache == nil || generation != c.generation {
+		return
+	}
+
+	cachedServerEntry := *serverEntry
+	c.cache.Add(string(serverEntryID), &cachedServerEntry)
+}
+
+// invalidate removes the specified server entries from the cache.
+func (c *serverEntryCache) invalidate(serverEntryIDs []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation += 1
+
+	if c.cache == nil {
+		return
+	}
+
+	for _, serverEntryID := range serverEntryIDs {
+		c.cache.Remove(serverEntryID)
+	}
+}
+
+// purge removes all server entries from the cache.
+func (c *serverEntryCache) purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation += 1
+
+	if c.cache != nil {
+		c.cache.Purge()
+	}
+}
+
+// DatastoreCorruptionStats are counts of distinct malformed datastore
+// records, which are skipped or deleted, encountered since the datastore was
+// opened.
+type DatastoreCorruptionStats struct {
+	MalformedServerEntries   int64
+	MalformedPersistentStats int64
+}
+
+// GetDatastoreCorruptionStats returns the counts of malformed server entry
+// and persistent stat records encountered since the datastore was opened.
+// Non-zero counts indicate datastore corruption, which is otherwise only
+// reported in alert notices.
+//
+// Malformed server entries are skipped, not deleted, and may be encountered
+// again in each iteration round and scan; each is counted once. Malformed
+// persistent stat records are deleted when encountered.
+func GetDatastoreCorruptionStats() DatastoreCorruptionStats {
+
+	datastoreMalformedServerEntryIDsMutex.Lock()
+	malformedServerEntryCount := len(datastoreMalformedServerEntryIDs)
+	datastoreMalformedServerEntryIDsMutex.Unlock()
+
+	return DatastoreCorruptionStats{
+		MalformedServerEntries:   int64(malformedServerEntryCount),
+		MalformedPersistentStats: atomic.LoadInt64(&datastoreMalformedPersistentStatCount),
+	}
+}
+
+// recordMalformedServerEntry records that the server entry record with the
+// specified ID is malformed.
+func recordMalformedServerEntry(serverEntryID []byte) {
+	datastoreMalformedServerEntryIDsMutex.Lock()
+	defer datastoreMalformedServerEntryIDsMutex.Unlock()
+
+	if datastoreMalformedServerEntryIDs == nil {
+		datastoreMalformedServerEntryIDs = make(map[string]bool)
+	}
+	datastoreMalformedServerEntryIDs[string(serverEntryID)] = true
+}
+
 // OpenDataStore opens and initializes the singleton data store instance.
 func OpenDataStore(config *Config) error {
 
@@ -77,11 +304,103 @@ func OpenDataStore(config *Config) error {
 
 	datastoreMutex.Unlock()
 
+	datastoreServerEntryCache.purge()
+
+	err = migrateDatastore()
+	if err != nil {
+		CloseDataStore()
+		return common.ContextError(err)
+	}
+
+	atomic.StoreInt64(&datastoreMemoryBudget, int64(config.DataStoreMemoryBudgetBytes))
+
+	datastoreServerEntrySignaturePublicKey.Store(config.ServerEntrySignaturePublicKey)
+
+	datastoreMalformedServerEntryIDsMutex.Lock()
+	datastoreMalformedServerEntryIDs = nil
+	datastoreMalformedServerEntryIDsMutex.Unlock()
+	atomic.StoreInt64(&datastoreMalformedPersistentStatCount, 0)
+
 	_ = resetAllPersistentStatsToUnreported()
 
 	return nil
 }
 
+// datastoreSchemaVersion is the current datastore schema version. When a
+// change to the datastore layout, such as a new key format, requires existing
+// records to be converted, increment datastoreSchemaVersion and add a
+// migration for the new version to datastoreMigrations.
+var datastoreSchemaVersion = 2
+
+// datastoreMigrations maps each schema version to the migration which
+// upgrades a datastore from the previous version. Version 1 is the baseline
+// schema, in place before versioning was introduced, and its migration is
+// a no-op. Version 2 introduces structured dial parameters keys.
+var datastoreMigrations = map[int]func(tx *datastoreTx) error{
+	1: func(_ *datastoreTx) error { return nil },
+	2: migrateDialParametersKeys,
+}
+
+// migrateDatastore runs, in order, the migrations for all schema versions
+// after the version recorded in the datastore, up to datastoreSchemaVersion.
+// A datastore with no recorded version, either new or created before
+// versioning, is at version 0.
+//
+// Each migration runs in its own transaction along with the update to the
+// recorded version, so each migration is applied exactly once, even if
+// interrupted.
+func migrateDatastore() error {
+
+	var version int
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		value := tx.bucket(datastoreKeyValueBucket).get(datastoreSchemaVersionKey)
+		if value == nil {
+			return nil
+		}
+		var err error
+		version, err = strconv.Atoi(string(value))
+		return err
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if version > datastoreSchemaVersion {
+		// The datastore was written by a newer client. Proceed, as records
+		// are expected to remain readable, but don't record the older version.
+		NoticeAlert("unexpected datastore schema version: %d", version)
+		return nil
+	}
+
+	for version < datastoreSchemaVersion {
+
+		nextVersion := version + 1
+
+		migration, ok := datastoreMigrations[nextVersion]
+		if !ok {
+			return common.ContextError(
+				fmt.Errorf("missing datastore migration: %d", nextVersion))
+		}
+
+		err := datastoreUpdate(func(tx *datastoreTx) error {
+			err := migration(tx)
+			if err != nil {
+				return err
+			}
+			return tx.bucket(datastoreKeyValueBucket).put(
+				datastoreSchemaVersionKey, []byte(strconv.Itoa(nextVersion)))
+		})
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		version = nextVersion
+	}
+
+	return nil
+}
+
 // CloseDataStore closes the singleton data store instance, if open.
 func CloseDataStore() {
 
@@ -98,6 +417,8 @@ func CloseDataStore() {
 	}
 
 	activeDatastoreDB = nil
+
+	datastoreServerEntryCache.purge()
 }
 
 func datastoreView(fn func(tx *datastoreTx) error) error {
@@ -142,12 +463,38 @@ func datastoreUpdate(fn func(tx *datastoreTx) error) error {
 // the entry is skipped; no error is returned.
 func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExists bool) error {
 
+	_, err := storeServerEntryBatch(
+		[]protocol.ServerEntryFields{serverEntryFields}, replaceIfExists, nil, nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// storeServerEntryBatch stores a batch of server entries in a single
+// datastore transaction. Each server entry is stored following the
+// StoreServerEntry replace and version semantics, in order; so, when the
+// batch contains multiple entries for the same server, later entries are
+// checked against earlier entries in the same batch.
+//
+// When checkpoint is not nil, it's stored, under checkpointKey, in the same
+// transaction. The return value is the number of server entries inserted or
+// updated.
+func storeServerEntryBatch(
+	serverEntryBatch []protocol.ServerEntryFields,
+	replaceIfExists bool,
+	checkpointKey []byte,
+	checkpoint *serverEntryImportCheckpoint) (int, error) {
+
 	// Server entries should already be validated before this point,
 	// so instead of skipping we fail with an error.
-	err := protocol.ValidateServerEntryFields(serverEntryFields)
-	if err != nil {
-		return common.ContextError(
-			fmt.Errorf("invalid server entry: %s", err))
+	for _, serverEntryFields := range serverEntryBatch {
+		err := protocol.ValidateServerEntryFields(serverEntryFields)
+		if err != nil {
+			return 0, common.ContextError(
+				fmt.Errorf("invalid server entry: %s", err))
+		}
 	}
 
 	// BoltDB implementation note:
@@ -158,49 +505,118 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 	// values (e.g., many servers support all protocols), performance
 	// is expected to be acceptable.
 
-	err = datastoreUpdate(func(tx *datastoreTx) error {
+	var storedServerEntryIDs []string
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		storedServerEntryIDs = nil
 
 		serverEntries := tx.bucket(datastoreServerEntriesBucket)
 
-		ipAddress := serverEntryFields.GetIPAddress()
-
-		// Check not only that the entry exists, but is valid. This
-		// will replace in the rare case where the data is corrupt.
-		existingConfigurationVersion := -1
-		existingData := serverEntries.get([]byte(ipAddress))
-		if existingData != nil {
-			var existingServerEntry *protocol.ServerEntry
-			err := json.Unmarshal(existingData, &existingServerEntry)
-			if err == nil {
-				existingConfigurationVersion = existingServerEntry.ConfigurationVersion
+		for _, serverEntryFields := range serverEntryBatch {
+			stored, err := storeServerEntry(serverEntries, serverEntryFields, replaceIfExists)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if stored {
+				storedServerEntryIDs = append(
+					storedServerEntryIDs, serverEntryFields.GetIPAddress())
 			}
 		}
 
-		exists := existingConfigurationVersion > -1
-		newer := exists && existingConfigurationVersion < serverEntryFields.GetConfigurationVersion()
-		update := !exists || replaceIfExists || newer
-
-		if !update {
-			// Disabling this notice, for now, as it generates too much noise
-			// in diagnostics with clients that always submit embedded servers
-			// to the core on each run.
-			// NoticeInfo("ignored update for server %s", serverEntry.IpAddress)
-			return nil
+		if checkpoint != nil {
+			data, err := json.Marshal(checkpoint)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			err = tx.bucket(datastoreKeyValueBucket).put(checkpointKey, data)
+			if err != nil {
+				return common.ContextError(err)
+			}
 		}
 
-		data, err := json.Marshal(serverEntryFields)
-		if err != nil {
-			return common.ContextError(err)
-		}
-		err = serverEntries.put([]byte(ipAddress), data)
-		if err != nil {
-			return common.ContextError(err)
+		return nil
+	})
+
+	// Invalidate after the transaction completes, so that a concurrent
+	// ServerEntryIterator.Next cannot re-cache the previous version of an
+	// updated server entry.
+	datastoreServerEntryCache.invalidate(storedServerEntryIDs)
+
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return len(storedServerEntryIDs), nil
+}
+
+func storeServerEntry(
+	serverEntries *datastoreBucket,
+	serverEntryFields protocol.ServerEntryFields,
+	replaceIfExists bool) (bool, error) {
+
+	ipAddress := serverEntryFields.GetIPAddress()
+
+	err := verifyServerEntrySignature(serverEntryFields)
+	if err != nil {
+		NoticeAlert("rejected server %s: %s", ipAddress, common.ContextError(err))
+		return false, nil
+	}
+
+	// Check not only that the entry exists, but is valid. This
+	// will replace in the rare case where the data is corrupt.
+	existingConfigurationVersion := -1
+	existingData := serverEntries.get([]byte(ipAddress))
+	if existingData != nil {
+		var existingServerEntry *protocol.ServerEntry
+		err := json.Unmarshal(existingData, &existingServerEntry)
+		if err == nil {
+			existingConfigurationVersion = existingServerEntry.ConfigurationVersion
 		}
+	}
 
-		NoticeInfo("updated server %s", ipAddress)
+	exists := existingConfigurationVersion > -1
+	newer := exists && existingConfigurationVersion < serverEntryFields.GetConfigurationVersion()
+	update := !exists || replaceIfExists || newer
 
+	if !update {
+		// Disabling this notice, for now, as it generates too much noise
+		// in diagnostics with clients that always submit embedded servers
+		// to the core on each run.
+		// NoticeInfo("ignored update for server %s", serverEntry.IpAddress)
+		return false, nil
+	}
+
+	data, err := json.Marshal(serverEntryFields)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	err = serverEntries.put([]byte(ipAddress), data)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	NoticeInfo("updated server %s", ipAddress)
+
+	return true, nil
+}
+
+// verifyServerEntrySignature checks the server entry signature when a
+// ServerEntrySignaturePublicKey is configured. Server entries from embedded
+// server lists and TargetServerEntry are trusted and not checked.
+func verifyServerEntrySignature(serverEntryFields protocol.ServerEntryFields) error {
+
+	publicKey, _ := datastoreServerEntrySignaturePublicKey.Load().(string)
+	if publicKey == "" {
 		return nil
-	})
+	}
+
+	switch serverEntryFields.GetLocalSource() {
+	case protocol.SERVER_ENTRY_SOURCE_EMBEDDED, protocol.SERVER_ENTRY_SOURCE_TARGET:
+		return nil
+	}
+
+	err := serverEntryFields.VerifySignature(publicKey)
 	if err != nil {
 		return common.ContextError(err)
 	}
@@ -225,19 +641,133 @@ func StoreServerEntries(
 	return nil
 }
 
-// StreamingStoreServerEntries stores a list of server entries.
-// There is an independent transaction for each entry insert/update.
+// StreamingStoreServerEntries stores a list of server entries. Server
+// entries are stored in batches, with one transaction for each batch of up
+// to ServerEntryImportBatchSize entries, and garbage collection is
+// triggered after storing each ServerEntryImportGCThreshold entries.
 func StreamingStoreServerEntries(
 	config *Config,
 	serverEntries *protocol.StreamingServerEntryDecoder,
 	replaceIfExists bool) error {
 
+	err := StreamingStoreServerEntriesWithProgress(
+		config, serverEntries, replaceIfExists, "", nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// ServerEntryImportProgress reports the progress of a server entry import.
+// Processed is the number of server entries read from the input, Stored is
+// the number of server entries inserted or updated, Skipped is the number
+// of server entries not stored because the existing server entry is the
+// same or a newer version, and Resumed is the number of server entries not
+// stored because they were imported in a previous, interrupted run.
+type ServerEntryImportProgress struct {
+	Processed int
+	Stored    int
+	Skipped   int
+	Resumed   int
+}
+
+// serverEntryImportCheckpoint records the progress of a resumable server
+// entry import: the number of server entries processed and the IP address
+// of the last processed server entry, which identifies the resume point.
+type serverEntryImportCheckpoint struct {
+	Processed int    `json:"processed"`
+	IPAddress string `json:"ip_address"`
+}
+
+// StreamingStoreServerEntriesWithProgress is StreamingStoreServerEntries
+// with optional progress reporting and resumption.
+//
+// When progressCallback is not nil, it's invoked with the cumulative
+// progress after each batch is stored.
+//
+// When resumeID is not "", the import is resumable: a checkpoint, keyed by
+// resumeID, is recorded in the datastore along with each stored batch, and
+// a subsequent call with the same resumeID and the same input skips the
+// server entries processed before the interruption. When the input no longer
+// matches the checkpoint, the checkpoint is discarded and an error is
+// returned; as storing server entries is idempotent, the caller may simply
+// retry, which will import all server entries. The checkpoint is deleted
+// when the import completes.
+func StreamingStoreServerEntriesWithProgress(
+	config *Config,
+	serverEntries *protocol.StreamingServerEntryDecoder,
+	replaceIfExists bool,
+	resumeID string,
+	progressCallback func(ServerEntryImportProgress)) error {
+
 	// Note: both StreamingServerEntryDecoder.Next and StoreServerEntry
 	// allocate temporary memory buffers for hex/JSON decoding/encoding,
 	// so this isn't true constant-memory streaming (it depends on garbage
-	// collection).
+	// collection). Larger batches retain more decoded server entries in
+	// memory, and hold the datastore transaction for longer, in exchange
+	// for fewer transaction commits.
+
+	clientParameters := config.GetClientParameters()
+	gcThreshold := datastoreBatchSize(
+		clientParameters.Int(parameters.ServerEntryImportGCThreshold),
+		datastoreEstimatedServerEntrySize)
+	batchSize := datastoreBatchSize(
+		clientParameters.Int(parameters.ServerEntryImportBatchSize),
+		datastoreEstimatedServerEntrySize)
+
+	recordDatastoreMemoryEstimate(
+		int64(batchSize) * datastoreEstimatedServerEntrySize)
+
+	var checkpointKey []byte
+	var resumeCheckpoint *serverEntryImportCheckpoint
+	if resumeID != "" {
+		checkpointKey = []byte(datastoreServerEntryImportCheckpointKeyPrefix + resumeID)
+		var err error
+		resumeCheckpoint, err = getServerEntryImportCheckpoint(checkpointKey)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	var progress ServerEntryImportProgress
 
 	n := 0
+
+	batchWriter := newServerEntryBatchWriter(
+		batchSize,
+		func(serverEntryBatch []protocol.ServerEntryFields) error {
+
+			var checkpoint *serverEntryImportCheckpoint
+			if checkpointKey != nil {
+				checkpoint = &serverEntryImportCheckpoint{
+					Processed: progress.Processed,
+					IPAddress: serverEntryBatch[len(serverEntryBatch)-1].GetIPAddress(),
+				}
+			}
+
+			stored, err := storeServerEntryBatch(
+				serverEntryBatch, replaceIfExists, checkpointKey, checkpoint)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			progress.Stored += stored
+			progress.Skipped += len(serverEntryBatch) - stored
+
+			if progressCallback != nil {
+				progressCallback(progress)
+			}
+
+			n += len(serverEntryBatch)
+			if n >= gcThreshold {
+				DoGarbageCollection()
+				n = 0
+			}
+
+			return nil
+		})
+
 	for {
 		serverEntry, err := serverEntries.Next()
 		if err != nil {
@@ -249,16 +779,288 @@ func StreamingStoreServerEntries(
 			break
 		}
 
-		err = StoreServerEntry(serverEntry, replaceIfExists)
+		progress.Processed += 1
+
+		if resumeCheckpoint != nil && progress.Processed <= resumeCheckpoint.Processed {
+
+			// Skip server entries up to the checkpoint. When the server
+			// entry at the checkpoint doesn't match, the input has
+			// changed and the skipped server entries may not have been
+			// stored. As the input can't be rewound, discard the
+			// checkpoint and fail, so that a retry imports all entries.
+
+			if progress.Processed < resumeCheckpoint.Processed {
+				progress.Resumed += 1
+				continue
+			}
+
+			if serverEntry.GetIPAddress() != resumeCheckpoint.IPAddress {
+				err = deleteServerEntryImportCheckpoint(checkpointKey)
+				if err != nil {
+					return common.ContextError(err)
+				}
+				return common.ContextError(
+					errors.New("server entry import checkpoint mismatch"))
+			}
+
+			progress.Resumed += 1
+			resumeCheckpoint = nil
+			continue
+		}
+
+		err = batchWriter.add(serverEntry)
 		if err != nil {
 			return common.ContextError(err)
 		}
+	}
 
-		n += 1
-		if n == datastoreServerEntryFetchGCThreshold {
-			DoGarbageCollection()
-			n = 0
+	err := batchWriter.flush()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if checkpointKey != nil {
+		err := deleteServerEntryImportCheckpoint(checkpointKey)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	return nil
+}
+
+// serverEntryBatchWriter accumulates server entries into batches of up to
+// batchSize entries. Each full batch, and the final partial batch written by
+// flush, is passed to writeBatch, after which references to the batch
+// entries are cleared to allow written entries to be garbage collected.
+type serverEntryBatchWriter struct {
+	batchSize  int
+	batch      []protocol.ServerEntryFields
+	writeBatch func([]protocol.ServerEntryFields) error
+}
+
+func newServerEntryBatchWriter(
+	batchSize int,
+	writeBatch func([]protocol.ServerEntryFields) error) *serverEntryBatchWriter {
+
+	return &serverEntryBatchWriter{
+		batchSize:  batchSize,
+		batch:      make([]protocol.ServerEntryFields, 0, batchSize),
+		writeBatch: writeBatch,
+	}
+}
+
+// add appends serverEntry to the current batch, writing the batch when it's
+// full.
+func (writer *serverEntryBatchWriter) add(serverEntry protocol.ServerEntryFields) error {
+
+	writer.batch = append(writer.batch, serverEntry)
+	if len(writer.batch) < writer.batchSize {
+		return nil
+	}
+
+	return writer.flush()
+}
+
+// flush writes any partial batch.
+func (writer *serverEntryBatchWriter) flush() error {
+
+	if len(writer.batch) == 0 {
+		return nil
+	}
+
+	err := writer.writeBatch(writer.batch)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	for i := range writer.batch {
+		writer.batch[i] = nil
+	}
+	writer.batch = writer.batch[:0]
+
+	return nil
+}
+
+// ReplaceAllServerEntries replaces the entire set of stored server entries
+// with the server entries read from serverEntries. Stored server entries not
+// in the new set are deleted, along with their dial parameters records and
+// any server affinity. Dial parameters and server affinity for server entries
+// in the new set are retained.
+//
+// The new set is first written, in batches, to a staging bucket; then, in a
+// single transaction, stale server entries are deleted and the staged server
+// entries are moved into place. An interruption before the final transaction
+// leaves the stored server entries unchanged, and any partially staged
+// server entries are discarded by the next ReplaceAllServerEntries.
+func ReplaceAllServerEntries(
+	config *Config,
+	serverEntries *protocol.StreamingServerEntryDecoder) error {
+
+	clientParameters := config.GetClientParameters()
+	batchSize := datastoreBatchSize(
+		clientParameters.Int(parameters.ServerEntryImportBatchSize),
+		datastoreEstimatedServerEntrySize)
+
+	recordDatastoreMemoryEstimate(
+		int64(batchSize) * datastoreEstimatedServerEntrySize)
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		return tx.clearBucket(datastoreServerEntriesStagingBucket)
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	batchWriter := newServerEntryBatchWriter(
+		batchSize,
+		func(serverEntryBatch []protocol.ServerEntryFields) error {
+
+			// Within the new set, the StoreServerEntry version semantics
+			// apply to duplicate server entries.
+			return datastoreUpdate(func(tx *datastoreTx) error {
+				staging := tx.bucket(datastoreServerEntriesStagingBucket)
+				for _, serverEntryFields := range serverEntryBatch {
+					_, err := storeServerEntry(staging, serverEntryFields, false)
+					if err != nil {
+						return common.ContextError(err)
+					}
+				}
+				return nil
+			})
+		})
+
+	for {
+		serverEntry, err := serverEntries.Next()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		if serverEntry == nil {
+			break
+		}
+
+		err = protocol.ValidateServerEntryFields(serverEntry)
+		if err != nil {
+			return common.ContextError(
+				fmt.Errorf("invalid server entry: %s", err))
 		}
+
+		err = batchWriter.add(serverEntry)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	err = batchWriter.flush()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+
+		serverEntriesBucket := tx.bucket(datastoreServerEntriesBucket)
+		stagingBucket := tx.bucket(datastoreServerEntriesStagingBucket)
+		dialParamsBucket := tx.bucket(datastoreDialParametersBucket)
+		keyValueBucket := tx.bucket(datastoreKeyValueBucket)
+
+		staleServerEntryIDs := make(map[string]bool)
+		cursor := serverEntriesBucket.cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			if stagingBucket.get(key) == nil {
+				staleServerEntryIDs[string(key)] = true
+			}
+		}
+		cursor.close()
+
+		for serverEntryID := range staleServerEntryIDs {
+			err := serverEntriesBucket.delete([]byte(serverEntryID))
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		var staleDialParamsKeys [][]byte
+		cursor = dialParamsBucket.cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			serverEntryID, _, ok := parseDialParametersKey(key)
+			if ok && staleServerEntryIDs[string(serverEntryID)] {
+				staleDialParamsKeys = append(staleDialParamsKeys, append([]byte(nil), key...))
+			}
+		}
+		cursor.close()
+
+		for _, key := range staleDialParamsKeys {
+			err := dialParamsBucket.delete(key)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		affinityServerEntryID := keyValueBucket.get(datastoreAffinityServerEntryIDKey)
+		if affinityServerEntryID != nil && staleServerEntryIDs[string(affinityServerEntryID)] {
+			err := keyValueBucket.delete(datastoreAffinityServerEntryIDKey)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		// Copy, as the staged data is deleted, below, in the same transaction.
+		cursor = stagingBucket.cursor()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			err := serverEntriesBucket.put(
+				append([]byte(nil), key...), append([]byte(nil), value...))
+			if err != nil {
+				cursor.close()
+				return common.ContextError(err)
+			}
+		}
+		cursor.close()
+
+		return tx.clearBucket(datastoreServerEntriesStagingBucket)
+	})
+
+	// The whole set may have changed, so discard all cached server entries.
+	datastoreServerEntryCache.purge()
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+func getServerEntryImportCheckpoint(
+	checkpointKey []byte) (*serverEntryImportCheckpoint, error) {
+
+	var checkpoint *serverEntryImportCheckpoint
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		data := tx.bucket(datastoreKeyValueBucket).get(checkpointKey)
+		if data == nil {
+			return nil
+		}
+		err := json.Unmarshal(data, &checkpoint)
+		if err != nil {
+			// A corrupt checkpoint is ignored and the import restarts.
+			checkpoint = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return checkpoint, nil
+}
+
+func deleteServerEntryImportCheckpoint(checkpointKey []byte) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		return tx.bucket(datastoreKeyValueBucket).delete(checkpointKey)
+	})
+	if err != nil {
+		return common.ContextError(err)
 	}
 
 	return nil
@@ -307,6 +1109,48 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 	return nil
 }
 
+// GetAffinityServerEntry returns the current server affinity server entry,
+// as set by PromoteServerEntry. nil is returned, with no error, when no
+// server affinity is set or when the affinity server entry is no longer in
+// the datastore.
+func GetAffinityServerEntry() (*protocol.ServerEntry, error) {
+
+	var data []byte
+
+	err := datastoreView(func(tx *datastoreTx) error {
+
+		bucket := tx.bucket(datastoreKeyValueBucket)
+		serverEntryID := bucket.get(datastoreAffinityServerEntryIDKey)
+		if serverEntryID == nil {
+			return nil
+		}
+
+		bucket = tx.bucket(datastoreServerEntriesBucket)
+		value := bucket.get(serverEntryID)
+		if value != nil {
+			// Must make a copy as slice is only valid within transaction.
+			data = make([]byte, len(value))
+			copy(data, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var serverEntry *protocol.ServerEntry
+	err = json.Unmarshal(data, &serverEntry)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return MakeCompatibleServerEntry(serverEntry), nil
+}
+
 func makeServerEntryFilterValue(config *Config) ([]byte, error) {
 
 	// Currently, only a change of EgressRegion will "break" server affinity.
@@ -324,23 +1168,38 @@ func hasServerEntryFilterChanged(config *Config) (bool, error) {
 	}
 
 	changed := false
+	var previousFilter []byte
 	err = datastoreView(func(tx *datastoreTx) error {
 
 		bucket := tx.bucket(datastoreKeyValueBucket)
-		previousFilter := bucket.get(datastoreLastServerEntryFilterKey)
+		value := bucket.get(datastoreLastServerEntryFilterKey)
 
-		// When not found, previousFilter will be nil; ensure this
+		// When not found, value will be nil; ensure this
 		// results in "changed", even if currentFilter is len(0).
-		if previousFilter == nil ||
-			bytes.Compare(previousFilter, currentFilter) != 0 {
+		if value == nil ||
+			bytes.Compare(value, currentFilter) != 0 {
 			changed = true
 		}
+
+		// Values returned by bucket.get are only valid for the
+		// lifetime of the transaction, so make a copy.
+		if value != nil {
+			previousFilter = make([]byte, len(value))
+			copy(previousFilter, value)
+		}
 		return nil
 	})
 	if err != nil {
 		return false, common.ContextError(err)
 	}
 
+	// Only report a reset when there was a previous filter; on a first run
+	// there is no affinity server to lose. The notice is emitted outside of
+	// the datastore transaction.
+	if changed && previousFilter != nil {
+		NoticeServerAffinityReset(string(previousFilter), string(currentFilter))
+	}
+
 	return changed, nil
 }
 
@@ -355,6 +1214,7 @@ type ServerEntryIterator struct {
 	isTargetServerEntryIterator  bool
 	hasNextTargetServerEntry     bool
 	targetServerEntry            *protocol.ServerEntry
+	gcThreshold                  int
 }
 
 // NewServerEntryIterator creates a new ServerEntryIterator.
@@ -368,7 +1228,6 @@ type ServerEntryIterator struct {
 // NewServerEntryIterator and any returned ServerEntryIterator are not
 // designed for concurrent use as not all related datastore operations are
 // performed in a single transaction.
-//
 func NewServerEntryIterator(config *Config) (bool, *ServerEntryIterator, error) {
 
 	// When configured, this target server entry is the only candidate
@@ -442,8 +1301,8 @@ func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *Server
 		if len(limitTunnelProtocols) > 0 {
 			// At the ServerEntryIterator level, only limitTunnelProtocols is applied;
 			// excludeIntensive is handled higher up.
-			if len(serverEntry.GetSupportedProtocols(
-				config.UseUpstreamProxy(), limitTunnelProtocols, false)) == 0 {
+			if len(serverEntry.GetUsableProtocols(
+				config.UseUpstreamProxy(), limitTunnelProtocols, false, GetBuildCapabilities())) == 0 {
 				return false, nil, common.ContextError(errors.New("TargetServerEntry does not support LimitTunnelProtocols"))
 			}
 		}
@@ -461,6 +1320,26 @@ func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *Server
 	return false, iterator, nil
 }
 
+// serverEntryIDsByTimestamp sorts server entry IDs by their corresponding
+// LocalTimestamp, with the most recently stored server entries first.
+type serverEntryIDsByTimestamp struct {
+	serverEntryIDs [][]byte
+	timestamps     []time.Time
+}
+
+func (s *serverEntryIDsByTimestamp) Len() int {
+	return len(s.serverEntryIDs)
+}
+
+func (s *serverEntryIDsByTimestamp) Less(i, j int) bool {
+	return s.timestamps[i].After(s.timestamps[j])
+}
+
+func (s *serverEntryIDsByTimestamp) Swap(i, j int) {
+	s.serverEntryIDs[i], s.serverEntryIDs[j] = s.serverEntryIDs[j], s.serverEntryIDs[i]
+	s.timestamps[i], s.timestamps[j] = s.timestamps[j], s.timestamps[i]
+}
+
 // Reset a NewServerEntryIterator to the start of its cycle. The next
 // call to Next will return the first server entry.
 func (iterator *ServerEntryIterator) Reset() error {
@@ -475,6 +1354,16 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 		return nil
 	}
 
+	iterator.gcThreshold = datastoreBatchSize(
+		datastoreServerEntryFetchGCThreshold,
+		datastoreEstimatedServerEntrySize)
+
+	datastoreServerEntryCache.configure(
+		iterator.config.GetClientParameters().Int(parameters.ServerEntryCacheSize))
+
+	recordDatastoreMemoryEstimate(
+		int64(iterator.gcThreshold) * datastoreEstimatedServerEntrySize)
+
 	// BoltDB implementation note:
 	// We don't keep a transaction open for the duration of the iterator
 	// because this would expose the following semantics to consumer code:
@@ -513,20 +1402,58 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 			}
 		}
 
+		// When ServerEntryShuffleTopPercent is set, the most recently
+		// stored server entries, by LocalTimestamp, are kept at the front of
+		// the list, in that order, and only the remainder is shuffled. This
+		// biases iteration towards fresh server entries, which are more
+		// likely to be reachable. Reading the LocalTimestamp requires
+		// unmarshaling each server entry, so this is skipped by default.
+
+		shuffleTopPercent := iterator.config.GetClientParameters().Int(
+			parameters.ServerEntryShuffleTopPercent)
+		if shuffleTopPercent > 100 {
+			shuffleTopPercent = 100
+		}
+
+		var timestamps []time.Time
+
 		bucket = tx.bucket(datastoreServerEntriesBucket)
 		cursor := bucket.cursor()
-		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
 			if affinityServerEntryID != nil {
 				if bytes.Equal(affinityServerEntryID, key) {
 					continue
 				}
 			}
 			serverEntryIDs = append(serverEntryIDs, append([]byte(nil), key...))
+
+			if shuffleTopPercent > 0 {
+				var serverEntry struct {
+					LocalTimestamp string `json:"localTimestamp"`
+				}
+				// A malformed server entry is sorted last and is skipped
+				// and recorded by Next.
+				_ = json.Unmarshal(value, &serverEntry)
+				timestamps = append(
+					timestamps,
+					protocol.ParseServerEntryTimestamp(serverEntry.LocalTimestamp))
+			}
 		}
 		cursor.close()
 
+		if shuffleTopPercent > 0 {
+
+			sort.Stable(&serverEntryIDsByTimestamp{
+				serverEntryIDs: serverEntryIDs[shuffleHead:],
+				timestamps:     timestamps,
+			})
+
+			shuffleHead += (len(serverEntryIDs) - shuffleHead) * shuffleTopPercent / 100
+		}
+
 		// Randomly shuffle the entire list of server IDs, excluding the
-		// server affinity candidate.
+		// server affinity candidate and any kept ServerEntryShuffleTopPercent
+		// server entries.
 
 		for i := len(serverEntryIDs) - 1; i > shuffleHead-1; i-- {
 			j := prng.Intn(i+1-shuffleHead) + shuffleHead
@@ -541,36 +1468,38 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 		// front. Whether the dial parameter remains valid for replay -- TTL,
 		// tactics/config unchanged, etc. --- is checked later.
 		//
-		// TODO: move only up to parameters.ReplayCandidateCount to front?
+		// At most ReplayCandidateCount candidates are moved to the front, as
+		// replay is skipped after that many candidates; any remaining
+		// servers with dial parameter records are left in shuffled order.
 
-		if isInitialRound &&
-			iterator.config.GetClientParameters().Int(parameters.ReplayCandidateCount) > 0 {
+		replayCandidateCount := iterator.config.GetClientParameters().Int(
+			parameters.ReplayCandidateCount)
+
+		if isInitialRound && replayCandidateCount > 0 {
 
 			networkID := []byte(iterator.config.GetNetworkID())
 
 			dialParamsBucket := tx.bucket(datastoreDialParametersBucket)
-			i := shuffleHead
+			hasDialParams := func(serverEntryID []byte) bool {
+				key := makeDialParametersKey(serverEntryID, networkID)
+				return dialParamsBucket.get(key) != nil
+			}
+
+			frontCount := 0
 			j := len(serverEntryIDs) - 1
-			for {
-				for ; i < j; i++ {
-					key := makeDialParametersKey(serverEntryIDs[i], networkID)
-					if dialParamsBucket.get(key) == nil {
-						break
-					}
+			for i := shuffleHead; i <= j && frontCount < replayCandidateCount; i++ {
+				if hasDialParams(serverEntryIDs[i]) {
+					frontCount++
+					continue
 				}
-				for ; i < j; j-- {
-					key := makeDialParametersKey(serverEntryIDs[j], networkID)
-					if dialParamsBucket.get(key) != nil {
-						break
-					}
+				for ; j > i && !hasDialParams(serverEntryIDs[j]); j-- {
 				}
-				if i < j {
-					serverEntryIDs[i], serverEntryIDs[j] = serverEntryIDs[j], serverEntryIDs[i]
-					i++
-					j--
-				} else {
+				if j <= i {
 					break
 				}
+				serverEntryIDs[i], serverEntryIDs[j] = serverEntryIDs[j], serverEntryIDs[i]
+				j--
+				frontCount++
 			}
 		}
 
@@ -625,39 +1554,54 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		serverEntryID := iterator.serverEntryIDs[iterator.serverEntryIndex]
 		iterator.serverEntryIndex += 1
 
-		var data []byte
+		// The server entry ID is the server IP address, so excluded server
+		// entries are skipped without being read from the datastore.
+		if iterator.config.IsExcludedServerIP(string(serverEntryID)) {
+			continue
+		}
+
+		var cacheGeneration int64
+		serverEntry, cacheGeneration = datastoreServerEntryCache.get(serverEntryID)
 
-		err = datastoreView(func(tx *datastoreTx) error {
-			bucket := tx.bucket(datastoreServerEntriesBucket)
-			value := bucket.get(serverEntryID)
-			if value != nil {
-				// Must make a copy as slice is only valid within transaction.
-				data = make([]byte, len(value))
-				copy(data, value)
+		if serverEntry == nil {
+
+			var data []byte
+
+			err = datastoreView(func(tx *datastoreTx) error {
+				bucket := tx.bucket(datastoreServerEntriesBucket)
+				value := bucket.get(serverEntryID)
+				if value != nil {
+					// Must make a copy as slice is only valid within transaction.
+					data = make([]byte, len(value))
+					copy(data, value)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, common.ContextError(err)
 			}
-			return nil
-		})
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
 
-		if data == nil {
-			// In case of data corruption or a bug causing this condition,
-			// do not stop iterating.
-			NoticeAlert("ServerEntryIterator.Next: unexpected missing server entry: %s", string(serverEntryID))
-			continue
-		}
+			if data == nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				NoticeAlert("ServerEntryIterator.Next: unexpected missing server entry: %s", string(serverEntryID))
+				continue
+			}
 
-		err = json.Unmarshal(data, &serverEntry)
-		if err != nil {
-			// In case of data corruption or a bug causing this condition,
-			// do not stop iterating.
-			NoticeAlert("ServerEntryIterator.Next: %s", common.ContextError(err))
-			continue
-		}
+			err = json.Unmarshal(data, &serverEntry)
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				NoticeAlert("ServerEntryIterator.Next: %s", common.ContextError(err))
+				recordMalformedServerEntry(serverEntryID)
+				continue
+			}
 
-		if iterator.serverEntryIndex%datastoreServerEntryFetchGCThreshold == 0 {
-			DoGarbageCollection()
+			datastoreServerEntryCache.add(serverEntryID, serverEntry, cacheGeneration)
+
+			if iterator.serverEntryIndex%iterator.gcThreshold == 0 {
+				DoGarbageCollection()
+			}
 		}
 
 		// Check filter requirements
@@ -695,6 +1639,14 @@ func MakeCompatibleServerEntry(serverEntry *protocol.ServerEntry) *protocol.Serv
 }
 
 func scanServerEntries(scanner func(*protocol.ServerEntry)) error {
+
+	gcThreshold := datastoreBatchSize(
+		datastoreServerEntryFetchGCThreshold,
+		datastoreEstimatedServerEntrySize)
+
+	recordDatastoreMemoryEstimate(
+		int64(gcThreshold) * datastoreEstimatedServerEntrySize)
+
 	err := datastoreView(func(tx *datastoreTx) error {
 		bucket := tx.bucket(datastoreServerEntriesBucket)
 		cursor := bucket.cursor()
@@ -706,12 +1658,13 @@ func scanServerEntries(scanner func(*protocol.ServerEntry)) error {
 				// In case of data corruption or a bug causing this condition,
 				// do not stop iterating.
 				NoticeAlert("scanServerEntries: %s", common.ContextError(err))
+				recordMalformedServerEntry(key)
 				continue
 			}
 			scanner(serverEntry)
 
 			n += 1
-			if n == datastoreServerEntryFetchGCThreshold {
+			if n == gcThreshold {
 				DoGarbageCollection()
 				n = 0
 			}
@@ -742,6 +1695,39 @@ func CountServerEntries() int {
 	return count
 }
 
+// GetServerEntriesByFreshness returns all stored server entries, sorted by
+// LocalTimestamp with the most recently obtained entries first. Server
+// entries with missing or malformed timestamps are sorted last.
+func GetServerEntriesByFreshness() ([]*protocol.ServerEntry, error) {
+
+	type timestampedServerEntry struct {
+		serverEntry *protocol.ServerEntry
+		timestamp   time.Time
+	}
+
+	var timestampedServerEntries []timestampedServerEntry
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+		timestampedServerEntries = append(
+			timestampedServerEntries,
+			timestampedServerEntry{serverEntry, serverEntry.GetLocalTimestamp()})
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	sort.SliceStable(timestampedServerEntries, func(i, j int) bool {
+		return timestampedServerEntries[i].timestamp.After(
+			timestampedServerEntries[j].timestamp)
+	})
+
+	serverEntries := make([]*protocol.ServerEntry, len(timestampedServerEntries))
+	for i, entry := range timestampedServerEntries {
+		serverEntries[i] = entry.serverEntry
+	}
+
+	return serverEntries, nil
+}
+
 // CountServerEntriesWithConstraints returns a count of stored server entries for
 // the specified region and tunnel protocol limits.
 func CountServerEntriesWithConstraints(
@@ -1074,6 +2060,7 @@ func TakeOutUnreportedPersistentStats(config *Config) (map[string][][]byte, erro
 					NoticeAlert(
 						"Invalid key in TakeOutUnreportedPersistentStats: %s: %s",
 						string(key), err)
+					atomic.AddInt64(&datastoreMalformedPersistentStatCount, 1)
 					bucket.delete(key)
 					continue
 				}
@@ -1174,28 +2161,189 @@ func ClearReportedPersistentStats(stats map[string][][]byte) error {
 // records to StateUnreported. This reset is called when the
 // datastore is initialized at start up, as we do not know if
 // persistent records in StateReporting were reported or not.
+//
+// When no memory budget is set, all records are reset in a single
+// transaction. Under a memory budget, records are reset in batches,
+// one transaction per batch.
 func resetAllPersistentStatsToUnreported() error {
 
+	batchSize := datastoreBatchSize(
+		math.MaxInt32, datastoreEstimatedPersistentStatSize)
+
+	if batchSize == math.MaxInt32 {
+
+		err := datastoreUpdate(func(tx *datastoreTx) error {
+			for _, statType := range persistentStatTypes {
+				_, err := resetPersistentStatsToUnreported(tx, statType, batchSize)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		return nil
+	}
+
+	for _, statType := range persistentStatTypes {
+
+		for {
+			var resetCount int
+
+			err := datastoreUpdate(func(tx *datastoreTx) error {
+				var err error
+				resetCount, err = resetPersistentStatsToUnreported(tx, statType, batchSize)
+				return err
+			})
+
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			if resetCount < batchSize {
+				break
+			}
+
+			DoGarbageCollection()
+		}
+	}
+
+	return nil
+}
+
+// resetPersistentStatsToUnreported sets up to batchSize persistent stat
+// records of the specified type, which are not already StateUnreported, to
+// StateUnreported. The number of records reset is returned.
+func resetPersistentStatsToUnreported(
+	tx *datastoreTx, statType string, batchSize int) (int, error) {
+
+	bucket := tx.bucket([]byte(statType))
+	resetKeys := make([][]byte, 0)
+	cursor := bucket.cursor()
+	for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+		if bytes.Equal(value, persistentStatStateUnreported) {
+			continue
+		}
+		resetKeys = append(resetKeys, key)
+		if len(resetKeys) >= batchSize {
+			break
+		}
+	}
+	cursor.close()
+
+	recordDatastoreMemoryEstimate(
+		int64(len(resetKeys)) * datastoreEstimatedPersistentStatSize)
+
+	// TODO: data mutation is done outside cursor. Is this
+	// strictly necessary in this case? As is, this means
+	// each batch of keys needs to be loaded into memory
+	// at once.
+	// https://godoc.org/github.com/boltdb/bolt#Cursor
+	for _, key := range resetKeys {
+		err := bucket.put(key, persistentStatStateUnreported)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(resetKeys), nil
+}
+
+// ExportPersistentStats returns all persistent stat records, in any state,
+// keyed by stat type. The result may be passed to ImportPersistentStats to
+// carry pending stats over to a new datastore; for example, before deleting
+// a corrupt datastore.
+func ExportPersistentStats() (map[string][][]byte, error) {
+
+	stats := make(map[string][][]byte)
+
+	err := datastoreView(func(tx *datastoreTx) error {
+
+		for _, statType := range persistentStatTypes {
+
+			bucket := tx.bucket([]byte(statType))
+			cursor := bucket.cursor()
+			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+
+				// Must make a copy as slice is only valid within transaction.
+				data := make([]byte, len(key))
+				copy(data, key)
+
+				stats[statType] = append(stats[statType], data)
+			}
+			cursor.close()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return stats, nil
+}
+
+// ImportPersistentStats stores persistent stat records, as returned by
+// ExportPersistentStats, in StateUnreported.
+//
+// As with StorePersistentStat, only up to PersistentStatsMaxStoreRecords are
+// stored per stat type and additional records are discarded. Records that
+// are already present are left unchanged. Records that fail the JSON
+// validation performed in TakeOutUnreportedPersistentStats are skipped.
+func ImportPersistentStats(config *Config, stats map[string][][]byte) error {
+
+	for statType := range stats {
+		if !common.Contains(persistentStatTypes, statType) {
+			return common.ContextError(fmt.Errorf("invalid persistent stat type: %s", statType))
+		}
+	}
+
+	maxStoreRecords := config.GetClientParameters().Int(parameters.PersistentStatsMaxStoreRecords)
+
 	err := datastoreUpdate(func(tx *datastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
 			bucket := tx.bucket([]byte(statType))
-			resetKeys := make([][]byte, 0)
+
+			count := 0
 			cursor := bucket.cursor()
 			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
-				resetKeys = append(resetKeys, key)
+				count++
 			}
 			cursor.close()
-			// TODO: data mutation is done outside cursor. Is this
-			// strictly necessary in this case? As is, this means
-			// all stats need to be loaded into memory at once.
-			// https://godoc.org/github.com/boltdb/bolt#Cursor
-			for _, key := range resetKeys {
-				err := bucket.put(key, persistentStatStateUnreported)
+
+			for _, key := range stats[statType] {
+
+				if count >= maxStoreRecords {
+					// Silently discard.
+					break
+				}
+
+				var jsonData interface{}
+				err := json.Unmarshal(key, &jsonData)
+				if err != nil {
+					NoticeAlert(
+						"Invalid key in ImportPersistentStats: %s: %s",
+						string(key), err)
+					continue
+				}
+
+				if bucket.get(key) != nil {
+					continue
+				}
+
+				err = bucket.put(key, persistentStatStateUnreported)
 				if err != nil {
 					return err
 				}
+
+				count++
 			}
 		}
 
@@ -1285,9 +2433,87 @@ func GetSLOK(id []byte) ([]byte, error) {
 	return key, nil
 }
 
+// makeDialParametersKey makes a dial parameters record key, which is the
+// uvarint encoded length of serverIPAddress followed by serverIPAddress and
+// networkID. The length prefix ensures that distinct serverIPAddress and
+// networkID pairs, such as "1.2.3.4"/"5-WIFI" and "1.2.3.45"/"-WIFI", have
+// distinct keys.
 func makeDialParametersKey(serverIPAddress, networkID []byte) []byte {
-	// TODO: structured key?
-	return append(append([]byte(nil), serverIPAddress...), networkID...)
+	key := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(serverIPAddress)+len(networkID))
+	n := binary.PutUvarint(key, uint64(len(serverIPAddress)))
+	key = append(key[:n], serverIPAddress...)
+	return append(key, networkID...)
+}
+
+// parseDialParametersKey splits a dial parameters record key, made by
+// makeDialParametersKey, into its server IP address and network ID. The
+// returned slices reference key. ok is false when key is malformed.
+func parseDialParametersKey(key []byte) (serverIPAddress, networkID []byte, ok bool) {
+	serverIPAddressLength, n := binary.Uvarint(key)
+	if n <= 0 || uint64(len(key)-n) < serverIPAddressLength {
+		return nil, nil, false
+	}
+	serverIPAddressEnd := n + int(serverIPAddressLength)
+	return key[n:serverIPAddressEnd], key[serverIPAddressEnd:], true
+}
+
+// migrateDialParametersKeys converts dial parameters record keys from the
+// schema version 1 format, the unstructured concatenation of the server IP
+// address and network ID, to the makeDialParametersKey format.
+//
+// As the version 1 format is ambiguous, each key is split by matching a
+// stored server entry IP address prefix. When there is no match, or multiple
+// matches, the record is deleted; dial parameters records are only used for
+// replay and are recreated on the next successful dial.
+func migrateDialParametersKeys(tx *datastoreTx) error {
+
+	type dialParametersRecord struct {
+		key   []byte
+		value []byte
+	}
+
+	serverEntriesBucket := tx.bucket(datastoreServerEntriesBucket)
+	dialParamsBucket := tx.bucket(datastoreDialParametersBucket)
+
+	var records []dialParametersRecord
+	cursor := dialParamsBucket.cursor()
+	for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+		records = append(records, dialParametersRecord{
+			key:   append([]byte(nil), key...),
+			value: append([]byte(nil), value...),
+		})
+	}
+	cursor.close()
+
+	for _, record := range records {
+
+		err := dialParamsBucket.delete(record.key)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		matchLength := 0
+		matchCount := 0
+		for i := 1; i <= len(record.key); i++ {
+			if serverEntriesBucket.get(record.key[:i]) != nil {
+				matchLength = i
+				matchCount += 1
+			}
+		}
+
+		if matchCount != 1 {
+			continue
+		}
+
+		err = dialParamsBucket.put(
+			makeDialParametersKey(record.key[:matchLength], record.key[matchLength:]),
+			record.value)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	return nil
 }
 
 // SetDialParameters stores dial parameters associated with the specified
@@ -1357,6 +2583,18 @@ func (t *TacticsStorer) GetSpeedTestSamplesRecord(networkID string) ([]byte, err
 	return getBucketValue(datastoreSpeedTestSamplesBucket, []byte(networkID))
 }
 
+// CountSpeedTestSamples returns the number of speed test samples stored for
+// the specified network ID.
+func (t *TacticsStorer) CountSpeedTestSamples(networkID string) (int, error) {
+	return tactics.CountSpeedTestSamples(t, networkID)
+}
+
+// TrimSpeedTestSamples retains at most max of the most recent speed test
+// samples stored for the specified network ID.
+func (t *TacticsStorer) TrimSpeedTestSamples(networkID string, max int) error {
+	return tactics.TrimSpeedTestSamples(t, networkID, max)
+}
+
 // GetTacticsStorer creates a TacticsStorer.
 func GetTacticsStorer() *TacticsStorer {
 	return &TacticsStorer{}
@@ -92,6 +92,7 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 	err = newDB.Update(func(tx *bolt.Tx) error {
 		requiredBuckets := [][]byte{
 			datastoreServerEntriesBucket,
+			datastoreServerEntriesStagingBucket,
 			datastoreSplitTunnelRouteETagsBucket,
 			datastoreSplitTunnelRouteDataBucket,
 			datastoreUrlETagsBucket,
@@ -0,0 +1,1951 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+func TestExportImportPersistentStats(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-persistent-stats-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	clientConfig := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   testDataDirName,
+	}
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	maxStoreRecords := 10
+
+	applyParameters := make(map[string]interface{})
+	applyParameters[parameters.PersistentStatsMaxStoreRecords] = maxStoreRecords
+	err = clientConfig.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+
+	for i := 0; i < maxStoreRecords/2; i++ {
+		err = StorePersistentStat(
+			clientConfig,
+			datastorePersistentStatTypeRemoteServerList,
+			[]byte(fmt.Sprintf(`{"index": %d}`, i)))
+		if err != nil {
+			t.Fatalf("StorePersistentStat failed: %s", err)
+		}
+	}
+
+	// Test: export includes records in StateReporting
+
+	_, err = TakeOutUnreportedPersistentStats(clientConfig)
+	if err != nil {
+		t.Fatalf("TakeOutUnreportedPersistentStats failed: %s", err)
+	}
+
+	stats, err := ExportPersistentStats()
+	if err != nil {
+		t.Fatalf("ExportPersistentStats failed: %s", err)
+	}
+
+	if len(stats[datastorePersistentStatTypeRemoteServerList]) != maxStoreRecords/2 {
+		t.Fatalf("unexpected exported record count")
+	}
+
+	CloseDataStore()
+
+	// Test: import into a fresh datastore restores records as unreported
+
+	os.RemoveAll(testDataDirName)
+	os.MkdirAll(testDataDirName, 0700)
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	err = ImportPersistentStats(clientConfig, stats)
+	if err != nil {
+		t.Fatalf("ImportPersistentStats failed: %s", err)
+	}
+
+	if CountUnreportedPersistentStats() != maxStoreRecords/2 {
+		t.Fatalf("unexpected unreported record count")
+	}
+
+	// Test: reimporting the same records doesn't add duplicates
+
+	err = ImportPersistentStats(clientConfig, stats)
+	if err != nil {
+		t.Fatalf("ImportPersistentStats failed: %s", err)
+	}
+
+	if CountUnreportedPersistentStats() != maxStoreRecords/2 {
+		t.Fatalf("unexpected unreported record count")
+	}
+
+	// Test: import truncates at PersistentStatsMaxStoreRecords and skips
+	// invalid JSON records
+
+	moreStats := make(map[string][][]byte)
+	moreStats[datastorePersistentStatTypeRemoteServerList] = append(
+		moreStats[datastorePersistentStatTypeRemoteServerList], []byte("{invalid"))
+	for i := maxStoreRecords; i < maxStoreRecords*2; i++ {
+		moreStats[datastorePersistentStatTypeRemoteServerList] = append(
+			moreStats[datastorePersistentStatTypeRemoteServerList],
+			[]byte(fmt.Sprintf(`{"index": %d}`, i)))
+	}
+	moreStats[datastorePersistentStatTypeFailedTunnel] = append(
+		moreStats[datastorePersistentStatTypeFailedTunnel], []byte(`{"index": 0}`))
+
+	err = ImportPersistentStats(clientConfig, moreStats)
+	if err != nil {
+		t.Fatalf("ImportPersistentStats failed: %s", err)
+	}
+
+	if CountUnreportedPersistentStats() != maxStoreRecords+1 {
+		t.Fatalf("unexpected unreported record count")
+	}
+
+	stats, err = ExportPersistentStats()
+	if err != nil {
+		t.Fatalf("ExportPersistentStats failed: %s", err)
+	}
+
+	if len(stats[datastorePersistentStatTypeRemoteServerList]) != maxStoreRecords {
+		t.Fatalf("unexpected exported record count")
+	}
+
+	for _, stat := range stats[datastorePersistentStatTypeRemoteServerList] {
+		if string(stat) == "{invalid" {
+			t.Fatalf("unexpected invalid record")
+		}
+	}
+
+	// Test: invalid stat type is rejected
+
+	err = ImportPersistentStats(
+		clientConfig, map[string][][]byte{"invalid": {[]byte("{}")}})
+	if err == nil {
+		t.Fatalf("unexpected ImportPersistentStats success")
+	}
+}
+
+func TestDataStoreMigration(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-migration-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	clientConfig := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   testDataDirName,
+	}
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	getSchemaVersion := func() string {
+		var version string
+		err := datastoreView(func(tx *datastoreTx) error {
+			version = string(tx.bucket(datastoreKeyValueBucket).get(datastoreSchemaVersionKey))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("datastoreView failed: %s", err)
+		}
+		return version
+	}
+
+	// Test: a new datastore is migrated to the current version
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+
+	if getSchemaVersion() != strconv.Itoa(datastoreSchemaVersion) {
+		t.Fatalf("unexpected schema version: %s", getSchemaVersion())
+	}
+
+	CloseDataStore()
+
+	// Test: an older version datastore runs a registered migration exactly
+	// once
+
+	savedSchemaVersion := datastoreSchemaVersion
+	savedMigrations := datastoreMigrations
+	defer func() {
+		datastoreSchemaVersion = savedSchemaVersion
+		datastoreMigrations = savedMigrations
+	}()
+
+	migrationCount := 0
+
+	testVersion := savedSchemaVersion + 1
+
+	datastoreSchemaVersion = testVersion
+	datastoreMigrations = make(map[int]func(tx *datastoreTx) error)
+	for version, migration := range savedMigrations {
+		datastoreMigrations[version] = migration
+	}
+	datastoreMigrations[testVersion] = func(tx *datastoreTx) error {
+		migrationCount += 1
+		return tx.bucket(datastoreKeyValueBucket).put(
+			[]byte("migrated"), []byte("true"))
+	}
+
+	for i := 0; i < 2; i++ {
+
+		err = OpenDataStore(clientConfig)
+		if err != nil {
+			t.Fatalf("error initializing client datastore: %s", err)
+		}
+
+		if migrationCount != 1 {
+			t.Fatalf("unexpected migration count: %d", migrationCount)
+		}
+
+		if getSchemaVersion() != strconv.Itoa(testVersion) {
+			t.Fatalf("unexpected schema version: %s", getSchemaVersion())
+		}
+
+		value, err := GetKeyValue("migrated")
+		if err != nil || value != "true" {
+			t.Fatalf("unexpected migrated value: %s, %v", value, err)
+		}
+
+		CloseDataStore()
+	}
+
+	// Test: a failed migration fails OpenDataStore, leaving the version unchanged
+
+	datastoreSchemaVersion = testVersion + 1
+	datastoreMigrations[testVersion+1] = func(_ *datastoreTx) error {
+		return errors.New("migration failed")
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err == nil {
+		CloseDataStore()
+		t.Fatalf("unexpected OpenDataStore success")
+	}
+
+	// Test: a newer version datastore is opened without migration
+
+	datastoreSchemaVersion = savedSchemaVersion
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	if getSchemaVersion() != strconv.Itoa(testVersion) {
+		t.Fatalf("unexpected schema version: %s", getSchemaVersion())
+	}
+}
+
+func TestDialParametersKeys(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-dial-parameters-keys-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	clientConfig := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   testDataDirName,
+	}
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+
+	// Test: server IP address and network ID pairs which collide when
+	// concatenated have distinct keys
+
+	if bytes.Equal(
+		makeDialParametersKey([]byte("1.2.3.4"), []byte("5-WIFI")),
+		makeDialParametersKey([]byte("1.2.3.45"), []byte("-WIFI"))) {
+		t.Fatalf("unexpected dial parameters key collision")
+	}
+
+	// Test: parseDialParametersKey inverts makeDialParametersKey
+
+	serverIPAddress, networkID, ok := parseDialParametersKey(
+		makeDialParametersKey([]byte("1.2.3.4"), []byte("5-WIFI")))
+	if !ok ||
+		string(serverIPAddress) != "1.2.3.4" ||
+		string(networkID) != "5-WIFI" {
+		t.Fatalf("unexpected parsed dial parameters key: %s, %s, %v",
+			serverIPAddress, networkID, ok)
+	}
+
+	_, _, ok = parseDialParametersKey([]byte{0x10, '1'})
+	if ok {
+		t.Fatalf("unexpected parse of malformed dial parameters key")
+	}
+
+	err = SetDialParameters("1.2.3.4", "5-WIFI", &DialParameters{TunnelProtocol: "OSSH"})
+	if err != nil {
+		t.Fatalf("SetDialParameters failed: %s", err)
+	}
+
+	err = SetDialParameters("1.2.3.45", "-WIFI", &DialParameters{TunnelProtocol: "SSH"})
+	if err != nil {
+		t.Fatalf("SetDialParameters failed: %s", err)
+	}
+
+	dialParams, err := GetDialParameters("1.2.3.4", "5-WIFI")
+	if err != nil || dialParams == nil || dialParams.TunnelProtocol != "OSSH" {
+		t.Fatalf("unexpected dial parameters: %+v, %v", dialParams, err)
+	}
+
+	dialParams, err = GetDialParameters("1.2.3.45", "-WIFI")
+	if err != nil || dialParams == nil || dialParams.TunnelProtocol != "SSH" {
+		t.Fatalf("unexpected dial parameters: %+v, %v", dialParams, err)
+	}
+
+	// Test: the migration from schema version 1 rewrites unambiguous
+	// concatenated keys and deletes the remainder
+
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+
+		err := tx.clearBucket(datastoreDialParametersBucket)
+		if err != nil {
+			return err
+		}
+
+		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+		for _, serverIPAddress := range []string{"10.0.0.1", "1.2.3.4", "1.2.3.45"} {
+			err := serverEntries.put([]byte(serverIPAddress), []byte("{}"))
+			if err != nil {
+				return err
+			}
+		}
+
+		dialParams := tx.bucket(datastoreDialParametersBucket)
+		for key, value := range map[string]string{
+			"10.0.0.1WIFI-A":  `{"TunnelProtocol": "OSSH"}`,
+			"1.2.3.45-WIFI":   `{"TunnelProtocol": "SSH"}`,
+			"192.168.0.1WIFI": `{"TunnelProtocol": "SSH"}`,
+		} {
+			err := dialParams.put([]byte(key), []byte(value))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.bucket(datastoreKeyValueBucket).put(
+			datastoreSchemaVersionKey, []byte("1"))
+	})
+	if err != nil {
+		t.Fatalf("datastoreUpdate failed: %s", err)
+	}
+
+	CloseDataStore()
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	dialParams, err = GetDialParameters("10.0.0.1", "WIFI-A")
+	if err != nil || dialParams == nil || dialParams.TunnelProtocol != "OSSH" {
+		t.Fatalf("unexpected dial parameters: %+v, %v", dialParams, err)
+	}
+
+	recordCount := 0
+	err = datastoreView(func(tx *datastoreTx) error {
+		cursor := tx.bucket(datastoreDialParametersBucket).cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			recordCount += 1
+		}
+		cursor.close()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+
+	if recordCount != 1 {
+		t.Fatalf("unexpected dial parameters record count: %d", recordCount)
+	}
+}
+
+func TestServerAffinityResetNotice(t *testing.T) {
+
+	config, cleanup := openTestServerEntryDataStore(t, 0)
+	defer cleanup()
+
+	emitDiagnosticNotices := GetEmitDiagnoticNotices()
+	SetEmitDiagnosticNotices(true)
+	defer SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+	var resetNotices []map[string]interface{}
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil {
+				return
+			}
+			if noticeType == "ServerAffinityReset" {
+				resetNotices = append(resetNotices, payload)
+			}
+		}))
+	defer SetNoticeWriter(ioutil.Discard)
+
+	newIterator := func() {
+		_, iterator, err := NewServerEntryIterator(config)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		iterator.Close()
+	}
+
+	// Test: no notice on a first run, with no previous filter
+
+	newIterator()
+
+	if len(resetNotices) != 0 {
+		t.Fatalf("unexpected reset notice: %+v", resetNotices)
+	}
+
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		makeTestEncodedServerEntry(t, 0, 0, ""),
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+
+	err = StoreServerEntry(serverEntryFields, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	err = PromoteServerEntry(config, serverEntryFields.GetIPAddress())
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+
+	// Test: no notice when the filter is unchanged
+
+	newIterator()
+
+	if len(resetNotices) != 0 {
+		t.Fatalf("unexpected reset notice: %+v", resetNotices)
+	}
+
+	// Test: notice when the filter changes
+
+	config.EgressRegion = "US"
+
+	newIterator()
+
+	if len(resetNotices) != 1 ||
+		resetNotices[0]["previousEgressRegion"] != "" ||
+		resetNotices[0]["egressRegion"] != "US" {
+		t.Fatalf("unexpected reset notices: %+v", resetNotices)
+	}
+}
+
+func TestGetAffinityServerEntry(t *testing.T) {
+
+	config, cleanup := openTestServerEntryDataStore(t, 0)
+	defer cleanup()
+
+	// Test: no affinity server entry is set
+
+	serverEntry, err := GetAffinityServerEntry()
+	if err != nil {
+		t.Fatalf("GetAffinityServerEntry failed: %s", err)
+	}
+	if serverEntry != nil {
+		t.Fatalf("unexpected affinity server entry: %+v", serverEntry)
+	}
+
+	var ipAddresses []string
+	for i := 0; i < 2; i++ {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			makeTestEncodedServerEntry(t, i, 0, ""),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+		ipAddresses = append(ipAddresses, serverEntryFields.GetIPAddress())
+	}
+
+	// Test: the promoted server entry is returned
+
+	for _, ipAddress := range ipAddresses {
+
+		err = PromoteServerEntry(config, ipAddress)
+		if err != nil {
+			t.Fatalf("PromoteServerEntry failed: %s", err)
+		}
+
+		serverEntry, err = GetAffinityServerEntry()
+		if err != nil {
+			t.Fatalf("GetAffinityServerEntry failed: %s", err)
+		}
+		if serverEntry == nil || serverEntry.IpAddress != ipAddress {
+			t.Fatalf("unexpected affinity server entry: %+v", serverEntry)
+		}
+	}
+
+	// Test: a dangling affinity server entry ID returns no server entry
+
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerEntriesBucket)
+		return bucket.delete([]byte(ipAddresses[len(ipAddresses)-1]))
+	})
+	if err != nil {
+		t.Fatalf("datastoreUpdate failed: %s", err)
+	}
+
+	serverEntry, err = GetAffinityServerEntry()
+	if err != nil {
+		t.Fatalf("GetAffinityServerEntry failed: %s", err)
+	}
+	if serverEntry != nil {
+		t.Fatalf("unexpected affinity server entry: %+v", serverEntry)
+	}
+}
+
+func TestServerEntrySignatureVerification(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-entry-signature-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	publicKey, privateKey, err := protocol.NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	clientConfig := &Config{
+		PropagationChannelId:          "0",
+		SponsorId:                     "0",
+		DataStoreDirectory:            testDataDirName,
+		ServerEntrySignaturePublicKey: publicKey,
+	}
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	testCases := []struct {
+		description    string
+		index          int
+		source         string
+		sign           bool
+		tamper         bool
+		expectedStored bool
+	}{
+		{"signed", 0, protocol.SERVER_ENTRY_SOURCE_REMOTE, true, false, true},
+		{"unsigned", 1, protocol.SERVER_ENTRY_SOURCE_REMOTE, false, false, false},
+		{"tampered", 2, protocol.SERVER_ENTRY_SOURCE_DISCOVERY, true, true, false},
+		{"unsigned embedded", 3, protocol.SERVER_ENTRY_SOURCE_EMBEDDED, false, false, true},
+		{"unsigned target", 4, protocol.SERVER_ENTRY_SOURCE_TARGET, false, false, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			serverEntryFields, err := protocol.DecodeServerEntryFields(
+				makeTestEncodedServerEntry(t, testCase.index, 0, ""),
+				common.GetCurrentTimestamp(),
+				testCase.source)
+			if err != nil {
+				t.Fatalf("DecodeServerEntryFields failed: %s", err)
+			}
+
+			if testCase.sign {
+				err = serverEntryFields.AddSignature(privateKey)
+				if err != nil {
+					t.Fatalf("AddSignature failed: %s", err)
+				}
+			}
+
+			if testCase.tamper {
+				serverEntryFields["webServerSecret"] = "tampered"
+			}
+
+			err = StoreServerEntry(serverEntryFields, true)
+			if err != nil {
+				t.Fatalf("StoreServerEntry failed: %s", err)
+			}
+
+			stored := false
+			err = datastoreView(func(tx *datastoreTx) error {
+				stored = tx.bucket(datastoreServerEntriesBucket).get(
+					[]byte(serverEntryFields.GetIPAddress())) != nil
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("datastoreView failed: %s", err)
+			}
+
+			if stored != testCase.expectedStored {
+				t.Fatalf("unexpected stored: %v", stored)
+			}
+		})
+	}
+
+	// Test: an invalid ServerEntrySignaturePublicKey is rejected
+
+	invalidConfig := &Config{
+		PropagationChannelId:          "0",
+		SponsorId:                     "0",
+		ServerEntrySignaturePublicKey: "invalid",
+	}
+	err = invalidConfig.Commit()
+	if err == nil {
+		t.Fatalf("unexpected Commit success")
+	}
+}
+
+func TestReplayCandidateCountCap(t *testing.T) {
+
+	clientConfig, cleanup := openTestServerEntryDataStore(t, 100)
+	defer cleanup()
+
+	serverEntryCount := 100
+	dialParamsCount := 30
+
+	networkID := clientConfig.GetNetworkID()
+
+	var dialParamsIDs []string
+	for i := 0; i < serverEntryCount; i++ {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			makeTestEncodedServerEntry(t, i, 0, ""),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+		if i < dialParamsCount {
+			err = SetDialParameters(
+				serverEntryFields.GetIPAddress(), networkID, &DialParameters{})
+			if err != nil {
+				t.Fatalf("SetDialParameters failed: %s", err)
+			}
+			dialParamsIDs = append(dialParamsIDs, serverEntryFields.GetIPAddress())
+		}
+	}
+
+	testCases := []struct {
+		replayCandidateCount int
+		expectedFrontCount   int
+	}{
+		{10, 10},
+		{dialParamsCount, dialParamsCount},
+		{50, dialParamsCount},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", testCase.replayCandidateCount), func(t *testing.T) {
+
+			applyParameters := make(map[string]interface{})
+			applyParameters[parameters.ReplayCandidateCount] = testCase.replayCandidateCount
+			err := clientConfig.SetClientParameters("", true, applyParameters)
+			if err != nil {
+				t.Fatalf("SetClientParameters failed: %s", err)
+			}
+
+			_, iterator, err := NewServerEntryIterator(clientConfig)
+			if err != nil {
+				t.Fatalf("NewServerEntryIterator failed: %s", err)
+			}
+			defer iterator.Close()
+
+			var positions []int
+			position := 0
+			for {
+				serverEntry, err := iterator.Next()
+				if err != nil {
+					t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+				}
+				if serverEntry == nil {
+					break
+				}
+				if common.Contains(dialParamsIDs, serverEntry.IpAddress) {
+					positions = append(positions, position)
+				}
+				position++
+			}
+
+			if position != serverEntryCount || len(positions) != dialParamsCount {
+				t.Fatalf("unexpected iteration counts: %d, %d", position, len(positions))
+			}
+
+			// The first expectedFrontCount positions are replay candidates.
+
+			for i := 0; i < testCase.expectedFrontCount; i++ {
+				if positions[i] != i {
+					t.Fatalf("unexpected candidate positions: %+v", positions)
+				}
+			}
+
+			// Candidates beyond the cap are left in shuffled order, and
+			// are not all contiguous with the front-loaded candidates.
+
+			if testCase.expectedFrontCount < dialParamsCount &&
+				positions[dialParamsCount-1] == dialParamsCount-1 {
+				t.Fatalf("unexpected candidate positions: %+v", positions)
+			}
+		})
+	}
+}
+
+func TestServerEntryShuffleTopPercent(t *testing.T) {
+
+	clientConfig, cleanup := openTestServerEntryDataStore(t, 100)
+	defer cleanup()
+
+	serverEntryCount := 100
+
+	// Server entry i is stored with the i-th oldest LocalTimestamp, so the
+	// freshest server entries have the highest indexes.
+
+	baseTime := time.Now().Add(-time.Duration(serverEntryCount) * time.Minute)
+
+	for i := 0; i < serverEntryCount; i++ {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			makeTestEncodedServerEntry(t, i, 0, ""),
+			protocol.FormatServerEntryTimestamp(
+				baseTime.Add(time.Duration(i)*time.Minute)),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	freshnessRanks := make(map[string]int)
+	for i := 0; i < serverEntryCount; i++ {
+		freshnessRanks[fmt.Sprintf("192.168.%d.%d", i/256, i%256)] = serverEntryCount - 1 - i
+	}
+
+	// iterate returns the freshness rank, 0 being the freshest, of the
+	// server entry at each iteration position.
+	iterate := func(shuffleTopPercent int) []int {
+
+		applyParameters := make(map[string]interface{})
+		applyParameters[parameters.ServerEntryShuffleTopPercent] = shuffleTopPercent
+		err := clientConfig.SetClientParameters("", true, applyParameters)
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+
+		_, iterator, err := NewServerEntryIterator(clientConfig)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		defer iterator.Close()
+
+		var ranks []int
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ranks = append(ranks, freshnessRanks[serverEntry.IpAddress])
+		}
+
+		if len(ranks) != serverEntryCount {
+			t.Fatalf("unexpected iteration count: %d", len(ranks))
+		}
+
+		return ranks
+	}
+
+	// frontRankSum returns the sum of the freshness ranks of the first
+	// frontCount server entries, over a number of iterations.
+	frontRankSum := func(shuffleTopPercent, frontCount int) int {
+		sum := 0
+		for i := 0; i < 10; i++ {
+			for _, rank := range iterate(shuffleTopPercent)[:frontCount] {
+				sum += rank
+			}
+		}
+		return sum
+	}
+
+	// Test: the top percent are kept at the front, freshest first, and the
+	// remainder is shuffled
+
+	for _, shuffleTopPercent := range []int{20, 50} {
+
+		topCount := serverEntryCount * shuffleTopPercent / 100
+
+		ranks := iterate(shuffleTopPercent)
+
+		for i := 0; i < topCount; i++ {
+			if ranks[i] != i {
+				t.Fatalf("unexpected top server entry ranks: %+v", ranks[:topCount])
+			}
+		}
+
+		sorted := true
+		for i := topCount + 1; i < serverEntryCount; i++ {
+			if ranks[i] < ranks[i-1] {
+				sorted = false
+				break
+			}
+		}
+		if sorted {
+			t.Fatalf("unexpected unshuffled remainder: %+v", ranks[topCount:])
+		}
+	}
+
+	// Test: with 100 percent, all server entries are ordered by freshness
+
+	ranks := iterate(100)
+	for i := 0; i < serverEntryCount; i++ {
+		if ranks[i] != i {
+			t.Fatalf("unexpected server entry ranks: %+v", ranks)
+		}
+	}
+
+	// Test: the distribution of the front of the iteration shifts towards
+	// fresher server entries as the percent increases. With the default, 0,
+	// the front of the iteration is fully shuffled.
+
+	frontCount := serverEntryCount / 4
+
+	shuffledSum := frontRankSum(0, frontCount)
+	biasedSum := frontRankSum(10, frontCount)
+
+	if biasedSum >= shuffledSum {
+		t.Fatalf("unexpected front rank sums: %d, %d", biasedSum, shuffledSum)
+	}
+
+	if shuffledSum <= frontRankSum(100, frontCount) {
+		t.Fatalf("unexpected front of shuffled iteration")
+	}
+}
+
+func TestDatastoreCorruptionStats(t *testing.T) {
+
+	clientConfig, cleanup := openTestServerEntryDataStore(t, 100)
+	defer cleanup()
+
+	serverEntryCount := 5
+
+	for i := 0; i < serverEntryCount; i++ {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			makeTestEncodedServerEntry(t, i, 0, ""),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	if GetDatastoreCorruptionStats() != (DatastoreCorruptionStats{}) {
+		t.Fatalf("unexpected corruption stats: %+v", GetDatastoreCorruptionStats())
+	}
+
+	// Write garbage server entry and persistent stat records.
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+		for _, key := range []string{"192.168.255.1", "192.168.255.2"} {
+			err := serverEntries.put([]byte(key), []byte("<garbage>"))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.bucket(datastoreRemoteServerListStatsBucket).put(
+			[]byte("<garbage>"), persistentStatStateUnreported)
+	})
+	if err != nil {
+		t.Fatalf("datastoreUpdate failed: %s", err)
+	}
+
+	// Test: iteration skips and counts malformed server entries
+
+	_, iterator, err := NewServerEntryIterator(clientConfig)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	count := 0
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		count += 1
+	}
+	iterator.Close()
+
+	if count != serverEntryCount {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	stats := GetDatastoreCorruptionStats()
+	if stats.MalformedServerEntries != 2 || stats.MalformedPersistentStats != 0 {
+		t.Fatalf("unexpected corruption stats: %+v", stats)
+	}
+
+	// Test: malformed server entries encountered again, in a scan, are not
+	// recounted
+
+	err = scanServerEntries(func(*protocol.ServerEntry) {})
+	if err != nil {
+		t.Fatalf("scanServerEntries failed: %s", err)
+	}
+
+	stats = GetDatastoreCorruptionStats()
+	if stats.MalformedServerEntries != 2 {
+		t.Fatalf("unexpected corruption stats: %+v", stats)
+	}
+
+	// Test: taking out persistent stats counts malformed records
+
+	_, err = TakeOutUnreportedPersistentStats(clientConfig)
+	if err != nil {
+		t.Fatalf("TakeOutUnreportedPersistentStats failed: %s", err)
+	}
+
+	stats = GetDatastoreCorruptionStats()
+	if stats.MalformedPersistentStats != 1 {
+		t.Fatalf("unexpected corruption stats: %+v", stats)
+	}
+
+	// Test: counts are reset when the datastore is reopened
+
+	CloseDataStore()
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	if GetDatastoreCorruptionStats() != (DatastoreCorruptionStats{}) {
+		t.Fatalf("unexpected corruption stats: %+v", GetDatastoreCorruptionStats())
+	}
+}
+
+func TestDataStoreMemoryBudget(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-memory-budget-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	emitDiagnosticNotices := GetEmitDiagnoticNotices()
+	SetEmitDiagnosticNotices(true)
+	defer SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+	var peakNoticeBytes []int64
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil {
+				return
+			}
+			if noticeType == "DatastorePeakMemoryEstimate" {
+				peakNoticeBytes = append(
+					peakNoticeBytes, int64(payload["bytes"].(float64)))
+			}
+		}))
+	defer SetNoticeWriter(ioutil.Discard)
+
+	atomic.StoreInt64(&datastorePeakMemoryEstimate, 0)
+
+	// Budget for 2 persistent stat records per batch.
+
+	clientConfig := &Config{
+		PropagationChannelId:       "0",
+		SponsorId:                  "0",
+		DataStoreDirectory:         testDataDirName,
+		DataStoreMemoryBudgetBytes: 2 * datastoreEstimatedPersistentStatSize,
+	}
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer atomic.StoreInt64(&datastoreMemoryBudget, 0)
+
+	if datastoreBatchSize(100, datastoreEstimatedPersistentStatSize) != 2 {
+		t.Fatalf("unexpected budget batch size")
+	}
+
+	if datastoreBatchSize(1, datastoreEstimatedPersistentStatSize) != 1 {
+		t.Fatalf("unexpected default batch size")
+	}
+
+	if datastoreBatchSize(100, 4*datastoreEstimatedPersistentStatSize) != 1 {
+		t.Fatalf("unexpected minimum batch size")
+	}
+
+	// Test: the batched reset, performed when the datastore is opened,
+	// resets all records taken out for reporting
+
+	statCount := 5
+
+	for i := 0; i < statCount; i++ {
+		err = StorePersistentStat(
+			clientConfig,
+			datastorePersistentStatTypeRemoteServerList,
+			[]byte(fmt.Sprintf(`{"index": %d}`, i)))
+		if err != nil {
+			t.Fatalf("StorePersistentStat failed: %s", err)
+		}
+	}
+
+	_, err = TakeOutUnreportedPersistentStats(clientConfig)
+	if err != nil {
+		t.Fatalf("TakeOutUnreportedPersistentStats failed: %s", err)
+	}
+
+	if CountUnreportedPersistentStats() != 0 {
+		t.Fatalf("unexpected unreported record count")
+	}
+
+	CloseDataStore()
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	if CountUnreportedPersistentStats() != statCount {
+		t.Fatalf("unexpected unreported record count")
+	}
+
+	// Test: the reset batches are sized with the same per-record estimate
+	// used for the budget, and the peak is reported in a notice
+
+	peakEstimate := GetDataStorePeakMemoryEstimate()
+	if peakEstimate != 2*datastoreEstimatedPersistentStatSize {
+		t.Fatalf("unexpected peak memory estimate: %d", peakEstimate)
+	}
+
+	if len(peakNoticeBytes) == 0 ||
+		peakNoticeBytes[len(peakNoticeBytes)-1] != peakEstimate {
+		t.Fatalf("unexpected peak memory estimate notices: %+v", peakNoticeBytes)
+	}
+}
+
+func TestStreamingStoreServerEntriesBatching(t *testing.T) {
+
+	for _, batchSize := range []int{1, 3, 100} {
+		t.Run(fmt.Sprintf("batch size %d", batchSize), func(t *testing.T) {
+
+			clientConfig, cleanup := openTestServerEntryDataStore(t, batchSize)
+			defer cleanup()
+
+			serverEntryCount := 10
+
+			type testEntry struct {
+				index   int
+				version int
+				tag     string
+			}
+
+			importEntries := func(entries []testEntry, replaceIfExists bool) {
+				encodedServerEntries := make([]string, len(entries))
+				for i, entry := range entries {
+					encodedServerEntries[i] = makeTestEncodedServerEntry(
+						t, entry.index, entry.version, entry.tag)
+				}
+				err := StreamingStoreServerEntries(
+					clientConfig,
+					protocol.NewStreamingServerEntryDecoder(
+						strings.NewReader(strings.Join(encodedServerEntries, "\n")),
+						common.GetCurrentTimestamp(),
+						protocol.SERVER_ENTRY_SOURCE_REMOTE),
+					replaceIfExists)
+				if err != nil {
+					t.Fatalf("StreamingStoreServerEntries failed: %s", err)
+				}
+			}
+
+			checkEntries := func(expectedVersion func(int) int, expectedTag func(int) string) {
+				for i := 0; i < serverEntryCount; i++ {
+					serverEntry := getTestServerEntry(t, i)
+					if serverEntry.ConfigurationVersion != expectedVersion(i) ||
+						serverEntry.WebServerSecret != expectedTag(i) {
+						t.Fatalf("unexpected server entry %d: %d, %s",
+							i, serverEntry.ConfigurationVersion, serverEntry.WebServerSecret)
+					}
+				}
+			}
+
+			// Test: initial import stores all entries. A duplicate entry, with a
+			// lower version, in the same import is ignored.
+
+			var entries []testEntry
+			for i := 0; i < serverEntryCount; i++ {
+				entries = append(entries, testEntry{i, 1, "initial"})
+			}
+			entries = append(entries, testEntry{0, 0, "duplicate"})
+
+			importEntries(entries, false)
+
+			if CountServerEntries() != serverEntryCount {
+				t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+			}
+
+			checkEntries(
+				func(int) int { return 1 },
+				func(int) string { return "initial" })
+
+			// Test: without replaceIfExists, only strictly newer entries replace
+			// existing entries.
+
+			entries = nil
+			for i := 0; i < serverEntryCount; i++ {
+				entries = append(entries, testEntry{i, i % 3, "update"})
+			}
+
+			importEntries(entries, false)
+
+			checkEntries(
+				func(i int) int {
+					if i%3 == 2 {
+						return 2
+					}
+					return 1
+				},
+				func(i int) string {
+					if i%3 == 2 {
+						return "update"
+					}
+					return "initial"
+				})
+
+			// Test: with replaceIfExists, all entries are replaced.
+
+			entries = nil
+			for i := 0; i < serverEntryCount; i++ {
+				entries = append(entries, testEntry{i, 0, "replace"})
+			}
+
+			importEntries(entries, true)
+
+			checkEntries(
+				func(int) int { return 0 },
+				func(int) string { return "replace" })
+		})
+	}
+}
+
+func TestReplaceAllServerEntries(t *testing.T) {
+
+	clientConfig, cleanup := openTestServerEntryDataStore(t, 3)
+	defer cleanup()
+
+	networkID := "WIFI"
+
+	makeInput := func(indexes []int, tag string, interrupt bool) *protocol.StreamingServerEntryDecoder {
+		var encodedServerEntries []string
+		for _, index := range indexes {
+			encodedServerEntries = append(
+				encodedServerEntries, makeTestEncodedServerEntry(t, index, 0, tag))
+		}
+		var reader io.Reader = strings.NewReader(
+			strings.Join(encodedServerEntries, "\n") + "\n")
+		if interrupt {
+			reader = io.MultiReader(reader, &errorReader{})
+		}
+		return protocol.NewStreamingServerEntryDecoder(
+			reader,
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	}
+
+	indexRange := func(start, end int) []int {
+		var indexes []int
+		for i := start; i < end; i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+
+	checkEntries := func(indexes []int, tag string) {
+		if CountServerEntries() != len(indexes) {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+		for _, index := range indexes {
+			serverEntry := getTestServerEntry(t, index)
+			if serverEntry.WebServerSecret != tag {
+				t.Fatalf("unexpected server entry %d: %s", index, serverEntry.WebServerSecret)
+			}
+		}
+	}
+
+	hasDialParameters := func(index int) bool {
+		dialParams, err := GetDialParameters(
+			fmt.Sprintf("192.168.%d.%d", index/256, index%256), networkID)
+		if err != nil {
+			t.Fatalf("GetDialParameters failed: %s", err)
+		}
+		return dialParams != nil
+	}
+
+	getAffinityServerEntryID := func() string {
+		var serverEntryID string
+		err := datastoreView(func(tx *datastoreTx) error {
+			serverEntryID = string(
+				tx.bucket(datastoreKeyValueBucket).get(datastoreAffinityServerEntryIDKey))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("datastoreView failed: %s", err)
+		}
+		return serverEntryID
+	}
+
+	err := StreamingStoreServerEntries(
+		clientConfig, makeInput(indexRange(0, 10), "initial", false), true)
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntries failed: %s", err)
+	}
+
+	for _, index := range []int{1, 8} {
+		err = SetDialParameters(
+			fmt.Sprintf("192.168.0.%d", index), networkID, &DialParameters{TunnelProtocol: "OSSH"})
+		if err != nil {
+			t.Fatalf("SetDialParameters failed: %s", err)
+		}
+	}
+
+	err = PromoteServerEntry(clientConfig, "192.168.0.8")
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+
+	// Test: an interrupted replacement leaves the stored set unchanged
+
+	err = ReplaceAllServerEntries(clientConfig, makeInput(indexRange(5, 15), "replace", true))
+	if err == nil {
+		t.Fatalf("unexpected ReplaceAllServerEntries success")
+	}
+
+	checkEntries(indexRange(0, 10), "initial")
+
+	// Test: stale server entries are removed, and surviving server entries
+	// keep their dial parameters and server affinity
+
+	err = ReplaceAllServerEntries(clientConfig, makeInput(indexRange(5, 15), "replace", false))
+	if err != nil {
+		t.Fatalf("ReplaceAllServerEntries failed: %s", err)
+	}
+
+	checkEntries(indexRange(5, 15), "replace")
+
+	if hasDialParameters(1) || !hasDialParameters(8) {
+		t.Fatalf("unexpected dial parameters")
+	}
+
+	if getAffinityServerEntryID() != "192.168.0.8" {
+		t.Fatalf("unexpected affinity server entry: %s", getAffinityServerEntryID())
+	}
+
+	// Test: server affinity is removed with its server entry
+
+	err = ReplaceAllServerEntries(clientConfig, makeInput(indexRange(20, 25), "final", false))
+	if err != nil {
+		t.Fatalf("ReplaceAllServerEntries failed: %s", err)
+	}
+
+	checkEntries(indexRange(20, 25), "final")
+
+	if hasDialParameters(8) {
+		t.Fatalf("unexpected dial parameters")
+	}
+
+	if getAffinityServerEntryID() != "" {
+		t.Fatalf("unexpected affinity server entry: %s", getAffinityServerEntryID())
+	}
+}
+
+func BenchmarkStreamingStoreServerEntries(b *testing.B) {
+
+	serverEntryCount := 1000
+
+	encodedServerEntries := make([]string, serverEntryCount)
+	for i := 0; i < serverEntryCount; i++ {
+		encodedServerEntries[i] = makeTestEncodedServerEntry(b, i, 0, "")
+	}
+	encodedServerEntryList := strings.Join(encodedServerEntries, "\n")
+
+	for _, batchSize := range []int{1, 100} {
+		b.Run(fmt.Sprintf("batch size %d", batchSize), func(b *testing.B) {
+
+			clientConfig, cleanup := openTestServerEntryDataStore(b, batchSize)
+			defer cleanup()
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				err := StreamingStoreServerEntries(
+					clientConfig,
+					protocol.NewStreamingServerEntryDecoder(
+						strings.NewReader(encodedServerEntryList),
+						common.GetCurrentTimestamp(),
+						protocol.SERVER_ENTRY_SOURCE_REMOTE),
+					true)
+				if err != nil {
+					b.Fatalf("StreamingStoreServerEntries failed: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestServerEntryCache(t *testing.T) {
+
+	clientConfig, cleanup := openTestServerEntryDataStore(t, 100)
+	defer cleanup()
+
+	serverEntryCount := 10
+	cacheSize := 5
+
+	applyParameters := make(map[string]interface{})
+	applyParameters[parameters.ServerEntryCacheSize] = cacheSize
+	err := clientConfig.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	storeEntries := func(tag string) {
+		for i := 0; i < serverEntryCount; i++ {
+			serverEntryFields, err := protocol.DecodeServerEntryFields(
+				makeTestEncodedServerEntry(t, i, 0, tag),
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_REMOTE)
+			if err != nil {
+				t.Fatalf("DecodeServerEntryFields failed: %s", err)
+			}
+			err = StoreServerEntry(serverEntryFields, true)
+			if err != nil {
+				t.Fatalf("StoreServerEntry failed: %s", err)
+			}
+		}
+	}
+
+	iterateEntries := func(expectedTag string) {
+		_, iterator, err := NewServerEntryIterator(clientConfig)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		defer iterator.Close()
+		count := 0
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			if serverEntry.WebServerSecret != expectedTag {
+				t.Fatalf("unexpected server entry %s: %s",
+					serverEntry.IpAddress, serverEntry.WebServerSecret)
+			}
+
+			// Modifying a returned server entry must not modify the cache.
+			serverEntry.WebServerSecret = "modified"
+
+			count += 1
+		}
+		if count != serverEntryCount {
+			t.Fatalf("unexpected server entry count: %d", count)
+		}
+	}
+
+	storeEntries("initial")
+
+	// Test: iteration populates the cache, up to its size limit
+
+	iterateEntries("initial")
+
+	if datastoreServerEntryCache.cache.Len() != cacheSize {
+		t.Fatalf("unexpected cache size: %d", datastoreServerEntryCache.cache.Len())
+	}
+
+	// Test: cached server entries are returned, unmodified
+
+	iterateEntries("initial")
+
+	// Test: StoreServerEntry invalidates cached server entries
+
+	storeEntries("update")
+
+	if datastoreServerEntryCache.cache.Len() != 0 {
+		t.Fatalf("unexpected cache size: %d", datastoreServerEntryCache.cache.Len())
+	}
+
+	iterateEntries("update")
+	iterateEntries("update")
+
+	// Test: a cache size of 0 disables the cache
+
+	applyParameters[parameters.ServerEntryCacheSize] = 0
+	err = clientConfig.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	iterateEntries("update")
+
+	if datastoreServerEntryCache.cache != nil {
+		t.Fatalf("unexpected cache")
+	}
+}
+
+func TestExcludeServerIPs(t *testing.T) {
+
+	clientConfig, cleanup := openTestServerEntryDataStore(t, 100)
+	defer cleanup()
+
+	serverEntryCount := 10
+
+	for i := 0; i < serverEntryCount; i++ {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			makeTestEncodedServerEntry(t, i, 0, ""),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	checkIteration := func(excludedServerIPs []string) {
+
+		_, iterator, err := NewServerEntryIterator(clientConfig)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		defer iterator.Close()
+
+		seenServerIPs := make(map[string]bool)
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			if common.Contains(excludedServerIPs, serverEntry.IpAddress) {
+				t.Fatalf("unexpected excluded server entry: %s", serverEntry.IpAddress)
+			}
+			seenServerIPs[serverEntry.IpAddress] = true
+		}
+
+		if len(seenServerIPs) != serverEntryCount-len(excludedServerIPs) {
+			t.Fatalf("unexpected server entry count: %d", len(seenServerIPs))
+		}
+	}
+
+	// Test: no exclusions
+
+	checkIteration(nil)
+
+	// Test: excluded server entries are skipped
+
+	excludedServerIPs := []string{"192.168.0.1", "192.168.0.5", "192.168.0.9"}
+	clientConfig.SetExcludedServerIPs(excludedServerIPs)
+
+	checkIteration(excludedServerIPs)
+
+	// Test: a runtime change of exclusions applies to the next iteration
+
+	excludedServerIPs = []string{"192.168.0.2"}
+	clientConfig.SetExcludedServerIPs(excludedServerIPs)
+
+	checkIteration(excludedServerIPs)
+
+	clientConfig.SetExcludedServerIPs(nil)
+
+	checkIteration(nil)
+
+	// Test: invalid ExcludeServerIPs values are rejected
+
+	invalidConfig := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		ExcludeServerIPs:     []string{"192.168.0.1", "invalid"},
+	}
+	err := invalidConfig.Commit()
+	if err == nil {
+		t.Fatalf("unexpected Commit success")
+	}
+}
+
+func BenchmarkServerEntryIterator(b *testing.B) {
+
+	serverEntryCount := 10000
+
+	encodedServerEntries := make([]string, serverEntryCount)
+	for i := 0; i < serverEntryCount; i++ {
+		encodedServerEntries[i] = makeTestEncodedServerEntry(b, i, 0, "")
+	}
+	encodedServerEntryList := strings.Join(encodedServerEntries, "\n")
+
+	for _, cacheSize := range []int{0, serverEntryCount} {
+		b.Run(fmt.Sprintf("cache size %d", cacheSize), func(b *testing.B) {
+
+			clientConfig, cleanup := openTestServerEntryDataStore(b, 100)
+			defer cleanup()
+
+			applyParameters := make(map[string]interface{})
+			applyParameters[parameters.ServerEntryCacheSize] = cacheSize
+			err := clientConfig.SetClientParameters("", true, applyParameters)
+			if err != nil {
+				b.Fatalf("SetClientParameters failed: %s", err)
+			}
+
+			err = StreamingStoreServerEntries(
+				clientConfig,
+				protocol.NewStreamingServerEntryDecoder(
+					strings.NewReader(encodedServerEntryList),
+					common.GetCurrentTimestamp(),
+					protocol.SERVER_ENTRY_SOURCE_REMOTE),
+				true)
+			if err != nil {
+				b.Fatalf("StreamingStoreServerEntries failed: %s", err)
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, iterator, err := NewServerEntryIterator(clientConfig)
+				if err != nil {
+					b.Fatalf("NewServerEntryIterator failed: %s", err)
+				}
+				for {
+					serverEntry, err := iterator.Next()
+					if err != nil {
+						b.Fatalf("ServerEntryIterator.Next failed: %s", err)
+					}
+					if serverEntry == nil {
+						break
+					}
+				}
+				iterator.Close()
+			}
+		})
+	}
+}
+
+func openTestServerEntryDataStore(tb testing.TB, batchSize int) (*Config, func()) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-entry-import-test")
+	if err != nil {
+		tb.Fatalf("TempDir failed: %s", err)
+	}
+
+	SetNoticeWriter(ioutil.Discard)
+
+	clientConfig := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   testDataDirName,
+	}
+
+	err = clientConfig.Commit()
+	if err != nil {
+		os.RemoveAll(testDataDirName)
+		tb.Fatalf("error committing configuration file: %s", err)
+	}
+
+	applyParameters := make(map[string]interface{})
+	applyParameters[parameters.ServerEntryImportBatchSize] = batchSize
+	err = clientConfig.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		os.RemoveAll(testDataDirName)
+		tb.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		os.RemoveAll(testDataDirName)
+		tb.Fatalf("error initializing client datastore: %s", err)
+	}
+
+	return clientConfig, func() {
+		CloseDataStore()
+		os.RemoveAll(testDataDirName)
+	}
+}
+
+func makeTestEncodedServerEntry(
+	tb testing.TB, index, configurationVersion int, tag string) string {
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:            fmt.Sprintf("192.168.%d.%d", index/256, index%256),
+			WebServerPort:        "8000",
+			WebServerSecret:      tag,
+			ConfigurationVersion: configurationVersion,
+		})
+	if err != nil {
+		tb.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	return encodedServerEntry
+}
+
+func getTestServerEntry(t *testing.T, index int) *protocol.ServerEntry {
+
+	var serverEntry *protocol.ServerEntry
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		data := tx.bucket(datastoreServerEntriesBucket).get(
+			[]byte(fmt.Sprintf("192.168.%d.%d", index/256, index%256)))
+		if data == nil {
+			return fmt.Errorf("server entry not found")
+		}
+		return json.Unmarshal(data, &serverEntry)
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+
+	return serverEntry
+}
+
+type errorReader struct {
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, errors.New("interrupted")
+}
+
+func TestResumableStreamingStoreServerEntries(t *testing.T) {
+
+	batchSize := 3
+
+	clientConfig, cleanup := openTestServerEntryDataStore(t, batchSize)
+	defer cleanup()
+
+	serverEntryCount := 10
+	interruptCount := 7
+
+	encodedServerEntries := make([]string, serverEntryCount)
+	for i := 0; i < serverEntryCount; i++ {
+		encodedServerEntries[i] = makeTestEncodedServerEntry(t, i, 0, "")
+	}
+
+	resumeID := "test"
+
+	importEntries := func(
+		reader io.Reader) ([]ServerEntryImportProgress, error) {
+
+		var progress []ServerEntryImportProgress
+		err := StreamingStoreServerEntriesWithProgress(
+			clientConfig,
+			protocol.NewStreamingServerEntryDecoder(
+				reader,
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_REMOTE),
+			false,
+			resumeID,
+			func(p ServerEntryImportProgress) {
+				progress = append(progress, p)
+			})
+		return progress, err
+	}
+
+	// Test: interrupted import stores complete batches and reports progress
+
+	progress, err := importEntries(
+		io.MultiReader(
+			strings.NewReader(
+				strings.Join(encodedServerEntries[:interruptCount], "\n")+"\n"),
+			&errorReader{}))
+	if err == nil {
+		t.Fatalf("unexpected import success")
+	}
+
+	expectedProgress := []ServerEntryImportProgress{
+		{Processed: 3, Stored: 3, Skipped: 0},
+		{Processed: 6, Stored: 6, Skipped: 0},
+	}
+	if !reflect.DeepEqual(progress, expectedProgress) {
+		t.Fatalf("unexpected progress: %+v", progress)
+	}
+
+	if CountServerEntries() != 6 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Test: resumed import skips previously imported entries
+
+	progress, err = importEntries(
+		strings.NewReader(strings.Join(encodedServerEntries, "\n")))
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntriesWithProgress failed: %s", err)
+	}
+
+	expectedProgress = []ServerEntryImportProgress{
+		{Processed: 9, Stored: 3, Skipped: 0, Resumed: 6},
+		{Processed: 10, Stored: 4, Skipped: 0, Resumed: 6},
+	}
+	if !reflect.DeepEqual(progress, expectedProgress) {
+		t.Fatalf("unexpected progress: %+v", progress)
+	}
+
+	if CountServerEntries() != serverEntryCount {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Test: completed import deletes the checkpoint, so a rerun processes all
+	// entries, which are skipped as already stored
+
+	progress, err = importEntries(
+		strings.NewReader(strings.Join(encodedServerEntries, "\n")))
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntriesWithProgress failed: %s", err)
+	}
+
+	if len(progress) == 0 ||
+		progress[len(progress)-1] != (ServerEntryImportProgress{
+			Processed: 10, Stored: 0, Skipped: 10, Resumed: 0}) {
+		t.Fatalf("unexpected progress: %+v", progress)
+	}
+
+	// Test: a checkpoint which doesn't match the input is discarded
+
+	_, err = importEntries(
+		io.MultiReader(
+			strings.NewReader(
+				strings.Join(encodedServerEntries[:interruptCount], "\n")+"\n"),
+			&errorReader{}))
+	if err == nil {
+		t.Fatalf("unexpected import success")
+	}
+
+	reversedServerEntries := make([]string, serverEntryCount)
+	for i := 0; i < serverEntryCount; i++ {
+		reversedServerEntries[i] = encodedServerEntries[serverEntryCount-1-i]
+	}
+
+	_, err = importEntries(
+		strings.NewReader(strings.Join(reversedServerEntries, "\n")))
+	if err == nil {
+		t.Fatalf("unexpected import success")
+	}
+
+	progress, err = importEntries(
+		strings.NewReader(strings.Join(reversedServerEntries, "\n")))
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntriesWithProgress failed: %s", err)
+	}
+
+	if len(progress) == 0 ||
+		progress[len(progress)-1].Processed != serverEntryCount {
+		t.Fatalf("unexpected progress: %+v", progress)
+	}
+}
+
+func TestGetServerEntriesByFreshness(t *testing.T) {
+
+	_, cleanup := openTestServerEntryDataStore(t, 100)
+	defer cleanup()
+
+	now := time.Now()
+
+	// The expected order is most recent first, with the malformed and missing
+	// timestamps last, in stored order.
+	timestamps := []string{
+		protocol.FormatServerEntryTimestamp(now.Add(-2 * time.Hour)),
+		"malformed",
+		protocol.FormatServerEntryTimestamp(now),
+		"",
+		protocol.FormatServerEntryTimestamp(now.Add(-1 * time.Hour)),
+	}
+	expectedOrder := []int{2, 4, 0, 1, 3}
+
+	for i, timestamp := range timestamps {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			makeTestEncodedServerEntry(t, i, 0, ""),
+			timestamp,
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	serverEntries, err := GetServerEntriesByFreshness()
+	if err != nil {
+		t.Fatalf("GetServerEntriesByFreshness failed: %s", err)
+	}
+
+	if len(serverEntries) != len(expectedOrder) {
+		t.Fatalf("unexpected server entry count: %d", len(serverEntries))
+	}
+
+	for i, index := range expectedOrder {
+		expectedIPAddress := fmt.Sprintf("192.168.%d.%d", index/256, index%256)
+		if serverEntries[i].IpAddress != expectedIPAddress {
+			t.Fatalf("unexpected server entry %d: %s", i, serverEntries[i].IpAddress)
+		}
+	}
+}
+
+func TestTacticsStorerSpeedTestSamples(t *testing.T) {
+
+	_, cleanup := openTestServerEntryDataStore(t, 0)
+	defer cleanup()
+
+	storer := GetTacticsStorer()
+	networkID := "NETWORK1"
+
+	record, err := json.Marshal(make([]tactics.SpeedTestSample, 5))
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	err = storer.SetSpeedTestSamplesRecord(networkID, record)
+	if err != nil {
+		t.Fatalf("SetSpeedTestSamplesRecord failed: %s", err)
+	}
+
+	count, err := storer.CountSpeedTestSamples(networkID)
+	if err != nil {
+		t.Fatalf("CountSpeedTestSamples failed: %s", err)
+	}
+	if count != 5 {
+		t.Fatalf("unexpected speed test samples count: %d", count)
+	}
+
+	err = storer.TrimSpeedTestSamples(networkID, 2)
+	if err != nil {
+		t.Fatalf("TrimSpeedTestSamples failed: %s", err)
+	}
+
+	count, err = storer.CountSpeedTestSamples(networkID)
+	if err != nil {
+		t.Fatalf("CountSpeedTestSamples failed: %s", err)
+	}
+	if count != 2 {
+		t.Fatalf("unexpected speed test samples count: %d", count)
+	}
+}
@@ -50,7 +50,8 @@ import (
 // MeekResolvedIPAddress is set asynchronously, as it is not known until the
 // dial process has begun. The atomic.Value will contain a string, initialized
 // to "", and set to the resolved IP address once that part of the dial
-// process has completed.
+// process has completed. Similarly, TLSVersion is set to the negotiated TLS
+// version name once the meek HTTPS pre-dial has completed.
 //
 // DialParameters is not safe for concurrent use.
 type DialParameters struct {
@@ -92,6 +93,7 @@ type DialParameters struct {
 	SelectedTLSProfile       bool
 	TLSProfile               string
 	RandomizedTLSProfileSeed *prng.Seed
+	TLSVersion               atomic.Value `json:"-"`
 
 	QUICVersion               string
 	QUICDialSNIAddress        string
@@ -503,9 +505,14 @@ func MakeDialParameters(
 		FragmentorConfig:              fragmentor.NewUpstreamConfig(p, dialParams.TunnelProtocol, dialParams.FragmentorSeed),
 	}
 
-	// Unconditionally initialize MeekResolvedIPAddress, so a valid string can
-	// always be read.
+	if config.UseCustomDialer(dialParams.TunnelProtocol) {
+		dialParams.dialConfig.CustomDialer = config.CustomDialer
+	}
+
+	// Unconditionally initialize MeekResolvedIPAddress and TLSVersion, so a
+	// valid string can always be read.
 	dialParams.MeekResolvedIPAddress.Store("")
+	dialParams.TLSVersion.Store("")
 
 	if protocol.TunnelProtocolUsesMeek(dialParams.TunnelProtocol) {
 
@@ -534,6 +541,10 @@ func MakeDialParameters(
 			dialParams.MeekResolvedIPAddress.Store(IPAddress)
 		}
 
+		dialParams.meekConfig.NegotiatedTLSVersionCallback = func(version uint16) {
+			dialParams.TLSVersion.Store(TLSVersionName(version))
+		}
+
 		if isTactics {
 			dialParams.meekConfig.RoundTripperOnly = true
 		}
@@ -610,6 +621,10 @@ func getConfigStateHash(
 	// TODO: add config.CustomHeaders, which could impact User-Agent header?
 
 	hash.Write([]byte(config.UpstreamProxyURL))
+	hash.Write([]byte(config.CustomDialer))
+	for _, tunnelProtocol := range config.CustomDialerTunnelProtocols {
+		hash.Write([]byte(tunnelProtocol))
+	}
 
 	return hash.Sum(nil)
 }
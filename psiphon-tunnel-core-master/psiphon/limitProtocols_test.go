@@ -35,6 +35,14 @@ import (
 )
 
 func TestLimitTunnelProtocols(t *testing.T) {
+	testLimitTunnelProtocols(t, false)
+}
+
+func TestDisableInitialLimitTunnelProtocols(t *testing.T) {
+	testLimitTunnelProtocols(t, true)
+}
+
+func testLimitTunnelProtocols(t *testing.T, disableInitialLimitTunnelProtocols bool) {
 
 	testDataDirName, err := ioutil.TempDir("", "psiphon-limit-tunnel-protocols-test")
 	if err != nil {
@@ -78,7 +86,13 @@ func TestLimitTunnelProtocols(t *testing.T) {
 				// checking of notice order is performed only up to 90% of
 				// InitialLimitTunnelProtocolsCandidateCount.
 
-				if initialConnectingCount <= (initialLimitTunnelProtocolsCandidateCount*9)/10 {
+				if disableInitialLimitTunnelProtocols {
+
+					if !common.Contains(limitTunnelProtocols, protocol) {
+						t.Fatalf("unexpected protocol: %s (%d %+v)", protocol, connectingCount, limitTunnelProtocols)
+					}
+
+				} else if initialConnectingCount <= (initialLimitTunnelProtocolsCandidateCount*9)/10 {
 
 					var expectedProtocols []string
 					if connectingCount <= initialLimitTunnelProtocolsCandidateCount {
@@ -108,6 +122,7 @@ func TestLimitTunnelProtocols(t *testing.T) {
 	}
 
 	clientConfig.DataStoreDirectory = testDataDirName
+	clientConfig.DisableInitialLimitTunnelProtocols = disableInitialLimitTunnelProtocols
 
 	err = clientConfig.Commit()
 	if err != nil {
@@ -182,6 +197,24 @@ func TestLimitTunnelProtocols(t *testing.T) {
 		t.Fatalf("error creating client controller: %s", err)
 	}
 
+	expectedInitialCount := 0
+	expectedCount := 0
+	for i := 0; i < 1000; i++ {
+		tunnelProtocol := protocol.SupportedTunnelProtocols[i%len(protocol.SupportedTunnelProtocols)]
+		if common.Contains(initialLimitTunnelProtocols, tunnelProtocol) {
+			expectedInitialCount += 1
+		}
+		if common.Contains(limitTunnelProtocols, tunnelProtocol) {
+			expectedCount += 1
+		}
+	}
+
+	initialCount, count := controller.CountCandidateServers()
+
+	if initialCount != expectedInitialCount || count != expectedCount {
+		t.Fatalf("unexpected candidate server counts: %d/%d", initialCount, count)
+	}
+
 	ctx, cancelFunc := context.WithCancel(context.Background())
 
 	controllerWaitGroup := new(sync.WaitGroup)
@@ -200,7 +233,11 @@ func TestLimitTunnelProtocols(t *testing.T) {
 
 	t.Logf("initial-connecting and connecting count: %d/%d", initialConnectingCount, connectingCount)
 
-	if initialConnectingCount != initialLimitTunnelProtocolsCandidateCount {
+	if disableInitialLimitTunnelProtocols {
+		if initialConnectingCount != 0 {
+			t.Fatalf("unexpected initial-connecting count")
+		}
+	} else if initialConnectingCount != initialLimitTunnelProtocolsCandidateCount {
 		t.Fatalf("unexpected initial-connecting count")
 	}
 
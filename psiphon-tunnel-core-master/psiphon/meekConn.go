@@ -107,6 +107,11 @@ type MeekConfig struct {
 	// tunnel protocol.
 	ClientTunnelProtocol string
 
+	// NegotiatedTLSVersionCallback, when set, is called with the TLS
+	// version negotiated by the initial HTTPS connection. This value is
+	// used for stats reporting.
+	NegotiatedTLSVersionCallback func(version uint16)
+
 	// RoundTripperOnly sets the MeekConn to operate in round tripper
 	// mode, which is used for untunneled tactics requests. In this
 	// mode, a connection is established to the meek server as usual,
@@ -252,7 +257,10 @@ func DialMeek(
 			RandomizedTLSProfileSeed:      meekConfig.RandomizedTLSProfileSeed,
 			TrustedCACertificatesFilename: dialConfig.TrustedCACertificatesFilename,
 		}
-		tlsConfig.EnableClientSessionCache(meekConfig.ClientParameters)
+		err := tlsConfig.EnableClientSessionCache(meekConfig.ClientParameters)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 
 		if meekConfig.UseObfuscatedSessionTickets {
 			tlsConfig.ObfuscatedSessionTicketKey = meekConfig.MeekObfuscatedKey
@@ -306,6 +314,11 @@ func DialMeek(
 
 		cachedTLSDialer = newCachedTLSDialer(preConn, tlsDialer)
 
+		if meekConfig.NegotiatedTLSVersionCallback != nil {
+			meekConfig.NegotiatedTLSVersionCallback(
+				GetTLSConnNegotiatedVersion(preConn))
+		}
+
 		if IsTLSConnUsingHTTP2(preConn) {
 			NoticeInfo("negotiated HTTP/2 for %s", meekConfig.DialAddress)
 			transport = &http2.Transport{
@@ -88,6 +88,14 @@ type DialConfig struct {
 	// FragmentorConfig specifies whether to layer a fragmentor.Conn on top
 	// of dialed TCP conns, and the fragmentation configuration to use.
 	FragmentorConfig *fragmentor.Config
+
+	// CustomDialer specifies the name of a custom dialer, registered with
+	// RegisterCustomDialer, to dial TCP conns through. The custom dialer is
+	// layered on top of the standard TCP dial, including any upstream proxy
+	// and fragmentor.
+	//
+	// CustomDialer is not used by UDPDial.
+	CustomDialer string
 }
 
 // NetworkConnectivityChecker defines the interface to the external
@@ -232,19 +240,73 @@ func WaitForNetworkConnectivity(
 // when we need to ensure that a DNS connection is tunneled.
 // Caller must set timeouts or interruptibility as required for conn.
 func ResolveIP(host string, conn net.Conn) (addrs []net.IP, ttls []time.Duration, err error) {
+	return ResolveIPWithRetry(host, conn, 0, 0)
+}
+
+// ResolveIPWithRetry is ResolveIP with a per-attempt timeout and retries.
+// When timeout is > 0, a read deadline of timeout is set for each attempt
+// and, when an attempt times out, the DNS query is resent, up to
+// retryCount times, before giving up. This accommodates dropped requests
+// or responses on lossy links. Other errors are not retried. Responses
+// which don't match the query ID, such as late responses to earlier
+// attempts, are discarded.
+//
+// Retries only help with datagram conns, where a request or response may be
+// dropped. Resending a query over a stream conn, such as a tunneled TCP port
+// forward, is pointless, so retryCount is ignored for any conn other than a
+// *net.UDPConn; callers should instead retry with a fresh conn, as
+// tunneledLookupIP does. For conns which don't support deadlines, such as SSH
+// channel conns, the conn is instead closed once timeout elapses.
+func ResolveIPWithRetry(
+	host string,
+	conn net.Conn,
+	timeout time.Duration,
+	retryCount int) (addrs []net.IP, ttls []time.Duration, err error) {
+
+	// As in dns.Conn, any net.Conn but *net.UDPConn uses DNS-over-TCP.
+	if _, ok := conn.(*net.UDPConn); !ok {
+		retryCount = 0
+	}
 
-	// Send the DNS query
 	dnsConn := &dns.Conn{Conn: conn}
 	defer dnsConn.Close()
 	query := new(dns.Msg)
 	query.SetQuestion(dns.Fqdn(host), dns.TypeA)
 	query.RecursionDesired = true
-	dnsConn.WriteMsg(query)
 
-	// Process the response
-	response, err := dnsConn.ReadMsg()
-	if err != nil {
-		return nil, nil, common.ContextError(err)
+	var response *dns.Msg
+
+	for attempt := 0; ; attempt++ {
+
+		if timeout > 0 {
+			err = conn.SetReadDeadline(time.Now().Add(timeout))
+			if err != nil {
+				// Deadlines aren't supported. Since retryCount is 0 for
+				// all but *net.UDPConn, which does support deadlines,
+				// there's only one attempt to bound.
+				timer := time.AfterFunc(timeout, func() { conn.Close() })
+				defer timer.Stop()
+			}
+		}
+
+		// Send the DNS query
+		dnsConn.WriteMsg(query)
+
+		// Process the response
+		for {
+			response, err = dnsConn.ReadMsg()
+			if err != nil || response.Id == query.Id {
+				break
+			}
+		}
+
+		if err == nil {
+			break
+		}
+
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() || attempt >= retryCount {
+			return nil, nil, common.ContextError(err)
+		}
 	}
 	addrs = make([]net.IP, 0)
 	ttls = make([]time.Duration, 0)
@@ -283,7 +345,10 @@ func MakeUntunneledHTTPClient(
 		SkipVerify:                    skipVerify,
 		TrustedCACertificatesFilename: untunneledDialConfig.TrustedCACertificatesFilename,
 	}
-	tlsConfig.EnableClientSessionCache(config.clientParameters)
+	err := tlsConfig.EnableClientSessionCache(config.clientParameters)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
 
 	tlsDialer := NewCustomTLSDialer(tlsConfig)
 
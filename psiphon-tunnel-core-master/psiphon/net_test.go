@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+)
+
+func TestResolveIPWithRetry(t *testing.T) {
+
+	testCases := []struct {
+		name          string
+		dropCount     int
+		retryCount    int
+		expectSuccess bool
+	}{
+		{"no drops, no retries", 0, 0, true},
+		{"dropped first response, retry", 1, 1, true},
+		{"dropped first response, no retries", 1, 0, false},
+		{"dropped all responses, retries exhausted", 3, 2, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+
+			serverAddress, stopServer, err := startTestDNSServer(testCase.dropCount)
+			if err != nil {
+				t.Fatalf("startTestDNSServer failed: %s", err)
+			}
+			defer stopServer()
+
+			conn, err := net.Dial("udp", serverAddress)
+			if err != nil {
+				t.Fatalf("Dial failed: %s", err)
+			}
+			defer conn.Close()
+
+			addrs, ttls, err := ResolveIPWithRetry(
+				"example.com", conn, 100*time.Millisecond, testCase.retryCount)
+
+			if !testCase.expectSuccess {
+				if err == nil {
+					t.Fatalf("ResolveIPWithRetry unexpectedly succeeded")
+				}
+				if !strings.Contains(err.Error(), "timeout") {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ResolveIPWithRetry failed: %s", err)
+			}
+			if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("192.0.2.1")) {
+				t.Fatalf("unexpected addrs: %v", addrs)
+			}
+			if len(ttls) != 1 || ttls[0] != 60*time.Second {
+				t.Fatalf("unexpected ttls: %v", ttls)
+			}
+		})
+	}
+}
+
+func TestResolveIPWithoutDeadlines(t *testing.T) {
+
+	testCases := []struct {
+		name          string
+		respond       bool
+		expectSuccess bool
+	}{
+		{"response", true, true},
+		{"no response", false, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+
+			clientConn, serverConn := net.Pipe()
+			defer serverConn.Close()
+
+			go func() {
+				dnsConn := &dns.Conn{Conn: serverConn}
+				query, err := dnsConn.ReadMsg()
+				if err != nil || !testCase.respond {
+					return
+				}
+				dnsConn.WriteMsg(makeTestDNSResponse(query))
+			}()
+
+			timeout := 100 * time.Millisecond
+
+			startTime := time.Now()
+
+			// The retry count is ignored for stream conns, so a failed
+			// attempt is expected to take only one timeout period.
+			addrs, _, err := ResolveIPWithRetry(
+				"example.com", &noDeadlineConn{Conn: clientConn}, timeout, 2)
+
+			if !testCase.expectSuccess {
+				if err == nil {
+					t.Fatalf("ResolveIPWithRetry unexpectedly succeeded")
+				}
+				if time.Since(startTime) > 2*timeout {
+					t.Fatalf("unexpected elapsed time: %s", time.Since(startTime))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ResolveIPWithRetry failed: %s", err)
+			}
+			if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("192.0.2.1")) {
+				t.Fatalf("unexpected addrs: %v", addrs)
+			}
+		})
+	}
+}
+
+func TestTunneledLookupIPRetry(t *testing.T) {
+
+	testCases := []struct {
+		name          string
+		dropCount     int
+		retryCount    int
+		expectSuccess bool
+		expectedDials int
+	}{
+		{"no drops, no retries", 0, 0, true, 1},
+		{"dropped first response, retry", 1, 1, true, 2},
+		{"dropped first response, no retries", 1, 0, false, 1},
+		{"dropped all responses, retries exhausted", 3, 2, false, 3},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+
+			tunneler := &testDNSTunneler{dropCount: testCase.dropCount}
+
+			addr, ttl, err := tunneledLookupIP(
+				"192.0.2.53",
+				tunneler,
+				"example.com",
+				100*time.Millisecond,
+				testCase.retryCount)
+
+			if tunneler.dialCount != testCase.expectedDials {
+				t.Fatalf("unexpected dial count: %d", tunneler.dialCount)
+			}
+
+			if !testCase.expectSuccess {
+				if err == nil {
+					t.Fatalf("tunneledLookupIP unexpectedly succeeded")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("tunneledLookupIP failed: %s", err)
+			}
+			if !addr.Equal(net.ParseIP("192.0.2.1")) || ttl != 60*time.Second {
+				t.Fatalf("unexpected result: %s, %s", addr, ttl)
+			}
+		})
+	}
+}
+
+// testDNSTunneler is a Tunneler which, like a tunnel, dials DNS port
+// forwards that don't support deadlines. The DNS server at the other end of
+// each port forward drops the queries sent over the first dropCount port
+// forwards.
+type testDNSTunneler struct {
+	dropCount int
+	dialCount int
+}
+
+func (tunneler *testDNSTunneler) Dial(
+	_ string, _ bool, _ net.Conn) (net.Conn, error) {
+
+	tunneler.dialCount++
+	respond := tunneler.dialCount > tunneler.dropCount
+
+	clientConn, serverConn := net.Pipe()
+
+	go func() {
+		defer serverConn.Close()
+		dnsConn := &dns.Conn{Conn: serverConn}
+		query, err := dnsConn.ReadMsg()
+		if err != nil {
+			return
+		}
+		if !respond {
+			// Hold the query until the client gives up.
+			dnsConn.ReadMsg()
+			return
+		}
+		dnsConn.WriteMsg(makeTestDNSResponse(query))
+	}()
+
+	return &noDeadlineConn{Conn: clientConn}, nil
+}
+
+func (tunneler *testDNSTunneler) DirectDial(_ string) (net.Conn, error) {
+	return nil, errors.New("not supported")
+}
+
+func (tunneler *testDNSTunneler) SignalComponentFailure() {
+}
+
+// noDeadlineConn is a net.Conn which, like an SSH channel conn, doesn't
+// support deadlines.
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (conn *noDeadlineConn) SetDeadline(_ time.Time) error {
+	return errors.New("deadline not supported")
+}
+
+func (conn *noDeadlineConn) SetReadDeadline(_ time.Time) error {
+	return errors.New("deadline not supported")
+}
+
+func (conn *noDeadlineConn) SetWriteDeadline(_ time.Time) error {
+	return errors.New("deadline not supported")
+}
+
+// startTestDNSServer runs a UDP DNS server which drops the first dropCount
+// queries and answers subsequent A queries with 192.0.2.1.
+func startTestDNSServer(dropCount int) (string, func(), error) {
+
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return "", nil, err
+	}
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := serverConn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if dropCount > 0 {
+				dropCount--
+				continue
+			}
+			query := new(dns.Msg)
+			if query.Unpack(buffer[:n]) != nil || len(query.Question) != 1 {
+				continue
+			}
+			packet, err := makeTestDNSResponse(query).Pack()
+			if err != nil {
+				continue
+			}
+			serverConn.WriteToUDP(packet, addr)
+		}
+	}()
+
+	return serverConn.LocalAddr().String(), func() { serverConn.Close() }, nil
+}
+
+// makeTestDNSResponse answers an A query with 192.0.2.1.
+func makeTestDNSResponse(query *dns.Msg) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   query.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.ParseIP("192.0.2.1"),
+	})
+	return response
+}
@@ -452,6 +452,11 @@ func noticeWithDialParameters(noticeType string, dialParams *DialParameters) {
 		args = append(args, "TLSProfile", dialParams.TLSProfile)
 	}
 
+	TLSVersion := dialParams.TLSVersion.Load().(string)
+	if TLSVersion != "" {
+		args = append(args, "TLSVersion", TLSVersion)
+	}
+
 	if dialParams.DialPortNumber != "" {
 		args = append(args, "dialPortNumber", dialParams.DialPortNumber)
 	}
@@ -512,6 +517,16 @@ func NoticeActiveTunnel(ipAddress, protocol string, isTCS bool) {
 		"isTCS", isTCS)
 }
 
+// NoticeServerAffinityReset indicates that the server entry filter has
+// changed since the last successful tunnel, so server affinity is not
+// applied. Currently, the filter consists only of the egress region.
+func NoticeServerAffinityReset(previousEgressRegion, egressRegion string) {
+	singletonNoticeLogger.outputNotice(
+		"ServerAffinityReset", noticeIsDiagnostic,
+		"previousEgressRegion", previousEgressRegion,
+		"egressRegion", egressRegion)
+}
+
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort
 func NoticeSocksProxyPortInUse(port int) {
 	singletonNoticeLogger.outputNotice(
@@ -664,6 +679,23 @@ func NoticeTotalBytesTransferred(ipAddress string, sent, received int64) {
 		"received", received)
 }
 
+// NoticePeriodicMetrics reports a sample of tunnel performance over the
+// preceding period: the number of active tunnels, the tunneled bytes
+// transferred, and the number of tunnel handshakes completed. This is not
+// a diagnostic notice: the user app has requested this notice with
+// EmitPeriodicMetricsPeriodMilliseconds.
+func NoticePeriodicMetrics(
+	period time.Duration, activeTunnels int, sent, received, handshakes int64) {
+
+	singletonNoticeLogger.outputNotice(
+		"PeriodicMetrics", 0,
+		"periodMilliseconds", int64(period/time.Millisecond),
+		"activeTunnels", activeTunnels,
+		"sent", sent,
+		"received", received,
+		"handshakes", handshakes)
+}
+
 // NoticeLocalProxyError reports a local proxy error message. Repetitive
 // errors for a given proxy type are suppressed.
 func NoticeLocalProxyError(proxyType string, err error) {
@@ -730,6 +762,16 @@ func NoticeServerTimestamp(timestamp string) {
 		"timestamp", timestamp)
 }
 
+// NoticeTunnelExhausted reports that the server has indicated that the
+// tunnel's traffic rules byte budget is exhausted and that the tunnel will be
+// closed by the server after the grace period.
+func NoticeTunnelExhausted(ipAddress string, gracePeriod time.Duration) {
+	singletonNoticeLogger.outputNotice(
+		"TunnelExhausted", 0,
+		"ipAddress", ipAddress,
+		"gracePeriod", gracePeriod)
+}
+
 // NoticeActiveAuthorizationIDs reports the authorizations the server has accepted.
 // Each ID is a base64-encoded accesscontrol.Authorization.ID value.
 func NoticeActiveAuthorizationIDs(activeAuthorizationIDs []string) {
@@ -744,6 +786,17 @@ func NoticeActiveAuthorizationIDs(activeAuthorizationIDs []string) {
 		"IDs", activeAuthorizationIDs)
 }
 
+// NoticeUnthrottledBytesRemaining reports the number of bytes the client may
+// read and write, as reported by the server in the handshake, before the
+// server's rate limits take effect. Both values are 0 when no unthrottled
+// byte budget applies or when the server doesn't report the budget.
+func NoticeUnthrottledBytesRemaining(readBytes, writeBytes int64) {
+	singletonNoticeLogger.outputNotice(
+		"UnthrottledBytesRemaining", 0,
+		"readBytes", readBytes,
+		"writeBytes", writeBytes)
+}
+
 func NoticeBindToDevice(deviceInfo string) {
 	outputRepetitiveNotice(
 		"BindToDevice", deviceInfo, 0,
@@ -764,6 +817,15 @@ func NoticeLivenessTest(ipAddress string, metrics *livenessTestMetrics, success
 		"success", success)
 }
 
+// NoticeDatastorePeakMemoryEstimate reports a new peak estimated memory, in
+// bytes, used by a batched datastore operation. See
+// GetDataStorePeakMemoryEstimate.
+func NoticeDatastorePeakMemoryEstimate(peakEstimate int64) {
+	singletonNoticeLogger.outputNotice(
+		"DatastorePeakMemoryEstimate", noticeIsDiagnostic,
+		"bytes", peakEstimate)
+}
+
 // NoticeEstablishTunnelTimeout reports that the configured EstablishTunnelTimeout
 // duration was exceeded.
 func NoticeEstablishTunnelTimeout(timeout time.Duration) {
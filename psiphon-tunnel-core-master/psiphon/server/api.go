@@ -39,10 +39,6 @@ import (
 const (
 	MAX_API_PARAMS_SIZE = 256 * 1024 // 256KB
 	PADDING_MAX_BYTES   = 16 * 1024
-
-	CLIENT_PLATFORM_ANDROID = "Android"
-	CLIENT_PLATFORM_WINDOWS = "Windows"
-	CLIENT_PLATFORM_IOS     = "iOS"
 )
 
 // sshAPIRequestHandler routes Psiphon API requests transported as
@@ -200,8 +196,8 @@ func handshakeAPIRequestHandler(
 	sponsorID, _ := getStringRequestParam(params, "sponsor_id")
 	clientVersion, _ := getStringRequestParam(params, "client_version")
 	clientPlatform, _ := getStringRequestParam(params, "client_platform")
-	isMobile := isMobileClientPlatform(clientPlatform)
-	normalizedPlatform := normalizeClientPlatform(clientPlatform)
+	normalizedPlatform, formFactor := protocol.NormalizeClientPlatform(clientPlatform)
+	isMobile := formFactor == protocol.CLIENT_PLATFORM_FORM_FACTOR_MOBILE
 
 	var authorizations []string
 	if params[protocol.PSIPHON_API_HANDSHAKE_AUTHORIZATIONS] != nil {
@@ -215,6 +211,9 @@ func handshakeAPIRequestHandler(
 	db := support.PsinetDatabase
 
 	httpsRequestRegexes := db.GetHttpsRequestRegexes(sponsorID)
+	if support.TrafficRulesSet.IsHttpsRequestRegexesDisabled(sponsorID) {
+		httpsRequestRegexes = make([]map[string]string, 0)
+	}
 
 	// Flag the SSH client as having completed its handshake. This
 	// may reselect traffic rules and starts allowing port forwards.
@@ -235,6 +234,20 @@ func handshakeAPIRequestHandler(
 		return nil, common.ContextError(err)
 	}
 
+	// Report the unthrottled byte budget of the traffic rules selected for
+	// the handshaked client, so that the client may display it. This value
+	// is informational only, so a failure to get it doesn't fail the
+	// handshake; 0 is reported instead.
+
+	readUnthrottledBytesRemaining, writeUnthrottledBytesRemaining, err :=
+		support.TunnelServer.GetClientUnthrottledBytesRemaining(sessionID)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"get unthrottled bytes remaining failed")
+		readUnthrottledBytesRemaining = 0
+		writeUnthrottledBytesRemaining = 0
+	}
+
 	tacticsPayload, err := support.TacticsServer.GetTacticsPayload(
 		common.GeoIPData(geoIPData), params)
 	if err != nil {
@@ -294,12 +307,15 @@ func handshakeAPIRequestHandler(
 		UpgradeClientVersion:   db.GetUpgradeClientVersion(clientVersion, normalizedPlatform),
 		PageViewRegexes:        make([]map[string]string, 0),
 		HttpsRequestRegexes:    httpsRequestRegexes,
-		EncodedServerList:      db.DiscoverServers(geoIPData.DiscoveryValue),
+		EncodedServerList:      db.DiscoverServers(geoIPData.DiscoveryValue, nil),
 		ClientRegion:           geoIPData.Country,
 		ServerTimestamp:        common.GetCurrentTimestamp(),
 		ActiveAuthorizationIDs: activeAuthorizationIDs,
 		TacticsPayload:         marshaledTacticsPayload,
 		Padding:                strings.Repeat(" ", pad_response),
+
+		ReadUnthrottledBytesRemaining:  readUnthrottledBytesRemaining,
+		WriteUnthrottledBytesRemaining: writeUnthrottledBytesRemaining,
 	}
 
 	responsePayload, err := json.Marshal(handshakeResponse)
@@ -639,6 +655,7 @@ var baseRequestParams = []requestParamSpec{
 	{"meek_transformed_host_name", isBooleanFlag, requestParamOptional | requestParamLogFlagAsBool},
 	{"user_agent", isAnyString, requestParamOptional},
 	{"tls_profile", isAnyString, requestParamOptional},
+	{"tls_version", isAnyString, requestParamOptional},
 	{"server_entry_region", isRegionCode, requestParamOptional},
 	{"server_entry_source", isServerEntrySource, requestParamOptional},
 	{"server_entry_timestamp", isISO8601Date, requestParamOptional},
@@ -785,6 +802,7 @@ func getRequestLogFields(
 	logFields["client_region"] = strings.Replace(geoIPData.Country, " ", "_", -1)
 	logFields["client_city"] = strings.Replace(geoIPData.City, " ", "_", -1)
 	logFields["client_isp"] = strings.Replace(geoIPData.ISP, " ", "_", -1)
+	logFields["client_asn"] = geoIPData.ASN
 
 	if len(authorizedAccessTypes) > 0 {
 		logFields["authorized_access_types"] = authorizedAccessTypes
@@ -1056,30 +1074,19 @@ func getStringArrayRequestParam(params common.APIParameters, name string) ([]str
 	return result, nil
 }
 
-// Normalize reported client platform. Android clients, for example, report
-// OS version, rooted status, and Google Play build status in the clientPlatform
-// string along with "Android".
-func normalizeClientPlatform(clientPlatform string) string {
-
-	if strings.Contains(strings.ToLower(clientPlatform), strings.ToLower(CLIENT_PLATFORM_ANDROID)) {
-		return CLIENT_PLATFORM_ANDROID
-	} else if strings.HasPrefix(clientPlatform, CLIENT_PLATFORM_IOS) {
-		return CLIENT_PLATFORM_IOS
+// getStringOrStringArrayRequestParam returns the value of a scalar string
+// param as a single element list, or the value of a string array param.
+func getStringOrStringArrayRequestParam(params common.APIParameters, name string) ([]string, error) {
+	if value, ok := params[name].(string); ok {
+		return []string{value}, nil
 	}
-
-	return CLIENT_PLATFORM_WINDOWS
+	return getStringArrayRequestParam(params, name)
 }
 
 func isAnyString(config *Config, value string) bool {
 	return true
 }
 
-func isMobileClientPlatform(clientPlatform string) bool {
-	normalizedClientPlatform := normalizeClientPlatform(clientPlatform)
-	return normalizedClientPlatform == CLIENT_PLATFORM_ANDROID ||
-		normalizedClientPlatform == CLIENT_PLATFORM_IOS
-}
-
 // Input validators follow the legacy validations rules in psi_web.
 
 func isServerSecret(config *Config, value string) bool {
@@ -20,6 +20,7 @@
 package server
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -73,6 +74,14 @@ type Config struct {
 	// unable to write any logs.
 	SkipPanickingLogWriter bool
 
+	// LogDebugSampleRate specifies the fraction, in the range
+	// [0.0, 1.0], of high volume debug logs, such as traffic
+	// rules filter checks, to emit. This allows operators to
+	// retain some verbose logs under load. A rate of 0.0 emits
+	// none of these logs. When omitted, the default, these logs
+	// are not sampled and are all emitted.
+	LogDebugSampleRate *float64
+
 	// DiscoveryValueHMACKey is the network-wide secret value
 	// used to determine a unique discovery strategy.
 	DiscoveryValueHMACKey string
@@ -85,6 +94,51 @@ type Config struct {
 	// ISP data in a separate file.
 	GeoIPDatabaseFilenames []string
 
+	// GeoIPCountryDatabaseFilename, GeoIPISPDatabaseFilename, and
+	// GeoIPASNDatabaseFilename are optional paths of GeoIP2/GeoLite2
+	// MaxMind database files which supply, respectively, only the
+	// country code and city, only the ISP, and only the ASN logged
+	// fields. These databases are queried after any
+	// GeoIPDatabaseFilenames databases and take precedence for
+	// their fields. Each database is hot reloaded independently.
+	// When a database file is missing at startup, its fields are
+	// left blank until the file is created and reloaded.
+	GeoIPCountryDatabaseFilename string
+	GeoIPISPDatabaseFilename     string
+	GeoIPASNDatabaseFilename     string
+
+	// GeoIPLookupCacheIPv4PrefixLength and
+	// GeoIPLookupCacheIPv6PrefixLength specify the client IP address
+	// prefix lengths used to key the GeoIP lookup cache. Clients within
+	// the same prefix share a cached lookup result. When 0, defaults of
+	// 24 and 48, respectively, are used.
+	GeoIPLookupCacheIPv4PrefixLength int
+	GeoIPLookupCacheIPv6PrefixLength int
+
+	// HealthCheckServerAddress is the "host:port" address on which to
+	// run an HTTP health check server, for use by load balancers and
+	// container orchestration. When blank, no health check server is
+	// run. The health check server should be bound to a private
+	// interface, distinct from the tunnel protocol listeners; see
+	// RunHealthCheckServer for the response format.
+	HealthCheckServerAddress string
+
+	// MetricsSink specifies where server_load metrics are sent. Valid
+	// values are "log", the default, which logs server_load records;
+	// and "statsd", which pushes numeric metrics as statsd gauges to
+	// MetricsSinkStatsdAddress. When "statsd" is used, server_load
+	// records are not logged.
+	MetricsSink string
+
+	// MetricsSinkStatsdAddress is the "host:port" UDP address of the
+	// statsd server used by the "statsd" MetricsSink.
+	MetricsSinkStatsdAddress string
+
+	// GeoIPLookupCacheMaxEntries specifies the maximum number of
+	// GeoIP lookup results to cache. When 0, a default of 100000 is
+	// used. When -1, GeoIP lookup results are not cached.
+	GeoIPLookupCacheMaxEntries int
+
 	// PsinetDatabaseFilename is the path of the Psiphon automation
 	// jsonpickle format Psiphon API data file.
 	PsinetDatabaseFilename string
@@ -162,6 +216,23 @@ type Config struct {
 	// run by this server instance, which use Obfuscated SSH.
 	ObfuscatedSSHKey string
 
+	// AlternateObfuscatedSSHKeys is a list of additional Obfuscated SSH
+	// keys which the server accepts, after first trying ObfuscatedSSHKey.
+	// To rotate keys, set ObfuscatedSSHKey to the new key and list the old
+	// key here until clients have the new key. Each alternate key adds the
+	// cost of a key derivation for client seed messages which don't match
+	// earlier keys. Only the Obfuscated SSH seed message accepts alternate
+	// keys; other values derived from ObfuscatedSSHKey, such as the SSH
+	// server version and the QUIC obfuscation key, use ObfuscatedSSHKey.
+	AlternateObfuscatedSSHKeys []string
+
+	// ObfuscatedSSHSeedReadTimeoutMilliseconds specifies the maximum time
+	// allowed for a client to send its complete Obfuscated SSH seed
+	// message. Clients which send a partial seed message are disconnected
+	// once the timeout elapses, rather than holding resources until the SSH
+	// handshake times out. The default, 0, is no seed message timeout.
+	ObfuscatedSSHSeedReadTimeoutMilliseconds int
+
 	// MeekCookieEncryptionPrivateKey is the NaCl private key used
 	// to decrypt meek cookie payload sent from clients. The same
 	// key is used for all meek protocols run by this server instance.
@@ -245,6 +316,16 @@ type Config struct {
 	// The default, 0, disables load logging.
 	LoadMonitorPeriodSeconds int
 
+	// SelfTestPeriodSeconds indicates how frequently to run a self-test,
+	// which makes a loopback connection to each tunnel protocol listener
+	// and performs the obfuscation and SSH key exchange, verifying the
+	// host key. Results are logged and reported, per tunnel protocol, in
+	// the server_load "self_test" metric, with 1 indicating success and 0
+	// failure. Meek, Marionette, and TapDance protocols are not tested.
+	// Tunnel protocols are tested one at a time. The default, 0, disables
+	// the self-test.
+	SelfTestPeriodSeconds int
+
 	// ProcessProfileOutputDirectory is the path of a directory to which
 	// process profiles will be written when signaled with SIGUSR2. The
 	// files are overwritten on each invocation. When set to the default
@@ -296,6 +377,69 @@ type Config struct {
 	// The default, 0 is no limit.
 	MaxConcurrentSSHHandshakes int
 
+	// MaxPendingAcceptsPerListener specifies a limit, for each tunnel
+	// protocol listener, on the number of accepted connections which have
+	// not yet completed the SSH handshake. When the limit is reached,
+	// additional connections accepted by that listener are immediately
+	// closed and counted as dropped, so that a connection flood on one
+	// tunnel protocol doesn't starve the others of handshake capacity. This
+	// limit is distinct from, and is applied before,
+	// MaxConcurrentSSHHandshakes. The limit is not applied to meek
+	// listeners, where a tunnel may span many HTTP connections.
+	// The default, 0 is no limit.
+	MaxPendingAcceptsPerListener int
+
+	// ListenerAcceptorCount specifies the number of concurrent accept
+	// goroutines to run for each plain TCP tunnel protocol listener. When
+	// the count is greater than 1 and the platform is Linux, each
+	// acceptor has its own listener socket bound with SO_REUSEPORT, and
+	// the kernel distributes accepts across cores. On other platforms,
+	// where SO_REUSEPORT doesn't distribute connections, the acceptors
+	// share one listener socket. Meek, QUIC, Marionette, and TapDance
+	// listeners always have a single acceptor. The default, 0, is a
+	// single acceptor.
+	ListenerAcceptorCount int
+
+	// TolerateListenerBindFailures specifies whether the server should
+	// start when some tunnel protocol listeners fail to bind, for example
+	// when a port is in use. When set, each failure is logged as a warning
+	// and reported in the server_load "listener_bind_failures" metric, and
+	// the server runs with the listeners that were bound; startup still
+	// fails when no listener is bound. While running with bind failures,
+	// the health check reports the server as degraded and not ready. The
+	// default, false, is to fail startup on any bind failure.
+	TolerateListenerBindFailures bool
+
+	// MaxConcurrentUDPAssociations specifies a server-wide limit on the
+	// number of concurrent udpgw UDP port forwards, across all clients.
+	// This complements the per-client traffic rules MaxUDPPortForwardCount
+	// and protects against aggregate exhaustion of server UDP sockets. When
+	// the limit is reached, new UDP port forwards are rejected; as the
+	// udpgw protocol has no error response, the client request is dropped.
+	// The default, 0 is no limit.
+	MaxConcurrentUDPAssociations int
+
+	// MaxHandshakeDurationMilliseconds specifies the maximum time allowed
+	// from accepting a client connection to completing the [obfuscated] SSH
+	// handshake, including any time spent waiting on
+	// MaxConcurrentSSHHandshakes. Clients which exceed the limit are
+	// disconnected and a "handshake timeout" is logged, which bounds
+	// resources held by slow or stalled handshakes.
+	// The default, 0, is SSH_HANDSHAKE_TIMEOUT, measured from the start of
+	// the SSH handshake and excluding time spent waiting on
+	// MaxConcurrentSSHHandshakes.
+	MaxHandshakeDurationMilliseconds int
+
+	// IdlePortForwardReaperIntervalSeconds enables a server-wide reaper
+	// which, on the specified interval, closes TCP and UDP port forwards
+	// idle for longer than the IdleTCPPortForwardTimeoutMilliseconds or
+	// IdleUDPPortForwardTimeoutMilliseconds traffic rules values in effect
+	// when each port forward was established. The reaper reports reaped and
+	// idle port forward counts in server_load metrics. Per-port forward
+	// idle timeouts remain in effect regardless of this setting.
+	// The default, 0 is no reaper.
+	IdlePortForwardReaperIntervalSeconds int
+
 	// PeriodicGarbageCollectionSeconds turns on periodic calls to runtime.GC,
 	// every specified number of seconds, to force garbage collection.
 	// The default, 0 is off.
@@ -332,11 +476,21 @@ func (config *Config) RunWebServer() bool {
 	return config.WebServerPort > 0
 }
 
+// RunHealthCheckServer indicates whether to run a health check server.
+func (config *Config) RunHealthCheckServer() bool {
+	return config.HealthCheckServerAddress != ""
+}
+
 // RunLoadMonitor indicates whether to monitor and log server load.
 func (config *Config) RunLoadMonitor() bool {
 	return config.LoadMonitorPeriodSeconds > 0
 }
 
+// RunSelfTest indicates whether to periodically run a self-test.
+func (config *Config) RunSelfTest() bool {
+	return config.SelfTestPeriodSeconds > 0
+}
+
 // RunPeriodicGarbageCollection indicates whether to run periodic garbage collection.
 func (config *Config) RunPeriodicGarbageCollection() bool {
 	return config.PeriodicGarbageCollectionSeconds > 0
@@ -355,6 +509,11 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		return nil, errors.New("ServerIPAddress is required")
 	}
 
+	if config.LogDebugSampleRate != nil &&
+		(*config.LogDebugSampleRate < 0.0 || *config.LogDebugSampleRate > 1.0) {
+		return nil, errors.New("LogDebugSampleRate must be in the range [0.0, 1.0]")
+	}
+
 	if config.WebServerPort > 0 && (config.WebServerSecret == "" || config.WebServerCertificate == "" ||
 		config.WebServerPrivateKey == "") {
 
@@ -442,6 +601,64 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		}
 	}
 
+	if config.GeoIPLookupCacheIPv4PrefixLength < 0 ||
+		config.GeoIPLookupCacheIPv4PrefixLength > 32 {
+		return nil, fmt.Errorf("GeoIPLookupCacheIPv4PrefixLength is invalid")
+	}
+
+	if config.GeoIPLookupCacheIPv6PrefixLength < 0 ||
+		config.GeoIPLookupCacheIPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("GeoIPLookupCacheIPv6PrefixLength is invalid")
+	}
+
+	if config.GeoIPLookupCacheMaxEntries < -1 {
+		return nil, fmt.Errorf("GeoIPLookupCacheMaxEntries is invalid")
+	}
+
+	if config.HealthCheckServerAddress != "" {
+		if err := validateNetworkAddress(config.HealthCheckServerAddress, false); err != nil {
+			return nil, fmt.Errorf("HealthCheckServerAddress is invalid: %s", err)
+		}
+	}
+
+	if config.MetricsSink == METRICS_SINK_STATSD {
+		if err := validateNetworkAddress(config.MetricsSinkStatsdAddress, false); err != nil {
+			return nil, fmt.Errorf("MetricsSinkStatsdAddress is invalid: %s", err)
+		}
+	} else if config.MetricsSink != "" && config.MetricsSink != METRICS_SINK_LOG {
+		return nil, fmt.Errorf("MetricsSink is invalid")
+	}
+
+	if config.MaxConcurrentUDPAssociations < 0 {
+		return nil, fmt.Errorf("MaxConcurrentUDPAssociations is invalid")
+	}
+
+	if config.SelfTestPeriodSeconds < 0 {
+		return nil, fmt.Errorf("SelfTestPeriodSeconds is invalid")
+	}
+
+	if config.MaxHandshakeDurationMilliseconds < 0 {
+		return nil, fmt.Errorf("MaxHandshakeDurationMilliseconds is invalid")
+	}
+
+	if config.ObfuscatedSSHSeedReadTimeoutMilliseconds < 0 {
+		return nil, fmt.Errorf("ObfuscatedSSHSeedReadTimeoutMilliseconds is invalid")
+	}
+
+	for _, key := range config.AlternateObfuscatedSSHKeys {
+		if key == "" {
+			return nil, fmt.Errorf("AlternateObfuscatedSSHKeys is invalid")
+		}
+	}
+
+	if config.IdlePortForwardReaperIntervalSeconds < 0 {
+		return nil, fmt.Errorf("IdlePortForwardReaperIntervalSeconds is invalid")
+	}
+
+	if config.ListenerAcceptorCount < 0 {
+		return nil, fmt.Errorf("ListenerAcceptorCount is invalid")
+	}
+
 	err = accesscontrol.ValidateVerificationKeyRing(&config.AccessControlVerificationKeyRing)
 	if err != nil {
 		return nil, fmt.Errorf(
@@ -469,6 +686,59 @@ func validateNetworkAddress(address string, requireIPaddress bool) error {
 	return nil
 }
 
+// MergeConfigJSON merges an ordered list of JSON encoded server configs
+// into a single JSON encoded server config, which may then be passed to
+// LoadConfig or RunServices. This allows a common base config to be combined
+// with per-host overrides of values such as ServerIPAddress and ports.
+//
+// Configs are merged in order, with values in later configs overriding
+// values for the same keys in earlier configs. Nested objects are merged
+// recursively; all other values, including arrays, are replaced. The merged
+// config is not validated until it is loaded.
+func MergeConfigJSON(configJSONs ...[]byte) ([]byte, error) {
+
+	if len(configJSONs) == 0 {
+		return nil, common.ContextError(errors.New("no config"))
+	}
+
+	merged := make(map[string]interface{})
+
+	for _, configJSON := range configJSONs {
+
+		// UseNumber preserves large integer values, such as byte counts,
+		// which would otherwise lose precision when decoded as float64.
+		decoder := json.NewDecoder(bytes.NewReader(configJSON))
+		decoder.UseNumber()
+
+		var config map[string]interface{}
+		err := decoder.Decode(&config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		mergeConfigObject(merged, config)
+	}
+
+	mergedJSON, err := json.Marshal(merged)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return mergedJSON, nil
+}
+
+func mergeConfigObject(dst, src map[string]interface{}) {
+	for key, srcValue := range src {
+		srcObject, srcIsObject := srcValue.(map[string]interface{})
+		dstObject, dstIsObject := dst[key].(map[string]interface{})
+		if srcIsObject && dstIsObject {
+			mergeConfigObject(dstObject, srcObject)
+		} else {
+			dst[key] = srcValue
+		}
+	}
+}
+
 // GenerateConfigParams specifies customizations to be applied to
 // a generated server config.
 type GenerateConfigParams struct {
@@ -485,6 +755,7 @@ type GenerateConfigParams struct {
 	TacticsConfigFilename       string
 	TacticsRequestPublicKey     string
 	TacticsRequestObfuscatedKey string
+	ListenerAcceptorCount       int
 }
 
 // GenerateConfig creates a new Psiphon server config. It returns JSON encoded
@@ -677,6 +948,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		OSLConfigFilename:              params.OSLConfigFilename,
 		TacticsConfigFilename:          params.TacticsConfigFilename,
 		MarionetteFormat:               params.MarionetteFormat,
+		ListenerAcceptorCount:          params.ListenerAcceptorCount,
 	}
 
 	encodedConfig, err := json.MarshalIndent(config, "\n", "    ")
@@ -0,0 +1,352 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeConfigJSON(t *testing.T) {
+
+	baseConfigJSON := `
+    {
+        "LogLevel" : "info",
+        "ServerIPAddress" : "127.0.0.1",
+        "TunnelProtocolPorts" : {"OSSH" : 1000, "SSH" : 1001},
+        "GeoIPDatabaseFilenames" : ["a", "b"],
+        "MeekProhibitedHeaders" : ["X-A"],
+        "HostID" : "base"
+    }
+    `
+
+	testCases := []struct {
+		description        string
+		overrideConfigJSON []string
+		expectedConfigJSON string
+	}{
+		{
+			"no overrides",
+			[]string{},
+			`
+            {
+                "LogLevel" : "info",
+                "ServerIPAddress" : "127.0.0.1",
+                "TunnelProtocolPorts" : {"OSSH" : 1000, "SSH" : 1001},
+                "GeoIPDatabaseFilenames" : ["a", "b"],
+                "MeekProhibitedHeaders" : ["X-A"],
+                "HostID" : "base"
+            }
+            `,
+		},
+		{
+			"scalar overrides",
+			[]string{
+				`{"ServerIPAddress" : "192.168.0.1", "HostID" : "host1"}`,
+			},
+			`
+            {
+                "LogLevel" : "info",
+                "ServerIPAddress" : "192.168.0.1",
+                "TunnelProtocolPorts" : {"OSSH" : 1000, "SSH" : 1001},
+                "GeoIPDatabaseFilenames" : ["a", "b"],
+                "MeekProhibitedHeaders" : ["X-A"],
+                "HostID" : "host1"
+            }
+            `,
+		},
+		{
+			"nested object and array overrides",
+			[]string{
+				`{"TunnelProtocolPorts" : {"OSSH" : 2000, "QUIC-OSSH" : 2001}, "GeoIPDatabaseFilenames" : ["c"]}`,
+			},
+			`
+            {
+                "LogLevel" : "info",
+                "ServerIPAddress" : "127.0.0.1",
+                "TunnelProtocolPorts" : {"OSSH" : 2000, "SSH" : 1001, "QUIC-OSSH" : 2001},
+                "GeoIPDatabaseFilenames" : ["c"],
+                "MeekProhibitedHeaders" : ["X-A"],
+                "HostID" : "base"
+            }
+            `,
+		},
+		{
+			"later overrides take precedence",
+			[]string{
+				`{"HostID" : "host1", "TunnelProtocolPorts" : {"OSSH" : 2000}}`,
+				`{"HostID" : "host2", "TunnelProtocolPorts" : {"SSH" : 3001}}`,
+			},
+			`
+            {
+                "LogLevel" : "info",
+                "ServerIPAddress" : "127.0.0.1",
+                "TunnelProtocolPorts" : {"OSSH" : 2000, "SSH" : 3001},
+                "GeoIPDatabaseFilenames" : ["a", "b"],
+                "MeekProhibitedHeaders" : ["X-A"],
+                "HostID" : "host2"
+            }
+            `,
+		},
+		{
+			"object replaces non-object and vice versa",
+			[]string{
+				`{"HostID" : {"a" : 1}, "TunnelProtocolPorts" : null}`,
+			},
+			`
+            {
+                "LogLevel" : "info",
+                "ServerIPAddress" : "127.0.0.1",
+                "TunnelProtocolPorts" : null,
+                "GeoIPDatabaseFilenames" : ["a", "b"],
+                "MeekProhibitedHeaders" : ["X-A"],
+                "HostID" : {"a" : 1}
+            }
+            `,
+		},
+		{
+			"large integer",
+			[]string{
+				`{"LoadMonitorPeriodSeconds" : 9007199254740993}`,
+			},
+			`
+            {
+                "LogLevel" : "info",
+                "ServerIPAddress" : "127.0.0.1",
+                "TunnelProtocolPorts" : {"OSSH" : 1000, "SSH" : 1001},
+                "GeoIPDatabaseFilenames" : ["a", "b"],
+                "MeekProhibitedHeaders" : ["X-A"],
+                "HostID" : "base",
+                "LoadMonitorPeriodSeconds" : 9007199254740993
+            }
+            `,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			configJSONs := [][]byte{[]byte(baseConfigJSON)}
+			for _, overrideConfigJSON := range testCase.overrideConfigJSON {
+				configJSONs = append(configJSONs, []byte(overrideConfigJSON))
+			}
+
+			mergedConfigJSON, err := MergeConfigJSON(configJSONs...)
+			if err != nil {
+				t.Fatalf("MergeConfigJSON failed: %s", err)
+			}
+
+			var mergedConfig, expectedConfig interface{}
+
+			decoder := json.NewDecoder(bytes.NewReader(mergedConfigJSON))
+			decoder.UseNumber()
+			err = decoder.Decode(&mergedConfig)
+			if err != nil {
+				t.Fatalf("Decode failed: %s", err)
+			}
+
+			decoder = json.NewDecoder(strings.NewReader(testCase.expectedConfigJSON))
+			decoder.UseNumber()
+			err = decoder.Decode(&expectedConfig)
+			if err != nil {
+				t.Fatalf("Decode failed: %s", err)
+			}
+
+			if !reflect.DeepEqual(mergedConfig, expectedConfig) {
+				t.Fatalf("unexpected merged config: %s", string(mergedConfigJSON))
+			}
+
+			// Test: merging is deterministic
+
+			repeatMergedConfigJSON, err := MergeConfigJSON(configJSONs...)
+			if err != nil {
+				t.Fatalf("MergeConfigJSON failed: %s", err)
+			}
+
+			if !bytes.Equal(mergedConfigJSON, repeatMergedConfigJSON) {
+				t.Fatalf("unexpected repeat merged config: %s", string(repeatMergedConfigJSON))
+			}
+		})
+	}
+
+	// Test: merged config is validated by LoadConfig
+
+	mergedConfigJSON, err := MergeConfigJSON(
+		[]byte(`{"LogLevel" : "info", "WebServerPort" : 8000}`),
+		[]byte(`{"ServerIPAddress" : "192.168.0.1", "WebServerPort" : 0}`))
+	if err != nil {
+		t.Fatalf("MergeConfigJSON failed: %s", err)
+	}
+
+	config, err := LoadConfig(mergedConfigJSON)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	if config.ServerIPAddress != "192.168.0.1" || config.WebServerPort != 0 {
+		t.Fatalf("unexpected loaded config: %+v", config)
+	}
+
+	mergedConfigJSON, err = MergeConfigJSON(
+		[]byte(`{"ServerIPAddress" : "192.168.0.1"}`),
+		[]byte(`{"ServerIPAddress" : ""}`))
+	if err != nil {
+		t.Fatalf("MergeConfigJSON failed: %s", err)
+	}
+
+	_, err = LoadConfig(mergedConfigJSON)
+	if err == nil {
+		t.Fatalf("LoadConfig unexpectedly succeeded")
+	}
+
+	// Test: invalid inputs
+
+	_, err = MergeConfigJSON()
+	if err == nil {
+		t.Fatalf("MergeConfigJSON unexpectedly succeeded with no configs")
+	}
+
+	_, err = MergeConfigJSON([]byte(baseConfigJSON), []byte(`{"HostID" :`))
+	if err == nil {
+		t.Fatalf("MergeConfigJSON unexpectedly succeeded with invalid JSON")
+	}
+
+	_, err = MergeConfigJSON([]byte(baseConfigJSON), []byte(`["HostID"]`))
+	if err == nil {
+		t.Fatalf("MergeConfigJSON unexpectedly succeeded with non-object JSON")
+	}
+}
+
+func TestValidateServerConfig(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-validate-server-config-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+	err = ioutil.WriteFile(trafficRulesFilename, []byte(`{"DefaultRules" : {}}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	invalidTrafficRulesFilename := filepath.Join(testDataDirName, "invalid_traffic_rules.json")
+	err = ioutil.WriteFile(invalidTrafficRulesFilename, []byte(`{"DefaultRules" :`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	serverConfigJSON, _, _, _, _, err := GenerateConfig(
+		&GenerateConfigParams{
+			ServerIPAddress:     "127.0.0.1",
+			WebServerPort:       8000,
+			TunnelProtocolPorts: map[string]int{"OSSH": 4000},
+		})
+	if err != nil {
+		t.Fatalf("GenerateConfig failed: %s", err)
+	}
+
+	// Reference only files created by this test.
+	baseConfigJSON, err := MergeConfigJSON(
+		serverConfigJSON,
+		[]byte(fmt.Sprintf(`
+        {
+            "LogFilename" : "",
+            "TrafficRulesFilename" : "%s",
+            "OSLConfigFilename" : "",
+            "PsinetDatabaseFilename" : "",
+            "TacticsConfigFilename" : ""
+        }`, trafficRulesFilename)))
+	if err != nil {
+		t.Fatalf("MergeConfigJSON failed: %s", err)
+	}
+
+	testCases := []struct {
+		description        string
+		overrideConfigJSON string
+		expectedError      string
+	}{
+		{
+			"valid",
+			`{}`,
+			"",
+		},
+		{
+			"missing server IP address",
+			`{"ServerIPAddress" : ""}`,
+			"ServerIPAddress",
+		},
+		{
+			"invalid log level",
+			`{"LogLevel" : "invalid"}`,
+			"LogLevel",
+		},
+		{
+			"invalid traffic rules file",
+			fmt.Sprintf(`{"TrafficRulesFilename" : "%s"}`, invalidTrafficRulesFilename),
+			"TrafficRulesFilename " + invalidTrafficRulesFilename,
+		},
+		{
+			"missing traffic rules file",
+			fmt.Sprintf(`{"TrafficRulesFilename" : "%s"}`,
+				filepath.Join(testDataDirName, "missing_traffic_rules.json")),
+			"TrafficRulesFilename",
+		},
+		{
+			"invalid SSH private key",
+			`{"SSHPrivateKey" : "invalid"}`,
+			"SSHPrivateKey",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			configJSON, err := MergeConfigJSON(
+				baseConfigJSON, []byte(testCase.overrideConfigJSON))
+			if err != nil {
+				t.Fatalf("MergeConfigJSON failed: %s", err)
+			}
+
+			err = ValidateServerConfig(configJSON)
+
+			if testCase.expectedError == "" {
+				if err != nil {
+					t.Fatalf("ValidateServerConfig failed: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("ValidateServerConfig unexpectedly succeeded")
+				}
+				if !strings.Contains(err.Error(), testCase.expectedError) {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+		})
+	}
+}
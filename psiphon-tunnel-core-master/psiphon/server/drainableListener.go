@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2026, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// drainableListener is a TCP listener which may be closed while its tunnel
+// protocol is drained, so that new client connections are refused rather
+// than accepted and then closed, and bound again when the tunnel protocol
+// is no longer drained. While the listener is drained, Accept blocks until
+// the listener is resumed or closed.
+//
+// Multiple acceptors may call Accept concurrently.
+type drainableListener struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	address  net.Addr
+	listen   func() (net.Listener, error)
+	resumed  chan struct{}
+	closed   bool
+}
+
+// newDrainableListener wraps listener. listen is used to bind a new listener
+// when the drainableListener is resumed.
+func newDrainableListener(
+	listener net.Listener, listen func() (net.Listener, error)) *drainableListener {
+
+	return &drainableListener{
+		listener: listener,
+		address:  listener.Addr(),
+		listen:   listen,
+	}
+}
+
+// Accept implements the net.Listener interface.
+func (listener *drainableListener) Accept() (net.Conn, error) {
+
+	for {
+		listener.mutex.Lock()
+		currentListener := listener.listener
+		resumed := listener.resumed
+		closed := listener.closed
+		listener.mutex.Unlock()
+
+		if closed {
+			return nil, common.ContextError(errors.New("listener closed"))
+		}
+
+		if currentListener == nil {
+			<-resumed
+			continue
+		}
+
+		conn, err := currentListener.Accept()
+		if err != nil {
+
+			// When the listener was closed by drain or Close, the error is
+			// expected; wait for resume or return the closed error.
+			listener.mutex.Lock()
+			replaced := listener.listener != currentListener
+			listener.mutex.Unlock()
+
+			if replaced {
+				continue
+			}
+
+			return nil, common.ContextError(err)
+		}
+
+		return conn, nil
+	}
+}
+
+// Close implements the net.Listener interface. Close may be called multiple
+// times.
+func (listener *drainableListener) Close() error {
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.closed {
+		return nil
+	}
+	listener.closed = true
+
+	if listener.listener == nil {
+		close(listener.resumed)
+		return nil
+	}
+
+	err := listener.listener.Close()
+	listener.listener = nil
+	return err
+}
+
+// Addr implements the net.Listener interface. The address remains
+// available while the listener is drained.
+func (listener *drainableListener) Addr() net.Addr {
+	return listener.address
+}
+
+// setDrained closes the underlying listener when drained is true, and binds
+// a new underlying listener when drained is false. When the new bind fails,
+// the listener remains drained and an error is returned.
+func (listener *drainableListener) setDrained(drained bool) error {
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.closed {
+		return nil
+	}
+
+	if drained {
+
+		if listener.listener == nil {
+			return nil
+		}
+
+		listener.resumed = make(chan struct{})
+		currentListener := listener.listener
+		listener.listener = nil
+
+		err := currentListener.Close()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		return nil
+	}
+
+	if listener.listener != nil {
+		return nil
+	}
+
+	newListener, err := listener.listen()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	listener.listener = newListener
+	close(listener.resumed)
+
+	return nil
+}
@@ -27,6 +27,8 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -35,20 +37,25 @@ import (
 )
 
 const (
-	GEOIP_SESSION_CACHE_TTL = 60 * time.Minute
-	GEOIP_UNKNOWN_VALUE     = "None"
+	GEOIP_SESSION_CACHE_TTL                       = 60 * time.Minute
+	GEOIP_UNKNOWN_VALUE                           = "None"
+	GEOIP_LOOKUP_CACHE_TTL                        = 10 * time.Minute
+	GEOIP_LOOKUP_CACHE_DEFAULT_IPV4_PREFIX_LENGTH = 24
+	GEOIP_LOOKUP_CACHE_DEFAULT_IPV6_PREFIX_LENGTH = 48
+	GEOIP_LOOKUP_CACHE_DEFAULT_MAX_ENTRIES        = 100000
 )
 
 // GeoIPData is GeoIP data for a client session. Individual client
 // IP addresses are neither logged nor explicitly referenced during a session.
-// The GeoIP country, city, and ISP corresponding to a client IP address are
-// resolved and then logged along with usage stats. The DiscoveryValue is
+// The GeoIP country, city, ISP, and ASN corresponding to a client IP address
+// are resolved and then logged along with usage stats. The DiscoveryValue is
 // a special value derived from the client IP that's used to compartmentalize
 // discoverable servers (see calculateDiscoveryValue for details).
 type GeoIPData struct {
 	Country        string
 	City           string
 	ISP            string
+	ASN            string
 	DiscoveryValue int
 }
 
@@ -59,112 +66,213 @@ func NewGeoIPData() GeoIPData {
 		Country: GEOIP_UNKNOWN_VALUE,
 		City:    GEOIP_UNKNOWN_VALUE,
 		ISP:     GEOIP_UNKNOWN_VALUE,
+		ASN:     GEOIP_UNKNOWN_VALUE,
 	}
 }
 
 // GeoIPService implements GeoIP lookup and session/GeoIP caching.
-// Lookup is via a MaxMind database; the ReloadDatabase function
+// Lookup is via MaxMind databases; the ReloadDatabase function
 // supports hot reloading of MaxMind data while the server is
 // running.
+//
+// Lookup results are cached by client IP address prefix, so that
+// clients on the same network reuse a single lookup. The lookup
+// cache is flushed whenever any database is reloaded.
 type GeoIPService struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	lookupCacheHits       int64
+	lookupCacheMisses     int64
 	databases             []*geoIPDatabase
 	sessionCache          *cache.Cache
+	lookupCache           *cache.Cache
+	lookupCacheIPv4Mask   net.IPMask
+	lookupCacheIPv6Mask   net.IPMask
+	lookupCacheMaxEntries int
 	discoveryValueHMACKey string
 }
 
+// geoIPDatabaseFields is a bit mask indicating which GeoIPData fields
+// a database supplies.
+type geoIPDatabaseFields int
+
+const (
+	geoIPCountryFields geoIPDatabaseFields = 1 << iota
+	geoIPISPFields
+	geoIPASNFields
+	geoIPAllFields = geoIPCountryFields | geoIPISPFields | geoIPASNFields
+)
+
 type geoIPDatabase struct {
 	common.ReloadableFile
 	filename       string
+	fields         geoIPDatabaseFields
 	tempFilename   string
 	tempFileSuffix int64
 	maxMindReader  *maxminddb.Reader
 }
 
 // NewGeoIPService initializes a new GeoIPService.
-func NewGeoIPService(
-	databaseFilenames []string,
-	discoveryValueHMACKey string) (*GeoIPService, error) {
+//
+// Each of config.GeoIPDatabaseFilenames supplies all GeoIPData fields. The
+// optional config.GeoIPCountryDatabaseFilename, GeoIPISPDatabaseFilename,
+// and GeoIPASNDatabaseFilename each supply only the corresponding fields. A
+// database file that is missing is not loaded and its fields are left
+// blank; the database will be loaded when the file exists on a subsequent
+// reload.
+func NewGeoIPService(config *Config) (*GeoIPService, error) {
+
+	IPv4PrefixLength := config.GeoIPLookupCacheIPv4PrefixLength
+	if IPv4PrefixLength == 0 {
+		IPv4PrefixLength = GEOIP_LOOKUP_CACHE_DEFAULT_IPV4_PREFIX_LENGTH
+	}
+
+	IPv6PrefixLength := config.GeoIPLookupCacheIPv6PrefixLength
+	if IPv6PrefixLength == 0 {
+		IPv6PrefixLength = GEOIP_LOOKUP_CACHE_DEFAULT_IPV6_PREFIX_LENGTH
+	}
+
+	maxEntries := config.GeoIPLookupCacheMaxEntries
+	if maxEntries == 0 {
+		maxEntries = GEOIP_LOOKUP_CACHE_DEFAULT_MAX_ENTRIES
+	}
 
 	geoIP := &GeoIPService{
-		databases:             make([]*geoIPDatabase, len(databaseFilenames)),
 		sessionCache:          cache.New(GEOIP_SESSION_CACHE_TTL, 1*time.Minute),
-		discoveryValueHMACKey: discoveryValueHMACKey,
+		lookupCache:           cache.New(GEOIP_LOOKUP_CACHE_TTL, 1*time.Minute),
+		lookupCacheIPv4Mask:   net.CIDRMask(IPv4PrefixLength, 8*net.IPv4len),
+		lookupCacheIPv6Mask:   net.CIDRMask(IPv6PrefixLength, 8*net.IPv6len),
+		lookupCacheMaxEntries: maxEntries,
+		discoveryValueHMACKey: config.DiscoveryValueHMACKey,
 	}
 
-	for i, filename := range databaseFilenames {
-
-		database := &geoIPDatabase{
-			filename: filename,
+	for _, filename := range config.GeoIPDatabaseFilenames {
+		err := geoIP.addDatabase(filename, geoIPAllFields)
+		if err != nil {
+			return nil, common.ContextError(err)
 		}
+	}
 
-		database.ReloadableFile = common.NewReloadableFile(
-			filename,
-			false,
-			func(_ []byte) error {
-
-				// In order to safely mmap the database file, a temporary copy
-				// is made and that copy is mmapped. The original file may be
-				// repaved without affecting the mmap; upon hot reload, a new
-				// temporary copy is made and once it is successful, the old
-				// mmap is closed and previous temporary file deleted.
-				//
-				// On any reload error, database state remains the same.
-
-				src, err := os.Open(database.filename)
-				if err != nil {
-					return common.ContextError(err)
-				}
-
-				tempFileSuffix := database.tempFileSuffix + 1
-
-				tempFilename := fmt.Sprintf(
-					"%s.%d",
-					filepath.Join(os.TempDir(), filepath.Base(database.filename)),
-					tempFileSuffix)
-
-				dst, err := os.Create(tempFilename)
-				if err != nil {
-					src.Close()
-					return common.ContextError(err)
-				}
-
-				_, err = io.Copy(dst, src)
-				src.Close()
-				dst.Close()
-				if err != nil {
-					_ = os.Remove(tempFilename)
-					return common.ContextError(err)
-				}
-
-				maxMindReader, err := maxminddb.Open(tempFilename)
-				if err != nil {
-					_ = os.Remove(tempFilename)
-					return common.ContextError(err)
-				}
-
-				if database.maxMindReader != nil {
-					database.maxMindReader.Close()
-					_ = os.Remove(database.tempFilename)
-				}
-
-				database.maxMindReader = maxMindReader
-				database.tempFilename = tempFilename
-				database.tempFileSuffix = tempFileSuffix
-
-				return nil
-			})
-
-		_, err := database.Reload()
+	for _, database := range []struct {
+		filename string
+		fields   geoIPDatabaseFields
+	}{
+		{config.GeoIPCountryDatabaseFilename, geoIPCountryFields},
+		{config.GeoIPISPDatabaseFilename, geoIPISPFields},
+		{config.GeoIPASNDatabaseFilename, geoIPASNFields},
+	} {
+		if database.filename == "" {
+			continue
+		}
+		err := geoIP.addDatabase(database.filename, database.fields)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
-
-		geoIP.databases[i] = database
 	}
 
 	return geoIP, nil
 }
 
+func (geoIP *GeoIPService) addDatabase(
+	filename string, fields geoIPDatabaseFields) error {
+
+	database := &geoIPDatabase{
+		filename: filename,
+		fields:   fields,
+	}
+
+	database.ReloadableFile = common.NewReloadableFile(
+		filename,
+		false,
+		func(_ []byte) error {
+
+			// In order to safely mmap the database file, a temporary copy
+			// is made and that copy is mmapped. The original file may be
+			// repaved without affecting the mmap; upon hot reload, a new
+			// temporary copy is made and once it is successful, the old
+			// mmap is closed and previous temporary file deleted.
+			//
+			// On any reload error, database state remains the same.
+
+			src, err := os.Open(database.filename)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			tempFileSuffix := database.tempFileSuffix + 1
+
+			tempFilename := fmt.Sprintf(
+				"%s.%d",
+				filepath.Join(os.TempDir(), filepath.Base(database.filename)),
+				tempFileSuffix)
+
+			dst, err := os.Create(tempFilename)
+			if err != nil {
+				src.Close()
+				return common.ContextError(err)
+			}
+
+			_, err = io.Copy(dst, src)
+			src.Close()
+			dst.Close()
+			if err != nil {
+				_ = os.Remove(tempFilename)
+				return common.ContextError(err)
+			}
+
+			maxMindReader, err := maxminddb.Open(tempFilename)
+			if err != nil {
+				_ = os.Remove(tempFilename)
+				return common.ContextError(err)
+			}
+
+			// Validate the database before replacing the current one.
+			err = maxMindReader.Verify()
+			if err != nil {
+				maxMindReader.Close()
+				_ = os.Remove(tempFilename)
+				return common.ContextError(err)
+			}
+
+			if database.maxMindReader != nil {
+				database.maxMindReader.Close()
+				_ = os.Remove(database.tempFilename)
+			}
+
+			database.maxMindReader = maxMindReader
+			database.tempFilename = tempFilename
+			database.tempFileSuffix = tempFileSuffix
+
+			// Discard lookup results from the previous database.
+			//
+			// Limitation: a concurrent Lookup that queried the previous
+			// database may still cache its result after this flush.
+			geoIP.lookupCache.Flush()
+
+			return nil
+		})
+
+	// A missing database file is not a startup failure. The database
+	// remains in the reloaders list so that it's loaded once the file
+	// is created.
+
+	_, err := os.Stat(filename)
+	if err != nil && os.IsNotExist(err) {
+		log.WithContextFields(
+			LogFields{"filename": filename}).Warning("GeoIP database not found")
+	} else {
+		_, err = database.Reload()
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	geoIP.databases = append(geoIP.databases, database)
+
+	return nil
+}
+
 // Reloaders gets the list of reloadable databases in use
 // by the GeoIPService. This list is used to hot reload
 // these databases.
@@ -178,15 +286,80 @@ func (geoIP *GeoIPService) Reloaders() []common.Reloader {
 
 // Lookup determines a GeoIPData for a given client IP address.
 func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
-	result := NewGeoIPData()
 
 	ip := net.ParseIP(ipAddress)
 
 	if ip == nil || len(geoIP.databases) == 0 {
-		return result
+		return NewGeoIPData()
+	}
+
+	// The DiscoveryValue is derived from the full client IP address, so
+	// it's not cached and is always calculated.
+
+	var result GeoIPData
+
+	if geoIP.lookupCacheMaxEntries > 0 {
+
+		key := geoIP.getLookupCacheKey(ip)
+
+		cachedResult, found := geoIP.lookupCache.Get(key)
+		if found {
+			atomic.AddInt64(&geoIP.lookupCacheHits, 1)
+			result = cachedResult.(GeoIPData)
+		} else {
+			atomic.AddInt64(&geoIP.lookupCacheMisses, 1)
+			result = geoIP.lookupDatabases(ip)
+			if geoIP.lookupCache.ItemCount() < geoIP.lookupCacheMaxEntries {
+				geoIP.lookupCache.Set(key, result, cache.DefaultExpiration)
+			}
+		}
+
+	} else {
+		result = geoIP.lookupDatabases(ip)
+	}
+
+	result.DiscoveryValue = calculateDiscoveryValue(
+		geoIP.discoveryValueHMACKey, ipAddress)
+
+	return result
+}
+
+// getLookupCacheKey returns the lookup cache key for the IP address, which
+// is the IP address prefix.
+func (geoIP *GeoIPService) getLookupCacheKey(ip net.IP) string {
+	if IPv4 := ip.To4(); IPv4 != nil {
+		return IPv4.Mask(geoIP.lookupCacheIPv4Mask).String()
 	}
+	return ip.Mask(geoIP.lookupCacheIPv6Mask).String()
+}
+
+// GetMetrics implements the common.MetricsSource interface. The metrics
+// are the GeoIP lookup cache hit and miss counts, and hit rate, since the
+// previous GetMetrics call.
+func (geoIP *GeoIPService) GetMetrics() common.LogFields {
+
+	hits := atomic.SwapInt64(&geoIP.lookupCacheHits, 0)
+	misses := atomic.SwapInt64(&geoIP.lookupCacheMisses, 0)
+
+	hitRate := 0.0
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses)
+	}
+
+	return common.LogFields{
+		"geoip_lookup_cache_hits":     hits,
+		"geoip_lookup_cache_misses":   misses,
+		"geoip_lookup_cache_hit_rate": hitRate,
+	}
+}
 
-	var geoIPFields struct {
+// lookupDatabases queries the GeoIP databases for the IP address. The
+// returned GeoIPData DiscoveryValue is not set.
+func (geoIP *GeoIPService) lookupDatabases(ip net.IP) GeoIPData {
+
+	result := NewGeoIPData()
+
+	type geoIPFields struct {
 		Country struct {
 			ISOCode string `maxminddb:"iso_code"`
 		} `maxminddb:"country"`
@@ -194,35 +367,54 @@ func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
 			Names map[string]string `maxminddb:"names"`
 		} `maxminddb:"city"`
 		ISP string `maxminddb:"isp"`
+		ASN uint   `maxminddb:"autonomous_system_number"`
 	}
 
-	// Each database will populate geoIPFields with the values it contains. In the
-	// current MaxMind deployment, the City database populates Country and City and
-	// the separate ISP database populates ISP.
+	// Each database will populate its fields with the values it contains,
+	// overriding values from previous databases. In the current MaxMind
+	// deployment, the City database populates Country and City and the
+	// separate ISP database populates ISP and ASN.
 	for _, database := range geoIP.databases {
+
+		var fields geoIPFields
+
 		database.ReloadableFile.RLock()
-		err := database.maxMindReader.Lookup(ip, &geoIPFields)
+		if database.maxMindReader == nil {
+			// The database file was not found.
+			database.ReloadableFile.RUnlock()
+			continue
+		}
+		err := database.maxMindReader.Lookup(ip, &fields)
 		database.ReloadableFile.RUnlock()
 		if err != nil {
 			log.WithContextFields(LogFields{"error": err}).Warning("GeoIP lookup failed")
+			continue
 		}
-	}
 
-	if geoIPFields.Country.ISOCode != "" {
-		result.Country = geoIPFields.Country.ISOCode
-	}
+		if database.fields&geoIPCountryFields != 0 {
 
-	name, ok := geoIPFields.City.Names["en"]
-	if ok && name != "" {
-		result.City = name
-	}
+			if fields.Country.ISOCode != "" {
+				result.Country = fields.Country.ISOCode
+			}
 
-	if geoIPFields.ISP != "" {
-		result.ISP = geoIPFields.ISP
-	}
+			name, ok := fields.City.Names["en"]
+			if ok && name != "" {
+				result.City = name
+			}
+		}
 
-	result.DiscoveryValue = calculateDiscoveryValue(
-		geoIP.discoveryValueHMACKey, ipAddress)
+		if database.fields&geoIPISPFields != 0 {
+			if fields.ISP != "" {
+				result.ISP = fields.ISP
+			}
+		}
+
+		if database.fields&geoIPASNFields != 0 {
+			if fields.ASN != 0 {
+				result.ASN = strconv.FormatUint(uint64(fields.ASN), 10)
+			}
+		}
+	}
 
 	return result
 }
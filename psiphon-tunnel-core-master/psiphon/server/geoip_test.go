@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeoIPServiceDatabases(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-geoip-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	missingFilename := filepath.Join(testDataDirName, "missing.mmdb")
+
+	invalidFilename := filepath.Join(testDataDirName, "invalid.mmdb")
+	err = ioutil.WriteFile(invalidFilename, []byte("invalid"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	// Test: missing databases don't fail startup and lookups return
+	// unknown values
+
+	geoIPService, err := NewGeoIPService(
+		&Config{
+			GeoIPDatabaseFilenames:       []string{missingFilename},
+			GeoIPCountryDatabaseFilename: missingFilename,
+			GeoIPISPDatabaseFilename:     missingFilename,
+			GeoIPASNDatabaseFilename:     missingFilename,
+		})
+	if err != nil {
+		t.Fatalf("NewGeoIPService failed: %s", err)
+	}
+
+	if len(geoIPService.Reloaders()) != 4 {
+		t.Fatalf("unexpected reloaders count")
+	}
+
+	geoIPData := geoIPService.Lookup("192.0.2.1")
+
+	expectedGeoIPData := NewGeoIPData()
+	expectedGeoIPData.DiscoveryValue = geoIPData.DiscoveryValue
+
+	if geoIPData != expectedGeoIPData {
+		t.Fatalf("unexpected GeoIP data: %+v", geoIPData)
+	}
+
+	// Test: a missing database that remains missing fails reload, retaining
+	// the previous state
+
+	_, err = geoIPService.Reloaders()[3].Reload()
+	if err == nil {
+		t.Fatalf("Reload unexpected success")
+	}
+
+	// Test: invalid databases fail validation
+
+	for _, filenames := range [][]string{
+		{invalidFilename, "", "", ""},
+		{"", invalidFilename, "", ""},
+		{"", "", invalidFilename, ""},
+		{"", "", "", invalidFilename},
+	} {
+
+		var databaseFilenames []string
+		if filenames[0] != "" {
+			databaseFilenames = []string{filenames[0]}
+		}
+
+		_, err := NewGeoIPService(
+			&Config{
+				GeoIPDatabaseFilenames:       databaseFilenames,
+				GeoIPCountryDatabaseFilename: filenames[1],
+				GeoIPISPDatabaseFilename:     filenames[2],
+				GeoIPASNDatabaseFilename:     filenames[3],
+			})
+		if err == nil {
+			t.Fatalf("NewGeoIPService unexpected success: %+v", filenames)
+		}
+	}
+}
+
+func TestGeoIPLookupCache(t *testing.T) {
+
+	geoIPService, err := NewGeoIPService(&Config{})
+	if err != nil {
+		t.Fatalf("NewGeoIPService failed: %s", err)
+	}
+
+	// With no database, the lookup cache isn't used.
+
+	geoIPService.Lookup("192.0.2.1")
+
+	metrics := geoIPService.GetMetrics()
+	if metrics["geoip_lookup_cache_hits"].(int64) != 0 ||
+		metrics["geoip_lookup_cache_misses"].(int64) != 0 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	// Test: lookup cache keys use the default prefix lengths
+
+	testCases := []struct {
+		ipAddress   string
+		expectedKey string
+	}{
+		{"192.0.2.1", "192.0.2.0"},
+		{"192.0.2.254", "192.0.2.0"},
+		{"192.0.3.1", "192.0.3.0"},
+		{"2001:db8:1:2::1", "2001:db8:1::"},
+		{"2001:db8:1:3::1", "2001:db8:1::"},
+		{"2001:db8:2::1", "2001:db8:2::"},
+	}
+
+	for _, testCase := range testCases {
+		key := geoIPService.getLookupCacheKey(net.ParseIP(testCase.ipAddress))
+		if key != testCase.expectedKey {
+			t.Fatalf("unexpected key for %s: %s", testCase.ipAddress, key)
+		}
+	}
+
+	// Test: a lookup cache miss and subsequent hit for the same prefix
+
+	geoIPService, err = NewGeoIPService(
+		&Config{
+			GeoIPLookupCacheIPv4PrefixLength: 16,
+			DiscoveryValueHMACKey:            "key",
+		})
+	if err != nil {
+		t.Fatalf("NewGeoIPService failed: %s", err)
+	}
+
+	// Add a database that's not loaded, which enables lookups.
+	geoIPService.databases = append(geoIPService.databases, &geoIPDatabase{})
+
+	geoIPData1 := geoIPService.Lookup("192.0.2.1")
+	geoIPData2 := geoIPService.Lookup("192.0.3.1")
+
+	metrics = geoIPService.GetMetrics()
+	if metrics["geoip_lookup_cache_hits"].(int64) != 1 ||
+		metrics["geoip_lookup_cache_misses"].(int64) != 1 ||
+		metrics["geoip_lookup_cache_hit_rate"].(float64) != 0.5 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	// The DiscoveryValue is not cached.
+	if geoIPData1.DiscoveryValue != calculateDiscoveryValue("key", "192.0.2.1") ||
+		geoIPData2.DiscoveryValue != calculateDiscoveryValue("key", "192.0.3.1") {
+		t.Fatalf("unexpected discovery values")
+	}
+
+	// Test: metrics are reset
+
+	metrics = geoIPService.GetMetrics()
+	if metrics["geoip_lookup_cache_hits"].(int64) != 0 ||
+		metrics["geoip_lookup_cache_misses"].(int64) != 0 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	// Test: lookup cache is disabled
+
+	geoIPService.lookupCacheMaxEntries = -1
+
+	geoIPService.Lookup("192.0.2.1")
+
+	metrics = geoIPService.GetMetrics()
+	if metrics["geoip_lookup_cache_hits"].(int64) != 0 ||
+		metrics["geoip_lookup_cache_misses"].(int64) != 0 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
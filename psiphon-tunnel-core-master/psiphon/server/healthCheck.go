@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	golanglog "log"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	HEALTH_CHECK_SERVER_IO_TIMEOUT = 10 * time.Second
+	HEALTH_CHECK_REQUEST_PATH      = "/health"
+)
+
+// HealthCheckResponse is the JSON response body returned by the health
+// check server.
+//
+// The response intentionally omits the server IP address, tunnel protocols,
+// and listening ports, so the health check server cannot be used to
+// enumerate tunnel endpoints.
+type HealthCheckResponse struct {
+
+	// Ready indicates whether all tunnel protocol listeners are bound and
+	// accepting connections.
+	Ready bool `json:"ready"`
+
+	// Degraded indicates that the server is running with only some of its
+	// tunnel protocol listeners, as others failed to bind. A degraded
+	// server is not ready.
+	Degraded bool `json:"degraded"`
+
+	// EstablishTunnels indicates whether the server is currently
+	// establishing new tunnels; this is false when new tunnels have been
+	// stopped with SIGTSTP.
+	EstablishTunnels bool `json:"establish_tunnels"`
+
+	// TunnelCount is the number of currently established tunnels.
+	TunnelCount int `json:"tunnel_count"`
+
+	// NumGoroutine is the number of running goroutines, a simple
+	// indicator of overall server load.
+	NumGoroutine int `json:"num_goroutine"`
+}
+
+// RunHealthCheckServer runs an HTTP server, on the config
+// HealthCheckServerAddress, which responds to requests for
+// HEALTH_CHECK_REQUEST_PATH with a JSON-encoded HealthCheckResponse. The
+// HTTP status is 200 when the server is ready and establishing tunnels,
+// and 503 otherwise, so that load balancers may use the status alone.
+func RunHealthCheckServer(
+	support *SupportServices,
+	shutdownBroadcast <-chan struct{}) error {
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc(
+		HEALTH_CHECK_REQUEST_PATH,
+		func(w http.ResponseWriter, r *http.Request) {
+			healthCheckHandler(support, w, r)
+		})
+
+	logWriter := NewLogWriter()
+	defer logWriter.Close()
+
+	server := &http.Server{
+		Handler:      serveMux,
+		ReadTimeout:  HEALTH_CHECK_SERVER_IO_TIMEOUT,
+		WriteTimeout: HEALTH_CHECK_SERVER_IO_TIMEOUT,
+		ErrorLog:     golanglog.New(logWriter, "", 0),
+	}
+
+	localAddress := support.Config.HealthCheckServerAddress
+
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("starting health check server")
+
+	err = nil
+	errors := make(chan error)
+	waitGroup := new(sync.WaitGroup)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		// Note: will be interrupted by listener.Close()
+		err := server.Serve(listener)
+
+		// As in RunWebServer, use an explicit stop signal to distinguish
+		// shutdown from a Serve failure.
+		select {
+		case <-shutdownBroadcast:
+		default:
+			if err != nil {
+				select {
+				case errors <- common.ContextError(err):
+				default:
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-shutdownBroadcast:
+	case err = <-errors:
+	}
+
+	listener.Close()
+
+	waitGroup.Wait()
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("stopped health check server")
+
+	return err
+}
+
+func healthCheckHandler(
+	support *SupportServices, w http.ResponseWriter, r *http.Request) {
+
+	response := getHealthCheckResponse(support)
+
+	responsePayload, err := json.Marshal(response)
+	if err != nil {
+		log.WithContextFields(
+			LogFields{"error": err}).Warning("failed to marshal health check response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if !response.Ready || !response.EstablishTunnels {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responsePayload)
+}
+
+func getHealthCheckResponse(support *SupportServices) *HealthCheckResponse {
+
+	response := &HealthCheckResponse{
+		NumGoroutine: runtime.NumGoroutine(),
+	}
+
+	// The tunnel server is set in RunServices and may be nil when the
+	// health check server is run independently.
+	tunnelServer := support.TunnelServer
+	if tunnelServer != nil {
+		response.Ready = tunnelServer.IsReady()
+		response.Degraded = tunnelServer.IsDegraded()
+		response.EstablishTunnels = tunnelServer.GetEstablishTunnels()
+		response.TunnelCount = tunnelServer.GetEstablishedClientCount()
+	}
+
+	return response
+}
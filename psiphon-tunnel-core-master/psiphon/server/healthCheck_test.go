@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthCheckHandler(t *testing.T) {
+
+	tunnelServer := &TunnelServer{
+		sshServer: &sshServer{
+			clients: map[string]*sshClient{
+				"1": {},
+				"2": {},
+			},
+		},
+	}
+
+	support := &SupportServices{
+		TunnelServer: tunnelServer,
+	}
+
+	testCases := []struct {
+		description               string
+		ready                     int32
+		establishTunnels          int32
+		bindFailedTunnelProtocols []string
+		expectedStatus            int
+		expectedReady             bool
+		expectedDegraded          bool
+	}{
+		{"not ready", 0, 1, nil, http.StatusServiceUnavailable, false, false},
+		{"not establishing tunnels", 1, 0, nil, http.StatusServiceUnavailable, true, false},
+		{"ready", 1, 1, nil, http.StatusOK, true, false},
+		{"degraded", 1, 1, []string{"OSSH"}, http.StatusServiceUnavailable, false, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			tunnelServer.listenersReady = testCase.ready
+			tunnelServer.sshServer.establishTunnels = testCase.establishTunnels
+			tunnelServer.bindFailedTunnelProtocols = testCase.bindFailedTunnelProtocols
+
+			recorder := httptest.NewRecorder()
+
+			healthCheckHandler(
+				support,
+				recorder,
+				httptest.NewRequest("GET", HEALTH_CHECK_REQUEST_PATH, nil))
+
+			if recorder.Code != testCase.expectedStatus {
+				t.Fatalf("unexpected status: %d", recorder.Code)
+			}
+
+			var response HealthCheckResponse
+			err := json.Unmarshal(recorder.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("Unmarshal failed: %s", err)
+			}
+
+			if response.Ready != testCase.expectedReady ||
+				response.Degraded != testCase.expectedDegraded ||
+				response.EstablishTunnels != (testCase.establishTunnels == 1) ||
+				response.TunnelCount != 2 ||
+				response.NumGoroutine == 0 {
+				t.Fatalf("unexpected response: %+v", response)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// idlePortForwardReaper periodically scans all TCP and UDP port forwards,
+// across all clients, and closes those idle for longer than their traffic
+// rules idle timeout.
+//
+// Each port forward ActivityMonitoredConn also enforces its idle timeout
+// with an I/O deadline; the reaper doesn't replace that mechanism, but adds
+// a server-wide reaping cadence, set by IdlePortForwardReaperIntervalSeconds,
+// and reaped and idle counts for metrics.
+//
+// A nil *idlePortForwardReaper, used when the reaper is disabled, ignores
+// add and remove calls.
+type idlePortForwardReaper struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	reapedCount  int64
+	idleCount    int64
+	interval     time.Duration
+	mutex        sync.Mutex
+	portForwards map[*common.ActivityMonitoredConn]time.Duration
+}
+
+func newIdlePortForwardReaper(interval time.Duration) *idlePortForwardReaper {
+	return &idlePortForwardReaper{
+		interval:     interval,
+		portForwards: make(map[*common.ActivityMonitoredConn]time.Duration),
+	}
+}
+
+// add registers a port forward conn with its traffic rules idle timeout.
+// An idleTimeout of 0 indicates no timeout; such port forwards are counted
+// as idle but never reaped.
+func (reaper *idlePortForwardReaper) add(
+	conn *common.ActivityMonitoredConn, idleTimeout time.Duration) {
+
+	if reaper == nil {
+		return
+	}
+
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+
+	reaper.portForwards[conn] = idleTimeout
+}
+
+// remove unregisters a port forward conn. remove must be called when the
+// port forward is closed, whether or not it was reaped.
+func (reaper *idlePortForwardReaper) remove(conn *common.ActivityMonitoredConn) {
+
+	if reaper == nil {
+		return
+	}
+
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+
+	delete(reaper.portForwards, conn)
+}
+
+// run reaps on the configured interval until shutdownBroadcast is
+// signaled.
+func (reaper *idlePortForwardReaper) run(shutdownBroadcast <-chan struct{}) {
+
+	ticker := time.NewTicker(reaper.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reaper.reap()
+		case <-shutdownBroadcast:
+			return
+		}
+	}
+}
+
+// reap performs one scan, closing port forwards which have exceeded their
+// idle timeout. The idle count is updated to the number of remaining port
+// forwards with no activity during the last interval.
+func (reaper *idlePortForwardReaper) reap() {
+
+	reapConns := make([]*common.ActivityMonitoredConn, 0)
+	idleCount := int64(0)
+
+	reaper.mutex.Lock()
+	for conn, idleTimeout := range reaper.portForwards {
+		idleDuration := conn.GetIdleDuration()
+		if idleTimeout > 0 && idleDuration >= idleTimeout {
+			reapConns = append(reapConns, conn)
+		} else if idleDuration >= reaper.interval {
+			idleCount += 1
+		}
+	}
+	reaper.mutex.Unlock()
+
+	// Close outside of the mutex. The port forward relays will be
+	// interrupted and will call remove as part of their normal cleanup.
+	for _, conn := range reapConns {
+		conn.Close()
+	}
+
+	atomic.AddInt64(&reaper.reapedCount, int64(len(reapConns)))
+	atomic.StoreInt64(&reaper.idleCount, idleCount)
+}
+
+func (reaper *idlePortForwardReaper) getMetrics() map[string]int64 {
+
+	reaper.mutex.Lock()
+	trackedCount := len(reaper.portForwards)
+	reaper.mutex.Unlock()
+
+	return map[string]int64{
+		"reaped_count":  atomic.LoadInt64(&reaper.reapedCount),
+		"idle_count":    atomic.LoadInt64(&reaper.idleCount),
+		"tracked_count": int64(trackedCount),
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestIdlePortForwardReaper(t *testing.T) {
+
+	interval := 50 * time.Millisecond
+
+	reaper := newIdlePortForwardReaper(interval)
+
+	newConn := func() (*common.ActivityMonitoredConn, net.Conn) {
+		conn, peerConn := net.Pipe()
+		activityConn, err := common.NewActivityMonitoredConn(conn, 0, true, nil, nil)
+		if err != nil {
+			t.Fatalf("NewActivityMonitoredConn failed: %s", err)
+		}
+		return activityConn, peerConn
+	}
+
+	expiredConn, expiredPeerConn := newConn()
+	defer expiredPeerConn.Close()
+	reaper.add(expiredConn, interval)
+
+	activeConn, activePeerConn := newConn()
+	defer activePeerConn.Close()
+	defer activeConn.Close()
+	reaper.add(activeConn, 10*time.Second)
+
+	noTimeoutConn, noTimeoutPeerConn := newConn()
+	defer noTimeoutPeerConn.Close()
+	defer noTimeoutConn.Close()
+	reaper.add(noTimeoutConn, 0)
+
+	time.Sleep(2 * interval)
+
+	reaper.reap()
+
+	// Test: only the port forward exceeding its idle timeout is reaped
+
+	_, err := expiredPeerConn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatalf("unexpected Read success")
+	}
+
+	expectedMetrics := map[string]int64{
+		"reaped_count":  1,
+		"idle_count":    2,
+		"tracked_count": 3,
+	}
+
+	metrics := reaper.getMetrics()
+	if !reflect.DeepEqual(metrics, expectedMetrics) {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	// Test: activity resets the idle duration
+
+	go activePeerConn.Write([]byte{0})
+	_, err = activeConn.Read(make([]byte, 1))
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	reaper.remove(expiredConn)
+
+	reaper.reap()
+
+	expectedMetrics = map[string]int64{
+		"reaped_count":  1,
+		"idle_count":    1,
+		"tracked_count": 2,
+	}
+
+	metrics = reaper.getMetrics()
+	if !reflect.DeepEqual(metrics, expectedMetrics) {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	// Test: a disabled reaper ignores add and remove
+
+	var disabledReaper *idlePortForwardReaper
+	disabledReaper.add(activeConn, interval)
+	disabledReaper.remove(activeConn)
+}
@@ -0,0 +1,67 @@
+// +build linux
+
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"golang.org/x/sys/unix"
+)
+
+func isReusePortSupported() bool {
+	return true
+}
+
+// listenReusePort creates a TCP listener with SO_REUSEPORT set, so that
+// multiple listeners may bind the same local address, with the kernel
+// distributing incoming connections across the listeners.
+//
+// Only Linux distributes connections across SO_REUSEPORT listeners. Other
+// platforms, such as darwin and freebsd, accept the option but deliver
+// connections to a single listener, so isReusePortSupported is false there
+// and the acceptors share one listener.
+func listenReusePort(localAddress string) (net.Listener, error) {
+
+	listenConfig := &net.ListenConfig{
+		Control: func(_, _ string, rawConn syscall.RawConn) error {
+			var setSockOptErr error
+			err := rawConn.Control(func(fd uintptr) {
+				setSockOptErr = unix.SetsockoptInt(
+					int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err == nil {
+				err = setSockOptErr
+			}
+			return err
+		},
+	}
+
+	listener, err := listenConfig.Listen(context.Background(), "tcp", localAddress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return listener, nil
+}
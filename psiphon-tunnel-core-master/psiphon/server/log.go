@@ -32,6 +32,7 @@ import (
 
 	"github.com/Psiphon-Inc/rotate-safe-writer"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 	"github.com/sirupsen/logrus"
 )
 
@@ -84,6 +85,21 @@ func (logger *ContextLogger) WithContextFields(fields LogFields) *logrus.Entry {
 	return logger.WithFields(logrus.Fields(fields))
 }
 
+// SampleDebug returns true when a sampled, high volume Debug log, such as
+// a traffic rules filter check, should be emitted. The sample rate is
+// configured with LogDebugSampleRate. Callers should check SampleDebug
+// before calling WithContextFields, so that no log fields are built for
+// dropped logs.
+func (logger *ContextLogger) SampleDebug() bool {
+	if logger.Level < logrus.DebugLevel {
+		return false
+	}
+	if logDebugSampleRate == nil {
+		return true
+	}
+	return prng.FlipWeightedCoin(*logDebugSampleRate)
+}
+
 // LogRawFieldsWithTimestamp directly logs the supplied fields adding only
 // an additional "timestamp" field; and "host_id" and "build_rev" fields
 // identifying this server and build. The stock "msg" and "level" fields are
@@ -223,6 +239,7 @@ func (f *CustomJSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 
 var log *ContextLogger
 var logHostID, logBuildRev string
+var logDebugSampleRate *float64
 var initLogging sync.Once
 
 // InitLogging configures a logger according to the specified
@@ -239,6 +256,8 @@ func InitLogging(config *Config) (retErr error) {
 		logHostID = config.HostID
 		logBuildRev = common.GetBuildInfo().BuildRev
 
+		logDebugSampleRate = config.LogDebugSampleRate
+
 		level, err := logrus.ParseLevel(config.LogLevel)
 		if err != nil {
 			retErr = common.ContextError(err)
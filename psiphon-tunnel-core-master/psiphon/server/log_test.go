@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2026, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"math"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSampleDebug(t *testing.T) {
+
+	sampleRate := func(rate float64) *float64 { return &rate }
+
+	testCases := []struct {
+		description      string
+		level            logrus.Level
+		debugSampleRate  *float64
+		expectedFraction float64
+	}{
+		{"no sampling", logrus.DebugLevel, nil, 1.0},
+		{"sample all", logrus.DebugLevel, sampleRate(1.0), 1.0},
+		{"sample none", logrus.DebugLevel, sampleRate(0.0), 0.0},
+		{"sample 1%", logrus.DebugLevel, sampleRate(0.01), 0.01},
+		{"sample 10%", logrus.DebugLevel, sampleRate(0.1), 0.1},
+		{"sample 50%", logrus.DebugLevel, sampleRate(0.5), 0.5},
+		{"sample 90%", logrus.DebugLevel, sampleRate(0.9), 0.9},
+		{"debug level disabled", logrus.InfoLevel, nil, 0.0},
+	}
+
+	savedSampleRate := logDebugSampleRate
+	defer func() { logDebugSampleRate = savedSampleRate }()
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			logger := &ContextLogger{&logrus.Logger{Level: testCase.level}}
+			logDebugSampleRate = testCase.debugSampleRate
+
+			iterations := 100000
+			sampled := 0
+
+			for i := 0; i < iterations; i++ {
+				if logger.SampleDebug() {
+					sampled += 1
+				}
+			}
+
+			// Allow for some deviation from the expected fraction. With
+			// 100000 iterations, the standard deviation of the sampled
+			// fraction is at most 0.0016.
+			fraction := float64(sampled) / float64(iterations)
+			if math.Abs(fraction-testCase.expectedFraction) > 0.01 {
+				t.Fatalf("unexpected sampled debug fraction: %f", fraction)
+			}
+		})
+	}
+}
@@ -654,28 +654,22 @@ func (server *MeekServer) getSessionOrEndpoint(
 
 func (server *MeekServer) rateLimit(clientIP string) bool {
 
-	historySize, thresholdSeconds, regions, ISPs, GCTriggerCount, _ :=
-		server.support.TrafficRulesSet.GetMeekRateLimiterConfig()
+	config := server.support.TrafficRulesSet.GetMeekRateLimiterConfig()
+
+	historySize := config.HistorySize
 
 	if historySize == 0 {
 		return false
 	}
 
-	if len(regions) > 0 || len(ISPs) > 0 {
+	if len(config.Regions) > 0 || len(config.ISPs) > 0 || len(config.ASNs) > 0 {
 
 		// TODO: avoid redundant GeoIP lookups?
 		geoIPData := server.support.GeoIPService.Lookup(clientIP)
 
-		if len(regions) > 0 {
-			if !common.Contains(regions, geoIPData.Country) {
-				return false
-			}
-		}
-
-		if len(ISPs) > 0 {
-			if !common.Contains(ISPs, geoIPData.ISP) {
-				return false
-			}
+		if !meekRateLimiterGeoIPMatch(
+			config.Regions, config.ISPs, config.ASNs, geoIPData) {
+			return false
 		}
 	}
 
@@ -683,7 +677,7 @@ func (server *MeekServer) rateLimit(clientIP string) bool {
 	triggerGC := false
 
 	now := monotime.Now()
-	threshold := now.Add(-time.Duration(thresholdSeconds) * time.Second)
+	threshold := now.Add(-time.Duration(config.ThresholdSeconds) * time.Second)
 
 	server.rateLimitLock.Lock()
 
@@ -708,7 +702,7 @@ func (server *MeekServer) rateLimit(clientIP string) bool {
 
 		server.rateLimitCount += 1
 
-		if server.rateLimitCount >= GCTriggerCount {
+		if server.rateLimitCount >= config.GCTriggerCount {
 			triggerGC = true
 			server.rateLimitCount = 0
 		}
@@ -726,24 +720,50 @@ func (server *MeekServer) rateLimit(clientIP string) bool {
 	return limit
 }
 
+// meekRateLimiterGeoIPMatch returns true when the client GeoIP data is within
+// the scope of the meek rate limiter, as specified by the
+// MeekRateLimiterRegions, MeekRateLimiterISPs, and MeekRateLimiterASNs
+// traffic rules values. Empty lists match any client.
+func meekRateLimiterGeoIPMatch(
+	regions, ISPs, ASNs []string, geoIPData GeoIPData) bool {
+
+	if len(regions) > 0 {
+		if !common.Contains(regions, geoIPData.Country) {
+			return false
+		}
+	}
+
+	if len(ISPs) > 0 {
+		if !common.Contains(ISPs, geoIPData.ISP) {
+			return false
+		}
+	}
+
+	if len(ASNs) > 0 {
+		if !common.Contains(ASNs, geoIPData.ASN) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (server *MeekServer) rateLimitWorker() {
 
-	_, _, _, _, _, reapFrequencySeconds :=
-		server.support.TrafficRulesSet.GetMeekRateLimiterConfig()
+	config := server.support.TrafficRulesSet.GetMeekRateLimiterConfig()
 
-	timer := time.NewTimer(time.Duration(reapFrequencySeconds) * time.Second)
+	timer := time.NewTimer(time.Duration(config.ReapFrequencySeconds) * time.Second)
 	defer timer.Stop()
 
 	for {
 		select {
 		case <-timer.C:
 
-			_, thresholdSeconds, _, _, _, reapFrequencySeconds :=
-				server.support.TrafficRulesSet.GetMeekRateLimiterConfig()
+			config := server.support.TrafficRulesSet.GetMeekRateLimiterConfig()
 
 			server.rateLimitLock.Lock()
 
-			threshold := monotime.Now().Add(-time.Duration(thresholdSeconds) * time.Second)
+			threshold := monotime.Now().Add(-time.Duration(config.ThresholdSeconds) * time.Second)
 
 			for key, history := range server.rateLimitHistory {
 				reap := true
@@ -764,7 +784,7 @@ func (server *MeekServer) rateLimitWorker() {
 
 			server.rateLimitLock.Unlock()
 
-			timer.Reset(time.Duration(reapFrequencySeconds) * time.Second)
+			timer.Reset(time.Duration(config.ReapFrequencySeconds) * time.Second)
 
 		case <-server.rateLimitSignalGC:
 			runtime.GC()
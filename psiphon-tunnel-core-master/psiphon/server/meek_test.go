@@ -543,3 +543,52 @@ func TestMeekRateLimiter(t *testing.T) {
 	// This wait will hang if shutdown is broken, and the test will ultimately panic
 	serverWaitGroup.Wait()
 }
+
+func TestMeekRateLimiterGeoIPScope(t *testing.T) {
+
+	geoIPData := NewGeoIPData()
+	geoIPData.Country = "US"
+	geoIPData.ISP = "ISP1"
+	geoIPData.ASN = "64512"
+
+	testCases := []struct {
+		description   string
+		regions       []string
+		ISPs          []string
+		ASNs          []string
+		expectedMatch bool
+	}{
+		{"no scope", nil, nil, nil, true},
+		{"matching ASN", nil, nil, []string{"64511", "64512"}, true},
+		{"non-matching ASN", nil, nil, []string{"64511"}, false},
+		{"matching region and ASN", []string{"US"}, nil, []string{"64512"}, true},
+		{"matching region, non-matching ASN", []string{"US"}, nil, []string{"64511"}, false},
+		{"non-matching ISP, matching ASN", nil, []string{"ISP2"}, []string{"64512"}, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			match := meekRateLimiterGeoIPMatch(
+				testCase.regions, testCase.ISPs, testCase.ASNs, geoIPData)
+			if match != testCase.expectedMatch {
+				t.Fatalf("unexpected match: %v", match)
+			}
+		})
+	}
+
+	// Test: invalid ASN values fail validation
+
+	for _, ASN := range []string{"AS64512", "", "-1"} {
+		set := &TrafficRulesSet{MeekRateLimiterASNs: []string{ASN}}
+		err := set.Validate()
+		if err == nil {
+			t.Fatalf("Validate unexpected success: %s", ASN)
+		}
+	}
+
+	set := &TrafficRulesSet{MeekRateLimiterASNs: []string{"64512"}}
+	err := set.Validate()
+	if err != nil {
+		t.Fatalf("Validate failed: %s", err)
+	}
+}
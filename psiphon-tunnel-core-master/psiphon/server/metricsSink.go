@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	METRICS_SINK_LOG                 = "log"
+	METRICS_SINK_STATSD              = "statsd"
+	METRICS_SINK_STATSD_PREFIX       = "psiphond"
+	METRICS_SINK_STATSD_MAX_PACKET   = 1432
+	METRICS_SINK_STATSD_NAME_REPLACE = " :|@"
+)
+
+// MetricsSink receives server metrics records. SendMetrics is invoked
+// with each server_load record, on the same schedule and triggers as
+// server_load logging: periodically, when the load monitor is enabled,
+// and on SIGUSR2. Each record includes an "event_name" field and, for
+// per-region records, a "region" field.
+//
+// SendMetrics may modify, but must not retain, the metrics. Close releases
+// any resources, such as network sockets, held by the sink.
+type MetricsSink interface {
+	SendMetrics(metrics LogFields)
+	Close() error
+}
+
+// NewMetricsSink creates the MetricsSink specified by the config
+// MetricsSink value. The default is a sink which logs metrics.
+func NewMetricsSink(config *Config) (MetricsSink, error) {
+
+	switch config.MetricsSink {
+	case "", METRICS_SINK_LOG:
+		return &logMetricsSink{}, nil
+	case METRICS_SINK_STATSD:
+		return newStatsdMetricsSink(config.MetricsSinkStatsdAddress)
+	}
+
+	return nil, common.ContextError(
+		fmt.Errorf("unknown metrics sink: %s", config.MetricsSink))
+}
+
+// logMetricsSink is a MetricsSink that logs metrics.
+type logMetricsSink struct {
+}
+
+func (sink *logMetricsSink) SendMetrics(metrics LogFields) {
+	log.LogRawFieldsWithTimestamp(metrics)
+}
+
+func (sink *logMetricsSink) Close() error {
+	return nil
+}
+
+// statsdMetricsSink is a MetricsSink that pushes numeric metrics, as statsd
+// gauges, to a statsd server over UDP. Gauge names are formed from the
+// record "event_name" and "region", when present, and the metric names,
+// with nested metric maps flattened using "." separators. For example,
+// "psiphond.server_load.OSSH.established_clients". Non-numeric metrics
+// are omitted.
+type statsdMetricsSink struct {
+	conn net.Conn
+}
+
+func newStatsdMetricsSink(address string) (*statsdMetricsSink, error) {
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &statsdMetricsSink{conn: conn}, nil
+}
+
+func (sink *statsdMetricsSink) SendMetrics(metrics LogFields) {
+
+	prefix := METRICS_SINK_STATSD_PREFIX
+
+	if eventName, ok := metrics["event_name"].(string); ok {
+		prefix += "." + statsdName(eventName)
+	}
+
+	if region, ok := metrics["region"].(string); ok {
+		prefix += ".region." + statsdName(region)
+	}
+
+	lines := make([]string, 0)
+	appendStatsdGauges(&lines, prefix, reflect.ValueOf(metrics))
+
+	// Sort for a stable packet layout.
+	sort.Strings(lines)
+
+	var packet bytes.Buffer
+
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > METRICS_SINK_STATSD_MAX_PACKET {
+			sink.writePacket(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	if packet.Len() > 0 {
+		sink.writePacket(packet.Bytes())
+	}
+}
+
+func (sink *statsdMetricsSink) Close() error {
+	return sink.conn.Close()
+}
+
+func (sink *statsdMetricsSink) writePacket(packet []byte) {
+	_, err := sink.conn.Write(packet)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("statsd write failed")
+	}
+}
+
+// appendStatsdGauges appends a statsd gauge line for each numeric value in
+// value, recursing into maps with string keys.
+func appendStatsdGauges(lines *[]string, name string, value reflect.Value) {
+
+	if value.Kind() == reflect.Interface && !value.IsNil() {
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return
+		}
+		for _, key := range value.MapKeys() {
+			appendStatsdGauges(
+				lines, name+"."+statsdName(key.String()), value.MapIndex(key))
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		*lines = append(*lines, fmt.Sprintf("%s:%d|g", name, value.Int()))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		*lines = append(*lines, fmt.Sprintf("%s:%d|g", name, value.Uint()))
+
+	case reflect.Float32, reflect.Float64:
+		*lines = append(*lines, fmt.Sprintf("%s:%f|g", name, value.Float()))
+	}
+}
+
+// statsdName replaces characters which are reserved in the statsd line
+// protocol.
+func statsdName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(METRICS_SINK_STATSD_NAME_REPLACE, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
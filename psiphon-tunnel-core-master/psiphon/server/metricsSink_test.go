@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+type testMetricsSource common.LogFields
+
+func (source testMetricsSource) GetMetrics() common.LogFields {
+	return common.LogFields(source)
+}
+
+func TestStatsdMetricsSink(t *testing.T) {
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer listener.Close()
+
+	sink, err := NewMetricsSink(
+		&Config{
+			MetricsSink:              METRICS_SINK_STATSD,
+			MetricsSinkStatsdAddress: listener.LocalAddr().String(),
+		})
+	if err != nil {
+		t.Fatalf("NewMetricsSink failed: %s", err)
+	}
+
+	metrics := LogFields{
+		"event_name": "server_load",
+		"region":     "R1",
+		"OSSH": map[string]int64{
+			"established_clients": 2,
+		},
+		"heap_alloc": uint64(1024),
+		"string":     "value",
+	}
+
+	combined := common.CombineMetricsSources(
+		testMetricsSource{"rate": 0.25, "override": 1},
+		nil,
+		testMetricsSource{
+			"nested":   common.LogFields{"a b": 3},
+			"override": 2,
+		}).GetMetrics()
+
+	for name, value := range combined {
+		metrics[name] = value
+	}
+
+	sink.SendMetrics(metrics)
+
+	listener.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+	packet := make([]byte, METRICS_SINK_STATSD_MAX_PACKET)
+	n, _, err := listener.ReadFrom(packet)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %s", err)
+	}
+
+	expectedLines := []string{
+		"psiphond.server_load.region.R1.OSSH.established_clients:2|g",
+		"psiphond.server_load.region.R1.heap_alloc:1024|g",
+		"psiphond.server_load.region.R1.nested.a_b:3|g",
+		"psiphond.server_load.region.R1.override:2|g",
+		"psiphond.server_load.region.R1.rate:0.250000|g",
+	}
+
+	lines := strings.Split(string(packet[:n]), "\n")
+
+	if strings.Join(lines, "\n") != strings.Join(expectedLines, "\n") {
+		t.Fatalf("unexpected statsd lines: %+v", lines)
+	}
+
+	// Test: Close closes the statsd socket
+
+	err = sink.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	_, err = sink.(*statsdMetricsSink).conn.Write([]byte("x"))
+	if err == nil {
+		t.Fatalf("unexpected Write success after Close")
+	}
+
+	// Test: invalid metrics sink
+
+	_, err = NewMetricsSink(&Config{MetricsSink: "invalid"})
+	if err == nil {
+		t.Fatalf("NewMetricsSink unexpected success")
+	}
+}
@@ -29,11 +29,16 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 )
 
 // Database serves Psiphon API data requests. It's safe for
@@ -42,11 +47,49 @@ import (
 type Database struct {
 	common.ReloadableFile
 
-	Hosts            map[string]Host            `json:"hosts"`
-	Servers          []Server                   `json:"servers"`
-	Sponsors         map[string]Sponsor         `json:"sponsors"`
-	Versions         map[string][]ClientVersion `json:"client_versions"`
-	DefaultSponsorID string                     `json:"default_sponsor_id"`
+	Hosts             map[string]Host            `json:"hosts"`
+	Servers           []Server                   `json:"servers"`
+	Sponsors          map[string]Sponsor         `json:"sponsors"`
+	Versions          map[string][]ClientVersion `json:"client_versions"`
+	DefaultSponsorID  string                     `json:"default_sponsor_id"`
+	DiscoveryStrategy string                     `json:"discovery_strategy"`
+
+	// HomePageRegionAliases maps client regions to region groups, such as
+	// "DE" and "FR" to "EU". When there are no home pages for the client
+	// region, GetHomepages tries the region group before the "None" default.
+	HomePageRegionAliases map[string]string `json:"home_page_region_aliases"`
+
+	// DiscoverPermanentServers makes servers marked IsPermanent eligible for
+	// discovery at any time, regardless of their discovery date range, which
+	// may be missing. When not set, permanent servers are discovered only
+	// within a discovery date range, as with all other servers.
+	DiscoverPermanentServers bool `json:"discover_permanent_servers"`
+
+	discoveryStrategy DiscoveryStrategy
+	discoveryServers  []discoveryServer
+
+	discoveryCacheMutex sync.Mutex
+	discoveryCache      *discoveryCache
+}
+
+// discoveryServer is a Servers entry with a parsed discovery date range.
+// When permanent is set, the server is always eligible for discovery and the
+// date range is not used.
+type discoveryServer struct {
+	index     int
+	start     time.Time
+	end       time.Time
+	permanent bool
+}
+
+// discoveryCache is the most recent set of discovery candidates and its
+// bucket partition. As the candidate set depends on the discovery date and
+// any required capabilities, the cache is reused only while the candidate
+// set is unchanged, which is the common case.
+type discoveryCache struct {
+	candidateIndexes []int
+	candidates       []Server
+	buckets          [][]Server
 }
 
 type Host struct {
@@ -86,6 +129,7 @@ type Server struct {
 	WebServerPort               string          `json:"web_server_port"`
 	WebServerSecret             string          `json:"web_server_secret"`
 	ConfigurationVersion        int             `json:"configuration_version"`
+	DiscoveryWeight             int             `json:"discovery_weight"`
 }
 
 type Sponsor struct {
@@ -139,6 +183,16 @@ func NewDatabase(filename string) (*Database, error) {
 			if err != nil {
 				return common.ContextError(err)
 			}
+			// Modify actual database only after validation, so that the
+			// previous database remains loaded on failure.
+			err = newDatabase.validate()
+			if err != nil {
+				return common.ContextError(err)
+			}
+			discoveryStrategy, err := NewDiscoveryStrategy(newDatabase.DiscoveryStrategy)
+			if err != nil {
+				return common.ContextError(err)
+			}
 			// Note: an unmarshal directly into &database would fail
 			// to reset to zero value fields not present in the JSON.
 			database.Hosts = newDatabase.Hosts
@@ -146,6 +200,13 @@ func NewDatabase(filename string) (*Database, error) {
 			database.Sponsors = newDatabase.Sponsors
 			database.Versions = newDatabase.Versions
 			database.DefaultSponsorID = newDatabase.DefaultSponsorID
+			database.DiscoveryStrategy = newDatabase.DiscoveryStrategy
+			database.HomePageRegionAliases = newDatabase.HomePageRegionAliases
+			database.DiscoverPermanentServers = newDatabase.DiscoverPermanentServers
+			database.discoveryStrategy = discoveryStrategy
+
+			// Invalidates any discovery cache for the previous Servers.
+			database.initDiscovery()
 
 			return nil
 		})
@@ -158,6 +219,68 @@ func NewDatabase(filename string) (*Database, error) {
 	return database, nil
 }
 
+// validate checks the database content for errors which would otherwise
+// silently result in missing data when serving requests.
+func (db *Database) validate() error {
+
+	for _, server := range db.Servers {
+
+		if _, ok := db.Hosts[server.HostId]; !ok {
+			return common.ContextError(
+				fmt.Errorf("server %s: unknown host ID: %s", server.Id, server.HostId))
+		}
+
+		if len(server.DiscoveryDateRange) == 0 {
+			continue
+		}
+		if len(server.DiscoveryDateRange) != 2 {
+			return common.ContextError(
+				fmt.Errorf("server %s: invalid discovery date range", server.Id))
+		}
+		for _, date := range server.DiscoveryDateRange {
+			_, err := time.Parse(DISCOVERY_DATE_FORMAT, date)
+			if err != nil {
+				return common.ContextError(
+					fmt.Errorf("server %s: invalid discovery date: %s", server.Id, err))
+			}
+		}
+	}
+
+	validateHomePages := func(sponsorID string, homePages map[string][]HomePage) error {
+		for region, regionHomePages := range homePages {
+			if region == "" {
+				return common.ContextError(
+					fmt.Errorf("sponsor %s: empty home page region", sponsorID))
+			}
+			for _, homePage := range regionHomePages {
+				if homePage.Url == "" {
+					return common.ContextError(
+						fmt.Errorf("sponsor %s: empty home page URL", sponsorID))
+				}
+				_, err := url.Parse(homePage.Url)
+				if err != nil {
+					return common.ContextError(
+						fmt.Errorf("sponsor %s: invalid home page URL: %s", sponsorID, err))
+				}
+			}
+		}
+		return nil
+	}
+
+	for sponsorID, sponsor := range db.Sponsors {
+		err := validateHomePages(sponsorID, sponsor.HomePages)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		err = validateHomePages(sponsorID, sponsor.MobileHomePages)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	return nil
+}
+
 // GetRandomizedHomepages returns a randomly ordered list of home pages
 // for the specified sponsor, region, and platform.
 func (db *Database) GetRandomizedHomepages(sponsorID, clientRegion string, isMobilePlatform bool) []string {
@@ -198,22 +321,21 @@ func (db *Database) GetHomepages(sponsorID, clientRegion string, isMobilePlatfor
 		}
 	}
 
-	// Case: lookup succeeded and corresponding homepages found for region
-	homePagesByRegion, ok := homePages[clientRegion]
-	if ok {
-		for _, homePage := range homePagesByRegion {
-			sponsorHomePages = append(sponsorHomePages, strings.Replace(homePage.Url, "client_region=XX", "client_region="+clientRegion, 1))
-		}
+	// Try, in order, the client region, the client region group, and the
+	// "None" default, using the first with corresponding homepages.
+	regions := []string{clientRegion}
+	if regionGroup, ok := db.HomePageRegionAliases[clientRegion]; ok {
+		regions = append(regions, regionGroup)
 	}
+	regions = append(regions, "None")
 
-	// Case: lookup failed or no corresponding homepages found for region --> use default
-	if len(sponsorHomePages) == 0 {
-		defaultHomePages, ok := homePages["None"]
-		if ok {
-			for _, homePage := range defaultHomePages {
-				// client_region query parameter substitution
-				sponsorHomePages = append(sponsorHomePages, strings.Replace(homePage.Url, "client_region=XX", "client_region="+clientRegion, 1))
-			}
+	for _, region := range regions {
+		for _, homePage := range homePages[region] {
+			// client_region query parameter substitution
+			sponsorHomePages = append(sponsorHomePages, strings.Replace(homePage.Url, "client_region=XX", "client_region="+clientRegion, 1))
+		}
+		if len(sponsorHomePages) > 0 {
+			break
 		}
 	}
 
@@ -222,7 +344,9 @@ func (db *Database) GetHomepages(sponsorID, clientRegion string, isMobilePlatfor
 
 // GetUpgradeClientVersion returns a new client version when an upgrade is
 // indicated for the specified client current version. The result is "" when
-// no upgrade is available. Caller should normalize clientPlatform.
+// no upgrade is available. Caller should normalize clientPlatform, using
+// protocol.NormalizeClientPlatform. Versions may be plain integer version
+// codes or dotted semantic versions; see parseClientVersion.
 func (db *Database) GetUpgradeClientVersion(clientVersion, clientPlatform string) string {
 	db.ReloadableFile.RLock()
 	defer db.ReloadableFile.RUnlock()
@@ -238,26 +362,80 @@ func (db *Database) GetUpgradeClientVersion(clientVersion, clientPlatform string
 		return ""
 	}
 
-	// NOTE: Assumes versions list is in ascending version order
-	lastVersion := clientVersions[len(clientVersions)-1].Version
-
-	lastVersionInt, err := strconv.Atoi(lastVersion)
-	if err != nil {
+	clientVersionNumber, ok := parseClientVersion(clientVersion)
+	if !ok {
 		return ""
 	}
-	clientVersionInt, err := strconv.Atoi(clientVersion)
-	if err != nil {
-		return ""
+
+	// Select the highest version, skipping any malformed entries. The
+	// versions list isn't assumed to be in ascending version order.
+
+	var lastVersion string
+	var lastVersionNumber parsedClientVersion
+
+	for _, version := range clientVersions {
+		versionNumber, ok := parseClientVersion(version.Version)
+		if !ok {
+			continue
+		}
+		if lastVersion == "" ||
+			compareClientVersions(versionNumber, lastVersionNumber) > 0 {
+
+			lastVersion = version.Version
+			lastVersionNumber = versionNumber
+		}
 	}
 
 	// Return latest version if upgrade needed
-	if lastVersionInt > clientVersionInt {
+	if lastVersion != "" &&
+		compareClientVersions(lastVersionNumber, clientVersionNumber) > 0 {
 		return lastVersion
 	}
 
 	return ""
 }
 
+// parsedClientVersion is a client version major, minor, and patch number.
+type parsedClientVersion [3]uint64
+
+// parseClientVersion parses a client version, which may be either a plain
+// integer version code, such as "123", or a dotted semantic version, such
+// as "2.1.3" or "2.1". A plain integer version code is treated as a major
+// version, and omitted minor or patch numbers are 0.
+func parseClientVersion(version string) (parsedClientVersion, bool) {
+
+	var versionNumber parsedClientVersion
+
+	parts := strings.Split(version, ".")
+	if len(parts) > len(versionNumber) {
+		return versionNumber, false
+	}
+
+	for i, part := range parts {
+		// ParseUint rejects empty parts and signs.
+		number, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return versionNumber, false
+		}
+		versionNumber[i] = number
+	}
+
+	return versionNumber, true
+}
+
+// compareClientVersions returns -1, 0, or 1 when a is less than, equal to,
+// or greater than b.
+func compareClientVersions(a, b parsedClientVersion) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
 // GetHttpsRequestRegexes returns bytes transferred stats regexes for the
 // specified sponsor.
 func (db *Database) GetHttpsRequestRegexes(sponsorID string) []map[string]string {
@@ -283,52 +461,292 @@ func (db *Database) GetHttpsRequestRegexes(sponsorID string) []map[string]string
 	return regexes
 }
 
+// GetSponsorBanner returns the banner, website banner, and website banner
+// link for the specified sponsor. When the sponsor is not found, the
+// DefaultSponsorID sponsor values are returned. The values are "" when
+// neither sponsor is found.
+func (db *Database) GetSponsorBanner(sponsorID string) (string, string, string) {
+	db.ReloadableFile.RLock()
+	defer db.ReloadableFile.RUnlock()
+
+	sponsor, ok := db.Sponsors[sponsorID]
+	if !ok {
+		sponsor, _ = db.Sponsors[db.DefaultSponsorID]
+	}
+
+	// As in GetHttpsRequestRegexes, sponsor is an empty Sponsor struct when
+	// neither sponsorID or DefaultSponsorID were found.
+	return sponsor.Banner, sponsor.WebsiteBanner, sponsor.WebsiteBannerLink
+}
+
+// GetAvailableRegions returns the sorted list of distinct host regions for
+// all servers in the database. Servers with an unknown host, and hosts with
+// no region, are skipped.
+func (db *Database) GetAvailableRegions() []string {
+	db.ReloadableFile.RLock()
+	defer db.ReloadableFile.RUnlock()
+
+	regionSet := make(map[string]bool)
+	for _, server := range db.Servers {
+		host, ok := db.Hosts[server.HostId]
+		if !ok || host.Region == "" {
+			continue
+		}
+		regionSet[host.Region] = true
+	}
+
+	regions := make([]string, 0, len(regionSet))
+	for region := range regionSet {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	return regions
+}
+
 // DiscoverServers selects new encoded server entries to be "discovered" by
 // the client, using the discoveryValue -- a function of the client's IP
 // address -- as the input into the discovery algorithm.
 // The server list (db.Servers) loaded from JSON is stored as an array instead of
 // a map to ensure servers are discovered deterministically. Each iteration over a
 // map in go is seeded with a random value which causes non-deterministic ordering.
-func (db *Database) DiscoverServers(discoveryValue int) []string {
+//
+// When requiredCapabilities is not empty, only servers with at least one of the
+// specified capabilities are eligible for discovery.
+func (db *Database) DiscoverServers(discoveryValue int, requiredCapabilities []string) []string {
 	db.ReloadableFile.RLock()
 	defer db.ReloadableFile.RUnlock()
 
+	servers := db.discoverServers(discoveryValue, requiredCapabilities)
+
+	encodedServerEntries := make([]string, 0)
+
+	for _, server := range servers {
+		encodedServerEntries = append(encodedServerEntries, db.getEncodedServerEntry(server))
+	}
+
+	return encodedServerEntries
+}
+
+// discoverServers implements the DiscoverServers selection. The caller must
+// hold the ReloadableFile read lock.
+func (db *Database) discoverServers(discoveryValue int, requiredCapabilities []string) []Server {
+
 	var servers []Server
 
 	discoveryDate := time.Now().UTC()
-	candidateServers := make([]Server, 0)
+	candidateIndexes := make([]int, 0)
 
-	for _, server := range db.Servers {
-		var start time.Time
-		var end time.Time
-		var err error
+	for _, discoveryServer := range db.discoveryServers {
 
-		// All servers that are discoverable on this day are eligible for discovery
-		if len(server.DiscoveryDateRange) != 0 {
-			start, err = time.Parse("2006-01-02T15:04:05", server.DiscoveryDateRange[0])
-			if err != nil {
-				continue
-			}
-			end, err = time.Parse("2006-01-02T15:04:05", server.DiscoveryDateRange[1])
-			if err != nil {
-				continue
-			}
-			if discoveryDate.After(start) && discoveryDate.Before(end) {
-				candidateServers = append(candidateServers, server)
-			}
+		if len(requiredCapabilities) > 0 &&
+			!serverHasAnyCapability(db.Servers[discoveryServer.index], requiredCapabilities) {
+			continue
+		}
+
+		// All servers that are discoverable on this day are eligible for
+		// discovery, as are permanent servers, when enabled. discoveryServers
+		// is in Servers order, so permanent servers are merged into the
+		// candidates in a stable position.
+		if discoveryServer.permanent ||
+			(discoveryDate.After(discoveryServer.start) &&
+				discoveryDate.Before(discoveryServer.end)) {
+			candidateIndexes = append(candidateIndexes, discoveryServer.index)
 		}
 	}
 
-	timeInSeconds := int(discoveryDate.Unix())
-	servers = selectServers(candidateServers, timeInSeconds, discoveryValue)
+	candidateServers, buckets := db.getDiscoveryCandidates(candidateIndexes)
 
-	encodedServerEntries := make([]string, 0)
+	discoveryStrategy := db.discoveryStrategy
+	if discoveryStrategy == nil {
+		discoveryStrategy = &consistentHashingDiscoveryStrategy{}
+	}
+
+	servers = discoveryStrategy.SelectServers(
+		candidateServers, buckets, int(discoveryDate.Unix()), discoveryValue)
 
+	return servers
+}
+
+// initDiscovery parses the Servers discovery date ranges and invalidates
+// the discovery cache. initDiscovery must be called whenever Servers or
+// DiscoverPermanentServers is changed. Servers with a missing or invalid
+// discovery date range are never discovered, unless they are permanent
+// servers and DiscoverPermanentServers is set.
+func (db *Database) initDiscovery() {
+
+	db.discoveryServers = make([]discoveryServer, 0, len(db.Servers))
+
+	for index, server := range db.Servers {
+		if db.DiscoverPermanentServers && server.IsPermanent {
+			db.discoveryServers = append(
+				db.discoveryServers, discoveryServer{index: index, permanent: true})
+			continue
+		}
+		if len(server.DiscoveryDateRange) < 2 {
+			continue
+		}
+		start, err := time.Parse(DISCOVERY_DATE_FORMAT, server.DiscoveryDateRange[0])
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse(DISCOVERY_DATE_FORMAT, server.DiscoveryDateRange[1])
+		if err != nil {
+			continue
+		}
+		db.discoveryServers = append(
+			db.discoveryServers, discoveryServer{index: index, start: start, end: end})
+	}
+
+	db.discoveryCacheMutex.Lock()
+	db.discoveryCache = nil
+	db.discoveryCacheMutex.Unlock()
+}
+
+// getDiscoveryCandidates returns the candidate servers, and their bucket
+// partition, for the specified Servers indexes. The result is cached and
+// reused while the same candidates are requested. The returned slices must
+// not be modified.
+func (db *Database) getDiscoveryCandidates(candidateIndexes []int) ([]Server, [][]Server) {
+
+	db.discoveryCacheMutex.Lock()
+	defer db.discoveryCacheMutex.Unlock()
+
+	cache := db.discoveryCache
+	if cache != nil && equalIndexes(cache.candidateIndexes, candidateIndexes) {
+		return cache.candidates, cache.buckets
+	}
+
+	candidates := make([]Server, len(candidateIndexes))
+	for i, index := range candidateIndexes {
+		candidates[i] = db.Servers[index]
+	}
+
+	var buckets [][]Server
+	if len(candidates) > 0 {
+		buckets = bucketizeServerList(candidates, calculateBucketCount(len(candidates)))
+	}
+
+	db.discoveryCache = &discoveryCache{
+		candidateIndexes: candidateIndexes,
+		candidates:       candidates,
+		buckets:          buckets,
+	}
+
+	return candidates, buckets
+}
+
+func equalIndexes(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	DISCOVERY_DATE_FORMAT                 = "2006-01-02T15:04:05"
+	DISCOVERY_STRATEGY_CONSISTENT_HASHING = "consistent-hashing"
+	DISCOVERY_STRATEGY_WEIGHTED_RANDOM    = "weighted-random"
+)
+
+// DiscoveryStrategy is a discovery algorithm that selects servers to be
+// discovered by a client. servers are the candidate servers which are
+// discoverable at the time of the request, timeInSeconds is the current
+// Unix time, and discoveryValue is derived from the client IP address.
+//
+// buckets is the consistent hashing partition of servers, which Database
+// precomputes and caches while the candidates are unchanged. Strategies
+// which don't partition servers ignore buckets. When buckets is nil,
+// strategies which partition servers compute the partition.
+type DiscoveryStrategy interface {
+	SelectServers(
+		servers []Server, buckets [][]Server, timeInSeconds, discoveryValue int) []Server
+}
+
+// NewDiscoveryStrategy returns the DiscoveryStrategy with the specified name.
+// When name is "", the default DISCOVERY_STRATEGY_CONSISTENT_HASHING
+// strategy is returned.
+func NewDiscoveryStrategy(name string) (DiscoveryStrategy, error) {
+	switch name {
+	case "", DISCOVERY_STRATEGY_CONSISTENT_HASHING:
+		return &consistentHashingDiscoveryStrategy{}, nil
+	case DISCOVERY_STRATEGY_WEIGHTED_RANDOM:
+		return &weightedRandomDiscoveryStrategy{}, nil
+	}
+	return nil, common.ContextError(
+		fmt.Errorf("unknown discovery strategy: %s", name))
+}
+
+// consistentHashingDiscoveryStrategy is the legacy discovery algorithm
+// implemented by selectServers.
+type consistentHashingDiscoveryStrategy struct {
+}
+
+func (strategy *consistentHashingDiscoveryStrategy) SelectServers(
+	servers []Server, buckets [][]Server, timeInSeconds, discoveryValue int) []Server {
+
+	if buckets == nil {
+		return selectServers(servers, timeInSeconds, discoveryValue)
+	}
+
+	return selectServersFromBuckets(buckets, timeInSeconds, discoveryValue)
+}
+
+// weightedRandomDiscoveryStrategy selects a single server at random, with
+// each server's probability of selection proportional to its
+// DiscoveryWeight. A DiscoveryWeight of 0 or less is treated as 1.
+//
+// Unlike the consistent hashing strategy, the selection doesn't depend on
+// the client IP address, so repeated requests from the same client may
+// discover any server.
+type weightedRandomDiscoveryStrategy struct {
+}
+
+func (strategy *weightedRandomDiscoveryStrategy) SelectServers(
+	servers []Server, _ [][]Server, _, _ int) []Server {
+
+	if len(servers) == 0 {
+		return nil
+	}
+
+	getWeight := func(server Server) int64 {
+		if server.DiscoveryWeight <= 0 {
+			return 1
+		}
+		return int64(server.DiscoveryWeight)
+	}
+
+	var totalWeight int64
 	for _, server := range servers {
-		encodedServerEntries = append(encodedServerEntries, db.getEncodedServerEntry(server))
+		totalWeight += getWeight(server)
 	}
 
-	return encodedServerEntries
+	value := prng.Int63n(totalWeight)
+
+	for _, server := range servers {
+		value -= getWeight(server)
+		if value < 0 {
+			return []Server{server}
+		}
+	}
+
+	return nil
+}
+
+// serverHasAnyCapability returns true if any of the capabilities is enabled
+// for the server.
+func serverHasAnyCapability(server Server, capabilities []string) bool {
+	for _, capability := range capabilities {
+		if server.Capabilities[capability] {
+			return true
+		}
+	}
+	return false
 }
 
 // Combine client IP address and time-of-day strategies to give out different
@@ -347,15 +765,11 @@ func (db *Database) DiscoverServers(discoveryValue int) []string {
 // priority: if there are only a couple of servers, for example, IP address alone
 // determines the outcome.
 func selectServers(servers []Server, timeInSeconds, discoveryValue int) []Server {
-	TIME_GRANULARITY := 3600
 
 	if len(servers) == 0 {
 		return nil
 	}
 
-	// Time truncated to an hour
-	timeStrategyValue := timeInSeconds / TIME_GRANULARITY
-
 	// Divide servers into buckets. The bucket count is chosen such that the number
 	// of buckets and the number of items in each bucket are close (using sqrt).
 	// IP address selects the bucket, time selects the item in the bucket.
@@ -367,6 +781,17 @@ func selectServers(servers []Server, timeInSeconds, discoveryValue int) []Server
 
 	buckets := bucketizeServerList(servers, bucketCount)
 
+	return selectServersFromBuckets(buckets, timeInSeconds, discoveryValue)
+}
+
+// selectServersFromBuckets performs the selectServers selection using a
+// precomputed bucket partition.
+func selectServersFromBuckets(buckets [][]Server, timeInSeconds, discoveryValue int) []Server {
+	TIME_GRANULARITY := 3600
+
+	// Time truncated to an hour
+	timeStrategyValue := timeInSeconds / TIME_GRANULARITY
+
 	if len(buckets) == 0 {
 		return nil
 	}
@@ -400,9 +825,6 @@ func bucketizeServerList(servers []Server, bucketCount int) [][]Server {
 	// Both use the same algorithm from:
 	// http://stackoverflow.com/questions/2659900/python-slicing-a-list-into-n-nearly-equal-length-partitions
 
-	// TODO: this partition is constant for fixed Database content, so it could
-	// be done once and cached in the Database ReloadableFile reloadAction.
-
 	buckets := make([][]Server, bucketCount)
 
 	division := float64(len(servers)) / float64(bucketCount)
@@ -420,9 +842,55 @@ func bucketizeServerList(servers []Server, bucketCount int) [][]Server {
 // Newer clients ignore the legacy fields and only utilize the extended (new) config.
 func (db *Database) getEncodedServerEntry(server Server) string {
 
+	extendedConfig, webServerCertificate, ok := db.getServerEntry(server)
+	if !ok {
+		return ""
+	}
+
+	jsonDump, err := json.Marshal(extendedConfig)
+	if err != nil {
+		return ""
+	}
+
+	// Legacy format + extended (new) config
+	prefixString := fmt.Sprintf("%s %s %s %s ", server.IpAddress, server.WebServerPort, server.WebServerSecret, webServerCertificate)
+
+	return hex.EncodeToString(append([]byte(prefixString)[:], []byte(jsonDump)[:]...))
+}
+
+// serverEntry is the extended (new) server entry config. The JSON field
+// names match protocol.ServerEntry.
+type serverEntry struct {
+	IpAddress                     string   `json:"ipAddress"`
+	WebServerPort                 string   `json:"webServerPort"` // not an int
+	WebServerSecret               string   `json:"webServerSecret"`
+	WebServerCertificate          string   `json:"webServerCertificate"`
+	SshPort                       int      `json:"sshPort"`
+	SshUsername                   string   `json:"sshUsername"`
+	SshPassword                   string   `json:"sshPassword"`
+	SshHostKey                    string   `json:"sshHostKey"`
+	SshObfuscatedPort             int      `json:"sshObfuscatedPort"`
+	SshObfuscatedQUICPort         int      `json:"sshObfuscatedQUICPort"`
+	SshObfuscatedTapdancePort     int      `json:"sshObfuscatedTapdancePort"`
+	SshObfuscatedKey              string   `json:"sshObfuscatedKey"`
+	Capabilities                  []string `json:"capabilities"`
+	Region                        string   `json:"region"`
+	MeekServerPort                int      `json:"meekServerPort"`
+	MeekCookieEncryptionPublicKey string   `json:"meekCookieEncryptionPublicKey"`
+	MeekObfuscatedKey             string   `json:"meekObfuscatedKey"`
+	TacticsRequestPublicKey       string   `json:"tacticsRequestPublicKey"`
+	TacticsRequestObfuscatedKey   string   `json:"tacticsRequestObfuscatedKey"`
+	ConfigurationVersion          int      `json:"configurationVersion"`
+}
+
+// getServerEntry returns the extended (new) server entry config for the
+// server, along with the web server certificate in legacy format. ok is false
+// when the server has no host or is missing credentials.
+func (db *Database) getServerEntry(server Server) (*serverEntry, string, bool) {
+
 	host, hostExists := db.Hosts[server.HostId]
 	if !hostExists {
-		return ""
+		return nil, "", false
 	}
 
 	// TCS web server certificate has PEM headers and newlines, so strip those now
@@ -439,33 +907,22 @@ func (db *Database) getEncodedServerEntry(server Server) string {
 
 	// Double-check that we're not giving our blank server credentials
 	if len(server.IpAddress) <= 1 || len(server.WebServerPort) <= 1 || len(server.WebServerSecret) <= 1 || len(webServerCertificate) <= 1 {
-		return ""
+		return nil, "", false
 	}
 
-	// Extended (new) entry fields are in a JSON string
-	var extendedConfig struct {
-		IpAddress                     string   `json:"ipAddress"`
-		WebServerPort                 string   `json:"webServerPort"` // not an int
-		WebServerSecret               string   `json:"webServerSecret"`
-		WebServerCertificate          string   `json:"webServerCertificate"`
-		SshPort                       int      `json:"sshPort"`
-		SshUsername                   string   `json:"sshUsername"`
-		SshPassword                   string   `json:"sshPassword"`
-		SshHostKey                    string   `json:"sshHostKey"`
-		SshObfuscatedPort             int      `json:"sshObfuscatedPort"`
-		SshObfuscatedQUICPort         int      `json:"sshObfuscatedQUICPort"`
-		SshObfuscatedTapdancePort     int      `json:"sshObfuscatedTapdancePort"`
-		SshObfuscatedKey              string   `json:"sshObfuscatedKey"`
-		Capabilities                  []string `json:"capabilities"`
-		Region                        string   `json:"region"`
-		MeekServerPort                int      `json:"meekServerPort"`
-		MeekCookieEncryptionPublicKey string   `json:"meekCookieEncryptionPublicKey"`
-		MeekObfuscatedKey             string   `json:"meekObfuscatedKey"`
-		TacticsRequestPublicKey       string   `json:"tacticsRequestPublicKey"`
-		TacticsRequestObfuscatedKey   string   `json:"tacticsRequestObfuscatedKey"`
-		ConfigurationVersion          int      `json:"configurationVersion"`
+	// The IP address is the first field of the space delimited legacy
+	// format, and is the key clients use to store the server entry. IPv6
+	// addresses contain colons but no spaces, so they're safe in both the
+	// legacy format and the extended config. Values that aren't plain IP
+	// addresses, such as bracketed IPv6 addresses, are rejected by clients
+	// and may break the legacy format, so such servers aren't given out.
+	if net.ParseIP(server.IpAddress) == nil {
+		return nil, "", false
 	}
 
+	// Extended (new) entry fields
+	extendedConfig := &serverEntry{}
+
 	// NOTE: also putting original values in extended config for easier parsing by new clients
 	extendedConfig.IpAddress = server.IpAddress
 	extendedConfig.WebServerPort = server.WebServerPort
@@ -510,33 +967,84 @@ func (db *Database) getEncodedServerEntry(server Server) string {
 	extendedConfig.TacticsRequestPublicKey = host.TacticsRequestPublicKey
 	extendedConfig.TacticsRequestObfuscatedKey = host.TacticsRequestObfuscatedKey
 
-	serverCapabilities := make(map[string]bool, 0)
-	for capability, enabled := range server.Capabilities {
-		serverCapabilities[capability] = enabled
-	}
+	extendedConfig.Capabilities = normalizeCapabilities(server, host)
 
-	if serverCapabilities["UNFRONTED-MEEK"] && host.MeekServerPort == 443 {
-		serverCapabilities["UNFRONTED-MEEK"] = false
-		serverCapabilities["UNFRONTED-MEEK-HTTPS"] = true
-	}
+	extendedConfig.ConfigurationVersion = server.ConfigurationVersion
+
+	return extendedConfig, webServerCertificate, true
+}
+
+// capabilityReplacements lists server capabilities which are given out as a
+// different capability when the condition, on the server and host fields,
+// holds. For example, an unfronted meek server on port 443 is an HTTPS meek
+// server, which clients must dial with TLS.
+var capabilityReplacements = []struct {
+	capability  string
+	replacement string
+	condition   func(server Server, host Host) bool
+}{
+	{
+		"UNFRONTED-MEEK",
+		"UNFRONTED-MEEK-HTTPS",
+		func(_ Server, host Host) bool { return host.MeekServerPort == 443 },
+	},
+}
+
+// capabilityRequirements maps server capabilities to the condition, on the
+// server and host fields, which must hold for the capability to be given
+// out. An enabled capability which fails its condition is omitted, as
+// clients would otherwise select a protocol the server can't accept.
+var capabilityRequirements = map[string]func(server Server, host Host) bool{
+
+	// QUIC clients dial the obfuscated QUIC port.
+	"QUIC": func(server Server, _ Host) bool {
+		return server.SshObfuscatedQUICPort > 0
+	},
+
+	// Session ticket clients dial the meek server with TLS, which requires an
+	// HTTPS meek server; see capabilityReplacements.
+	"UNFRONTED-MEEK-SESSION-TICKET": func(_ Server, host Host) bool {
+		return host.MeekServerPort == 443
+	},
+}
 
-	for capability, enabled := range serverCapabilities {
-		if enabled == true {
-			extendedConfig.Capabilities = append(extendedConfig.Capabilities, capability)
+// normalizeCapabilities returns the sorted list of capabilities to give out
+// in the server entry for server. Enabled server capabilities are first
+// mapped by capabilityReplacements and then filtered by
+// capabilityRequirements. To support a new protocol capability which depends
+// on server or host fields, add an entry to one of these tables.
+func normalizeCapabilities(server Server, host Host) []string {
+
+	normalizedCapabilities := make(map[string]bool)
+
+	for capability, enabled := range server.Capabilities {
+		if !enabled {
+			continue
 		}
+		for _, replacement := range capabilityReplacements {
+			if capability == replacement.capability &&
+				replacement.condition(server, host) {
+
+				capability = replacement.replacement
+				break
+			}
+		}
+		normalizedCapabilities[capability] = true
 	}
 
-	extendedConfig.ConfigurationVersion = server.ConfigurationVersion
+	var capabilities []string
 
-	jsonDump, err := json.Marshal(extendedConfig)
-	if err != nil {
-		return ""
+	for capability := range normalizedCapabilities {
+		requirement, ok := capabilityRequirements[capability]
+		if ok && !requirement(server, host) {
+			continue
+		}
+		capabilities = append(capabilities, capability)
 	}
 
-	// Legacy format + extended (new) config
-	prefixString := fmt.Sprintf("%s %s %s %s ", server.IpAddress, server.WebServerPort, server.WebServerSecret, webServerCertificate)
+	sort.Strings(capabilities)
 
-	return hex.EncodeToString(append([]byte(prefixString)[:], []byte(jsonDump)[:]...))
+	return capabilities
 }
 
 // Parse string of format "ssh-key-type ssh-key".
@@ -20,9 +20,18 @@
 package psinet
 
 import (
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
 
 func TestDiscoveryBuckets(t *testing.T) {
@@ -133,3 +142,975 @@ func TestDiscoveryBuckets(t *testing.T) {
 	})
 
 }
+
+func TestDiscoveryStrategies(t *testing.T) {
+
+	servers := make([]Server, 0)
+	for i := 0; i < 105; i++ {
+		servers = append(servers, Server{Id: fmt.Sprintf("%d", i)})
+	}
+
+	t.Run("consistent hashing selections unchanged", func(t *testing.T) {
+
+		for _, name := range []string{"", DISCOVERY_STRATEGY_CONSISTENT_HASHING} {
+
+			strategy, err := NewDiscoveryStrategy(name)
+			if err != nil {
+				t.Fatalf("NewDiscoveryStrategy failed: %s", err)
+			}
+
+			testCases := []struct {
+				servers        []Server
+				timeInSeconds  int
+				discoveryValue int
+				expectedID     string
+			}{
+				{servers, 0, 0, "0"},
+				{servers, 3600, 0, "1"},
+				{servers, 7200, 5, "50"},
+				{servers, 1234567890, 200, "24"},
+				{servers, 1571184000, 77, "0"},
+				{servers, 1571187600, 255, "20"},
+				{servers[0:3], 1571184000, 77, "2"},
+			}
+
+			for _, testCase := range testCases {
+
+				// The selection is the same whether the strategy computes the
+				// bucket partition or is given the precomputed partition.
+
+				buckets := bucketizeServerList(
+					testCase.servers, calculateBucketCount(len(testCase.servers)))
+
+				for _, testBuckets := range [][][]Server{nil, buckets} {
+					selected := strategy.SelectServers(
+						testCase.servers,
+						testBuckets,
+						testCase.timeInSeconds,
+						testCase.discoveryValue)
+					if len(selected) != 1 || selected[0].Id != testCase.expectedID {
+						t.Fatalf("unexpected selection: %+v", selected)
+					}
+				}
+			}
+
+			if strategy.SelectServers(nil, nil, 0, 0) != nil {
+				t.Fatalf("unexpected selection")
+			}
+		}
+	})
+
+	t.Run("weighted random selections honor weights", func(t *testing.T) {
+
+		strategy, err := NewDiscoveryStrategy(DISCOVERY_STRATEGY_WEIGHTED_RANDOM)
+		if err != nil {
+			t.Fatalf("NewDiscoveryStrategy failed: %s", err)
+		}
+
+		weightedServers := []Server{
+			{Id: "0"},
+			{Id: "1", DiscoveryWeight: 3},
+		}
+
+		counts := make(map[string]int)
+		iterations := 10000
+
+		for i := 0; i < iterations; i++ {
+			selected := strategy.SelectServers(weightedServers, nil, 0, 0)
+			if len(selected) != 1 {
+				t.Fatalf("unexpected selection: %+v", selected)
+			}
+			counts[selected[0].Id] += 1
+		}
+
+		// Expect a 1:3 distribution, with a generous tolerance.
+		if counts["0"] < iterations/8 || counts["0"] > iterations*3/8 {
+			t.Fatalf("unexpected distribution: %+v", counts)
+		}
+
+		if strategy.SelectServers(nil, nil, 0, 0) != nil {
+			t.Fatalf("unexpected selection")
+		}
+	})
+
+	t.Run("unknown strategy", func(t *testing.T) {
+
+		_, err := NewDiscoveryStrategy("unknown")
+		if err == nil {
+			t.Fatalf("NewDiscoveryStrategy unexpected success")
+		}
+	})
+
+	t.Run("database discovery strategy", func(t *testing.T) {
+
+		testDataDirName, err := ioutil.TempDir("", "psiphon-psinet-test")
+		if err != nil {
+			t.Fatalf("TempDir failed: %s", err)
+		}
+		defer os.RemoveAll(testDataDirName)
+
+		filename := filepath.Join(testDataDirName, "psinet.json")
+
+		testCases := []struct {
+			databaseJSON     string
+			expectedStrategy DiscoveryStrategy
+		}{
+			{`{}`, &consistentHashingDiscoveryStrategy{}},
+			{`{"discovery_strategy" : "consistent-hashing"}`, &consistentHashingDiscoveryStrategy{}},
+			{`{"discovery_strategy" : "weighted-random"}`, &weightedRandomDiscoveryStrategy{}},
+			{`{"discovery_strategy" : "unknown"}`, nil},
+		}
+
+		for _, testCase := range testCases {
+
+			err = ioutil.WriteFile(filename, []byte(testCase.databaseJSON), 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+
+			db, err := NewDatabase(filename)
+			if testCase.expectedStrategy == nil {
+				if err == nil {
+					t.Fatalf("NewDatabase unexpected success")
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("NewDatabase failed: %s", err)
+			}
+
+			if reflect.TypeOf(db.discoveryStrategy) !=
+				reflect.TypeOf(testCase.expectedStrategy) {
+				t.Fatalf("unexpected discovery strategy: %T", db.discoveryStrategy)
+			}
+		}
+	})
+}
+
+func TestDatabaseValidation(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-psinet-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	filename := filepath.Join(testDataDirName, "psinet.json")
+
+	validJSON := `
+    {
+        "hosts" : {"host" : {"id" : "host"}},
+        "servers" : [
+            {"id" : "1", "host_id" : "host", "discovery_date_range" : ["2019-01-01T00:00:00", "2030-01-01T00:00:00"]},
+            {"id" : "2", "host_id" : "host"}
+        ],
+        "sponsors" : {
+            "sponsor" : {
+                "home_pages" : {"None" : [{"region" : null, "url" : "https://example.org/"}]},
+                "mobile_home_pages" : {"CA" : [{"region" : "CA", "url" : "https://example.org/mobile"}]}
+            }
+        }
+    }`
+
+	testCases := []struct {
+		description  string
+		databaseJSON string
+		expectError  bool
+	}{
+		{
+			"valid",
+			validJSON,
+			false,
+		},
+		{
+			"unknown host",
+			`{"hosts" : {"host" : {"id" : "host"}}, "servers" : [{"id" : "1", "host_id" : "unknown"}]}`,
+			true,
+		},
+		{
+			"invalid discovery date",
+			`{"hosts" : {"host" : {}}, "servers" : [{"id" : "1", "host_id" : "host", "discovery_date_range" : ["2019-01-01", "2030-01-01T00:00:00"]}]}`,
+			true,
+		},
+		{
+			"incomplete discovery date range",
+			`{"hosts" : {"host" : {}}, "servers" : [{"id" : "1", "host_id" : "host", "discovery_date_range" : ["2019-01-01T00:00:00"]}]}`,
+			true,
+		},
+		{
+			"empty home page region",
+			`{"sponsors" : {"sponsor" : {"home_pages" : {"" : [{"url" : "https://example.org/"}]}}}}`,
+			true,
+		},
+		{
+			"empty home page URL",
+			`{"sponsors" : {"sponsor" : {"home_pages" : {"None" : [{"url" : ""}]}}}}`,
+			true,
+		},
+		{
+			"invalid mobile home page URL",
+			`{"sponsors" : {"sponsor" : {"mobile_home_pages" : {"None" : [{"url" : "https://example.org/%zz"}]}}}}`,
+			true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			err = ioutil.WriteFile(filename, []byte(testCase.databaseJSON), 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+
+			_, err := NewDatabase(filename)
+			if testCase.expectError {
+				if err == nil {
+					t.Fatalf("NewDatabase unexpected success")
+				}
+			} else if err != nil {
+				t.Fatalf("NewDatabase failed: %s", err)
+			}
+		})
+	}
+
+	t.Run("failed reload retains database", func(t *testing.T) {
+
+		err = ioutil.WriteFile(filename, []byte(validJSON), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		db, err := NewDatabase(filename)
+		if err != nil {
+			t.Fatalf("NewDatabase failed: %s", err)
+		}
+
+		err = ioutil.WriteFile(
+			filename,
+			[]byte(`{"hosts" : {}, "servers" : [{"id" : "1", "host_id" : "unknown"}]}`),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		_, err = db.Reload()
+		if err == nil {
+			t.Fatalf("Reload unexpected success")
+		}
+
+		if len(db.Servers) != 2 || len(db.GetHomepages("sponsor", "", false)) != 1 {
+			t.Fatalf("unexpected database state after failed reload")
+		}
+	})
+}
+
+func TestGetHomepages(t *testing.T) {
+
+	db := &Database{
+		Sponsors: map[string]Sponsor{
+			"sponsor": {
+				HomePages: map[string][]HomePage{
+					"CA": {{Url: "https://ca.example.org/?client_region=XX"}},
+					"EU": {{Url: "https://eu.example.org/?client_region=XX"}},
+					"None": {
+						{Url: "https://example.org/?client_region=XX"},
+						{Url: "https://example.org/2"},
+					},
+				},
+			},
+		},
+		HomePageRegionAliases: map[string]string{
+			"DE": "EU",
+			"FR": "EU",
+			"CA": "NA",
+			"US": "NA",
+		},
+	}
+
+	testCases := []struct {
+		description       string
+		clientRegion      string
+		expectedHomepages []string
+	}{
+		{
+			"region hit",
+			"CA",
+			[]string{"https://ca.example.org/?client_region=CA"},
+		},
+		{
+			"alias hit",
+			"DE",
+			[]string{"https://eu.example.org/?client_region=DE"},
+		},
+		{
+			"alias without homepages falls back to default",
+			"US",
+			[]string{"https://example.org/?client_region=US", "https://example.org/2"},
+		},
+		{
+			"default hit",
+			"JP",
+			[]string{"https://example.org/?client_region=JP", "https://example.org/2"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			homepages := db.GetHomepages("sponsor", testCase.clientRegion, false)
+
+			if !reflect.DeepEqual(homepages, testCase.expectedHomepages) {
+				t.Fatalf("unexpected homepages: %+v", homepages)
+			}
+		})
+	}
+}
+
+func TestGetSponsorBanner(t *testing.T) {
+
+	sponsors := map[string]Sponsor{
+		"sponsor": {
+			Banner:            "banner",
+			WebsiteBanner:     "website-banner",
+			WebsiteBannerLink: "https://example.org/",
+		},
+		"default": {
+			Banner: "default-banner",
+		},
+	}
+
+	testCases := []struct {
+		description               string
+		defaultSponsorID          string
+		sponsorID                 string
+		expectedBanner            string
+		expectedWebsiteBanner     string
+		expectedWebsiteBannerLink string
+	}{
+		{"sponsor found", "default", "sponsor", "banner", "website-banner", "https://example.org/"},
+		{"missing sponsor uses default", "default", "missing", "default-banner", "", ""},
+		{"missing sponsor and default", "missing-default", "missing", "", "", ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			db := &Database{
+				Sponsors:         sponsors,
+				DefaultSponsorID: testCase.defaultSponsorID,
+			}
+
+			banner, websiteBanner, websiteBannerLink := db.GetSponsorBanner(testCase.sponsorID)
+
+			if banner != testCase.expectedBanner ||
+				websiteBanner != testCase.expectedWebsiteBanner ||
+				websiteBannerLink != testCase.expectedWebsiteBannerLink {
+
+				t.Fatalf("unexpected banner: '%s', '%s', '%s'",
+					banner, websiteBanner, websiteBannerLink)
+			}
+		})
+	}
+}
+
+func TestGetAvailableRegions(t *testing.T) {
+
+	hosts := map[string]Host{
+		"host1": {Id: "host1", Region: "US"},
+		"host2": {Id: "host2", Region: "CA"},
+		"host3": {Id: "host3", Region: "US"},
+		"host4": {Id: "host4", Region: "DE"},
+		"host5": {Id: "host5"},
+	}
+
+	testCases := []struct {
+		description     string
+		servers         []Server
+		expectedRegions []string
+	}{
+		{
+			"no servers",
+			nil,
+			[]string{},
+		},
+		{
+			"multiple hosts across regions",
+			[]Server{
+				{Id: "1", HostId: "host1"},
+				{Id: "2", HostId: "host2"},
+				{Id: "3", HostId: "host3"},
+				{Id: "4", HostId: "host4"},
+				{Id: "5", HostId: "host1"},
+			},
+			[]string{"CA", "DE", "US"},
+		},
+		{
+			"missing host and empty region skipped",
+			[]Server{
+				{Id: "1", HostId: "host1"},
+				{Id: "2", HostId: "unknown"},
+				{Id: "3", HostId: "host5"},
+			},
+			[]string{"US"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			db := &Database{
+				Hosts:   hosts,
+				Servers: testCase.servers,
+			}
+
+			regions := db.GetAvailableRegions()
+
+			if !reflect.DeepEqual(regions, testCase.expectedRegions) {
+				t.Fatalf("unexpected regions: %+v", regions)
+			}
+		})
+	}
+}
+
+func TestGetUpgradeClientVersion(t *testing.T) {
+
+	versions := func(versions ...string) []ClientVersion {
+		clientVersions := make([]ClientVersion, 0)
+		for _, version := range versions {
+			clientVersions = append(clientVersions, ClientVersion{Version: version})
+		}
+		return clientVersions
+	}
+
+	db := &Database{
+		Versions: map[string][]ClientVersion{
+			"numeric":   versions("100", "101", "102"),
+			"semver":    versions("2.0.0", "2.1.3", "2.1.10", "2.0.9"),
+			"mixed":     versions("1", "2.1", "3", "2.5.1"),
+			"malformed": versions("1.2.3", "x", "1.2.3.4", "-5", "1..2", "", "10.0.0-beta"),
+			"empty":     versions(),
+		},
+	}
+
+	testCases := []struct {
+		description     string
+		clientPlatform  string
+		clientVersion   string
+		expectedUpgrade string
+	}{
+		{"numeric upgrade", "numeric", "100", "102"},
+		{"numeric current", "numeric", "102", ""},
+		{"numeric newer", "numeric", "200", ""},
+		{"semver upgrade", "semver", "2.1.3", "2.1.10"},
+		{"semver patch ordering", "semver", "2.1.9", "2.1.10"},
+		{"semver current", "semver", "2.1.10", ""},
+		{"semver short form", "semver", "2.1", "2.1.10"},
+		{"mixed upgrade", "mixed", "2", "3"},
+		{"mixed semver client", "mixed", "2.5.1", "3"},
+		{"mixed current", "mixed", "3.0.0", ""},
+		{"malformed entries skipped", "malformed", "1.2.2", "1.2.3"},
+		{"malformed client version", "numeric", "1.0-beta", ""},
+		{"empty client version", "numeric", "", ""},
+		{"no versions", "empty", "1", ""},
+		{"unknown platform", "unknown", "1", ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			upgrade := db.GetUpgradeClientVersion(
+				testCase.clientVersion, testCase.clientPlatform)
+
+			if upgrade != testCase.expectedUpgrade {
+				t.Fatalf("unexpected upgrade: '%s'", upgrade)
+			}
+		})
+	}
+}
+
+func TestDiscoverServersRequiredCapabilities(t *testing.T) {
+
+	now := time.Now().UTC()
+	discoveryDateRange := []string{
+		now.Add(-24 * time.Hour).Format("2006-01-02T15:04:05"),
+		now.Add(24 * time.Hour).Format("2006-01-02T15:04:05"),
+	}
+
+	newServer := func(IPAddress string, capabilities map[string]bool) Server {
+		return Server{
+			Id:                   IPAddress,
+			HostId:               "host",
+			IpAddress:            IPAddress,
+			WebServerPort:        "8000",
+			WebServerSecret:      "secret",
+			WebServerCertificate: "certificate",
+			Capabilities:         capabilities,
+			DiscoveryDateRange:   discoveryDateRange,
+		}
+	}
+
+	db := &Database{
+		Hosts: map[string]Host{"host": {Id: "host"}},
+		Servers: []Server{
+			newServer("192.0.2.1", map[string]bool{"OSSH": true}),
+			newServer("192.0.2.2", map[string]bool{"OSSH": true, "QUIC-OSSH": true}),
+			newServer("192.0.2.3", map[string]bool{"SSH": true, "QUIC-OSSH": false}),
+		},
+	}
+	db.initDiscovery()
+
+	testCases := []struct {
+		description          string
+		requiredCapabilities []string
+		expectedIPAddresses  []string
+	}{
+		{
+			"no required capabilities",
+			nil,
+			[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		},
+		{
+			"single capability",
+			[]string{"QUIC-OSSH"},
+			[]string{"192.0.2.2"},
+		},
+		{
+			"any of multiple capabilities",
+			[]string{"SSH", "QUIC-OSSH"},
+			[]string{"192.0.2.2", "192.0.2.3"},
+		},
+		{
+			"no matching servers",
+			[]string{"FRONTED-MEEK"},
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			discoveredIPAddresses := make(map[string]bool)
+
+			for discoveryValue := 0; discoveryValue < 256; discoveryValue++ {
+
+				for _, encodedServerEntry := range db.DiscoverServers(
+					discoveryValue, testCase.requiredCapabilities) {
+
+					serverEntry, err := hex.DecodeString(encodedServerEntry)
+					if err != nil {
+						t.Fatalf("DecodeString failed: %s", err)
+					}
+
+					IPAddress := strings.Split(string(serverEntry), " ")[0]
+					discoveredIPAddresses[IPAddress] = true
+				}
+			}
+
+			// Depending on the discovery time, not all eligible servers are
+			// necessarily discovered.
+
+			if (len(discoveredIPAddresses) == 0) != (len(testCase.expectedIPAddresses) == 0) {
+				t.Fatalf("unexpected discovered servers: %+v", discoveredIPAddresses)
+			}
+
+			for IPAddress := range discoveredIPAddresses {
+				if !common.Contains(testCase.expectedIPAddresses, IPAddress) {
+					t.Fatalf("unexpected discovered server: %s", IPAddress)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeServerEntryIPv6(t *testing.T) {
+
+	db := &Database{
+		Hosts: map[string]Host{"host": {Id: "host"}},
+	}
+
+	newServer := func(IPAddress string) Server {
+		return Server{
+			Id:                   IPAddress,
+			HostId:               "host",
+			IpAddress:            IPAddress,
+			WebServerPort:        "8000",
+			WebServerSecret:      "secret",
+			WebServerCertificate: "certificate",
+			Capabilities:         map[string]bool{"OSSH": true},
+		}
+	}
+
+	testCases := []struct {
+		IPAddress     string
+		expectEncoded bool
+	}{
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+		{"::ffff:192.0.2.1", true},
+		{"[2001:db8::1]", false},
+		{"2001:db8::1 8000", false},
+		{"invalid", false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.IPAddress, func(t *testing.T) {
+
+			encodedServerEntry := db.getEncodedServerEntry(newServer(testCase.IPAddress))
+
+			if (encodedServerEntry != "") != testCase.expectEncoded {
+				t.Fatalf("unexpected encoded server entry: %s", encodedServerEntry)
+			}
+
+			if !testCase.expectEncoded {
+				return
+			}
+
+			serverEntry, err := protocol.DecodeServerEntry(encodedServerEntry, "", "")
+			if err != nil {
+				t.Fatalf("DecodeServerEntry failed: %s", err)
+			}
+
+			if serverEntry.IpAddress != testCase.IPAddress ||
+				serverEntry.WebServerPort != "8000" ||
+				serverEntry.WebServerSecret != "secret" {
+				t.Fatalf("unexpected server entry: %+v", serverEntry)
+			}
+
+			// The legacy format prefix must still split into its four fields.
+
+			legacyServerEntry, err := hex.DecodeString(encodedServerEntry)
+			if err != nil {
+				t.Fatalf("DecodeString failed: %s", err)
+			}
+
+			fields := strings.SplitN(string(legacyServerEntry), " ", 5)
+			if len(fields) != 5 ||
+				fields[0] != testCase.IPAddress ||
+				fields[1] != "8000" ||
+				fields[2] != "secret" ||
+				fields[3] != "certificate" {
+				t.Fatalf("unexpected legacy fields: %+v", fields)
+			}
+		})
+	}
+}
+
+func TestNormalizeCapabilities(t *testing.T) {
+
+	testCases := []struct {
+		description          string
+		capabilities         map[string]bool
+		meekServerPort       int
+		quicPort             int
+		expectedCapabilities []string
+	}{
+		{
+			"no capabilities",
+			nil,
+			0,
+			0,
+			nil,
+		},
+		{
+			"disabled capabilities",
+			map[string]bool{"OSSH": true, "SSH": false},
+			0,
+			0,
+			[]string{"OSSH"},
+		},
+		{
+			"unfronted meek",
+			map[string]bool{"UNFRONTED-MEEK": true},
+			80,
+			0,
+			[]string{"UNFRONTED-MEEK"},
+		},
+		{
+			"unfronted meek on 443",
+			map[string]bool{"UNFRONTED-MEEK": true, "OSSH": true},
+			443,
+			0,
+			[]string{"OSSH", "UNFRONTED-MEEK-HTTPS"},
+		},
+		{
+			"session ticket on 443",
+			map[string]bool{"UNFRONTED-MEEK": true, "UNFRONTED-MEEK-SESSION-TICKET": true},
+			443,
+			0,
+			[]string{"UNFRONTED-MEEK-HTTPS", "UNFRONTED-MEEK-SESSION-TICKET"},
+		},
+		{
+			"session ticket without HTTPS",
+			map[string]bool{"UNFRONTED-MEEK": true, "UNFRONTED-MEEK-SESSION-TICKET": true},
+			80,
+			0,
+			[]string{"UNFRONTED-MEEK"},
+		},
+		{
+			"QUIC",
+			map[string]bool{"OSSH": true, "QUIC": true},
+			0,
+			4000,
+			[]string{"OSSH", "QUIC"},
+		},
+		{
+			"QUIC without port",
+			map[string]bool{"OSSH": true, "QUIC": true},
+			0,
+			0,
+			[]string{"OSSH"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			capabilities := normalizeCapabilities(
+				Server{
+					Capabilities:          testCase.capabilities,
+					SshObfuscatedQUICPort: testCase.quicPort,
+				},
+				Host{
+					MeekServerPort: testCase.meekServerPort,
+				})
+
+			if !reflect.DeepEqual(capabilities, testCase.expectedCapabilities) {
+				t.Fatalf("unexpected capabilities: %+v", capabilities)
+			}
+		})
+	}
+}
+
+func TestDiscoverPermanentServers(t *testing.T) {
+
+	now := time.Now().UTC()
+	currentDateRange := []string{
+		now.Add(-24 * time.Hour).Format("2006-01-02T15:04:05"),
+		now.Add(24 * time.Hour).Format("2006-01-02T15:04:05"),
+	}
+	expiredDateRange := []string{
+		now.Add(-48 * time.Hour).Format("2006-01-02T15:04:05"),
+		now.Add(-24 * time.Hour).Format("2006-01-02T15:04:05"),
+	}
+
+	newServer := func(IPAddress string, isPermanent bool, discoveryDateRange []string) Server {
+		return Server{
+			Id:                   IPAddress,
+			HostId:               "host",
+			IpAddress:            IPAddress,
+			WebServerPort:        "8000",
+			WebServerSecret:      "secret",
+			WebServerCertificate: "certificate",
+			IsPermanent:          isPermanent,
+			DiscoveryDateRange:   discoveryDateRange,
+		}
+	}
+
+	servers := []Server{
+		newServer("192.0.2.1", true, nil),
+		newServer("192.0.2.2", false, currentDateRange),
+		newServer("192.0.2.3", true, expiredDateRange),
+		newServer("192.0.2.4", false, expiredDateRange),
+		newServer("192.0.2.5", false, nil),
+		newServer("192.0.2.6", true, currentDateRange),
+	}
+
+	testCases := []struct {
+		description              string
+		discoverPermanentServers bool
+		expectedIPAddresses      []string
+	}{
+		{
+			"date ranged discovery",
+			false,
+			[]string{"192.0.2.2", "192.0.2.6"},
+		},
+		{
+			"discover permanent servers",
+			true,
+			[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.6"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			db := &Database{
+				Hosts:                    map[string]Host{"host": {Id: "host"}},
+				Servers:                  servers,
+				DiscoverPermanentServers: testCase.discoverPermanentServers,
+			}
+			db.initDiscovery()
+
+			discoveredIPAddresses := make(map[string]bool)
+
+			for discoveryValue := 0; discoveryValue < 256; discoveryValue++ {
+				for _, encodedServerEntry := range db.DiscoverServers(discoveryValue, nil) {
+					serverEntry, err := hex.DecodeString(encodedServerEntry)
+					if err != nil {
+						t.Fatalf("DecodeString failed: %s", err)
+					}
+					discoveredIPAddresses[strings.Split(string(serverEntry), " ")[0]] = true
+				}
+			}
+
+			for IPAddress := range discoveredIPAddresses {
+				if !common.Contains(testCase.expectedIPAddresses, IPAddress) {
+					t.Fatalf("unexpected discovered server: %s", IPAddress)
+				}
+			}
+
+			// Depending on the discovery time, not all eligible servers are
+			// necessarily discovered, so also check the candidates, which
+			// are expected to be in Servers order.
+
+			var candidateIPAddresses []string
+			for _, server := range db.discoveryCache.candidates {
+				candidateIPAddresses = append(candidateIPAddresses, server.IpAddress)
+			}
+
+			if !reflect.DeepEqual(candidateIPAddresses, testCase.expectedIPAddresses) {
+				t.Fatalf("unexpected candidate servers: %+v", candidateIPAddresses)
+			}
+		})
+	}
+}
+
+func TestDiscoverServersReload(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-psinet-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	filename := filepath.Join(testDataDirName, "psinet.json")
+
+	now := time.Now().UTC()
+	start := now.Add(-24 * time.Hour).Format("2006-01-02T15:04:05")
+	end := now.Add(24 * time.Hour).Format("2006-01-02T15:04:05")
+
+	writeDatabase := func(IPAddresses []string) {
+		servers := make([]string, 0)
+		for _, IPAddress := range IPAddresses {
+			servers = append(servers, fmt.Sprintf(
+				`{"id" : "%s", "host_id" : "host", "ip_address" : "%s", `+
+					`"web_server_port" : "8000", "web_server_secret" : "secret", `+
+					`"web_server_certificate" : "certificate", `+
+					`"discovery_date_range" : ["%s", "%s"]}`,
+				IPAddress, IPAddress, start, end))
+		}
+		databaseJSON := fmt.Sprintf(
+			`{"hosts" : {"host" : {"id" : "host"}}, "servers" : [%s]}`,
+			strings.Join(servers, ","))
+		err := ioutil.WriteFile(filename, []byte(databaseJSON), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	discoverIPAddresses := func(db *Database) map[string]bool {
+		discoveredIPAddresses := make(map[string]bool)
+		for discoveryValue := 0; discoveryValue < 256; discoveryValue++ {
+			for _, encodedServerEntry := range db.DiscoverServers(discoveryValue, nil) {
+				serverEntry, err := hex.DecodeString(encodedServerEntry)
+				if err != nil {
+					t.Fatalf("DecodeString failed: %s", err)
+				}
+				discoveredIPAddresses[strings.Split(string(serverEntry), " ")[0]] = true
+			}
+		}
+		return discoveredIPAddresses
+	}
+
+	writeDatabase([]string{"192.0.2.1", "192.0.2.2"})
+
+	db, err := NewDatabase(filename)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %s", err)
+	}
+
+	discoveredIPAddresses := discoverIPAddresses(db)
+	if len(discoveredIPAddresses) == 0 || discoveredIPAddresses["192.0.2.3"] {
+		t.Fatalf("unexpected discovered servers: %+v", discoveredIPAddresses)
+	}
+
+	// Test: reload replaces the cached candidates and buckets
+
+	writeDatabase([]string{"192.0.2.3"})
+
+	reloaded, err := db.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+	if !reloaded {
+		t.Fatalf("Reload unexpectedly skipped")
+	}
+
+	discoveredIPAddresses = discoverIPAddresses(db)
+	if len(discoveredIPAddresses) != 1 || !discoveredIPAddresses["192.0.2.3"] {
+		t.Fatalf("unexpected discovered servers: %+v", discoveredIPAddresses)
+	}
+
+	// Test: a reload with an unknown discovery strategy fails and leaves the
+	// previous servers and discovery state in place
+
+	writeDatabase([]string{"192.0.2.4", "192.0.2.5", "192.0.2.6"})
+	databaseJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	databaseJSON = []byte(strings.Replace(
+		string(databaseJSON), `{"hosts"`, `{"discovery_strategy" : "unknown", "hosts"`, 1))
+	err = ioutil.WriteFile(filename, databaseJSON, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	_, err = db.Reload()
+	if err == nil {
+		t.Fatalf("Reload unexpected success")
+	}
+
+	if len(db.Servers) != 1 || db.DiscoveryStrategy != "" {
+		t.Fatalf("unexpected database state after failed reload")
+	}
+
+	discoveredIPAddresses = discoverIPAddresses(db)
+	if len(discoveredIPAddresses) != 1 || !discoveredIPAddresses["192.0.2.3"] {
+		t.Fatalf("unexpected discovered servers: %+v", discoveredIPAddresses)
+	}
+}
+
+func BenchmarkDiscoverServers(b *testing.B) {
+
+	now := time.Now().UTC()
+	discoveryDateRange := []string{
+		now.Add(-24 * time.Hour).Format("2006-01-02T15:04:05"),
+		now.Add(24 * time.Hour).Format("2006-01-02T15:04:05"),
+	}
+
+	db := &Database{
+		Hosts: map[string]Host{"host": {Id: "host"}},
+	}
+
+	for i := 0; i < 10000; i++ {
+		db.Servers = append(db.Servers, Server{
+			Id:                   fmt.Sprintf("%d", i),
+			HostId:               "host",
+			IpAddress:            fmt.Sprintf("192.0.%d.%d", i/256, i%256),
+			WebServerPort:        "8000",
+			WebServerSecret:      "secret",
+			WebServerCertificate: "certificate",
+			DiscoveryDateRange:   discoveryDateRange,
+		})
+	}
+
+	db.initDiscovery()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		db.DiscoverServers(i%256, nil)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
+)
+
+const (
+	SELF_TEST_TIMEOUT = 10 * time.Second
+)
+
+// selfTestSupportsTunnelProtocol indicates whether the self-test can dial
+// the tunnel protocol. Meek, Marionette, and TapDance require client
+// components that aren't available to the server and are not tested.
+func selfTestSupportsTunnelProtocol(tunnelProtocol string) bool {
+	return !protocol.TunnelProtocolUsesMeek(tunnelProtocol) &&
+		!protocol.TunnelProtocolUsesMarionette(tunnelProtocol) &&
+		!protocol.TunnelProtocolUsesTapdance(tunnelProtocol)
+}
+
+// runSelfTest makes a loopback connection to each configured and supported
+// tunnel protocol listener, and performs the obfuscation layer, when used,
+// and the SSH key exchange, verifying the server host key. Tunnel protocols
+// are tested sequentially, each with a timeout of SELF_TEST_TIMEOUT, to
+// limit the load added by the self-test. Results are logged and recorded
+// for GetMetrics.
+//
+// The self-test runs once the listeners are bound, including when the server
+// is degraded; tunnel protocols whose listeners failed to bind are recorded
+// as failed without being dialed.
+func (server *TunnelServer) runSelfTest() {
+
+	if atomic.LoadInt32(&server.listenersReady) != 1 {
+		return
+	}
+
+	config := server.sshServer.support.Config
+
+	bindFailedTunnelProtocols := server.getBindFailedTunnelProtocols()
+
+	var tunnelProtocols []string
+	for tunnelProtocol := range config.TunnelProtocolPorts {
+		if selfTestSupportsTunnelProtocol(tunnelProtocol) {
+			tunnelProtocols = append(tunnelProtocols, tunnelProtocol)
+		}
+	}
+	sort.Strings(tunnelProtocols)
+
+	results := make(map[string]int64)
+
+	for _, tunnelProtocol := range tunnelProtocols {
+
+		select {
+		case <-server.shutdownBroadcast:
+			return
+		default:
+		}
+
+		startTime := time.Now()
+
+		var err error
+		if common.Contains(bindFailedTunnelProtocols, tunnelProtocol) {
+			err = common.ContextError(errors.New("listener bind failed"))
+		} else {
+			err = server.selfTestTunnelProtocol(tunnelProtocol)
+		}
+
+		logFields := LogFields{
+			"tunnelProtocol": tunnelProtocol,
+			"duration":       time.Since(startTime) / time.Millisecond,
+		}
+
+		if err != nil {
+			results[tunnelProtocol] = 0
+			logFields["error"] = err
+			log.WithContextFields(logFields).Warning("self-test failed")
+		} else {
+			results[tunnelProtocol] = 1
+			log.WithContextFields(logFields).Info("self-test succeeded")
+		}
+	}
+
+	server.selfTestMutex.Lock()
+	server.selfTestResults = results
+	server.selfTestMutex.Unlock()
+}
+
+func (server *TunnelServer) selfTestTunnelProtocol(tunnelProtocol string) error {
+
+	config := server.sshServer.support.Config
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), SELF_TEST_TIMEOUT)
+	defer cancelFunc()
+
+	address := fmt.Sprintf(
+		"%s:%d", config.ServerIPAddress, config.TunnelProtocolPorts[tunnelProtocol])
+
+	var conn net.Conn
+
+	if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
+
+		remoteAddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		packetConn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		obfuscationPaddingSeed, err := prng.NewSeed()
+		if err != nil {
+			packetConn.Close()
+			return common.ContextError(err)
+		}
+
+		// quic.Dial closes packetConn on failure.
+		conn, err = quic.Dial(
+			ctx,
+			packetConn,
+			remoteAddr,
+			address,
+			"",
+			config.ObfuscatedSSHKey,
+			obfuscationPaddingSeed)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+	} else {
+
+		dialer := &net.Dialer{}
+		var err error
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	defer conn.Close()
+
+	// Interrupt the handshake when the timeout expires.
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	sshConn := conn
+
+	if protocol.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
+
+		obfuscationPaddingSeed, err := prng.NewSeed()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		sshConn, err = obfuscator.NewObfuscatedSSHConn(
+			obfuscator.OBFUSCATION_CONN_MODE_CLIENT,
+			conn,
+			config.ObfuscatedSSHKey,
+			obfuscationPaddingSeed,
+			nil,
+			nil)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	expectedPublicKey := server.sshServer.sshHostKey.PublicKey().Marshal()
+
+	// The host key callback aborts the SSH handshake once the server host
+	// key is verified. The self-test stops short of SSH authentication, so
+	// no client is registered and no server_tunnel is logged.
+	var hostKeyVerified int32
+
+	sshClientConfig := &ssh.ClientConfig{
+		HostKeyCallback: func(_ string, _ net.Addr, publicKey ssh.PublicKey) error {
+			if !bytes.Equal(expectedPublicKey, publicKey.Marshal()) {
+				return common.ContextError(errors.New("unexpected host public key"))
+			}
+			atomic.StoreInt32(&hostKeyVerified, 1)
+			return errors.New("host key verified")
+		},
+	}
+
+	// As in the client, the obfuscated SSH protocols omit Encrypt-then-MAC
+	// hash algorithms, and TUNNEL_PROTOCOL_SSH expects a randomized server
+	// KEX.
+	if protocol.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
+		sshClientConfig.NoEncryptThenMACHash = true
+	} else if config.ObfuscatedSSHKey != "" {
+		var err error
+		sshClientConfig.PeerKEXPRNGSeed, err = protocol.DeriveSSHServerKEXPRNGSeed(
+			config.ObfuscatedSSHKey)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	_, _, _, err := ssh.NewClientConn(sshConn, "", sshClientConfig)
+	if atomic.LoadInt32(&hostKeyVerified) != 1 {
+		if err == nil {
+			err = errors.New("host key not verified")
+		}
+		return common.ContextError(err)
+	}
+
+	return nil
+}
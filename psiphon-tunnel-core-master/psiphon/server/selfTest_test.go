@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestSelfTest(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-self-test-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+	err = ioutil.WriteFile(trafficRulesFilename, []byte(`{"DefaultRules" : {}}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	getFreePort := func(network string) int {
+		if network == "udp" {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("ListenPacket failed: %s", err)
+			}
+			defer conn.Close()
+			return conn.LocalAddr().(*net.UDPAddr).Port
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+
+	tunnelProtocolPorts := map[string]int{
+		protocol.TUNNEL_PROTOCOL_SSH:                 getFreePort("tcp"),
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH:      getFreePort("tcp"),
+		protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH: getFreePort("udp"),
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK:      getFreePort("tcp"),
+	}
+
+	serverConfigJSON, _, _, _, _, err := GenerateConfig(
+		&GenerateConfigParams{
+			ServerIPAddress:     "127.0.0.1",
+			TunnelProtocolPorts: tunnelProtocolPorts,
+		})
+	if err != nil {
+		t.Fatalf("GenerateConfig failed: %s", err)
+	}
+
+	serverConfigJSON, err = MergeConfigJSON(
+		serverConfigJSON,
+		[]byte(fmt.Sprintf(`
+        {
+            "LogFilename" : "",
+            "TrafficRulesFilename" : "%s",
+            "OSLConfigFilename" : "",
+            "PsinetDatabaseFilename" : "",
+            "TacticsConfigFilename" : ""
+        }`, trafficRulesFilename)))
+	if err != nil {
+		t.Fatalf("MergeConfigJSON failed: %s", err)
+	}
+
+	config, err := LoadConfig(serverConfigJSON)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	supportServices, err := NewSupportServices(config)
+	if err != nil {
+		t.Fatalf("NewSupportServices failed: %s", err)
+	}
+
+	shutdownBroadcast := make(chan struct{})
+
+	tunnelServer, err := NewTunnelServer(supportServices, shutdownBroadcast)
+	if err != nil {
+		t.Fatalf("NewTunnelServer failed: %s", err)
+	}
+	supportServices.TunnelServer = tunnelServer
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- tunnelServer.Run()
+	}()
+
+	defer func() {
+		close(shutdownBroadcast)
+		err := <-runErr
+		if err != nil {
+			t.Fatalf("Run failed: %s", err)
+		}
+	}()
+
+	// Wait for all listeners to be bound.
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !tunnelServer.IsReady() {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel server not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Test: supported tunnel protocols succeed; meek is not tested
+
+	tunnelServer.runSelfTest()
+
+	expectedResults := map[string]int64{
+		protocol.TUNNEL_PROTOCOL_SSH:                 1,
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH:      1,
+		protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH: 1,
+	}
+
+	results := tunnelServer.GetMetrics()["self_test"]
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Fatalf("unexpected self-test results: %+v", results)
+	}
+
+	if tunnelServer.GetEstablishedClientCount() != 0 {
+		t.Fatalf("unexpected established clients")
+	}
+
+	// Test: an unreachable listener fails
+
+	failingConfig := *config
+	failingConfig.TunnelProtocolPorts = map[string]int{
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: getFreePort("tcp"),
+	}
+
+	failingTunnelServer := &TunnelServer{
+		listenersReady:    1,
+		shutdownBroadcast: shutdownBroadcast,
+		sshServer: &sshServer{
+			support: &SupportServices{
+				Config:          &failingConfig,
+				TrafficRulesSet: supportServices.TrafficRulesSet,
+			},
+			sshHostKey:           tunnelServer.sshServer.sshHostKey,
+			clients:              make(map[string]*sshClient),
+			listenerAcceptCounts: make(map[string]*listenerAcceptCounts),
+		},
+	}
+
+	failingTunnelServer.runSelfTest()
+
+	results = failingTunnelServer.GetMetrics()["self_test"]
+	if !reflect.DeepEqual(
+		results, map[string]int64{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 0}) {
+		t.Fatalf("unexpected self-test results: %+v", results)
+	}
+
+	// Test: a degraded server runs the self-test; the listeners that are
+	// bound succeed and the listener that failed to bind fails
+
+	degradedTunnelServer := &TunnelServer{
+		listenersReady:    1,
+		shutdownBroadcast: shutdownBroadcast,
+		bindFailedTunnelProtocols: []string{
+			protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH},
+		sshServer: tunnelServer.sshServer,
+	}
+
+	if !degradedTunnelServer.IsDegraded() {
+		t.Fatalf("tunnel server not degraded")
+	}
+
+	degradedTunnelServer.runSelfTest()
+
+	expectedResults = map[string]int64{
+		protocol.TUNNEL_PROTOCOL_SSH:                 1,
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH:      1,
+		protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH: 0,
+	}
+
+	results = degradedTunnelServer.GetMetrics()["self_test"]
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Fatalf("unexpected self-test results: %+v", results)
+	}
+}
@@ -414,6 +414,24 @@ func TestUnusedAuthorization(t *testing.T) {
 		})
 }
 
+func TestAuthorizationKeyRotation(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:         "OSSH",
+			enableSSHAPIRequests:   true,
+			doHotReload:            false,
+			doDefaultSponsorID:     false,
+			denyTrafficRules:       false,
+			requireAuthorization:   true,
+			omitAuthorization:      false,
+			doTunneledWebRequest:   true,
+			doTunneledNTPRequest:   true,
+			forceFragmenting:       false,
+			forceLivenessTest:      false,
+			rotateAuthorizationKey: true,
+		})
+}
+
 func TestTCPOnlySLOK(t *testing.T) {
 	runServer(t,
 		&runServerConfig{
@@ -466,18 +484,19 @@ func TestLivenessTest(t *testing.T) {
 }
 
 type runServerConfig struct {
-	tunnelProtocol       string
-	tlsProfile           string
-	enableSSHAPIRequests bool
-	doHotReload          bool
-	doDefaultSponsorID   bool
-	denyTrafficRules     bool
-	requireAuthorization bool
-	omitAuthorization    bool
-	doTunneledWebRequest bool
-	doTunneledNTPRequest bool
-	forceFragmenting     bool
-	forceLivenessTest    bool
+	tunnelProtocol         string
+	tlsProfile             string
+	enableSSHAPIRequests   bool
+	doHotReload            bool
+	doDefaultSponsorID     bool
+	denyTrafficRules       bool
+	requireAuthorization   bool
+	omitAuthorization      bool
+	doTunneledWebRequest   bool
+	doTunneledNTPRequest   bool
+	forceFragmenting       bool
+	forceLivenessTest      bool
+	rotateAuthorizationKey bool
 }
 
 var (
@@ -500,6 +519,23 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		Keys: []*accesscontrol.VerificationKey{accessControlVerificationKey},
 	}
 
+	if runConfig.rotateAuthorizationKey {
+
+		// Simulate a key rotation transition period, where the key ring
+		// contains both the new key and the previous key, and the client
+		// presents an authorization signed with the previous key.
+
+		previousAccessControlSigningKey, previousAccessControlVerificationKey, err := accesscontrol.NewKeyPair(accessType)
+		if err != nil {
+			t.Fatalf("error creating access control key pair: %s", err)
+		}
+
+		accessControlVerificationKeyRing.Keys = append(
+			accessControlVerificationKeyRing.Keys, previousAccessControlVerificationKey)
+
+		accessControlSigningKey = previousAccessControlSigningKey
+	}
+
 	var authorizationID [32]byte
 
 	clientAuthorization, err := accesscontrol.IssueAuthorization(
@@ -787,6 +823,7 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	clientConfig.LocalSocksProxyPort = localSOCKSProxyPort
 	clientConfig.LocalHttpProxyPort = localHTTPProxyPort
 	clientConfig.EmitSLOKs = true
+	clientConfig.EmitPeriodicMetricsPeriodMilliseconds = 250
 
 	if !runConfig.omitAuthorization {
 		clientConfig.Authorizations = []string{clientAuthorization}
@@ -859,6 +896,9 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	homepageReceived := make(chan struct{}, 1)
 	slokSeeded := make(chan struct{}, 1)
 	clientConnectedNotice := make(chan map[string]interface{}, 1)
+	periodicMetricsHandshakes := make(chan struct{}, 1)
+	periodicMetricsBytesReceived := make(chan struct{}, 1)
+	unthrottledBytesRemainingReceived := make(chan struct{}, 1)
 
 	psiphon.SetNoticeWriter(psiphon.NewNoticeReceiver(
 		func(notice []byte) {
@@ -894,6 +934,24 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 				case clientConnectedNotice <- payload:
 				default:
 				}
+
+			case "PeriodicMetrics":
+				if payload["handshakes"].(float64) > 0 {
+					sendNotificationReceived(periodicMetricsHandshakes)
+				}
+				if payload["received"].(float64) > 0 {
+					sendNotificationReceived(periodicMetricsBytesReceived)
+				}
+
+			case "UnthrottledBytesRemaining":
+				readBytes := int(payload["readBytes"].(float64))
+				writeBytes := int(payload["writeBytes"].(float64))
+				if readBytes > livenessTestSize || writeBytes > livenessTestSize {
+					// TODO: wrong goroutine for t.FatalNow()
+					t.Fatalf("unexpected unthrottled bytes remaining: %d, %d",
+						readBytes, writeBytes)
+				}
+				sendNotificationReceived(unthrottledBytesRemainingReceived)
 			}
 		}))
 
@@ -944,6 +1002,8 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 
 	waitOnNotification(t, tunnelsEstablished, timeoutSignal, "tunnel establish timeout exceeded")
 	waitOnNotification(t, homepageReceived, timeoutSignal, "homepage received timeout exceeded")
+	waitOnNotification(t, periodicMetricsHandshakes, timeoutSignal, "periodic metrics handshakes timeout exceeded")
+	waitOnNotification(t, unthrottledBytesRemainingReceived, timeoutSignal, "unthrottled bytes remaining timeout exceeded")
 
 	expectTrafficFailure := runConfig.denyTrafficRules || (runConfig.omitAuthorization && runConfig.requireAuthorization)
 
@@ -984,6 +1044,12 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		}
 	}
 
+	// Test: periodic metrics report tunneled bytes transferred
+
+	if runConfig.doTunneledWebRequest && !expectTrafficFailure {
+		waitOnNotification(t, periodicMetricsBytesReceived, timeoutSignal, "periodic metrics bytes timeout exceeded")
+	}
+
 	// Test: await SLOK payload
 
 	if !expectTrafficFailure {
@@ -1270,7 +1336,7 @@ func makeTunneledNTPRequestAttempt(
 		}
 		defer serverUDPConn.Close()
 
-		udpgwPreambleSize := 11 // see writeUdpgwPreamble
+		udpgwPreambleSize := 7 + len(destinationIP) // see writeUdpgwPreamble
 		buffer := make([]byte, udpgwProtocolMaxMessageSize)
 		packetSize, clientAddr, err := serverUDPConn.ReadFromUDP(
 			buffer[udpgwPreambleSize:])
@@ -24,6 +24,7 @@
 package server
 
 import (
+	"encoding/base64"
 	"fmt"
 	"math/rand"
 	"os"
@@ -34,10 +35,12 @@ import (
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/accesscontrol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/server/psinet"
+	"github.com/sirupsen/logrus"
 )
 
 // RunServices initializes support functions including logging and GeoIP services;
@@ -64,9 +67,24 @@ func RunServices(configJSON []byte) error {
 		log.WithContextFields(LogFields{"error": err}).Error("init support services failed")
 		return common.ContextError(err)
 	}
+	defer supportServices.MetricsSink.Close()
 
 	log.WithContextFields(*common.GetBuildInfo().ToMap()).Info("startup")
 
+	// Duplicate verification key IDs are tolerated, as the first matching key
+	// is used, but likely indicate a key ring misconfiguration.
+	duplicateKeyIDs := accesscontrol.GetDuplicateVerificationKeyIDs(
+		&config.AccessControlVerificationKeyRing)
+	if len(duplicateKeyIDs) > 0 {
+		encodedKeyIDs := make([]string, len(duplicateKeyIDs))
+		for i, keyID := range duplicateKeyIDs {
+			encodedKeyIDs[i] = base64.StdEncoding.EncodeToString(keyID)
+		}
+		log.WithContextFields(
+			LogFields{"keyIDs": encodedKeyIDs}).Warning(
+			"duplicate access control verification key IDs")
+	}
+
 	waitGroup := new(sync.WaitGroup)
 	shutdownBroadcast := make(chan struct{})
 	errors := make(chan error)
@@ -123,7 +141,7 @@ func RunServices(configJSON []byte) error {
 				case <-shutdownBroadcast:
 					return
 				case <-ticker.C:
-					logServerLoad(tunnelServer)
+					logServerLoad(supportServices)
 				}
 			}
 		}()
@@ -146,6 +164,23 @@ func RunServices(configJSON []byte) error {
 		}()
 	}
 
+	if config.RunSelfTest() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			ticker := time.NewTicker(time.Duration(config.SelfTestPeriodSeconds) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-shutdownBroadcast:
+					return
+				case <-ticker.C:
+					tunnelServer.runSelfTest()
+				}
+			}
+		}()
+	}
+
 	if config.RunWebServer() {
 		waitGroup.Add(1)
 		go func() {
@@ -158,6 +193,18 @@ func RunServices(configJSON []byte) error {
 		}()
 	}
 
+	if config.RunHealthCheckServer() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			err := RunHealthCheckServer(supportServices, shutdownBroadcast)
+			select {
+			case errors <- err:
+			default:
+			}
+		}()
+	}
+
 	// The tunnel server is always run; it launches multiple
 	// listeners, depending on which tunnel protocols are enabled.
 	waitGroup.Add(1)
@@ -233,7 +280,7 @@ loop:
 			case signalProcessProfiles <- *new(struct{}):
 			default:
 			}
-			logServerLoad(tunnelServer)
+			logServerLoad(supportServices)
 
 		case <-systemStopSignal:
 			log.WithContext().Info("shutdown by system")
@@ -311,7 +358,9 @@ func outputProcessProfiles(config *Config, filenameSuffix string) {
 	}
 }
 
-func logServerLoad(server *TunnelServer) {
+func logServerLoad(support *SupportServices) {
+
+	server := support.TunnelServer
 
 	protocolStats, regionStats := server.GetLoadStats()
 
@@ -325,7 +374,22 @@ func logServerLoad(server *TunnelServer) {
 		serverLoad[protocol] = stats
 	}
 
-	log.LogRawFieldsWithTimestamp(serverLoad)
+	authorizationKeyIDStats := server.GetAuthorizationKeyIDStats()
+	if len(authorizationKeyIDStats) > 0 {
+		serverLoad["verified_authorization_key_ids"] = authorizationKeyIDStats
+	}
+
+	metrics, collisions := common.MetricsSources{
+		server, support.GeoIPService}.MergeMetrics()
+	if len(collisions) > 0 {
+		log.WithContextFields(
+			LogFields{"metrics": collisions}).Warning("duplicate server load metrics")
+	}
+	for name, value := range metrics {
+		serverLoad[name] = value
+	}
+
+	support.MetricsSink.SendMetrics(serverLoad)
 
 	for region, regionProtocolStats := range regionStats {
 
@@ -338,8 +402,43 @@ func logServerLoad(server *TunnelServer) {
 			serverLoad[protocol] = stats
 		}
 
-		log.LogRawFieldsWithTimestamp(serverLoad)
+		support.MetricsSink.SendMetrics(serverLoad)
+	}
+}
+
+// ValidateServerConfig loads and validates a JSON encoded server config,
+// along with the traffic rules, OSL, psinet, GeoIP, blocklist, and tactics
+// files it references and the SSH host key, without initializing logging or
+// starting any server components. ValidateServerConfig performs the same
+// validation as RunServices, and may be used to check a config before it is
+// deployed. The first error encountered is returned.
+func ValidateServerConfig(configJSON []byte) error {
+
+	config, err := LoadConfig(configJSON)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	_, err = logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		return common.ContextError(fmt.Errorf("LogLevel: %s", err))
+	}
+
+	supportServices, err := NewSupportServices(config)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// The metrics sink, which may hold a socket, is only used by a running
+	// server.
+	defer supportServices.MetricsSink.Close()
+
+	_, err = NewTunnelServer(supportServices, make(chan struct{}))
+	if err != nil {
+		return common.ContextError(err)
 	}
+
+	return nil
 }
 
 // SupportServices carries common and shared data components
@@ -358,6 +457,7 @@ type SupportServices struct {
 	PacketTunnelServer *tun.Server
 	TacticsServer      *tactics.Server
 	Blocklist          *Blocklist
+	MetricsSink        MetricsSink
 }
 
 // NewSupportServices initializes a new SupportServices.
@@ -365,33 +465,37 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 
 	trafficRulesSet, err := NewTrafficRulesSet(config.TrafficRulesFilename)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, common.ContextError(
+			fmt.Errorf("TrafficRulesFilename %s: %s", config.TrafficRulesFilename, err))
 	}
 
 	oslConfig, err := osl.NewConfig(config.OSLConfigFilename)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, common.ContextError(
+			fmt.Errorf("OSLConfigFilename %s: %s", config.OSLConfigFilename, err))
 	}
 
 	psinetDatabase, err := psinet.NewDatabase(config.PsinetDatabaseFilename)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, common.ContextError(
+			fmt.Errorf("PsinetDatabaseFilename %s: %s", config.PsinetDatabaseFilename, err))
 	}
 
-	geoIPService, err := NewGeoIPService(
-		config.GeoIPDatabaseFilenames, config.DiscoveryValueHMACKey)
+	geoIPService, err := NewGeoIPService(config)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
 	dnsResolver, err := NewDNSResolver(config.DNSResolverIPAddress)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, common.ContextError(
+			fmt.Errorf("DNSResolverIPAddress %s: %s", config.DNSResolverIPAddress, err))
 	}
 
 	blocklist, err := NewBlocklist(config.BlocklistFilename)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, common.ContextError(
+			fmt.Errorf("BlocklistFilename %s: %s", config.BlocklistFilename, err))
 	}
 
 	tacticsServer, err := tactics.NewServer(
@@ -399,6 +503,12 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		getTacticsAPIParameterLogFieldFormatter(),
 		getTacticsAPIParameterValidator(config),
 		config.TacticsConfigFilename)
+	if err != nil {
+		return nil, common.ContextError(
+			fmt.Errorf("TacticsConfigFilename %s: %s", config.TacticsConfigFilename, err))
+	}
+
+	metricsSink, err := NewMetricsSink(config)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -412,6 +522,7 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		DNSResolver:     dnsResolver,
 		TacticsServer:   tacticsServer,
 		Blocklist:       blocklist,
+		MetricsSink:     metricsSink,
 	}, nil
 }
 
@@ -437,8 +548,15 @@ func (support *SupportServices) Reload() {
 	// In both the traffic rules and OSL cases, there is some impact from state
 	// reset, so the reset should be avoided where possible.
 	reloadPostActions := map[common.Reloader]func(){
-		support.TrafficRulesSet: func() { support.TunnelServer.ResetAllClientTrafficRules() },
-		support.OSLConfig:       func() { support.TunnelServer.ResetAllClientOSLConfigs() },
+		support.TrafficRulesSet: func() {
+			support.TunnelServer.ResetAllClientTrafficRules()
+			support.TunnelServer.UpdateDrainedListeners()
+			log.WithContextFields(
+				LogFields{
+					"status": support.TunnelServer.GetTunnelProtocolDrainStatus(),
+				}).Info("tunnel protocol drain status")
+		},
+		support.OSLConfig: func() { support.TunnelServer.ResetAllClientOSLConfigs() },
 	}
 
 	for _, reloader := range reloaders {
@@ -24,8 +24,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
 
 const (
@@ -93,6 +98,13 @@ type TrafficRulesSet struct {
 	// is applied to all client ISPs.
 	MeekRateLimiterISPs []string
 
+	// MeekRateLimiterASNs, if set, limits application of the meek
+	// late-stage rate limiter to clients in the specified list of GeoIP
+	// autonomous system numbers. Each ASN is a decimal number string; for
+	// example, "13335". When omitted or empty, meek rate limiting, if
+	// configured, is applied to all client ASNs.
+	MeekRateLimiterASNs []string
+
 	// MeekRateLimiterGarbageCollectionTriggerCount specifies the number of
 	// rate limit events after which garbage collection is manually triggered
 	// in order to reclaim memory used by rate limited and other rejected
@@ -106,6 +118,38 @@ type TrafficRulesSet struct {
 	// A default of 600 is used when
 	// MeekRateLimiterReapHistoryFrequencySeconds is 0.
 	MeekRateLimiterReapHistoryFrequencySeconds int
+
+	// DrainTunnelProtocols is a list of tunnel protocols to drain. New
+	// tunnels are not established, while existing tunnels continue until
+	// they disconnect. Plain TCP listeners for drained tunnel protocols are
+	// closed, so that new connections are refused. Meek, QUIC, Marionette,
+	// and TapDance listeners remain open, and new connections are accepted
+	// and then closed. A drained tunnel protocol is "draining" while tunnels
+	// remain, and then "drained"; see TunnelServer.GetTunnelProtocolDrainStatus.
+	// Remove a tunnel protocol from this list, and hot reload, to resume
+	// establishing new tunnels.
+	DrainTunnelProtocols []string
+
+	// DisableHttpsRequestRegexesSponsorIDs is a list of sponsor IDs for which
+	// no HTTPS request stats regexes are sent to clients in the handshake
+	// response, overriding the sponsor regexes in the psinet database. This
+	// is a temporary operational control for neutralizing a problematic
+	// regex without a psinet database change; the psinet database remains the
+	// source of truth, and the sponsor ID should be removed from this list,
+	// and hot reloaded, once the sponsor regexes are fixed. The sponsor ID is
+	// matched against the sponsor ID reported by the client.
+	DisableHttpsRequestRegexesSponsorIDs []string
+
+	// FailClosedOnReloadError specifies that, when a hot reload fails due to
+	// an invalid traffic rules file, the traffic rules are replaced with a
+	// restrictive ruleset which denies all port forwards, and an alert is
+	// logged. By default, a failed reload leaves the previous rules in
+	// place.
+	//
+	// The value in effect is the one from the last successfully loaded
+	// file. The deny-all rules remain in place until a valid file is
+	// loaded.
+	FailClosedOnReloadError bool
 }
 
 // TrafficRulesFilter defines a filter to match against client attributes.
@@ -125,6 +169,25 @@ type TrafficRulesFilter struct {
 	// match this filter. When omitted or empty, any client ISP matches.
 	ISPs []string
 
+	// ClientPlatforms is a list of client platforms, one of which the client
+	// must report in its handshake in order to match this filter. Values are
+	// compared against the normalized client_platform handshake parameter:
+	// "Android", "iOS", or "Windows". When omitted or empty, any client
+	// platform matches.
+	ClientPlatforms []string
+
+	// TimeOfDayUTC specifies a daily time window, in UTC, within which the
+	// current time must fall in order to match this filter. The window may
+	// wrap midnight; for example, a Start of "22:00" and an End of "06:00".
+	// When omitted, any time of day matches.
+	//
+	// The window is checked only when traffic rules are selected for a
+	// client: when the tunnel is established, at handshake, and when traffic
+	// rules are reloaded or authorizations are revoked. A connected client's
+	// traffic rules don't change when the current time crosses a window
+	// boundary.
+	TimeOfDayUTC *TimeOfDayWindow
+
 	// APIProtocol specifies whether the client must use the SSH
 	// API protocol (when "ssh") or the web API protocol (when "web").
 	// When omitted or blank, any API protocol matches.
@@ -132,10 +195,20 @@ type TrafficRulesFilter struct {
 
 	// HandshakeParameters specifies handshake API parameter names and
 	// a list of values, one of which must be specified to match this
-	// filter. Only scalar string API parameters may be filtered.
+	// filter. Scalar string and string array API parameters may be
+	// filtered; for string array parameters, any one element must match.
 	// Values may be patterns containing the '*' wildcard.
 	HandshakeParameters map[string][]string
 
+	// HandshakeParameterComparisons specifies handshake API parameter
+	// names and a list of numeric comparisons, one of which must be
+	// satisfied to match this filter. Each comparison is an operator, one
+	// of ">=", "<=", ">", or "<", followed by an integer; e.g., ">=200".
+	// Only client values that are integer strings can satisfy a
+	// comparison. As with HandshakeParameters, for string array
+	// parameters, any one element must match.
+	HandshakeParameterComparisons map[string][]string
+
 	// AuthorizedAccessTypes specifies a list of access types, at least
 	// one of which the client must have presented an active authorization
 	// for and which must not be revoked.
@@ -148,6 +221,69 @@ type TrafficRulesFilter struct {
 	AuthorizationsRevoked bool
 }
 
+// TimeOfDayWindow specifies a daily time window. Start and End are "HH:MM"
+// 24-hour clock times. Start is inclusive and End is exclusive. When End is
+// earlier than Start, the window wraps midnight.
+type TimeOfDayWindow struct {
+	Start string
+	End   string
+}
+
+// parseTimeOfDay parses a "HH:MM" time and returns the number of minutes
+// since midnight.
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks that the window Start and End are valid and distinct.
+func (window *TimeOfDayWindow) Validate() error {
+
+	start, err := parseTimeOfDay(window.Start)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	end, err := parseTimeOfDay(window.End)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if start == end {
+		return common.ContextError(errors.New("empty time of day window"))
+	}
+
+	return nil
+}
+
+// Contains returns true when the time of day of t, which is assumed to be
+// in the window's time zone, falls within the window. Contains returns
+// false for an invalid window.
+func (window *TimeOfDayWindow) Contains(t time.Time) bool {
+
+	start, err := parseTimeOfDay(window.Start)
+	if err != nil {
+		return false
+	}
+
+	end, err := parseTimeOfDay(window.End)
+	if err != nil {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+
+	if start < end {
+		return minute >= start && minute < end
+	}
+
+	// The window wraps midnight.
+	return minute >= start || minute < end
+}
+
 // TrafficRules specify the limits placed on client traffic.
 type TrafficRules struct {
 
@@ -200,6 +336,21 @@ type TrafficRules struct {
 	// DefaultRules, DEFAULT_MAX_UDP_PORT_FORWARD_COUNT is used.
 	MaxUDPPortForwardCount *int
 
+	// MaxAggregateTCPPortForwardCount is the maximum number of TCP port
+	// forwards, dialing or established, shared by all clients that select
+	// the same rules; that is, all clients matching the same FilteredRules
+	// entry, or all clients matching no entry and using DefaultRules. Once
+	// the shared limit is reached, new TCP port forwards are rejected.
+	// A value of 0 specifies no maximum, which is the default.
+	// Limitation: rules are identified by position, so editing the order
+	// of FilteredRules in a hot reload will reassign in-use counts.
+	MaxAggregateTCPPortForwardCount *int
+
+	// aggregateTCPPortForwardKey identifies the selected rules for
+	// MaxAggregateTCPPortForwardCount accounting. It is set only when
+	// MaxAggregateTCPPortForwardCount is > 0.
+	aggregateTCPPortForwardKey string
+
 	// AllowTCPPorts specifies a whitelist of TCP ports that
 	// are permitted for port forwarding. When set, only ports
 	// in the list are accessible to clients.
@@ -219,6 +370,32 @@ type TrafficRules struct {
 	// forwards where the client sends an IP address. Domain
 	// names aren not resolved before checking AllowSubnets.
 	AllowSubnets []string
+
+	// AllowDomains specifies a list of domain names for which all
+	// TCP ports are allowed. This list is consulted if a port is
+	// disallowed by the AllowTCPPorts configuration and the client
+	// sends a domain name, rather than an IP address, as the port
+	// forward destination. Entries may be patterns containing the
+	// '*' wildcard; for example, "*.example.com". Entries must be
+	// lowercase, and client domain names are lowercased before
+	// matching.
+	//
+	// AllowDomains is checked only after the domain name has been
+	// resolved, so a domain name that fails to resolve is rejected
+	// regardless of AllowDomains. Destinations the client sends as IP
+	// addresses, including all packet tunnel traffic, never match
+	// AllowDomains, as no reverse lookup is performed.
+	AllowDomains []string
+
+	// MaxTunnelProtocolBytes specifies, per tunnel protocol, the
+	// maximum number of port forward bytes, up and down combined,
+	// each client may transfer. Once a client tunneling with a listed
+	// protocol reaches its limit, new port forwards are rejected and
+	// established port forwards are closed. Tunnel protocols not in
+	// the map are unlimited. When omitted, all tunnel protocols are
+	// unlimited.
+	// Limitation: established packet tunnel flows are not interrupted.
+	MaxTunnelProtocolBytes map[string]int64
 }
 
 // RateLimits is a clone of common.RateLimits with pointers
@@ -226,11 +403,12 @@ type TrafficRules struct {
 // omitted values in JSON serialized traffic rules.
 // See common.RateLimits for field descriptions.
 type RateLimits struct {
-	ReadUnthrottledBytes  *int64
-	ReadBytesPerSecond    *int64
-	WriteUnthrottledBytes *int64
-	WriteBytesPerSecond   *int64
-	CloseAfterExhausted   *bool
+	ReadUnthrottledBytes                 *int64
+	ReadBytesPerSecond                   *int64
+	WriteUnthrottledBytes                *int64
+	WriteBytesPerSecond                  *int64
+	CloseAfterExhausted                  *bool
+	CloseAfterExhaustedGraceMilliseconds *int64
 
 	// UnthrottleFirstTunnelOnly specifies whether any
 	// ReadUnthrottledBytes/WriteUnthrottledBytes apply
@@ -241,11 +419,12 @@ type RateLimits struct {
 // CommonRateLimits converts a RateLimits to a common.RateLimits.
 func (rateLimits *RateLimits) CommonRateLimits() common.RateLimits {
 	return common.RateLimits{
-		ReadUnthrottledBytes:  *rateLimits.ReadUnthrottledBytes,
-		ReadBytesPerSecond:    *rateLimits.ReadBytesPerSecond,
-		WriteUnthrottledBytes: *rateLimits.WriteUnthrottledBytes,
-		WriteBytesPerSecond:   *rateLimits.WriteBytesPerSecond,
-		CloseAfterExhausted:   *rateLimits.CloseAfterExhausted,
+		ReadUnthrottledBytes:                 *rateLimits.ReadUnthrottledBytes,
+		ReadBytesPerSecond:                   *rateLimits.ReadBytesPerSecond,
+		WriteUnthrottledBytes:                *rateLimits.WriteUnthrottledBytes,
+		WriteBytesPerSecond:                  *rateLimits.WriteBytesPerSecond,
+		CloseAfterExhausted:                  *rateLimits.CloseAfterExhausted,
+		CloseAfterExhaustedGraceMilliseconds: *rateLimits.CloseAfterExhaustedGraceMilliseconds,
 	}
 }
 
@@ -261,11 +440,22 @@ func NewTrafficRulesSet(filename string) (*TrafficRulesSet, error) {
 		func(fileContent []byte) error {
 			var newSet TrafficRulesSet
 			err := json.Unmarshal(fileContent, &newSet)
-			if err != nil {
-				return common.ContextError(err)
+			if err == nil {
+				err = newSet.Validate()
 			}
-			err = newSet.Validate()
 			if err != nil {
+				if set.FailClosedOnReloadError {
+
+					// Report success so that the post-reload action resets
+					// existing clients to the deny-all rules.
+					set.setDenyAllRules()
+
+					log.WithContextFields(
+						LogFields{"error": err}).Error(
+						"traffic rules reload failed: denying all port forwards")
+
+					return nil
+				}
 				return common.ContextError(err)
 			}
 
@@ -274,8 +464,12 @@ func NewTrafficRulesSet(filename string) (*TrafficRulesSet, error) {
 			set.MeekRateLimiterThresholdSeconds = newSet.MeekRateLimiterThresholdSeconds
 			set.MeekRateLimiterRegions = newSet.MeekRateLimiterRegions
 			set.MeekRateLimiterISPs = newSet.MeekRateLimiterISPs
+			set.MeekRateLimiterASNs = newSet.MeekRateLimiterASNs
 			set.MeekRateLimiterGarbageCollectionTriggerCount = newSet.MeekRateLimiterGarbageCollectionTriggerCount
 			set.MeekRateLimiterReapHistoryFrequencySeconds = newSet.MeekRateLimiterReapHistoryFrequencySeconds
+			set.DrainTunnelProtocols = newSet.DrainTunnelProtocols
+			set.DisableHttpsRequestRegexesSponsorIDs = newSet.DisableHttpsRequestRegexesSponsorIDs
+			set.FailClosedOnReloadError = newSet.FailClosedOnReloadError
 			set.DefaultRules = newSet.DefaultRules
 			set.FilteredRules = newSet.FilteredRules
 
@@ -290,6 +484,18 @@ func NewTrafficRulesSet(filename string) (*TrafficRulesSet, error) {
 	return set, nil
 }
 
+// setDenyAllRules replaces the default and filtered rules with rules that
+// deny all TCP and UDP port forwards. An empty AllowTCPPorts or AllowUDPPorts
+// list permits all ports, so the lists are set to contain only port 0, which
+// is never a valid port forward destination.
+func (set *TrafficRulesSet) setDenyAllRules() {
+	set.DefaultRules = TrafficRules{
+		AllowTCPPorts: []int{0},
+		AllowUDPPorts: []int{0},
+	}
+	set.FilteredRules = nil
+}
+
 // Validate checks for correct input formats in a TrafficRulesSet.
 func (set *TrafficRulesSet) Validate() error {
 
@@ -308,18 +514,35 @@ func (set *TrafficRulesSet) Validate() error {
 		}
 	}
 
+	for _, ASN := range set.MeekRateLimiterASNs {
+		_, err := strconv.ParseUint(ASN, 10, 32)
+		if err != nil {
+			return common.ContextError(
+				fmt.Errorf("invalid MeekRateLimiterASNs value: %s", ASN))
+		}
+	}
+
+	for _, tunnelProtocol := range set.DrainTunnelProtocols {
+		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+			return common.ContextError(
+				fmt.Errorf("invalid DrainTunnelProtocols value: %s", tunnelProtocol))
+		}
+	}
+
 	validateTrafficRules := func(rules *TrafficRules) error {
 
 		if (rules.RateLimits.ReadUnthrottledBytes != nil && *rules.RateLimits.ReadUnthrottledBytes < 0) ||
 			(rules.RateLimits.ReadBytesPerSecond != nil && *rules.RateLimits.ReadBytesPerSecond < 0) ||
 			(rules.RateLimits.WriteUnthrottledBytes != nil && *rules.RateLimits.WriteUnthrottledBytes < 0) ||
 			(rules.RateLimits.WriteBytesPerSecond != nil && *rules.RateLimits.WriteBytesPerSecond < 0) ||
+			(rules.RateLimits.CloseAfterExhaustedGraceMilliseconds != nil && *rules.RateLimits.CloseAfterExhaustedGraceMilliseconds < 0) ||
 			(rules.DialTCPPortForwardTimeoutMilliseconds != nil && *rules.DialTCPPortForwardTimeoutMilliseconds < 0) ||
 			(rules.IdleTCPPortForwardTimeoutMilliseconds != nil && *rules.IdleTCPPortForwardTimeoutMilliseconds < 0) ||
 			(rules.IdleUDPPortForwardTimeoutMilliseconds != nil && *rules.IdleUDPPortForwardTimeoutMilliseconds < 0) ||
 			(rules.MaxTCPDialingPortForwardCount != nil && *rules.MaxTCPDialingPortForwardCount < 0) ||
 			(rules.MaxTCPPortForwardCount != nil && *rules.MaxTCPPortForwardCount < 0) ||
-			(rules.MaxUDPPortForwardCount != nil && *rules.MaxUDPPortForwardCount < 0) {
+			(rules.MaxUDPPortForwardCount != nil && *rules.MaxUDPPortForwardCount < 0) ||
+			(rules.MaxAggregateTCPPortForwardCount != nil && *rules.MaxAggregateTCPPortForwardCount < 0) {
 			return common.ContextError(
 				errors.New("TrafficRules values must be >= 0"))
 		}
@@ -332,6 +555,26 @@ func (set *TrafficRulesSet) Validate() error {
 			}
 		}
 
+		for _, domain := range rules.AllowDomains {
+			if domain == "" ||
+				domain != strings.ToLower(domain) ||
+				strings.ContainsAny(domain, " /:") {
+				return common.ContextError(
+					fmt.Errorf("invalid domain: %s", domain))
+			}
+		}
+
+		for tunnelProtocol, maxBytes := range rules.MaxTunnelProtocolBytes {
+			if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+				return common.ContextError(
+					fmt.Errorf("invalid tunnel protocol: %s", tunnelProtocol))
+			}
+			if maxBytes < 0 {
+				return common.ContextError(
+					errors.New("MaxTunnelProtocolBytes values must be >= 0"))
+			}
+		}
+
 		return nil
 	}
 
@@ -342,18 +585,41 @@ func (set *TrafficRulesSet) Validate() error {
 
 	for _, filteredRule := range set.FilteredRules {
 
+		for _, clientPlatform := range filteredRule.Filter.ClientPlatforms {
+			if clientPlatform == "" {
+				return common.ContextError(
+					errors.New("invalid client platform"))
+			}
+		}
+
+		if filteredRule.Filter.TimeOfDayUTC != nil {
+			err := filteredRule.Filter.TimeOfDayUTC.Validate()
+			if err != nil {
+				return common.ContextError(
+					fmt.Errorf("invalid time of day window: %s", err))
+			}
+		}
+
 		for paramName := range filteredRule.Filter.HandshakeParameters {
-			validParamName := false
-			for _, paramSpec := range baseRequestParams {
-				if paramSpec.name == paramName {
-					validParamName = true
-					break
-				}
+			if !isBaseRequestParamName(paramName) {
+				return common.ContextError(
+					fmt.Errorf("invalid parameter name: %s", paramName))
 			}
-			if !validParamName {
+		}
+
+		for paramName, comparisons := range filteredRule.Filter.HandshakeParameterComparisons {
+			if !isBaseRequestParamName(paramName) {
 				return common.ContextError(
 					fmt.Errorf("invalid parameter name: %s", paramName))
 			}
+
+			for _, comparison := range comparisons {
+				_, _, err := parseNumericComparison(comparison)
+				if err != nil {
+					return common.ContextError(
+						fmt.Errorf("invalid parameter comparison: %s %s", paramName, err))
+				}
+			}
 		}
 
 		err := validateTrafficRules(&filteredRule.Rules)
@@ -377,6 +643,23 @@ func (set *TrafficRulesSet) GetTrafficRules(
 	set.ReloadableFile.RLock()
 	defer set.ReloadableFile.RUnlock()
 
+	trafficRules, _ := set.selectTrafficRules(
+		isFirstTunnelInSession, tunnelProtocol, geoIPData, state, time.Now().UTC())
+
+	return trafficRules
+}
+
+// selectTrafficRules implements GetTrafficRules, evaluating any
+// TimeOfDayUTC filters at the specified time. The index of the matching
+// FilteredRules entry, or -1 when no entry matched, is also returned. The
+// caller must hold the ReloadableFile read lock.
+func (set *TrafficRulesSet) selectTrafficRules(
+	isFirstTunnelInSession bool,
+	tunnelProtocol string,
+	geoIPData GeoIPData,
+	state handshakeState,
+	now time.Time) (TrafficRules, int) {
+
 	// Start with a copy of the DefaultRules, and then select the first
 	// matching Rules from FilteredTrafficRules, taking only the explicitly
 	// specified fields from that Rules.
@@ -415,6 +698,10 @@ func (set *TrafficRulesSet) GetTrafficRules(
 		trafficRules.RateLimits.CloseAfterExhausted = new(bool)
 	}
 
+	if trafficRules.RateLimits.CloseAfterExhaustedGraceMilliseconds == nil {
+		trafficRules.RateLimits.CloseAfterExhaustedGraceMilliseconds = new(int64)
+	}
+
 	if trafficRules.RateLimits.UnthrottleFirstTunnelOnly == nil {
 		trafficRules.RateLimits.UnthrottleFirstTunnelOnly = new(bool)
 	}
@@ -453,6 +740,10 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			intPtr(DEFAULT_MAX_UDP_PORT_FORWARD_COUNT)
 	}
 
+	if trafficRules.MaxAggregateTCPPortForwardCount == nil {
+		trafficRules.MaxAggregateTCPPortForwardCount = new(int)
+	}
+
 	if trafficRules.AllowTCPPorts == nil {
 		trafficRules.AllowTCPPorts = make([]int, 0)
 	}
@@ -465,10 +756,318 @@ func (set *TrafficRulesSet) GetTrafficRules(
 		trafficRules.AllowSubnets = make([]string, 0)
 	}
 
+	if trafficRules.AllowDomains == nil {
+		trafficRules.AllowDomains = make([]string, 0)
+	}
+
+	if trafficRules.MaxTunnelProtocolBytes == nil {
+		trafficRules.MaxTunnelProtocolBytes = make(map[string]int64)
+	}
+
+	index := set.getFilteredRulesIndex(tunnelProtocol, geoIPData, state, now)
+
+	if index != -1 {
+
+		filteredRules := set.FilteredRules[index]
+
+		// This is the first match. Override defaults using provided fields from selected rules.
+
+		if filteredRules.Rules.RateLimits.ReadUnthrottledBytes != nil {
+			trafficRules.RateLimits.ReadUnthrottledBytes = filteredRules.Rules.RateLimits.ReadUnthrottledBytes
+		}
+
+		if filteredRules.Rules.RateLimits.ReadBytesPerSecond != nil {
+			trafficRules.RateLimits.ReadBytesPerSecond = filteredRules.Rules.RateLimits.ReadBytesPerSecond
+		}
+
+		if filteredRules.Rules.RateLimits.WriteUnthrottledBytes != nil {
+			trafficRules.RateLimits.WriteUnthrottledBytes = filteredRules.Rules.RateLimits.WriteUnthrottledBytes
+		}
+
+		if filteredRules.Rules.RateLimits.WriteBytesPerSecond != nil {
+			trafficRules.RateLimits.WriteBytesPerSecond = filteredRules.Rules.RateLimits.WriteBytesPerSecond
+		}
+
+		if filteredRules.Rules.RateLimits.CloseAfterExhausted != nil {
+			trafficRules.RateLimits.CloseAfterExhausted = filteredRules.Rules.RateLimits.CloseAfterExhausted
+		}
+
+		if filteredRules.Rules.RateLimits.CloseAfterExhaustedGraceMilliseconds != nil {
+			trafficRules.RateLimits.CloseAfterExhaustedGraceMilliseconds = filteredRules.Rules.RateLimits.CloseAfterExhaustedGraceMilliseconds
+		}
+
+		if filteredRules.Rules.RateLimits.UnthrottleFirstTunnelOnly != nil {
+			trafficRules.RateLimits.UnthrottleFirstTunnelOnly = filteredRules.Rules.RateLimits.UnthrottleFirstTunnelOnly
+		}
+
+		if filteredRules.Rules.DialTCPPortForwardTimeoutMilliseconds != nil {
+			trafficRules.DialTCPPortForwardTimeoutMilliseconds = filteredRules.Rules.DialTCPPortForwardTimeoutMilliseconds
+		}
+
+		if filteredRules.Rules.IdleTCPPortForwardTimeoutMilliseconds != nil {
+			trafficRules.IdleTCPPortForwardTimeoutMilliseconds = filteredRules.Rules.IdleTCPPortForwardTimeoutMilliseconds
+		}
+
+		if filteredRules.Rules.IdleUDPPortForwardTimeoutMilliseconds != nil {
+			trafficRules.IdleUDPPortForwardTimeoutMilliseconds = filteredRules.Rules.IdleUDPPortForwardTimeoutMilliseconds
+		}
+
+		if filteredRules.Rules.MaxTCPDialingPortForwardCount != nil {
+			trafficRules.MaxTCPDialingPortForwardCount = filteredRules.Rules.MaxTCPDialingPortForwardCount
+		}
+
+		if filteredRules.Rules.MaxTCPPortForwardCount != nil {
+			trafficRules.MaxTCPPortForwardCount = filteredRules.Rules.MaxTCPPortForwardCount
+		}
+
+		if filteredRules.Rules.MaxUDPPortForwardCount != nil {
+			trafficRules.MaxUDPPortForwardCount = filteredRules.Rules.MaxUDPPortForwardCount
+		}
+
+		if filteredRules.Rules.MaxAggregateTCPPortForwardCount != nil {
+			trafficRules.MaxAggregateTCPPortForwardCount = filteredRules.Rules.MaxAggregateTCPPortForwardCount
+		}
+
+		if filteredRules.Rules.AllowTCPPorts != nil {
+			trafficRules.AllowTCPPorts = filteredRules.Rules.AllowTCPPorts
+		}
+
+		if filteredRules.Rules.AllowUDPPorts != nil {
+			trafficRules.AllowUDPPorts = filteredRules.Rules.AllowUDPPorts
+		}
+
+		if filteredRules.Rules.AllowSubnets != nil {
+			trafficRules.AllowSubnets = filteredRules.Rules.AllowSubnets
+		}
+
+		if filteredRules.Rules.AllowDomains != nil {
+			trafficRules.AllowDomains = filteredRules.Rules.AllowDomains
+		}
+
+		if filteredRules.Rules.MaxTunnelProtocolBytes != nil {
+			trafficRules.MaxTunnelProtocolBytes = filteredRules.Rules.MaxTunnelProtocolBytes
+		}
+	}
+
+	if *trafficRules.MaxAggregateTCPPortForwardCount > 0 {
+		if index == -1 {
+			trafficRules.aggregateTCPPortForwardKey = TRAFFIC_RULES_SOURCE_DEFAULT_RULES
+		} else {
+			trafficRules.aggregateTCPPortForwardKey = fmt.Sprintf("FilteredRules[%d]", index)
+		}
+	}
+
+	if *trafficRules.RateLimits.UnthrottleFirstTunnelOnly && !isFirstTunnelInSession {
+		trafficRules.RateLimits.ReadUnthrottledBytes = new(int64)
+		trafficRules.RateLimits.WriteUnthrottledBytes = new(int64)
+	}
+
+	log.WithContextFields(LogFields{"trafficRules": trafficRules}).Debug("selected traffic rules")
+
+	return trafficRules, index
+}
+
+// TrafficRulesDerivationStep is one step in the derivation of a client's
+// effective traffic rules, as reported by ExplainTrafficRules. Source
+// identifies the origin of the step and Fields lists the TrafficRules
+// fields, such as "RateLimits.ReadBytesPerSecond", set by that step.
+type TrafficRulesDerivationStep struct {
+	Source string
+	Fields []string
+}
+
+const (
+	TRAFFIC_RULES_SOURCE_BUILT_IN_DEFAULTS            = "built-in defaults"
+	TRAFFIC_RULES_SOURCE_DEFAULT_RULES                = "DefaultRules"
+	TRAFFIC_RULES_SOURCE_UNTHROTTLE_FIRST_TUNNEL_ONLY = "UnthrottleFirstTunnelOnly"
+)
+
+// ExplainTrafficRules returns the same TrafficRules as GetTrafficRules
+// along with an ordered derivation trace describing how the rules were
+// selected: which fields were taken from DefaultRules or built-in defaults,
+// which fields were overridden by the first matching FilteredRules entry,
+// identified as "FilteredRules[<index>]", and whether
+// UnthrottleFirstTunnelOnly zeroed the unthrottled byte budgets.
+//
+// ExplainTrafficRules is intended for inspection and debugging and is not
+// optimized; use GetTrafficRules for enforcement.
+func (set *TrafficRulesSet) ExplainTrafficRules(
+	isFirstTunnelInSession bool,
+	tunnelProtocol string,
+	geoIPData GeoIPData,
+	state handshakeState) (TrafficRules, []TrafficRulesDerivationStep) {
+
+	set.ReloadableFile.RLock()
+	defer set.ReloadableFile.RUnlock()
+
+	trafficRules, index := set.selectTrafficRules(
+		isFirstTunnelInSession, tunnelProtocol, geoIPData, state, time.Now().UTC())
+
+	var trace []TrafficRulesDerivationStep
+
+	defaultFields := getSpecifiedTrafficRulesFields(&set.DefaultRules)
+
+	var filteredFields []string
+	if index != -1 {
+		filteredFields = getSpecifiedTrafficRulesFields(&set.FilteredRules[index].Rules)
+	}
+
+	// Built-in defaults are applied only to fields that are still unset
+	// after DefaultRules and any matching FilteredRules entry.
+
+	var builtInFields []string
+	for _, field := range getSpecifiedTrafficRulesFields(&trafficRules) {
+		if !common.Contains(defaultFields, field) &&
+			!common.Contains(filteredFields, field) {
+			builtInFields = append(builtInFields, field)
+		}
+	}
+
+	trace = append(trace, TrafficRulesDerivationStep{
+		Source: TRAFFIC_RULES_SOURCE_BUILT_IN_DEFAULTS,
+		Fields: builtInFields,
+	})
+
+	trace = append(trace, TrafficRulesDerivationStep{
+		Source: TRAFFIC_RULES_SOURCE_DEFAULT_RULES,
+		Fields: defaultFields,
+	})
+
+	if index != -1 {
+		trace = append(trace, TrafficRulesDerivationStep{
+			Source: fmt.Sprintf("FilteredRules[%d]", index),
+			Fields: filteredFields,
+		})
+	}
+
+	if *trafficRules.RateLimits.UnthrottleFirstTunnelOnly && !isFirstTunnelInSession {
+		trace = append(trace, TrafficRulesDerivationStep{
+			Source: TRAFFIC_RULES_SOURCE_UNTHROTTLE_FIRST_TUNNEL_ONLY,
+			Fields: []string{
+				"RateLimits.ReadUnthrottledBytes",
+				"RateLimits.WriteUnthrottledBytes",
+			},
+		})
+	}
+
+	return trafficRules, trace
+}
+
+// TrafficRulesClientAttributes are synthetic client attributes, input to
+// DescribeTrafficRulesFor. The fields correspond to the client attributes
+// used by GetTrafficRules. When HandshakeCompleted is false, filters which
+// require a completed handshake do not match, as is the case for a real
+// client before the handshake. EvaluationTime is the time at which
+// TimeOfDayUTC filters are evaluated; when zero, the current time is used.
+type TrafficRulesClientAttributes struct {
+	IsFirstTunnelInSession bool
+	TunnelProtocol         string
+	GeoIPData              GeoIPData
+	HandshakeCompleted     bool
+	APIProtocol            string
+	HandshakeParameters    map[string]interface{}
+	AuthorizedAccessTypes  []string
+	AuthorizationsRevoked  bool
+	EvaluationTime         time.Time
+}
+
+// TrafficRulesDescription is the result of DescribeTrafficRulesFor.
+// MatchedFilteredRulesIndex is the index of the matching FilteredRules
+// entry, or -1 when no entry matched, in which case MatchedFilter is nil.
+// EvaluationTime is the UTC time at which the rules were evaluated.
+type TrafficRulesDescription struct {
+	TrafficRules              TrafficRules
+	MatchedFilteredRulesIndex int
+	MatchedFilter             *TrafficRulesFilter
+	EvaluationTime            time.Time
+}
+
+// DescribeTrafficRulesFor returns the traffic rules that GetTrafficRules
+// would select for a client with the specified attributes, along with the
+// FilteredRules entry that matched. This supports a dry-run of the loaded
+// rule set without connecting such a client. DescribeTrafficRulesFor is
+// read-only.
+func (set *TrafficRulesSet) DescribeTrafficRulesFor(
+	attributes *TrafficRulesClientAttributes) *TrafficRulesDescription {
+
+	state := handshakeState{
+		completed:             attributes.HandshakeCompleted,
+		apiProtocol:           attributes.APIProtocol,
+		apiParams:             common.APIParameters(attributes.HandshakeParameters),
+		authorizedAccessTypes: attributes.AuthorizedAccessTypes,
+		authorizationsRevoked: attributes.AuthorizationsRevoked,
+	}
+
+	evaluationTime := attributes.EvaluationTime
+	if evaluationTime.IsZero() {
+		evaluationTime = time.Now()
+	}
+	evaluationTime = evaluationTime.UTC()
+
+	set.ReloadableFile.RLock()
+	defer set.ReloadableFile.RUnlock()
+
+	trafficRules, index := set.selectTrafficRules(
+		attributes.IsFirstTunnelInSession,
+		attributes.TunnelProtocol,
+		attributes.GeoIPData,
+		state,
+		evaluationTime)
+
+	description := &TrafficRulesDescription{
+		TrafficRules:              trafficRules,
+		MatchedFilteredRulesIndex: index,
+		EvaluationTime:            evaluationTime,
+	}
+
+	if description.MatchedFilteredRulesIndex != -1 {
+		filter := set.FilteredRules[description.MatchedFilteredRulesIndex].Filter
+		description.MatchedFilter = &filter
+	}
+
+	return description
+}
+
+// getSpecifiedTrafficRulesFields returns the names of the non-nil pointer,
+// slice, and map fields of the specified TrafficRules. RateLimits fields are
+// prefixed with "RateLimits.".
+func getSpecifiedTrafficRulesFields(rules *TrafficRules) []string {
+
+	var fields []string
+
+	appendFields := func(prefix string, value reflect.Value) {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Field(i)
+			switch field.Kind() {
+			case reflect.Ptr, reflect.Slice, reflect.Map:
+				if !field.IsNil() {
+					fields = append(fields, prefix+value.Type().Field(i).Name)
+				}
+			}
+		}
+	}
+
+	appendFields("RateLimits.", reflect.ValueOf(rules.RateLimits))
+	appendFields("", reflect.ValueOf(*rules))
+
+	return fields
+}
+
+// getFilteredRulesIndex returns the index of the first FilteredRules entry
+// whose Filter matches the client attributes at the specified time, or -1
+// when no entry matches. The caller must hold the ReloadableFile read lock.
+func (set *TrafficRulesSet) getFilteredRulesIndex(
+	tunnelProtocol string,
+	geoIPData GeoIPData,
+	state handshakeState,
+	now time.Time) int {
+
 	// TODO: faster lookup?
-	for _, filteredRules := range set.FilteredRules {
+	for index, filteredRules := range set.FilteredRules {
 
-		log.WithContextFields(LogFields{"filter": filteredRules.Filter}).Debug("filter check")
+		if log.SampleDebug() {
+			log.WithContextFields(LogFields{"filter": filteredRules.Filter}).Debug("filter check")
+		}
 
 		if len(filteredRules.Filter.TunnelProtocols) > 0 {
 			if !common.Contains(filteredRules.Filter.TunnelProtocols, tunnelProtocol) {
@@ -488,6 +1087,30 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			}
 		}
 
+		if filteredRules.Filter.TimeOfDayUTC != nil {
+			if !filteredRules.Filter.TimeOfDayUTC.Contains(now) {
+				continue
+			}
+		}
+
+		if len(filteredRules.Filter.ClientPlatforms) > 0 {
+			if !state.completed {
+				continue
+			}
+
+			clientPlatform, err := getStringRequestParam(state.apiParams, "client_platform")
+			if err != nil {
+				continue
+			}
+
+			normalizedPlatform, _ := protocol.NormalizeClientPlatform(clientPlatform)
+
+			if !common.Contains(
+				filteredRules.Filter.ClientPlatforms, normalizedPlatform) {
+				continue
+			}
+		}
+
 		if filteredRules.Filter.APIProtocol != "" {
 			if !state.completed {
 				continue
@@ -504,8 +1127,26 @@ func (set *TrafficRulesSet) GetTrafficRules(
 
 			mismatch := false
 			for name, values := range filteredRules.Filter.HandshakeParameters {
-				clientValue, err := getStringRequestParam(state.apiParams, name)
-				if err != nil || !common.ContainsWildcard(values, clientValue) {
+				clientValues, err := getStringOrStringArrayRequestParam(state.apiParams, name)
+				if err != nil || !common.ContainsAnyWildcard(values, clientValues) {
+					mismatch = true
+					break
+				}
+			}
+			if mismatch {
+				continue
+			}
+		}
+
+		if filteredRules.Filter.HandshakeParameterComparisons != nil {
+			if !state.completed {
+				continue
+			}
+
+			mismatch := false
+			for name, comparisons := range filteredRules.Filter.HandshakeParameterComparisons {
+				clientValues, err := getStringOrStringArrayRequestParam(state.apiParams, name)
+				if err != nil || !matchNumericComparisons(comparisons, clientValues) {
 					mismatch = true
 					break
 				}
@@ -538,86 +1179,123 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			}
 		}
 
-		log.WithContextFields(LogFields{"filter": filteredRules.Filter}).Debug("filter match")
-
-		// This is the first match. Override defaults using provided fields from selected rules, and return result.
-
-		if filteredRules.Rules.RateLimits.ReadUnthrottledBytes != nil {
-			trafficRules.RateLimits.ReadUnthrottledBytes = filteredRules.Rules.RateLimits.ReadUnthrottledBytes
-		}
-
-		if filteredRules.Rules.RateLimits.ReadBytesPerSecond != nil {
-			trafficRules.RateLimits.ReadBytesPerSecond = filteredRules.Rules.RateLimits.ReadBytesPerSecond
+		if log.SampleDebug() {
+			log.WithContextFields(LogFields{"filter": filteredRules.Filter}).Debug("filter match")
 		}
+		return index
+	}
 
-		if filteredRules.Rules.RateLimits.WriteUnthrottledBytes != nil {
-			trafficRules.RateLimits.WriteUnthrottledBytes = filteredRules.Rules.RateLimits.WriteUnthrottledBytes
-		}
+	return -1
+}
 
-		if filteredRules.Rules.RateLimits.WriteBytesPerSecond != nil {
-			trafficRules.RateLimits.WriteBytesPerSecond = filteredRules.Rules.RateLimits.WriteBytesPerSecond
+// isBaseRequestParamName indicates whether paramName is a handshake API
+// parameter that may be filtered on.
+func isBaseRequestParamName(paramName string) bool {
+	for _, paramSpec := range baseRequestParams {
+		if paramSpec.name == paramName {
+			return true
 		}
+	}
+	return false
+}
 
-		if filteredRules.Rules.RateLimits.CloseAfterExhausted != nil {
-			trafficRules.RateLimits.CloseAfterExhausted = filteredRules.Rules.RateLimits.CloseAfterExhausted
+// numericComparisonOperators lists the supported
+// HandshakeParameterComparisons operators. Two character operators are
+// listed first so that prefix matching selects, e.g., ">=" rather than ">".
+var numericComparisonOperators = []string{">=", "<=", ">", "<"}
+
+// parseNumericComparison splits a numeric comparison into its operator
+// and integer operand.
+func parseNumericComparison(comparison string) (string, int64, error) {
+	for _, operator := range numericComparisonOperators {
+		if strings.HasPrefix(comparison, operator) {
+			operand, err := strconv.ParseInt(
+				strings.TrimPrefix(comparison, operator), 10, 64)
+			if err != nil {
+				return "", 0, common.ContextError(
+					fmt.Errorf("invalid numeric comparison: %s", comparison))
+			}
+			return operator, operand, nil
 		}
+	}
+	return "", 0, common.ContextError(
+		fmt.Errorf("missing comparison operator: %s", comparison))
+}
 
-		if filteredRules.Rules.RateLimits.UnthrottleFirstTunnelOnly != nil {
-			trafficRules.RateLimits.UnthrottleFirstTunnelOnly = filteredRules.Rules.RateLimits.UnthrottleFirstTunnelOnly
-		}
+// matchNumericComparisons returns true if any client value that is an
+// integer string satisfies any of the comparisons.
+func matchNumericComparisons(comparisons, clientValues []string) bool {
 
-		if filteredRules.Rules.DialTCPPortForwardTimeoutMilliseconds != nil {
-			trafficRules.DialTCPPortForwardTimeoutMilliseconds = filteredRules.Rules.DialTCPPortForwardTimeoutMilliseconds
-		}
+	for _, comparison := range comparisons {
 
-		if filteredRules.Rules.IdleTCPPortForwardTimeoutMilliseconds != nil {
-			trafficRules.IdleTCPPortForwardTimeoutMilliseconds = filteredRules.Rules.IdleTCPPortForwardTimeoutMilliseconds
-		}
-
-		if filteredRules.Rules.IdleUDPPortForwardTimeoutMilliseconds != nil {
-			trafficRules.IdleUDPPortForwardTimeoutMilliseconds = filteredRules.Rules.IdleUDPPortForwardTimeoutMilliseconds
-		}
-
-		if filteredRules.Rules.MaxTCPDialingPortForwardCount != nil {
-			trafficRules.MaxTCPDialingPortForwardCount = filteredRules.Rules.MaxTCPDialingPortForwardCount
+		operator, operand, err := parseNumericComparison(comparison)
+		if err != nil {
+			// Invalid comparisons are rejected by Validate.
+			continue
 		}
 
-		if filteredRules.Rules.MaxTCPPortForwardCount != nil {
-			trafficRules.MaxTCPPortForwardCount = filteredRules.Rules.MaxTCPPortForwardCount
+		for _, clientValue := range clientValues {
+			number, err := strconv.ParseInt(clientValue, 10, 64)
+			if err != nil {
+				continue
+			}
+			match := false
+			switch operator {
+			case ">=":
+				match = number >= operand
+			case "<=":
+				match = number <= operand
+			case ">":
+				match = number > operand
+			case "<":
+				match = number < operand
+			}
+			if match {
+				return true
+			}
 		}
+	}
 
-		if filteredRules.Rules.MaxUDPPortForwardCount != nil {
-			trafficRules.MaxUDPPortForwardCount = filteredRules.Rules.MaxUDPPortForwardCount
-		}
+	return false
+}
 
-		if filteredRules.Rules.AllowTCPPorts != nil {
-			trafficRules.AllowTCPPorts = filteredRules.Rules.AllowTCPPorts
-		}
+// MeekRateLimiterConfig is a snapshot of the meek rate limiter
+// configuration values. See the corresponding TrafficRulesSet
+// MeekRateLimiter fields for descriptions.
+type MeekRateLimiterConfig struct {
+	HistorySize          int
+	ThresholdSeconds     int
+	Regions              []string
+	ISPs                 []string
+	ASNs                 []string
+	GCTriggerCount       int
+	ReapFrequencySeconds int
+}
 
-		if filteredRules.Rules.AllowUDPPorts != nil {
-			trafficRules.AllowUDPPorts = filteredRules.Rules.AllowUDPPorts
-		}
+// IsTunnelProtocolDrained indicates whether the specified tunnel protocol
+// is listed in DrainTunnelProtocols.
+func (set *TrafficRulesSet) IsTunnelProtocolDrained(tunnelProtocol string) bool {
 
-		if filteredRules.Rules.AllowSubnets != nil {
-			trafficRules.AllowSubnets = filteredRules.Rules.AllowSubnets
-		}
+	set.ReloadableFile.RLock()
+	defer set.ReloadableFile.RUnlock()
 
-		break
-	}
+	return common.Contains(set.DrainTunnelProtocols, tunnelProtocol)
+}
 
-	if *trafficRules.RateLimits.UnthrottleFirstTunnelOnly && !isFirstTunnelInSession {
-		trafficRules.RateLimits.ReadUnthrottledBytes = new(int64)
-		trafficRules.RateLimits.WriteUnthrottledBytes = new(int64)
-	}
+// IsHttpsRequestRegexesDisabled indicates whether the specified sponsor ID
+// is listed in DisableHttpsRequestRegexesSponsorIDs.
+func (set *TrafficRulesSet) IsHttpsRequestRegexesDisabled(sponsorID string) bool {
 
-	log.WithContextFields(LogFields{"trafficRules": trafficRules}).Debug("selected traffic rules")
+	set.ReloadableFile.RLock()
+	defer set.ReloadableFile.RUnlock()
 
-	return trafficRules
+	return common.Contains(set.DisableHttpsRequestRegexesSponsorIDs, sponsorID)
 }
 
 // GetMeekRateLimiterConfig gets a snapshot of the meek rate limiter
-// configuration values.
-func (set *TrafficRulesSet) GetMeekRateLimiterConfig() (int, int, []string, []string, int, int) {
+// configuration values. Defaults are applied to GCTriggerCount and
+// ReapFrequencySeconds when unset.
+func (set *TrafficRulesSet) GetMeekRateLimiterConfig() *MeekRateLimiterConfig {
 
 	set.ReloadableFile.RLock()
 	defer set.ReloadableFile.RUnlock()
@@ -633,10 +1311,13 @@ func (set *TrafficRulesSet) GetMeekRateLimiterConfig() (int, int, []string, []st
 
 	}
 
-	return set.MeekRateLimiterHistorySize,
-		set.MeekRateLimiterThresholdSeconds,
-		set.MeekRateLimiterRegions,
-		set.MeekRateLimiterISPs,
-		GCTriggerCount,
-		reapFrequencySeconds
+	return &MeekRateLimiterConfig{
+		HistorySize:          set.MeekRateLimiterHistorySize,
+		ThresholdSeconds:     set.MeekRateLimiterThresholdSeconds,
+		Regions:              set.MeekRateLimiterRegions,
+		ISPs:                 set.MeekRateLimiterISPs,
+		ASNs:                 set.MeekRateLimiterASNs,
+		GCTriggerCount:       GCTriggerCount,
+		ReapFrequencySeconds: reapFrequencySeconds,
+	}
 }
@@ -0,0 +1,1177 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func newTestTrafficRulesSet(t *testing.T, trafficRulesJSON string) *TrafficRulesSet {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-traffic-rules-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	filename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	err = ioutil.WriteFile(filename, []byte(trafficRulesJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	set, err := NewTrafficRulesSet(filename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	return set
+}
+
+func TestTrafficRulesClientPlatforms(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" :  {
+            "RateLimits" : {
+                "ReadBytesPerSecond": 1000
+            }
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "ClientPlatforms" : ["Android"]
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 2000
+                    }
+                }
+            }
+        ]
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	testCases := []struct {
+		description                string
+		state                      handshakeState
+		expectedReadBytesPerSecond int64
+	}{
+		{
+			"handshake not completed",
+			handshakeState{},
+			1000,
+		},
+		{
+			"Android client",
+			handshakeState{
+				completed: true,
+				apiParams: common.APIParameters{
+					"client_platform": "Android_4.0.4_com.example.exampleClientLibraryApp",
+				},
+			},
+			2000,
+		},
+		{
+			"iOS client",
+			handshakeState{
+				completed: true,
+				apiParams: common.APIParameters{
+					"client_platform": "iOS_11.0_com.example",
+				},
+			},
+			1000,
+		},
+		{
+			"Windows client",
+			handshakeState{
+				completed: true,
+				apiParams: common.APIParameters{
+					"client_platform": "Windows",
+				},
+			},
+			1000,
+		},
+		{
+			"missing client platform",
+			handshakeState{
+				completed: true,
+				apiParams: common.APIParameters{},
+			},
+			1000,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			rules := set.GetTrafficRules(true, "OSSH", GeoIPData{}, testCase.state)
+
+			if *rules.RateLimits.ReadBytesPerSecond != testCase.expectedReadBytesPerSecond {
+				t.Fatalf(
+					"unexpected ReadBytesPerSecond: %d",
+					*rules.RateLimits.ReadBytesPerSecond)
+			}
+		})
+	}
+
+	// Test: empty client platform fails validation
+
+	set.FilteredRules[0].Filter.ClientPlatforms = []string{""}
+
+	err := set.Validate()
+	if err == nil {
+		t.Fatalf("Validate unexpected success")
+	}
+}
+
+func TestTrafficRulesHandshakeParameters(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" :  {
+            "RateLimits" : {
+                "ReadBytesPerSecond": 1000
+            }
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "HandshakeParameters" : {
+                        "client_version" : ["1", "2*"],
+                        "upstream_proxy_custom_header_names" : ["X-Example-*"]
+                    }
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 2000
+                    }
+                }
+            }
+        ]
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	testCases := []struct {
+		description                string
+		apiParams                  common.APIParameters
+		expectedReadBytesPerSecond int64
+	}{
+		{
+			"scalar and array match",
+			common.APIParameters{
+				"client_version":                     "20",
+				"upstream_proxy_custom_header_names": []interface{}{"X-Other", "X-Example-Header"},
+			},
+			2000,
+		},
+		{
+			"scalar mismatch",
+			common.APIParameters{
+				"client_version":                     "3",
+				"upstream_proxy_custom_header_names": []interface{}{"X-Example-Header"},
+			},
+			1000,
+		},
+		{
+			"array mismatch",
+			common.APIParameters{
+				"client_version":                     "1",
+				"upstream_proxy_custom_header_names": []interface{}{"X-Other"},
+			},
+			1000,
+		},
+		{
+			"empty array",
+			common.APIParameters{
+				"client_version":                     "1",
+				"upstream_proxy_custom_header_names": []interface{}{},
+			},
+			1000,
+		},
+		{
+			"missing parameter",
+			common.APIParameters{
+				"client_version": "1",
+			},
+			1000,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			state := handshakeState{
+				completed: true,
+				apiParams: testCase.apiParams,
+			}
+
+			rules := set.GetTrafficRules(true, "OSSH", GeoIPData{}, state)
+
+			if *rules.RateLimits.ReadBytesPerSecond != testCase.expectedReadBytesPerSecond {
+				t.Fatalf(
+					"unexpected ReadBytesPerSecond: %d",
+					*rules.RateLimits.ReadBytesPerSecond)
+			}
+		})
+	}
+}
+
+func TestTrafficRulesHandshakeParameterComparisons(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" :  {
+            "RateLimits" : {
+                "ReadBytesPerSecond": 1000
+            }
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "HandshakeParameterComparisons" : {
+                        "client_version" : [">=200"]
+                    }
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 2000
+                    }
+                }
+            },
+            {
+                "Filter" : {
+                    "HandshakeParameterComparisons" : {
+                        "client_version" : ["<10", "<=100"]
+                    }
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 3000
+                    }
+                }
+            },
+            {
+                "Filter" : {
+                    "HandshakeParameters" : {
+                        "client_version" : ["<=1*"]
+                    }
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 4000
+                    }
+                }
+            }
+        ]
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	testCases := []struct {
+		description                string
+		clientVersion              interface{}
+		expectedReadBytesPerSecond int64
+	}{
+		{"greater than or equal, equal", "200", 2000},
+		{"greater than or equal, greater", "350", 2000},
+		{"less than or equal, equal", "100", 3000},
+		{"less than or equal, less", "5", 3000},
+		{"between comparisons", "150", 1000},
+		{"operator prefix in pattern is literal", "<=150", 4000},
+		{"no match", "199", 1000},
+		{"non-numeric client value", "abc", 1000},
+		{"missing parameter", nil, 1000},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			apiParams := common.APIParameters{}
+			if testCase.clientVersion != nil {
+				apiParams["client_version"] = testCase.clientVersion
+			}
+
+			state := handshakeState{
+				completed: true,
+				apiParams: apiParams,
+			}
+
+			rules := set.GetTrafficRules(true, "OSSH", GeoIPData{}, state)
+
+			if *rules.RateLimits.ReadBytesPerSecond != testCase.expectedReadBytesPerSecond {
+				t.Fatalf(
+					"unexpected ReadBytesPerSecond: %d",
+					*rules.RateLimits.ReadBytesPerSecond)
+			}
+		})
+	}
+
+	for _, comparison := range []string{"200", ">=abc", "<=", ">1.5", "<=-"} {
+
+		set.FilteredRules[0].Filter.HandshakeParameterComparisons["client_version"] = []string{comparison}
+
+		err := set.Validate()
+		if err == nil {
+			t.Fatalf("Validate unexpected success: %s", comparison)
+		}
+	}
+}
+
+func TestTrafficRulesFailClosedOnReloadError(t *testing.T) {
+
+	testCases := []struct {
+		description           string
+		failClosed            bool
+		expectReloadError     bool
+		expectedAllowTCPPorts []int
+		expectedAllowUDPPorts []int
+	}{
+		{"keep previous rules", false, true, []int{443}, []int{53}},
+		{"fail closed", true, false, []int{0}, []int{0}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-traffic-rules-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			filename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+			trafficRulesJSON := fmt.Sprintf(`
+            {
+                "FailClosedOnReloadError" : %v,
+                "DefaultRules" :  {
+                    "AllowTCPPorts" : [443],
+                    "AllowUDPPorts" : [53]
+                }
+            }
+            `, testCase.failClosed)
+
+			err = ioutil.WriteFile(filename, []byte(trafficRulesJSON), 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+
+			set, err := NewTrafficRulesSet(filename)
+			if err != nil {
+				t.Fatalf("NewTrafficRulesSet failed: %s", err)
+			}
+
+			err = ioutil.WriteFile(filename, []byte(`{"DefaultRules" : {`), 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+
+			_, err = set.Reload()
+			if (err != nil) != testCase.expectReloadError {
+				t.Fatalf("unexpected Reload result: %v", err)
+			}
+
+			rules := set.GetTrafficRules(
+				true, "OSSH", GeoIPData{}, handshakeState{completed: true})
+
+			if !reflect.DeepEqual(rules.AllowTCPPorts, testCase.expectedAllowTCPPorts) ||
+				!reflect.DeepEqual(rules.AllowUDPPorts, testCase.expectedAllowUDPPorts) {
+				t.Fatalf(
+					"unexpected allowed ports: %v %v",
+					rules.AllowTCPPorts, rules.AllowUDPPorts)
+			}
+		})
+	}
+}
+
+func TestTrafficRulesMaxTunnelProtocolBytes(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" :  {
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "Regions" : ["R1"]
+                },
+                "Rules" : {
+                    "MaxTunnelProtocolBytes" : {"QUIC-OSSH" : 1000}
+                }
+            }
+        ]
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	testCases := []struct {
+		description    string
+		region         string
+		tunnelProtocol string
+		bytes          int64
+		expectExceeded bool
+	}{
+		{"default unlimited", "R0", "QUIC-OSSH", 1000000, false},
+		{"unlisted protocol unlimited", "R1", "OSSH", 1000000, false},
+		{"under limit", "R1", "QUIC-OSSH", 999, false},
+		{"at limit", "R1", "QUIC-OSSH", 1000, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			sshClient := &sshClient{
+				tunnelProtocol: testCase.tunnelProtocol,
+				trafficRules: set.GetTrafficRules(
+					true,
+					testCase.tunnelProtocol,
+					GeoIPData{Country: testCase.region},
+					handshakeState{}),
+			}
+			sshClient.tunnelProtocolBytes = testCase.bytes
+
+			if sshClient.isTunnelProtocolBytesExhausted() != testCase.expectExceeded {
+				t.Fatalf("unexpected isTunnelProtocolBytesExhausted result")
+			}
+		})
+	}
+
+	// Test: bytes are tallied as they are relayed, and an established port
+	// forward is closed once the limit is reached
+
+	sshClient := &sshClient{
+		tunnelProtocol: "QUIC-OSSH",
+		trafficRules: set.GetTrafficRules(
+			true, "QUIC-OSSH", GeoIPData{Country: "R1"}, handshakeState{}),
+	}
+
+	conn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	updater := &tunnelProtocolBytesUpdater{sshClient: sshClient, conn: conn}
+
+	updater.UpdateProgress(500, 499, 0)
+
+	if sshClient.tunnelProtocolBytes != 999 {
+		t.Fatalf("unexpected tunnelProtocolBytes: %d", sshClient.tunnelProtocolBytes)
+	}
+
+	go peerConn.Read(make([]byte, 1))
+	_, err := conn.Write([]byte{0})
+	if err != nil {
+		t.Fatalf("port forward unexpectedly closed: %s", err)
+	}
+
+	updater.UpdateProgress(0, 1, 0)
+
+	_, err = conn.Write([]byte{0})
+	if err != io.ErrClosedPipe {
+		t.Fatalf("port forward not closed: %v", err)
+	}
+
+	// Test: invalid tunnel protocol fails validation
+
+	set.FilteredRules[0].Rules.MaxTunnelProtocolBytes = map[string]int64{"invalid": 1000}
+
+	err = set.Validate()
+	if err == nil {
+		t.Fatalf("Validate unexpected success")
+	}
+
+	// Test: negative limit fails validation
+
+	set.FilteredRules[0].Rules.MaxTunnelProtocolBytes = map[string]int64{"QUIC-OSSH": -1}
+
+	err = set.Validate()
+	if err == nil {
+		t.Fatalf("Validate unexpected success")
+	}
+}
+
+func TestGetMeekRateLimiterConfig(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "MeekRateLimiterHistorySize" : 10,
+        "MeekRateLimiterThresholdSeconds" : 60,
+        "MeekRateLimiterRegions" : ["R1"],
+        "MeekRateLimiterISPs" : ["I1"],
+        "MeekRateLimiterASNs" : ["1"],
+        "MeekRateLimiterGarbageCollectionTriggerCount" : 0,
+        "MeekRateLimiterReapHistoryFrequencySeconds" : 0
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	config := set.GetMeekRateLimiterConfig()
+
+	if config.HistorySize != 10 ||
+		config.ThresholdSeconds != 60 ||
+		!reflect.DeepEqual(config.Regions, []string{"R1"}) ||
+		!reflect.DeepEqual(config.ISPs, []string{"I1"}) ||
+		!reflect.DeepEqual(config.ASNs, []string{"1"}) {
+		t.Fatalf("unexpected meek rate limiter config: %+v", config)
+	}
+
+	// Test: defaults are applied for zero values
+
+	if config.GCTriggerCount != DEFAULT_MEEK_RATE_LIMITER_GARBAGE_COLLECTOR_TRIGGER_COUNT ||
+		config.ReapFrequencySeconds != DEFAULT_MEEK_RATE_LIMITER_REAP_HISTORY_FREQUENCY_SECONDS {
+		t.Fatalf("unexpected meek rate limiter config defaults: %+v", config)
+	}
+
+	// Test: non-zero values override defaults
+
+	set.MeekRateLimiterGarbageCollectionTriggerCount = 1
+	set.MeekRateLimiterReapHistoryFrequencySeconds = 2
+
+	config = set.GetMeekRateLimiterConfig()
+
+	if config.GCTriggerCount != 1 || config.ReapFrequencySeconds != 2 {
+		t.Fatalf("unexpected meek rate limiter config: %+v", config)
+	}
+}
+
+func TestExplainTrafficRules(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" :  {
+            "RateLimits" : {
+                "ReadUnthrottledBytes": 10000,
+                "ReadBytesPerSecond": 1000,
+                "UnthrottleFirstTunnelOnly": true
+            },
+            "AllowTCPPorts" : [443]
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "Regions" : ["R1"]
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "WriteBytesPerSecond": 2000
+                    }
+                }
+            },
+            {
+                "Filter" : {
+                    "Regions" : ["R2"]
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 3000
+                    },
+                    "AllowUDPPorts" : [53]
+                }
+            }
+        ]
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	testCases := []struct {
+		description            string
+		isFirstTunnelInSession bool
+		region                 string
+		expectedTrace          map[string][]string
+	}{
+		{
+			"no filter match",
+			true,
+			"R0",
+			map[string][]string{
+				TRAFFIC_RULES_SOURCE_DEFAULT_RULES: {
+					"RateLimits.ReadUnthrottledBytes",
+					"RateLimits.ReadBytesPerSecond",
+					"RateLimits.UnthrottleFirstTunnelOnly",
+					"AllowTCPPorts",
+				},
+			},
+		},
+		{
+			"second filter match",
+			true,
+			"R2",
+			map[string][]string{
+				TRAFFIC_RULES_SOURCE_DEFAULT_RULES: {
+					"RateLimits.ReadUnthrottledBytes",
+					"RateLimits.ReadBytesPerSecond",
+					"RateLimits.UnthrottleFirstTunnelOnly",
+					"AllowTCPPorts",
+				},
+				"FilteredRules[1]": {
+					"RateLimits.ReadBytesPerSecond",
+					"AllowUDPPorts",
+				},
+			},
+		},
+		{
+			"not first tunnel",
+			false,
+			"R1",
+			map[string][]string{
+				TRAFFIC_RULES_SOURCE_DEFAULT_RULES: {
+					"RateLimits.ReadUnthrottledBytes",
+					"RateLimits.ReadBytesPerSecond",
+					"RateLimits.UnthrottleFirstTunnelOnly",
+					"AllowTCPPorts",
+				},
+				"FilteredRules[0]": {
+					"RateLimits.WriteBytesPerSecond",
+				},
+				TRAFFIC_RULES_SOURCE_UNTHROTTLE_FIRST_TUNNEL_ONLY: {
+					"RateLimits.ReadUnthrottledBytes",
+					"RateLimits.WriteUnthrottledBytes",
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			geoIPData := GeoIPData{Country: testCase.region}
+
+			rules, trace := set.ExplainTrafficRules(
+				testCase.isFirstTunnelInSession, "OSSH", geoIPData, handshakeState{})
+
+			expectedRules := set.GetTrafficRules(
+				testCase.isFirstTunnelInSession, "OSSH", geoIPData, handshakeState{})
+
+			if !reflect.DeepEqual(rules, expectedRules) {
+				t.Fatalf("unexpected traffic rules: %+v", rules)
+			}
+
+			if len(trace) == 0 || trace[0].Source != TRAFFIC_RULES_SOURCE_BUILT_IN_DEFAULTS {
+				t.Fatalf("missing built-in defaults step: %+v", trace)
+			}
+
+			if !common.Contains(trace[0].Fields, "RateLimits.WriteUnthrottledBytes") {
+				t.Fatalf("unexpected built-in defaults fields: %+v", trace[0].Fields)
+			}
+
+			// Test: built-in defaults are attributed only fields that are
+			// not set by DefaultRules or the matching FilteredRules entry
+
+			for source, fields := range testCase.expectedTrace {
+				if source == TRAFFIC_RULES_SOURCE_UNTHROTTLE_FIRST_TUNNEL_ONLY {
+					continue
+				}
+				for _, field := range fields {
+					if common.Contains(trace[0].Fields, field) {
+						t.Fatalf("unexpected built-in defaults field: %s", field)
+					}
+				}
+			}
+
+			trace = trace[1:]
+
+			if len(trace) != len(testCase.expectedTrace) {
+				t.Fatalf("unexpected trace: %+v", trace)
+			}
+
+			for _, step := range trace {
+				if !reflect.DeepEqual(step.Fields, testCase.expectedTrace[step.Source]) {
+					t.Fatalf("unexpected trace step: %+v", step)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeOfDayWindow(t *testing.T) {
+
+	testCases := []struct {
+		description    string
+		start          string
+		end            string
+		time           string
+		expectContains bool
+	}{
+		{"non-wrapping before", "09:00", "17:00", "08:59", false},
+		{"non-wrapping start", "09:00", "17:00", "09:00", true},
+		{"non-wrapping within", "09:00", "17:00", "12:30", true},
+		{"non-wrapping end", "09:00", "17:00", "17:00", false},
+		{"wrapping before midnight", "22:00", "06:00", "23:15", true},
+		{"wrapping midnight", "22:00", "06:00", "00:00", true},
+		{"wrapping after midnight", "22:00", "06:00", "05:59", true},
+		{"wrapping end", "22:00", "06:00", "06:00", false},
+		{"wrapping outside", "22:00", "06:00", "12:00", false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			window := &TimeOfDayWindow{Start: testCase.start, End: testCase.end}
+
+			err := window.Validate()
+			if err != nil {
+				t.Fatalf("Validate failed: %s", err)
+			}
+
+			now, err := time.Parse("15:04", testCase.time)
+			if err != nil {
+				t.Fatalf("Parse failed: %s", err)
+			}
+
+			if window.Contains(now) != testCase.expectContains {
+				t.Fatalf("unexpected Contains result")
+			}
+		})
+	}
+}
+
+func TestTrafficRulesTimeOfDayUTC(t *testing.T) {
+
+	now := time.Now().UTC()
+
+	trafficRulesJSON := fmt.Sprintf(`
+    {
+        "DefaultRules" :  {
+            "RateLimits" : {
+                "ReadBytesPerSecond": 1000
+            }
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "TimeOfDayUTC" : {"Start" : "%s", "End" : "%s"}
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 2000
+                    }
+                }
+            },
+            {
+                "Filter" : {
+                    "TimeOfDayUTC" : {"Start" : "%s", "End" : "%s"}
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 3000
+                    }
+                }
+            }
+        ]
+    }
+    `,
+		now.Add(2*time.Hour).Format("15:04"),
+		now.Add(4*time.Hour).Format("15:04"),
+		now.Add(-2*time.Hour).Format("15:04"),
+		now.Add(2*time.Hour).Format("15:04"))
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	// Test: only the window containing the current time matches
+
+	rules := set.GetTrafficRules(true, "OSSH", GeoIPData{}, handshakeState{})
+
+	if *rules.RateLimits.ReadBytesPerSecond != 3000 {
+		t.Fatalf(
+			"unexpected ReadBytesPerSecond: %d",
+			*rules.RateLimits.ReadBytesPerSecond)
+	}
+
+	// Test: invalid windows fail validation
+
+	for _, window := range []TimeOfDayWindow{
+		{Start: "25:00", End: "06:00"},
+		{Start: "22:00", End: "6pm"},
+		{Start: "", End: "06:00"},
+		{Start: "06:00", End: "06:00"},
+	} {
+		set.FilteredRules[0].Filter.TimeOfDayUTC = &window
+
+		err := set.Validate()
+		if err == nil {
+			t.Fatalf("Validate unexpected success: %+v", window)
+		}
+	}
+}
+
+func TestTrafficRulesTimeOfDayUTCSelectionTime(t *testing.T) {
+
+	now := time.Now().UTC()
+
+	trafficRulesJSON := fmt.Sprintf(`
+    {
+        "DefaultRules" :  {
+            "RateLimits" : {
+                "ReadBytesPerSecond": 1000
+            }
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "TimeOfDayUTC" : {"Start" : "%s", "End" : "%s"}
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 2000
+                    }
+                }
+            }
+        ]
+    }
+    `,
+		now.Add(-2*time.Hour).Format("15:04"),
+		now.Add(2*time.Hour).Format("15:04"))
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	sshClient := &sshClient{
+		sshServer: &sshServer{
+			support: &SupportServices{
+				TrafficRulesSet: set,
+			},
+		},
+		tunnelProtocol: "OSSH",
+	}
+
+	// Test: the window containing the current time is applied when traffic
+	// rules are selected
+
+	sshClient.setTrafficRules()
+
+	if *sshClient.trafficRules.RateLimits.ReadBytesPerSecond != 2000 {
+		t.Fatalf(
+			"unexpected ReadBytesPerSecond: %d",
+			*sshClient.trafficRules.RateLimits.ReadBytesPerSecond)
+	}
+
+	// Simulate the current time leaving the window by moving the window.
+
+	set.FilteredRules[0].Filter.TimeOfDayUTC = &TimeOfDayWindow{
+		Start: now.Add(2 * time.Hour).Format("15:04"),
+		End:   now.Add(4 * time.Hour).Format("15:04"),
+	}
+
+	// Test: the selected traffic rules are unchanged until traffic rules are
+	// selected again
+
+	if *sshClient.trafficRules.RateLimits.ReadBytesPerSecond != 2000 {
+		t.Fatalf(
+			"unexpected ReadBytesPerSecond: %d",
+			*sshClient.trafficRules.RateLimits.ReadBytesPerSecond)
+	}
+
+	sshClient.setTrafficRules()
+
+	if *sshClient.trafficRules.RateLimits.ReadBytesPerSecond != 1000 {
+		t.Fatalf(
+			"unexpected ReadBytesPerSecond: %d",
+			*sshClient.trafficRules.RateLimits.ReadBytesPerSecond)
+	}
+}
+
+func TestTrafficRulesAllowDomains(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" :  {
+            "AllowTCPPorts" : [443],
+            "AllowUDPPorts" : [53],
+            "AllowDomains" : ["example.com", "*.example.org"]
+        }
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	sshClient := &sshClient{
+		sshServer: &sshServer{
+			support: &SupportServices{
+				Config:    &Config{},
+				Blocklist: &Blocklist{},
+			},
+		},
+		handshakeState: handshakeState{completed: true},
+		trafficRules: set.GetTrafficRules(
+			true, "OSSH", GeoIPData{}, handshakeState{}),
+	}
+
+	remoteIP := net.ParseIP("192.0.2.1")
+
+	testCases := []struct {
+		description     string
+		portForwardType int
+		domain          string
+		port            int
+		expectPermitted bool
+	}{
+		{"allowed port", portForwardTypeTCP, "", 443, true},
+		{"no domain", portForwardTypeTCP, "", 80, false},
+		{"exact domain", portForwardTypeTCP, "example.com", 80, true},
+		{"exact domain mixed case", portForwardTypeTCP, "Example.COM", 80, true},
+		{"wildcard domain", portForwardTypeTCP, "www.example.org", 80, true},
+		{"wildcard domain without subdomain", portForwardTypeTCP, "example.org", 80, false},
+		{"denied domain", portForwardTypeTCP, "example.net", 80, false},
+		{"denied subdomain", portForwardTypeTCP, "www.example.com", 80, false},
+		{"UDP", portForwardTypeUDP, "example.com", 80, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			permitted := sshClient.isPortForwardPermitted(
+				testCase.portForwardType, testCase.domain, remoteIP, testCase.port)
+
+			if permitted != testCase.expectPermitted {
+				t.Fatalf("unexpected isPortForwardPermitted result")
+			}
+		})
+	}
+
+	// Test: invalid domains fail validation
+
+	for _, domain := range []string{"", "Example.com", "example.com:443"} {
+
+		set.DefaultRules.AllowDomains = []string{domain}
+
+		err := set.Validate()
+		if err == nil {
+			t.Fatalf("Validate unexpected success: %s", domain)
+		}
+	}
+}
+
+func TestDisableHttpsRequestRegexes(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-traffic-rules-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	filename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	err = ioutil.WriteFile(
+		filename, []byte(`{"DisableHttpsRequestRegexesSponsorIDs" : ["S1"]}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	set, err := NewTrafficRulesSet(filename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	if !set.IsHttpsRequestRegexesDisabled("S1") {
+		t.Fatalf("unexpected enabled sponsor regexes")
+	}
+
+	if set.IsHttpsRequestRegexesDisabled("S2") {
+		t.Fatalf("unexpected disabled sponsor regexes")
+	}
+
+	// Test: removing the override and reloading restores the sponsor regexes
+
+	err = ioutil.WriteFile(filename, []byte(`{}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	reloaded, err := set.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("Reload failed: %v, %s", reloaded, err)
+	}
+
+	if set.IsHttpsRequestRegexesDisabled("S1") {
+		t.Fatalf("unexpected disabled sponsor regexes")
+	}
+}
+
+func TestDescribeTrafficRulesFor(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" :  {
+            "RateLimits" : {
+                "ReadBytesPerSecond": 1000
+            }
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "Regions" : ["R1"],
+                    "ISPs" : ["I1"]
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 2000
+                    }
+                }
+            },
+            {
+                "Filter" : {
+                    "TunnelProtocols" : ["OSSH"],
+                    "HandshakeParameters" : {
+                        "client_platform" : ["Android*"]
+                    }
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 3000
+                    }
+                }
+            },
+            {
+                "Filter" : {
+                    "Regions" : ["R2"],
+                    "TimeOfDayUTC" : {"Start" : "10:00", "End" : "11:00"}
+                },
+                "Rules" : {
+                    "RateLimits" : {
+                        "ReadBytesPerSecond": 4000
+                    }
+                }
+            }
+        ]
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	inWindow := time.Date(2019, 1, 1, 10, 59, 59, 0, time.UTC)
+	windowEnd := time.Date(2019, 1, 1, 11, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		description                string
+		attributes                 TrafficRulesClientAttributes
+		expectedIndex              int
+		expectedReadBytesPerSecond int64
+	}{
+		{
+			"no filter match",
+			TrafficRulesClientAttributes{
+				TunnelProtocol: "OSSH",
+				GeoIPData:      NewGeoIPData(),
+			},
+			-1,
+			1000,
+		},
+		{
+			"region and ISP match",
+			TrafficRulesClientAttributes{
+				TunnelProtocol: "OSSH",
+				GeoIPData:      GeoIPData{Country: "R1", ISP: "I1"},
+			},
+			0,
+			2000,
+		},
+		{
+			"handshake not completed",
+			TrafficRulesClientAttributes{
+				TunnelProtocol:      "OSSH",
+				GeoIPData:           NewGeoIPData(),
+				HandshakeParameters: map[string]interface{}{"client_platform": "Android_4.0.4"},
+			},
+			-1,
+			1000,
+		},
+		{
+			"handshake parameters match",
+			TrafficRulesClientAttributes{
+				TunnelProtocol:      "OSSH",
+				GeoIPData:           NewGeoIPData(),
+				HandshakeCompleted:  true,
+				HandshakeParameters: map[string]interface{}{"client_platform": "Android_4.0.4"},
+			},
+			1,
+			3000,
+		},
+		{
+			"time of day match",
+			TrafficRulesClientAttributes{
+				TunnelProtocol: "OSSH",
+				GeoIPData:      GeoIPData{Country: "R2"},
+				EvaluationTime: inWindow,
+			},
+			2,
+			4000,
+		},
+		{
+			"time of day window end",
+			TrafficRulesClientAttributes{
+				TunnelProtocol: "OSSH",
+				GeoIPData:      GeoIPData{Country: "R2"},
+				EvaluationTime: windowEnd,
+			},
+			-1,
+			1000,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			description := set.DescribeTrafficRulesFor(&testCase.attributes)
+
+			if testCase.attributes.EvaluationTime.IsZero() {
+				if description.EvaluationTime.IsZero() {
+					t.Fatalf("missing evaluation time")
+				}
+			} else if !description.EvaluationTime.Equal(testCase.attributes.EvaluationTime) {
+				t.Fatalf("unexpected evaluation time: %s", description.EvaluationTime)
+			}
+
+			if description.MatchedFilteredRulesIndex != testCase.expectedIndex {
+				t.Fatalf("unexpected matched index: %d", description.MatchedFilteredRulesIndex)
+			}
+
+			if testCase.expectedIndex == -1 {
+				if description.MatchedFilter != nil {
+					t.Fatalf("unexpected matched filter: %+v", description.MatchedFilter)
+				}
+			} else if !reflect.DeepEqual(
+				*description.MatchedFilter, set.FilteredRules[testCase.expectedIndex].Filter) {
+				t.Fatalf("unexpected matched filter: %+v", description.MatchedFilter)
+			}
+
+			if *description.TrafficRules.RateLimits.ReadBytesPerSecond !=
+				testCase.expectedReadBytesPerSecond {
+				t.Fatalf("unexpected traffic rules: %+v", description.TrafficRules.RateLimits)
+			}
+		})
+	}
+}
@@ -30,7 +30,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -68,6 +70,9 @@ const (
 	MAX_AUTHORIZATIONS                    = 16
 	PRE_HANDSHAKE_RANDOM_STREAM_MAX_COUNT = 1
 	RANDOM_STREAM_MAX_BYTES               = 10485760
+	TUNNEL_PROTOCOL_ACTIVE                = "active"
+	TUNNEL_PROTOCOL_DRAINING              = "draining"
+	TUNNEL_PROTOCOL_DRAINED               = "drained"
 )
 
 // TunnelServer is the main server that accepts Psiphon client
@@ -79,10 +84,17 @@ const (
 // and meek protocols, which provide further circumvention
 // capabilities.
 type TunnelServer struct {
-	runWaitGroup      *sync.WaitGroup
-	listenerError     chan error
-	shutdownBroadcast <-chan struct{}
-	sshServer         *sshServer
+	listenersReady            int32
+	runWaitGroup              *sync.WaitGroup
+	listenerError             chan error
+	shutdownBroadcast         <-chan struct{}
+	sshServer                 *sshServer
+	bindFailuresMutex         sync.Mutex
+	bindFailedTunnelProtocols []string
+	drainableListenersMutex   sync.Mutex
+	drainableListeners        map[string][]*drainableListener
+	selfTestMutex             sync.Mutex
+	selfTestResults           map[string]int64
 }
 
 // NewTunnelServer initializes a new tunnel server.
@@ -125,11 +137,78 @@ func NewTunnelServer(
 // comment in sshClient.stop(). TODO: fully synchronized shutdown.
 func (server *TunnelServer) Run() error {
 
-	type sshListener struct {
-		net.Listener
-		localAddress   string
-		tunnelProtocol string
+	listeners, err := server.bindListeners()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	server.UpdateDrainedListeners()
+
+	if server.sshServer.idlePortForwardReaper != nil {
+		server.runWaitGroup.Add(1)
+		go func() {
+			defer server.runWaitGroup.Done()
+			server.sshServer.idlePortForwardReaper.run(server.shutdownBroadcast)
+		}()
+	}
+
+	atomic.StoreInt32(&server.listenersReady, 1)
+
+	for _, listener := range listeners {
+		server.runWaitGroup.Add(1)
+		go func(listener *sshListener) {
+			defer server.runWaitGroup.Done()
+
+			log.WithContextFields(
+				LogFields{
+					"localAddress":   listener.localAddress,
+					"tunnelProtocol": listener.tunnelProtocol,
+				}).Info("running")
+
+			server.sshServer.runListener(
+				listener.Listener,
+				server.listenerError,
+				listener.tunnelProtocol)
+
+			log.WithContextFields(
+				LogFields{
+					"localAddress":   listener.localAddress,
+					"tunnelProtocol": listener.tunnelProtocol,
+				}).Info("stopped")
+
+		}(listener)
+	}
+
+	select {
+	case <-server.shutdownBroadcast:
+	case err = <-server.listenerError:
+	}
+
+	atomic.StoreInt32(&server.listenersReady, 0)
+
+	for _, listener := range listeners {
+		listener.Close()
 	}
+	server.sshServer.stopClients()
+	server.runWaitGroup.Wait()
+
+	log.WithContext().Info("stopped")
+
+	return err
+}
+
+type sshListener struct {
+	net.Listener
+	localAddress   string
+	tunnelProtocol string
+}
+
+// bindListeners binds a listener for each configured tunnel protocol. By
+// default, any bind failure is fatal: all bound listeners are closed and an
+// error is returned. When Config.TolerateListenerBindFailures is set, tunnel
+// protocols that fail to bind are logged, recorded for GetMetrics, and
+// skipped; an error is returned only when no listeners are bound.
+func (server *TunnelServer) bindListeners() ([]*sshListener, error) {
 
 	// TODO: should TunnelServer hold its own support pointer?
 	support := server.sshServer.support
@@ -138,12 +217,47 @@ func (server *TunnelServer) Run() error {
 	// start accepting connections on each.
 
 	var listeners []*sshListener
+	var bindFailedTunnelProtocols []string
+	drainableListeners := make(map[string][]*drainableListener)
+
+	closeListeners := func() {
+		for _, existingListener := range listeners {
+			existingListener.Listener.Close()
+		}
+	}
 
 	for tunnelProtocol, listenPort := range support.Config.TunnelProtocolPorts {
 
 		localAddress := fmt.Sprintf(
 			"%s:%d", support.Config.ServerIPAddress, listenPort)
 
+		// When configured, run multiple acceptors for plain TCP listeners.
+		// Meek listeners are excluded as meek sessions, which span multiple
+		// TCP connections, are tracked per meek server. On Linux, each
+		// acceptor has its own SO_REUSEPORT listener socket and the kernel
+		// distributes connections across them; otherwise, the acceptors
+		// share a single listener.
+
+		acceptorCount := 1
+		useReusePort := false
+
+		if support.Config.ListenerAcceptorCount > 1 &&
+			!protocol.TunnelProtocolUsesQUIC(tunnelProtocol) &&
+			!protocol.TunnelProtocolUsesMarionette(tunnelProtocol) &&
+			!protocol.TunnelProtocolUsesTapdance(tunnelProtocol) &&
+			!protocol.TunnelProtocolUsesMeek(tunnelProtocol) {
+
+			acceptorCount = support.Config.ListenerAcceptorCount
+			useReusePort = isReusePortSupported()
+
+			if !useReusePort {
+				log.WithContextFields(
+					LogFields{"tunnelProtocol": tunnelProtocol}).Warning(
+					"SO_REUSEPORT balancing not supported; acceptors will share one listener")
+			}
+		}
+
+		var acceptorListeners []net.Listener
 		var listener net.Listener
 		var err error
 
@@ -166,79 +280,171 @@ func (server *TunnelServer) Run() error {
 
 		} else {
 
-			listener, err = net.Listen("tcp", localAddress)
+			var tcpListeners []*drainableListener
+			tcpListeners, err = listenTCPAcceptors(
+				localAddress, acceptorCount, useReusePort)
+
+			for i, tcpListener := range tcpListeners {
+				acceptorListeners = append(acceptorListeners, tcpListener)
+				if i == 0 || tcpListener != tcpListeners[0] {
+					drainableListeners[tunnelProtocol] = append(
+						drainableListeners[tunnelProtocol], tcpListener)
+				}
+			}
 		}
 
 		if err != nil {
-			for _, existingListener := range listeners {
-				existingListener.Listener.Close()
+
+			if !support.Config.TolerateListenerBindFailures {
+				closeListeners()
+				return nil, common.ContextError(err)
 			}
-			return common.ContextError(err)
+
+			log.WithContextFields(
+				LogFields{
+					"localAddress":   localAddress,
+					"tunnelProtocol": tunnelProtocol,
+					"error":          err,
+				}).Warning("listener bind failed")
+
+			bindFailedTunnelProtocols = append(bindFailedTunnelProtocols, tunnelProtocol)
+			continue
 		}
 
-		tacticsListener := tactics.NewListener(
-			listener,
-			support.TacticsServer,
-			tunnelProtocol,
-			func(IPAddress string) common.GeoIPData {
-				return common.GeoIPData(support.GeoIPService.Lookup(IPAddress))
-			})
+		if listener != nil {
+			acceptorListeners = []net.Listener{listener}
+		}
+
+		for _, acceptorListener := range acceptorListeners {
+
+			tacticsListener := tactics.NewListener(
+				acceptorListener,
+				support.TacticsServer,
+				tunnelProtocol,
+				func(IPAddress string) common.GeoIPData {
+					return common.GeoIPData(support.GeoIPService.Lookup(IPAddress))
+				})
+
+			listeners = append(
+				listeners,
+				&sshListener{
+					Listener:       tacticsListener,
+					localAddress:   localAddress,
+					tunnelProtocol: tunnelProtocol,
+				})
+		}
 
 		log.WithContextFields(
 			LogFields{
 				"localAddress":   localAddress,
 				"tunnelProtocol": tunnelProtocol,
+				"acceptorCount":  acceptorCount,
 			}).Info("listening")
+	}
 
-		listeners = append(
-			listeners,
-			&sshListener{
-				Listener:       tacticsListener,
-				localAddress:   localAddress,
-				tunnelProtocol: tunnelProtocol,
-			})
+	if len(listeners) == 0 && len(bindFailedTunnelProtocols) > 0 {
+		return nil, common.ContextError(
+			fmt.Errorf("all listeners failed to bind: %s",
+				strings.Join(bindFailedTunnelProtocols, ", ")))
 	}
 
-	for _, listener := range listeners {
-		server.runWaitGroup.Add(1)
-		go func(listener *sshListener) {
-			defer server.runWaitGroup.Done()
+	sort.Strings(bindFailedTunnelProtocols)
 
-			log.WithContextFields(
-				LogFields{
-					"localAddress":   listener.localAddress,
-					"tunnelProtocol": listener.tunnelProtocol,
-				}).Info("running")
+	server.bindFailuresMutex.Lock()
+	server.bindFailedTunnelProtocols = bindFailedTunnelProtocols
+	server.bindFailuresMutex.Unlock()
 
-			server.sshServer.runListener(
-				listener.Listener,
-				server.listenerError,
-				listener.tunnelProtocol)
+	server.drainableListenersMutex.Lock()
+	server.drainableListeners = drainableListeners
+	server.drainableListenersMutex.Unlock()
 
-			log.WithContextFields(
-				LogFields{
-					"localAddress":   listener.localAddress,
-					"tunnelProtocol": listener.tunnelProtocol,
-				}).Info("stopped")
+	return listeners, nil
+}
 
-		}(listener)
-	}
+// listenTCPAcceptors creates the TCP listeners for acceptorCount acceptors.
+// When useReusePort is set, each acceptor has its own listener bound with
+// SO_REUSEPORT; otherwise, all acceptors share one listener. The listeners
+// may be closed, and bound again, using drainableListener.setDrained.
+func listenTCPAcceptors(
+	localAddress string, acceptorCount int, useReusePort bool) ([]*drainableListener, error) {
 
-	var err error
-	select {
-	case <-server.shutdownBroadcast:
-	case err = <-server.listenerError:
+	if !useReusePort {
+		listener, err := net.Listen("tcp", localAddress)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		// When drained and resumed, bind the same port, which may have been
+		// assigned by the OS.
+		boundAddress := listener.Addr().String()
+		drainable := newDrainableListener(
+			listener,
+			func() (net.Listener, error) {
+				return net.Listen("tcp", boundAddress)
+			})
+
+		listeners := make([]*drainableListener, acceptorCount)
+		for i := range listeners {
+			listeners[i] = drainable
+		}
+		return listeners, nil
 	}
 
-	for _, listener := range listeners {
-		listener.Close()
+	var listeners []*drainableListener
+
+	for i := 0; i < acceptorCount; i++ {
+		listener, err := listenReusePort(localAddress)
+		if err != nil {
+			for _, existingListener := range listeners {
+				existingListener.Close()
+			}
+			return nil, common.ContextError(err)
+		}
+
+		// Subsequent listeners must bind the same port, which may have been
+		// assigned by the OS.
+		localAddress = listener.Addr().String()
+
+		boundAddress := localAddress
+		listeners = append(
+			listeners,
+			newDrainableListener(
+				listener,
+				func() (net.Listener, error) {
+					return listenReusePort(boundAddress)
+				}))
 	}
-	server.sshServer.stopClients()
-	server.runWaitGroup.Wait()
 
-	log.WithContext().Info("stopped")
+	return listeners, nil
+}
 
-	return err
+// UpdateDrainedListeners closes the plain TCP listeners for tunnel protocols
+// drained by the traffic rules DrainTunnelProtocols, so that new connections
+// are refused, and binds the listeners again for tunnel protocols that are no
+// longer drained. When a listener can't be bound again, it remains closed
+// until the next call.
+func (server *TunnelServer) UpdateDrainedListeners() {
+
+	server.drainableListenersMutex.Lock()
+	defer server.drainableListenersMutex.Unlock()
+
+	for tunnelProtocol, listeners := range server.drainableListeners {
+
+		drained := server.sshServer.support.TrafficRulesSet.IsTunnelProtocolDrained(
+			tunnelProtocol)
+
+		for _, listener := range listeners {
+			err := listener.setDrained(drained)
+			if err != nil {
+				log.WithContextFields(
+					LogFields{
+						"tunnelProtocol": tunnelProtocol,
+						"drained":        drained,
+						"error":          err,
+					}).Warning("update drained listener failed")
+			}
+		}
+	}
 }
 
 // GetLoadStats returns load stats for the tunnel server. The stats are
@@ -249,6 +455,91 @@ func (server *TunnelServer) GetLoadStats() (ProtocolStats, RegionStats) {
 	return server.sshServer.getLoadStats()
 }
 
+// IsReady indicates whether all tunnel protocol listeners are bound and
+// accepting connections. When Config.TolerateListenerBindFailures is set and
+// some listeners failed to bind, the server is not ready; see IsDegraded.
+func (server *TunnelServer) IsReady() bool {
+	return atomic.LoadInt32(&server.listenersReady) == 1 &&
+		len(server.getBindFailedTunnelProtocols()) == 0
+}
+
+// IsDegraded indicates whether the server is running, accepting connections
+// on some tunnel protocol listeners, while other listeners failed to bind.
+// This state occurs only when Config.TolerateListenerBindFailures is set.
+func (server *TunnelServer) IsDegraded() bool {
+	return atomic.LoadInt32(&server.listenersReady) == 1 &&
+		len(server.getBindFailedTunnelProtocols()) > 0
+}
+
+func (server *TunnelServer) getBindFailedTunnelProtocols() []string {
+	server.bindFailuresMutex.Lock()
+	defer server.bindFailuresMutex.Unlock()
+	return server.bindFailedTunnelProtocols
+}
+
+// GetEstablishedClientCount returns the number of clients with established
+// tunnels.
+func (server *TunnelServer) GetEstablishedClientCount() int {
+	return server.sshServer.getEstablishedClientCount()
+}
+
+// GetAuthorizationKeyIDStats returns the number of authorizations verified
+// by each access control verification key, keyed by base64-encoded key ID,
+// since the previous call. These stats may be used to monitor the progress
+// of a verification key rotation.
+func (server *TunnelServer) GetAuthorizationKeyIDStats() map[string]int64 {
+	return server.sshServer.getAuthorizationKeyIDStats()
+}
+
+// GetMetrics implements the common.MetricsSource interface. The metrics
+// are the total port forward bytes, up and down, transferred by all
+// clients since the server started, aggregated by tunnel protocol.
+func (server *TunnelServer) GetMetrics() common.LogFields {
+	metrics := common.LogFields{
+		"tunnel_protocol_bytes":        server.sshServer.getTunnelProtocolBytes(),
+		"listener_accept_counts":       server.sshServer.getListenerAcceptCounts(),
+		"tunnel_protocol_drain_status": server.getTunnelProtocolDrainStatus(),
+		"udp_associations":             server.sshServer.getUDPAssociationStats(),
+		"handshake_timeout_count":      atomic.LoadInt64(&server.sshServer.handshakeTimeoutCount),
+	}
+	bindFailedTunnelProtocols := server.getBindFailedTunnelProtocols()
+	if len(bindFailedTunnelProtocols) > 0 {
+		bindFailures := make(map[string]int64)
+		for _, tunnelProtocol := range bindFailedTunnelProtocols {
+			bindFailures[tunnelProtocol] = 1
+		}
+		metrics["listener_bind_failures"] = bindFailures
+	}
+	server.selfTestMutex.Lock()
+	if len(server.selfTestResults) > 0 {
+		metrics["self_test"] = server.selfTestResults
+	}
+	server.selfTestMutex.Unlock()
+	if server.sshServer.idlePortForwardReaper != nil {
+		metrics["idle_port_forward_reaper"] =
+			server.sshServer.idlePortForwardReaper.getMetrics()
+	}
+	return metrics
+}
+
+// GetTunnelProtocolDrainStatus returns the drain status of each bound
+// tunnel protocol listener: TUNNEL_PROTOCOL_ACTIVE, when not drained;
+// TUNNEL_PROTOCOL_DRAINING, when drained but tunnels remain; or
+// TUNNEL_PROTOCOL_DRAINED, when drained and no tunnels remain. Tunnel
+// protocols are drained using the traffic rules DrainTunnelProtocols.
+// Tunnel protocols which failed to bind are omitted.
+func (server *TunnelServer) GetTunnelProtocolDrainStatus() map[string]string {
+	return server.getTunnelProtocolDrainStatus()
+}
+
+func (server *TunnelServer) getTunnelProtocolDrainStatus() map[string]string {
+	status := server.sshServer.getTunnelProtocolDrainStatus()
+	for _, tunnelProtocol := range server.getBindFailedTunnelProtocols() {
+		delete(status, tunnelProtocol)
+	}
+	return status
+}
+
 // ResetAllClientTrafficRules resets all established client traffic rules
 // to use the latest config and client properties. Any existing traffic
 // rule state is lost, including throttling state.
@@ -299,6 +590,15 @@ func (server *TunnelServer) UpdateClientAPIParameters(
 	return server.sshServer.updateClientAPIParameters(sessionID, apiParams)
 }
 
+// GetClientUnthrottledBytesRemaining returns the approximate number of read
+// and write bytes the client may transfer before its traffic rules rate
+// limits take effect.
+func (server *TunnelServer) GetClientUnthrottledBytesRemaining(
+	sessionID string) (int64, int64, error) {
+
+	return server.sshServer.getClientUnthrottledBytesRemaining(sessionID)
+}
+
 // ExpectClientDomainBytes indicates whether the client was configured to report
 // domain bytes in its handshake response.
 func (server *TunnelServer) ExpectClientDomainBytes(
@@ -324,6 +624,9 @@ type sshServer struct {
 	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
 	lastAuthLog                  int64
 	authFailedCount              int64
+	udpAssociationCount          int64
+	udpAssociationRejectedCount  int64
+	handshakeTimeoutCount        int64
 	support                      *SupportServices
 	establishTunnels             int32
 	concurrentSSHHandshakes      semaphore.Semaphore
@@ -337,6 +640,25 @@ type sshServer struct {
 	oslSessionCache              *cache.Cache
 	authorizationSessionIDsMutex sync.Mutex
 	authorizationSessionIDs      map[string]string
+	authorizationKeyIDCounts     map[string]int64
+	tunnelProtocolBytesMutex     sync.Mutex
+	tunnelProtocolBytes          map[string]map[string]int64
+	aggregatePortForwardsMutex   sync.Mutex
+	aggregateTCPPortForwards     map[string]int64
+	listenerAcceptCounts         map[string]*listenerAcceptCounts
+	idlePortForwardReaper        *idlePortForwardReaper
+}
+
+// listenerAcceptCounts tracks the connections accepted by a tunnel protocol
+// listener. pending is the number of accepted connections which have not
+// yet completed the SSH handshake.
+type listenerAcceptCounts struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	accepted int64
+	dropped  int64
+	pending  int64
 }
 
 func newSSHServer(
@@ -345,7 +667,7 @@ func newSSHServer(
 
 	privateKey, err := ssh.ParseRawPrivateKey([]byte(support.Config.SSHPrivateKey))
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, common.ContextError(fmt.Errorf("SSHPrivateKey: %s", err))
 	}
 
 	// TODO: use cert (ssh.NewCertSigner) for anti-fingerprint?
@@ -372,16 +694,37 @@ func newSSHServer(
 	// were known, infer some activity.
 	oslSessionCache := cache.New(OSL_SESSION_CACHE_TTL, 1*time.Minute)
 
+	// Listener accept counts are populated once, for all configured non-meek
+	// listeners, and is not modified after this point.
+	acceptCounts := make(map[string]*listenerAcceptCounts)
+	for tunnelProtocol := range support.Config.TunnelProtocolPorts {
+		if protocol.TunnelProtocolUsesMeek(tunnelProtocol) {
+			continue
+		}
+		acceptCounts[tunnelProtocol] = &listenerAcceptCounts{}
+	}
+
+	var reaper *idlePortForwardReaper
+	if support.Config.IdlePortForwardReaperIntervalSeconds > 0 {
+		reaper = newIdlePortForwardReaper(
+			time.Duration(support.Config.IdlePortForwardReaperIntervalSeconds) * time.Second)
+	}
+
 	return &sshServer{
-		support:                 support,
-		establishTunnels:        1,
-		concurrentSSHHandshakes: concurrentSSHHandshakes,
-		shutdownBroadcast:       shutdownBroadcast,
-		sshHostKey:              signer,
-		acceptedClientCounts:    make(map[string]map[string]int64),
-		clients:                 make(map[string]*sshClient),
-		oslSessionCache:         oslSessionCache,
-		authorizationSessionIDs: make(map[string]string),
+		support:                  support,
+		establishTunnels:         1,
+		concurrentSSHHandshakes:  concurrentSSHHandshakes,
+		shutdownBroadcast:        shutdownBroadcast,
+		sshHostKey:               signer,
+		acceptedClientCounts:     make(map[string]map[string]int64),
+		clients:                  make(map[string]*sshClient),
+		oslSessionCache:          oslSessionCache,
+		authorizationSessionIDs:  make(map[string]string),
+		authorizationKeyIDCounts: make(map[string]int64),
+		tunnelProtocolBytes:      make(map[string]map[string]int64),
+		aggregateTCPPortForwards: make(map[string]int64),
+		listenerAcceptCounts:     acceptCounts,
+		idlePortForwardReaper:    reaper,
 	}, nil
 }
 
@@ -421,7 +764,10 @@ func (sshServer *sshServer) runListener(
 		runningProtocols = append(runningProtocols, tunnelProtocol)
 	}
 
-	handleClient := func(clientTunnelProtocol string, clientConn net.Conn) {
+	handleClient := func(
+		clientTunnelProtocol string,
+		clientConn net.Conn,
+		onPendingAcceptFinished func()) {
 
 		// Note: establish tunnel limiter cannot simply stop TCP
 		// listeners in all cases (e.g., meek) since SSH tunnel can
@@ -430,6 +776,9 @@ func (sshServer *sshServer) runListener(
 		if !sshServer.getEstablishTunnels() {
 			log.WithContext().Debug("not establishing tunnels")
 			clientConn.Close()
+			if onPendingAcceptFinished != nil {
+				onPendingAcceptFinished()
+			}
 			return
 		}
 
@@ -446,8 +795,23 @@ func (sshServer *sshServer) runListener(
 			tunnelProtocol = clientTunnelProtocol
 		}
 
+		// New tunnels aren't established for drained tunnel protocols, while
+		// existing tunnels are unaffected. Plain TCP listeners for drained
+		// tunnel protocols are closed by UpdateDrainedListeners, so this
+		// case applies to meek, QUIC, Marionette, and TapDance listeners,
+		// which remain open, and to connections racing a drain.
+		if sshServer.support.TrafficRulesSet.IsTunnelProtocolDrained(tunnelProtocol) {
+			log.WithContextFields(
+				LogFields{"tunnelProtocol": tunnelProtocol}).Debug("tunnel protocol drained")
+			clientConn.Close()
+			if onPendingAcceptFinished != nil {
+				onPendingAcceptFinished()
+			}
+			return
+		}
+
 		// process each client connection concurrently
-		go sshServer.handleClient(tunnelProtocol, clientConn)
+		go sshServer.handleClient(tunnelProtocol, clientConn, onPendingAcceptFinished)
 	}
 
 	// Note: when exiting due to a unrecoverable error, be sure
@@ -464,7 +828,9 @@ func (sshServer *sshServer) runListener(
 			protocol.TunnelProtocolUsesMeekHTTPS(listenerTunnelProtocol),
 			protocol.TunnelProtocolUsesFrontedMeek(listenerTunnelProtocol),
 			protocol.TunnelProtocolUsesObfuscatedSessionTickets(listenerTunnelProtocol),
-			handleClient,
+			func(clientTunnelProtocol string, clientConn net.Conn) {
+				handleClient(clientTunnelProtocol, clientConn, nil)
+			},
 			sshServer.shutdownBroadcast)
 
 		if err == nil {
@@ -481,6 +847,13 @@ func (sshServer *sshServer) runListener(
 
 	} else {
 
+		acceptCounts := sshServer.listenerAcceptCounts[listenerTunnelProtocol]
+		maxPendingAccepts := int64(sshServer.support.Config.MaxPendingAcceptsPerListener)
+
+		onPendingAcceptFinished := func() {
+			atomic.AddInt64(&acceptCounts.pending, -1)
+		}
+
 		for {
 			conn, err := listener.Accept()
 
@@ -507,7 +880,22 @@ func (sshServer *sshServer) runListener(
 				return
 			}
 
-			handleClient("", conn)
+			// When configured, apply backpressure by dropping connections
+			// while this listener has too many pending accepts. The
+			// pending count is decremented when the SSH handshake
+			// completes or fails.
+
+			pending := atomic.AddInt64(&acceptCounts.pending, 1)
+			if maxPendingAccepts > 0 && pending > maxPendingAccepts {
+				onPendingAcceptFinished()
+				atomic.AddInt64(&acceptCounts.dropped, 1)
+				conn.Close()
+				continue
+			}
+
+			atomic.AddInt64(&acceptCounts.accepted, 1)
+
+			handleClient("", conn, onPendingAcceptFinished)
 		}
 	}
 }
@@ -554,6 +942,10 @@ func (sshServer *sshServer) registerEstablishedClient(client *sshClient) bool {
 	//   and reestablished. In this case, when the same server is selected, this logic
 	//   will be hit; closing the old, dangling client is desirable.
 	// - Multi-tunnel clients should not normally use one server for multiple tunnels.
+	//
+	// As a consequence, there is at most one concurrent tunnel per client session
+	// on this server, regardless of the client TunnelPoolSize; a separate limit on
+	// concurrent tunnels per session isn't required.
 	existingClient := sshServer.clients[client.sessionID]
 
 	sshServer.clients[client.sessionID] = client
@@ -591,12 +983,54 @@ func (sshServer *sshServer) unregisterEstablishedClient(client *sshClient) {
 		delete(sshServer.clients, client.sessionID)
 	}
 
+	drained := false
+	if registeredClient == client &&
+		sshServer.support.TrafficRulesSet.IsTunnelProtocolDrained(client.tunnelProtocol) {
+		drained = sshServer.getTunnelProtocolClientCount(client.tunnelProtocol) == 0
+	}
+
 	sshServer.clientsMutex.Unlock()
 
+	if drained {
+		log.WithContextFields(
+			LogFields{"tunnelProtocol": client.tunnelProtocol}).Info("tunnel protocol drained")
+	}
+
 	// Call stop() outside the mutex to avoid deadlock.
 	client.stop()
 }
 
+// getTunnelProtocolClientCount returns the number of established clients
+// using the specified tunnel protocol. The caller must hold clientsMutex.
+func (sshServer *sshServer) getTunnelProtocolClientCount(tunnelProtocol string) int {
+	count := 0
+	for _, client := range sshServer.clients {
+		if client.tunnelProtocol == tunnelProtocol {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (sshServer *sshServer) getTunnelProtocolDrainStatus() map[string]string {
+
+	sshServer.clientsMutex.Lock()
+	defer sshServer.clientsMutex.Unlock()
+
+	status := make(map[string]string)
+	for tunnelProtocol := range sshServer.support.Config.TunnelProtocolPorts {
+		if !sshServer.support.TrafficRulesSet.IsTunnelProtocolDrained(tunnelProtocol) {
+			status[tunnelProtocol] = TUNNEL_PROTOCOL_ACTIVE
+		} else if sshServer.getTunnelProtocolClientCount(tunnelProtocol) > 0 {
+			status[tunnelProtocol] = TUNNEL_PROTOCOL_DRAINING
+		} else {
+			status[tunnelProtocol] = TUNNEL_PROTOCOL_DRAINED
+		}
+	}
+
+	return status
+}
+
 type ProtocolStats map[string]map[string]int64
 type RegionStats map[string]map[string]map[string]int64
 
@@ -709,6 +1143,128 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 	return protocolStats, regionStats
 }
 
+func (sshServer *sshServer) getEstablishedClientCount() int {
+
+	sshServer.clientsMutex.Lock()
+	defer sshServer.clientsMutex.Unlock()
+
+	return len(sshServer.clients)
+}
+
+func (sshServer *sshServer) getAuthorizationKeyIDStats() map[string]int64 {
+
+	sshServer.authorizationSessionIDsMutex.Lock()
+	defer sshServer.authorizationSessionIDsMutex.Unlock()
+
+	stats := sshServer.authorizationKeyIDCounts
+	sshServer.authorizationKeyIDCounts = make(map[string]int64)
+
+	return stats
+}
+
+func (sshServer *sshServer) addTunnelProtocolBytes(
+	tunnelProtocol string, bytesUp, bytesDown int64) {
+
+	sshServer.tunnelProtocolBytesMutex.Lock()
+	defer sshServer.tunnelProtocolBytesMutex.Unlock()
+
+	if sshServer.tunnelProtocolBytes[tunnelProtocol] == nil {
+		sshServer.tunnelProtocolBytes[tunnelProtocol] = make(map[string]int64)
+	}
+
+	sshServer.tunnelProtocolBytes[tunnelProtocol]["bytes_up"] += bytesUp
+	sshServer.tunnelProtocolBytes[tunnelProtocol]["bytes_down"] += bytesDown
+}
+
+func (sshServer *sshServer) getTunnelProtocolBytes() map[string]map[string]int64 {
+
+	sshServer.tunnelProtocolBytesMutex.Lock()
+	defer sshServer.tunnelProtocolBytesMutex.Unlock()
+
+	// Return a copy, as the counters continue to be updated.
+	stats := make(map[string]map[string]int64)
+	for tunnelProtocol, bytes := range sshServer.tunnelProtocolBytes {
+		stats[tunnelProtocol] = map[string]int64{
+			"bytes_up":   bytes["bytes_up"],
+			"bytes_down": bytes["bytes_down"],
+		}
+	}
+
+	return stats
+}
+
+// allocateAggregateTCPPortForward reserves a slot in the TCP port forward
+// pool shared by all clients selecting the traffic rules identified by key,
+// returning false when the pool's limit, max, is reached. Each successful
+// allocation must be paired with releaseAggregateTCPPortForward.
+func (sshServer *sshServer) allocateAggregateTCPPortForward(key string, max int) bool {
+
+	sshServer.aggregatePortForwardsMutex.Lock()
+	defer sshServer.aggregatePortForwardsMutex.Unlock()
+
+	if sshServer.aggregateTCPPortForwards[key] >= int64(max) {
+		return false
+	}
+
+	sshServer.aggregateTCPPortForwards[key] += 1
+
+	return true
+}
+
+func (sshServer *sshServer) releaseAggregateTCPPortForward(key string) {
+
+	sshServer.aggregatePortForwardsMutex.Lock()
+	defer sshServer.aggregatePortForwardsMutex.Unlock()
+
+	sshServer.aggregateTCPPortForwards[key] -= 1
+	if sshServer.aggregateTCPPortForwards[key] <= 0 {
+		delete(sshServer.aggregateTCPPortForwards, key)
+	}
+}
+
+// allocateUDPAssociation reserves a slot for a new UDP port forward,
+// returning false when MaxConcurrentUDPAssociations is exceeded. Each
+// successful allocation must be paired with releaseUDPAssociation.
+func (sshServer *sshServer) allocateUDPAssociation() bool {
+
+	maxAssociations := int64(sshServer.support.Config.MaxConcurrentUDPAssociations)
+
+	count := atomic.AddInt64(&sshServer.udpAssociationCount, 1)
+	if maxAssociations > 0 && count > maxAssociations {
+		atomic.AddInt64(&sshServer.udpAssociationCount, -1)
+		atomic.AddInt64(&sshServer.udpAssociationRejectedCount, 1)
+		return false
+	}
+
+	return true
+}
+
+func (sshServer *sshServer) releaseUDPAssociation() {
+	atomic.AddInt64(&sshServer.udpAssociationCount, -1)
+}
+
+func (sshServer *sshServer) getUDPAssociationStats() map[string]int64 {
+	return map[string]int64{
+		"current":  atomic.LoadInt64(&sshServer.udpAssociationCount),
+		"max":      int64(sshServer.support.Config.MaxConcurrentUDPAssociations),
+		"rejected": atomic.LoadInt64(&sshServer.udpAssociationRejectedCount),
+	}
+}
+
+func (sshServer *sshServer) getListenerAcceptCounts() map[string]map[string]int64 {
+
+	stats := make(map[string]map[string]int64)
+	for tunnelProtocol, counts := range sshServer.listenerAcceptCounts {
+		stats[tunnelProtocol] = map[string]int64{
+			"accepted": atomic.LoadInt64(&counts.accepted),
+			"dropped":  atomic.LoadInt64(&counts.dropped),
+			"pending":  atomic.LoadInt64(&counts.pending),
+		}
+	}
+
+	return stats
+}
+
 func (sshServer *sshServer) resetAllClientTrafficRules() {
 
 	sshServer.clientsMutex.Lock()
@@ -782,6 +1338,22 @@ func (sshServer *sshServer) getClientHandshaked(
 	return completed, exhausted, nil
 }
 
+func (sshServer *sshServer) getClientUnthrottledBytesRemaining(
+	sessionID string) (int64, int64, error) {
+
+	sshServer.clientsMutex.Lock()
+	client := sshServer.clients[sessionID]
+	sshServer.clientsMutex.Unlock()
+
+	if client == nil {
+		return 0, 0, common.ContextError(errors.New("unknown session ID"))
+	}
+
+	readRemaining, writeRemaining := client.getUnthrottledBytesRemaining()
+
+	return readRemaining, writeRemaining, nil
+}
+
 func (sshServer *sshServer) updateClientAPIParameters(
 	sessionID string,
 	apiParams common.APIParameters) error {
@@ -851,7 +1423,13 @@ func (sshServer *sshServer) stopClients() {
 	}
 }
 
-func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.Conn) {
+func (sshServer *sshServer) handleClient(
+	tunnelProtocol string, clientConn net.Conn, onPendingAcceptFinished func()) {
+
+	// When MaxHandshakeDurationMilliseconds is set, the handshake timeout is
+	// measured from this point, so that time spent waiting to acquire the
+	// concurrent SSH handshake semaphore is included.
+	acceptTime := time.Now()
 
 	// Calling clientConn.RemoteAddr at this point, before any Read calls,
 	// satisfies the constraint documented in tapdance.Listen.
@@ -876,9 +1454,6 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 	//
 	// TODO:
 	//
-	// - deduct time spent acquiring the semaphore from SSH_HANDSHAKE_TIMEOUT in
-	//   sshClient.run, since the client is also applying an SSH handshake timeout
-	//   and won't exclude time spent waiting.
 	// - each call to sshServer.handleClient (in sshServer.runListener) is invoked
 	//   in its own goroutine, but shutdown doesn't synchronously await these
 	//   goroutnes. Once this is synchronizes, the following context.WithTimeout
@@ -895,6 +1470,9 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 		err := sshServer.concurrentSSHHandshakes.Acquire(ctx, 1)
 		if err != nil {
 			clientConn.Close()
+			if onPendingAcceptFinished != nil {
+				onPendingAcceptFinished()
+			}
 			// This is a debug log as the only possible error is context timeout.
 			log.WithContextFields(LogFields{"error": err}).Debug(
 				"acquire SSH handshake semaphore failed")
@@ -906,13 +1484,41 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 		}
 	}
 
+	if onPendingAcceptFinished != nil {
+		releaseSemaphore := onSSHHandshakeFinished
+		onSSHHandshakeFinished = func() {
+			if releaseSemaphore != nil {
+				releaseSemaphore()
+			}
+			onPendingAcceptFinished()
+		}
+	}
+
 	sshClient := newSshClient(sshServer, tunnelProtocol, geoIPData)
 
 	// sshClient.run _must_ call onSSHHandshakeFinished to release the semaphore:
 	// in any error case; or, as soon as the SSH handshake phase has successfully
 	// completed.
 
-	sshClient.run(clientConn, onSSHHandshakeFinished)
+	sshClient.run(clientConn, acceptTime, onSSHHandshakeFinished)
+}
+
+// getHandshakeTimeout returns the time remaining, for a client connection
+// accepted at acceptTime, before MaxHandshakeDurationMilliseconds is
+// exceeded. A return value <= 0 indicates the handshake has already timed
+// out. When MaxHandshakeDurationMilliseconds is not set, the timeout is the
+// full SSH_HANDSHAKE_TIMEOUT, which excludes time spent before the handshake
+// begins, such as waiting on MaxConcurrentSSHHandshakes.
+func (sshServer *sshServer) getHandshakeTimeout(acceptTime time.Time) time.Duration {
+
+	if sshServer.support.Config.MaxHandshakeDurationMilliseconds <= 0 {
+		return SSH_HANDSHAKE_TIMEOUT
+	}
+
+	maxDuration := time.Duration(
+		sshServer.support.Config.MaxHandshakeDurationMilliseconds) * time.Millisecond
+
+	return maxDuration - time.Since(acceptTime)
 }
 
 func (sshServer *sshServer) monitorPortForwardDialError(err error) {
@@ -959,6 +1565,7 @@ type sshClient struct {
 	trafficRules                         TrafficRules
 	tcpTrafficState                      trafficState
 	udpTrafficState                      trafficState
+	tunnelProtocolBytes                  int64
 	qualityMetrics                       qualityMetrics
 	tcpPortForwardLRU                    *common.LRUConns
 	oslClientSeedState                   *osl.ClientSeedState
@@ -970,6 +1577,9 @@ type sshClient struct {
 	stopTimer                            *time.Timer
 	preHandshakeRandomStreamMetrics      randomStreamMetrics
 	postHandshakeRandomStreamMetrics     randomStreamMetrics
+	exhausted                            int32
+	exhaustedRequestPending              bool
+	exhaustedRequestSent                 bool
 }
 
 type trafficState struct {
@@ -1040,7 +1650,7 @@ func newSshClient(
 }
 
 func (sshClient *sshClient) run(
-	baseConn net.Conn, onSSHHandshakeFinished func()) {
+	baseConn net.Conn, acceptTime time.Time, onSSHHandshakeFinished func()) {
 
 	// onSSHHandshakeFinished must be called even if the SSH handshake is aborted.
 	defer func() {
@@ -1079,6 +1689,7 @@ func (sshClient *sshClient) run(
 	// Further wrap the connection in a rate limiting ThrottledConn.
 
 	throttledConn := common.NewThrottledConn(conn, sshClient.rateLimits())
+	throttledConn.SetExhaustedCallback(sshClient.handleThrottledConnExhausted)
 	conn = throttledConn
 
 	// Run the initial [obfuscated] SSH handshake in a goroutine so we can both
@@ -1091,17 +1702,25 @@ func (sshClient *sshClient) run(
 		sshConn           *ssh.ServerConn
 		channels          <-chan ssh.NewChannel
 		requests          <-chan *ssh.Request
+		timedOut          bool
 		err               error
 	}
 
 	resultChannel := make(chan *sshNewServerConnResult, 2)
 
-	var afterFunc *time.Timer
-	if SSH_HANDSHAKE_TIMEOUT > 0 {
-		afterFunc = time.AfterFunc(time.Duration(SSH_HANDSHAKE_TIMEOUT), func() {
-			resultChannel <- &sshNewServerConnResult{err: errors.New("ssh handshake timeout")}
-		})
-	}
+	// The handshake timeout is SSH_HANDSHAKE_TIMEOUT or, when configured, the
+	// remaining MaxHandshakeDurationMilliseconds since the client connection
+	// was accepted. When no time remains, the timer fires immediately.
+	handshakeTimeout := sshClient.sshServer.getHandshakeTimeout(acceptTime)
+	if handshakeTimeout < 0 {
+		handshakeTimeout = 0
+	}
+	afterFunc := time.AfterFunc(handshakeTimeout, func() {
+		resultChannel <- &sshNewServerConnResult{
+			timedOut: true,
+			err:      errors.New("handshake timeout"),
+		}
+	})
 
 	go func(baseConn, conn net.Conn) {
 		sshServerConfig := &ssh.ServerConfig{
@@ -1139,13 +1758,22 @@ func (sshClient *sshClient) run(
 		// Wrap the connection in an SSH deobfuscator when required.
 
 		if err == nil && protocol.TunnelProtocolUsesObfuscatedSSH(sshClient.tunnelProtocol) {
-			// Note: NewObfuscatedSSHConn blocks on network I/O
+			// Note: NewServerObfuscatedSSHConn blocks on network I/O
 			// TODO: ensure this won't block shutdown
-			result.obfuscatedSSHConn, err = obfuscator.NewObfuscatedSSHConn(
-				obfuscator.OBFUSCATION_CONN_MODE_SERVER,
+			//
+			// NewServerObfuscatedSSHConn leaves the SeedReadTimeout read
+			// deadline in place. Here, the underlying ActivityMonitoredConn
+			// re-arms the SSH_CONNECTION_READ_DEADLINE inactivity deadline
+			// after each read, including the final seed message read.
+			result.obfuscatedSSHConn, err = obfuscator.NewServerObfuscatedSSHConn(
 				conn,
-				sshClient.sshServer.support.Config.ObfuscatedSSHKey,
-				nil, nil, nil)
+				&obfuscator.ObfuscatorConfig{
+					Keyword:           sshClient.sshServer.support.Config.ObfuscatedSSHKey,
+					AlternateKeywords: sshClient.sshServer.support.Config.AlternateObfuscatedSSHKeys,
+					SeedReadTimeout: time.Duration(
+						sshClient.sshServer.support.Config.ObfuscatedSSHSeedReadTimeoutMilliseconds) *
+						time.Millisecond,
+				})
 			if err != nil {
 				err = common.ContextError(err)
 			} else {
@@ -1192,8 +1820,21 @@ func (sshClient *sshClient) run(
 		return
 	}
 
-	if afterFunc != nil {
-		afterFunc.Stop()
+	afterFunc.Stop()
+
+	if result.timedOut {
+		conn.Close()
+		atomic.AddInt64(&sshClient.sshServer.handshakeTimeoutCount, 1)
+		// Unlike "handshake failed", this is an Info log: timeouts indicate
+		// slow or stalled clients, or an overloaded server, and the distinct
+		// message allows correlation with client-side failed tunnels.
+		log.WithContextFields(
+			LogFields{
+				"error":          result.err,
+				"tunnelProtocol": sshClient.tunnelProtocol,
+				"region":         sshClient.geoIPData.Country,
+			}).Info("handshake timeout")
+		return
 	}
 
 	if result.err != nil {
@@ -1216,8 +1857,15 @@ func (sshClient *sshClient) run(
 	sshClient.sshConn = result.sshConn
 	sshClient.activityConn = activityConn
 	sshClient.throttledConn = throttledConn
+	sendExhaustedRequest := sshClient.takeExhaustedRequest()
 	sshClient.Unlock()
 
+	// The unthrottled bytes may have been exhausted during the handshake, in
+	// which case the exhausted request is sent now.
+	if sendExhaustedRequest {
+		sshClient.startSendExhaustedRequest()
+	}
+
 	if !sshClient.sshServer.registerEstablishedClient(sshClient) {
 		conn.Close()
 		log.WithContext().Warning("register failed")
@@ -1322,7 +1970,9 @@ func (sshClient *sshClient) passwordCallback(conn ssh.ConnMetadata, password []b
 	sshClient.Lock()
 
 	// After this point, these values are read-only as they are read
-	// without obtaining sshClient.Lock.
+	// without obtaining sshClient.Lock. The exception is the ThrottledConn
+	// exhausted callback, which may run concurrently with the handshake and
+	// so reads supportsServerRequests with sshClient.Lock held.
 	sshClient.sessionID = sessionID
 	sshClient.isFirstTunnelInSession = isFirstTunnelInSession
 	sshClient.supportsServerRequests = supportsServerRequests
@@ -1809,17 +2459,21 @@ func (sshClient *sshClient) handleNewPacketTunnelChannel(
 	// will stop packet tunnel workers for any previous packet tunnel channel.
 
 	checkAllowedTCPPortFunc := func(upstreamIPAddress net.IP, port int) bool {
-		return sshClient.isPortForwardPermitted(portForwardTypeTCP, upstreamIPAddress, port)
+		return sshClient.isPortForwardPermitted(portForwardTypeTCP, "", upstreamIPAddress, port)
 	}
 
 	checkAllowedUDPPortFunc := func(upstreamIPAddress net.IP, port int) bool {
-		return sshClient.isPortForwardPermitted(portForwardTypeUDP, upstreamIPAddress, port)
+		return sshClient.isPortForwardPermitted(portForwardTypeUDP, "", upstreamIPAddress, port)
 	}
 
 	flowActivityUpdaterMaker := func(
 		upstreamHostname string, upstreamIPAddress net.IP) []tun.FlowActivityUpdater {
 
-		var updaters []tun.FlowActivityUpdater
+		// Packet tunnel flows can't be closed individually, so the
+		// tunnelProtocolBytesUpdater only accounts bytes; once the limit is
+		// reached, new flows are rejected by isPortForwardPermitted.
+		updaters := []tun.FlowActivityUpdater{
+			&tunnelProtocolBytesUpdater{sshClient: sshClient}}
 		oslUpdater := sshClient.newClientSeedPortForward(upstreamIPAddress)
 		if oslUpdater != nil {
 			updaters = append(updaters, oslUpdater)
@@ -1837,6 +2491,11 @@ func (sshClient *sshClient) handleNewPacketTunnelChannel(
 		sshClient.udpTrafficState.bytesUp += UDPApplicationBytesUp
 		sshClient.udpTrafficState.bytesDown += UDPApplicationBytesDown
 		sshClient.Unlock()
+
+		sshClient.sshServer.addTunnelProtocolBytes(
+			sshClient.tunnelProtocol,
+			TCPApplicationBytesUp+UDPApplicationBytesUp,
+			TCPApplicationBytesDown+UDPApplicationBytesDown)
 	}
 
 	err = sshClient.sshServer.support.PacketTunnelServer.ClientConnected(
@@ -1988,6 +2647,7 @@ func (sshClient *sshClient) logTunnel(additionalMetrics []LogFields) {
 
 	logFields["session_id"] = sshClient.sessionID
 	logFields["handshake_completed"] = sshClient.handshakeState.completed
+	logFields["exhausted"] = atomic.LoadInt32(&sshClient.exhausted) == 1
 	logFields["start_time"] = sshClient.activityConn.GetStartTime()
 	logFields["duration"] = sshClient.activityConn.GetActiveDuration() / time.Millisecond
 	logFields["bytes_up_tcp"] = sshClient.tcpTrafficState.bytesUp
@@ -2001,6 +2661,12 @@ func (sshClient *sshClient) logTunnel(additionalMetrics []LogFields) {
 	logFields["peak_concurrent_port_forward_count_udp"] = sshClient.udpTrafficState.peakConcurrentPortForwardCount
 	logFields["total_port_forward_count_udp"] = sshClient.udpTrafficState.totalPortForwardCount
 
+	if sshClient.throttledConn != nil {
+		readRemaining, writeRemaining := sshClient.throttledConn.GetUnthrottledBytesRemaining()
+		logFields["read_unthrottled_bytes_remaining"] = readRemaining
+		logFields["write_unthrottled_bytes_remaining"] = writeRemaining
+	}
+
 	logFields["pre_handshake_random_stream_count"] = sshClient.preHandshakeRandomStreamMetrics.count
 	logFields["pre_handshake_random_stream_upstream_bytes"] = sshClient.preHandshakeRandomStreamMetrics.upstreamBytes
 	logFields["pre_handshake_random_stream_received_upstream_bytes"] = sshClient.preHandshakeRandomStreamMetrics.receivedUpstreamBytes
@@ -2150,6 +2816,120 @@ func (sshClient *sshClient) sendOSLRequest() error {
 	return nil
 }
 
+// handleThrottledConnExhausted is invoked by the client's ThrottledConn when
+// CloseAfterExhausted is set and the unthrottled bytes are exhausted. When
+// there is a grace period before the tunnel is closed, the client is sent an
+// exhausted request so that it may report why the tunnel is closing. When
+// the tunnel is closed, an "exhausted" event is logged with the bytes
+// transferred.
+//
+// The ThrottledConn may be exhausted before the SSH handshake completes, in
+// which case the exhausted request is left pending and sent by run once the
+// handshake completes.
+func (sshClient *sshClient) handleThrottledConnExhausted(
+	inGracePeriod bool, bytesRead, bytesWritten int64) {
+
+	atomic.StoreInt32(&sshClient.exhausted, 1)
+
+	if !inGracePeriod {
+		sshClient.logExhausted(bytesRead, bytesWritten)
+		return
+	}
+
+	sshClient.Lock()
+	sshClient.exhaustedRequestPending = true
+	sendExhaustedRequest := sshClient.takeExhaustedRequest()
+	sshClient.Unlock()
+
+	if sendExhaustedRequest {
+		sshClient.startSendExhaustedRequest()
+	}
+}
+
+// takeExhaustedRequest returns true when a pending exhausted request may now
+// be sent: the SSH handshake has completed and the client supports server
+// requests. The exhausted request is sent at most once per tunnel, as a
+// traffic rules reload, which calls ThrottledConn.SetLimits, may restart the
+// grace period. takeExhaustedRequest must be called with sshClient.Lock held.
+func (sshClient *sshClient) takeExhaustedRequest() bool {
+
+	if !sshClient.exhaustedRequestPending ||
+		sshClient.exhaustedRequestSent ||
+		sshClient.sshConn == nil ||
+		!sshClient.supportsServerRequests {
+
+		return false
+	}
+
+	sshClient.exhaustedRequestPending = false
+	sshClient.exhaustedRequestSent = true
+
+	return true
+}
+
+// startSendExhaustedRequest sends the exhausted request in a new goroutine,
+// as the ThrottledConn callback must not block.
+func (sshClient *sshClient) startSendExhaustedRequest() {
+	go func() {
+		err := sshClient.sendExhaustedRequest()
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning("send exhausted request failed")
+		}
+	}()
+}
+
+// logExhausted logs an "exhausted" event for a tunnel closed due to
+// CloseAfterExhausted.
+func (sshClient *sshClient) logExhausted(bytesRead, bytesWritten int64) {
+
+	// Invoke asynchronously as the ThrottledConn callback must not block.
+	go func() {
+		sshClient.Lock()
+		logFields := LogFields{
+			"event_name":     "exhausted",
+			"session_id":     sshClient.sessionID,
+			"relay_protocol": sshClient.tunnelProtocol,
+			"bytes_read":     bytesRead,
+			"bytes_written":  bytesWritten,
+		}
+		sshClient.Unlock()
+
+		log.LogRawFieldsWithTimestamp(logFields)
+	}()
+}
+
+// sendExhaustedRequest sends an exhausted request to the client, indicating
+// that the tunnel will close once the traffic rules grace period expires.
+func (sshClient *sshClient) sendExhaustedRequest() error {
+
+	sshClient.Lock()
+	sshConn := sshClient.sshConn
+	graceMilliseconds := *sshClient.trafficRules.RateLimits.CloseAfterExhaustedGraceMilliseconds
+	sshClient.Unlock()
+
+	if sshConn == nil {
+		return nil
+	}
+
+	exhaustedRequest := protocol.ExhaustedRequest{
+		GraceMilliseconds: graceMilliseconds,
+	}
+	requestPayload, err := json.Marshal(exhaustedRequest)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	_, _, err = sshConn.SendRequest(
+		protocol.PSIPHON_API_EXHAUSTED_REQUEST_NAME,
+		false,
+		requestPayload)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 func (sshClient *sshClient) rejectNewChannel(newChannel ssh.NewChannel, logMessage string) {
 
 	// We always return the reject reason "Prohibited":
@@ -2211,6 +2991,7 @@ func (sshClient *sshClient) setHandshakeState(
 	// protocol/logs don't need to handle 'null' values.
 	authorizationIDs := make([]string, 0)
 	authorizedAccessTypes := make([]string, 0)
+	verifiedKeyIDs := make([]string, 0)
 	var stopTime time.Time
 
 	for i, authorization := range authorizations {
@@ -2221,7 +3002,7 @@ func (sshClient *sshClient) setHandshakeState(
 			break
 		}
 
-		verifiedAuthorization, err := accesscontrol.VerifyAuthorization(
+		verifiedAuthorization, verifiedKeyID, err := accesscontrol.VerifyAuthorizationWithKeyID(
 			&sshClient.sshServer.support.Config.AccessControlVerificationKeyRing,
 			authorization)
 
@@ -2241,6 +3022,7 @@ func (sshClient *sshClient) setHandshakeState(
 
 		authorizationIDs = append(authorizationIDs, authorizationID)
 		authorizedAccessTypes = append(authorizedAccessTypes, verifiedAuthorization.AccessType)
+		verifiedKeyIDs = append(verifiedKeyIDs, base64.StdEncoding.EncodeToString(verifiedKeyID))
 
 		if stopTime.IsZero() || stopTime.After(verifiedAuthorization.Expires) {
 			stopTime = verifiedAuthorization.Expires
@@ -2265,6 +3047,9 @@ func (sshClient *sshClient) setHandshakeState(
 	//   this case is distinguished and no revocation action is taken.
 
 	sshClient.sshServer.authorizationSessionIDsMutex.Lock()
+	for _, keyID := range verifiedKeyIDs {
+		sshClient.sshServer.authorizationKeyIDCounts[keyID] += 1
+	}
 	for _, authorizationID := range authorizationIDs {
 		sessionID, ok := sshClient.sshServer.authorizationSessionIDs[authorizationID]
 		if ok && sessionID != sshClient.sessionID {
@@ -2354,6 +3139,20 @@ func (sshClient *sshClient) getHandshaked() (bool, bool) {
 	return completed, exhausted
 }
 
+// getUnthrottledBytesRemaining returns the remaining unthrottled read and
+// write bytes in the client's ThrottledConn. The remaining counts are reset
+// whenever traffic rules are reset.
+func (sshClient *sshClient) getUnthrottledBytesRemaining() (int64, int64) {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	if sshClient.throttledConn == nil {
+		return 0, 0
+	}
+
+	return sshClient.throttledConn.GetUnthrottledBytesRemaining()
+}
+
 func (sshClient *sshClient) updateAPIParameters(
 	apiParams common.APIParameters) {
 
@@ -2513,8 +3312,83 @@ const (
 	portForwardTypeUDP
 )
 
+// isTunnelProtocolBytesExhausted checks whether the client has reached the
+// MaxTunnelProtocolBytes limit, if any, for its tunnel protocol. The caller
+// must hold the sshClient lock.
+func (sshClient *sshClient) isTunnelProtocolBytesExhausted() bool {
+
+	maxBytes, ok := sshClient.trafficRules.MaxTunnelProtocolBytes[sshClient.tunnelProtocol]
+	if !ok {
+		return false
+	}
+
+	return sshClient.tunnelProtocolBytes >= maxBytes
+}
+
+// updateTunnelProtocolBytes adds bytes relayed through the client's port
+// forwards to the MaxTunnelProtocolBytes tally and returns true when the
+// client has reached its limit.
+func (sshClient *sshClient) updateTunnelProtocolBytes(bytes int64) bool {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	sshClient.tunnelProtocolBytes += bytes
+
+	return sshClient.isTunnelProtocolBytesExhausted()
+}
+
+// tunnelProtocolBytesUpdater is an activity updater which tallies port
+// forward bytes towards MaxTunnelProtocolBytes as they are relayed, rather
+// than when the port forward closes. When conn is set, it is closed once
+// the limit is reached, interrupting the established port forward. Any
+// chained updater, such as an OSL seed port forward, is also updated.
+type tunnelProtocolBytesUpdater struct {
+	sshClient *sshClient
+	conn      net.Conn
+	updater   common.ActivityUpdater
+}
+
+func (updater *tunnelProtocolBytesUpdater) UpdateProgress(
+	bytesRead, bytesWritten int64, durationNanoseconds int64) {
+
+	if updater.updater != nil {
+		updater.updater.UpdateProgress(bytesRead, bytesWritten, durationNanoseconds)
+	}
+
+	if updater.sshClient.updateTunnelProtocolBytes(bytesRead+bytesWritten) &&
+		updater.conn != nil {
+
+		updater.conn.Close()
+	}
+}
+
+// newPortForwardActivityUpdater returns the activity updater for a new port
+// forward to ipAddress. conn, when not nil, is closed once the client
+// reaches its MaxTunnelProtocolBytes limit.
+func (sshClient *sshClient) newPortForwardActivityUpdater(
+	conn net.Conn, ipAddress net.IP) common.ActivityUpdater {
+
+	updater := &tunnelProtocolBytesUpdater{
+		sshClient: sshClient,
+		conn:      conn,
+	}
+
+	// Ensure nil interface if newClientSeedPortForward returns nil
+	seedUpdater := sshClient.newClientSeedPortForward(ipAddress)
+	if seedUpdater != nil {
+		updater.updater = seedUpdater
+	}
+
+	return updater
+}
+
+// isPortForwardPermitted checks whether the client may port forward to the
+// specified destination. remoteDomain is the domain name sent by the client,
+// if any, and is used only for AllowDomains checks; remoteIP is the
+// destination IP address, resolved from remoteDomain when specified.
 func (sshClient *sshClient) isPortForwardPermitted(
 	portForwardType int,
+	remoteDomain string,
 	remoteIP net.IP,
 	port int) bool {
 
@@ -2550,6 +3424,10 @@ func (sshClient *sshClient) isPortForwardPermitted(
 
 	// Traffic rules checks.
 
+	if sshClient.isTunnelProtocolBytesExhausted() {
+		return false
+	}
+
 	var allowPorts []int
 	if portForwardType == portForwardTypeTCP {
 		allowPorts = sshClient.trafficRules.AllowTCPPorts
@@ -2578,6 +3456,13 @@ func (sshClient *sshClient) isPortForwardPermitted(
 		}
 	}
 
+	if portForwardType == portForwardTypeTCP && remoteDomain != "" {
+		if common.ContainsWildcard(
+			sshClient.trafficRules.AllowDomains, strings.ToLower(remoteDomain)) {
+			return true
+		}
+	}
+
 	log.WithContextFields(
 		LogFields{
 			"type": portForwardType,
@@ -2639,6 +3524,36 @@ func (sshClient *sshClient) abortedTCPPortForward() {
 	sshClient.tcpTrafficState.concurrentDialingPortForwardCount -= 1
 }
 
+// allocateAggregateTCPPortForward reserves a slot in the shared TCP port
+// forward pool for the client's traffic rules, when those rules specify
+// MaxAggregateTCPPortForwardCount. The returned key, which is "" when there
+// is no aggregate limit, must be passed to releaseAggregateTCPPortForward.
+// The key is returned, rather than looked up on release, as the client's
+// traffic rules may be reset by a hot reload in the meantime.
+func (sshClient *sshClient) allocateAggregateTCPPortForward() (string, bool) {
+
+	sshClient.Lock()
+	key := sshClient.trafficRules.aggregateTCPPortForwardKey
+	max := *sshClient.trafficRules.MaxAggregateTCPPortForwardCount
+	sshClient.Unlock()
+
+	if key == "" {
+		return "", true
+	}
+
+	if !sshClient.sshServer.allocateAggregateTCPPortForward(key, max) {
+		return "", false
+	}
+
+	return key, true
+}
+
+func (sshClient *sshClient) releaseAggregateTCPPortForward(key string) {
+	if key != "" {
+		sshClient.sshServer.releaseAggregateTCPPortForward(key)
+	}
+}
+
 func (sshClient *sshClient) allocatePortForward(portForwardType int) bool {
 
 	sshClient.Lock()
@@ -2771,6 +3686,9 @@ func (sshClient *sshClient) closedPortForward(
 
 	sshClient.Unlock()
 
+	sshClient.sshServer.addTunnelProtocolBytes(
+		sshClient.tunnelProtocol, bytesUp, bytesDown)
+
 	// Signal any goroutine waiting in establishedPortForward
 	// that an established port forward slot is available.
 	state.availablePortForwardCond.Signal()
@@ -2882,11 +3800,18 @@ func (sshClient *sshClient) handleTCPChannel(
 		return
 	}
 
-	// Enforce traffic rules, using the resolved IP address.
+	// Enforce traffic rules, using the resolved IP address and, when the
+	// client sent a domain name, that domain name.
+
+	var domainToConnect string
+	if net.ParseIP(hostToConnect) == nil {
+		domainToConnect = hostToConnect
+	}
 
 	if !isWebServerPortForward &&
 		!sshClient.isPortForwardPermitted(
 			portForwardTypeTCP,
+			domainToConnect,
 			IP,
 			portToConnect) {
 
@@ -2896,6 +3821,25 @@ func (sshClient *sshClient) handleTCPChannel(
 		return
 	}
 
+	// Reserve a slot in the shared TCP port forward pool, if any, for the
+	// client's traffic rules. The slot is held while dialing and, if the
+	// dial succeeds, until the port forward is closed. As with the traffic
+	// rules check, web API request port forwards are exempt, so that
+	// clients can always complete API requests.
+
+	if !isWebServerPortForward {
+
+		aggregateKey, ok := sshClient.allocateAggregateTCPPortForward()
+		if !ok {
+
+			// Note: not recording a port forward failure in this case
+
+			sshClient.rejectNewChannel(newChannel, "aggregate port forward limit exceeded")
+			return
+		}
+		defer sshClient.releaseAggregateTCPPortForward(aggregateKey)
+	}
+
 	// TCP dial.
 
 	remoteAddr := net.JoinHostPort(IP.String(), strconv.Itoa(portToConnect))
@@ -2949,31 +3893,40 @@ func (sshClient *sshClient) handleTCPChannel(
 	// "established = true" cancels the deferred abortedTCPPortForward()
 	established = true
 
-	// TODO: 64-bit alignment? https://golang.org/pkg/sync/atomic/#pkg-note-BUG
-	var bytesUp, bytesDown int64
+	lruEntry := sshClient.tcpPortForwardLRU.Add(fwdConn)
+	defer lruEntry.Remove()
+
+	// CountingConn tallies the realized bytes relayed through the port
+	// forward: bytes written to fwdConn are upstream and bytes read from
+	// fwdConn are downstream.
+
+	countingConn := common.NewCountingConn(fwdConn)
+	fwdConn = countingConn
+
 	defer func() {
 		sshClient.closedPortForward(
-			portForwardTypeTCP, atomic.LoadInt64(&bytesUp), atomic.LoadInt64(&bytesDown))
+			portForwardTypeTCP, countingConn.BytesWritten(), countingConn.BytesRead())
 	}()
 
-	lruEntry := sshClient.tcpPortForwardLRU.Add(fwdConn)
-	defer lruEntry.Remove()
-
 	// ActivityMonitoredConn monitors the TCP port forward I/O and updates
 	// its LRU status. ActivityMonitoredConn also times out I/O on the port
 	// forward if both reads and writes have been idle for the specified
 	// duration.
 
-	// Ensure nil interface if newClientSeedPortForward returns nil
-	var updater common.ActivityUpdater
-	seedUpdater := sshClient.newClientSeedPortForward(IP)
-	if seedUpdater != nil {
-		updater = seedUpdater
+	// As with the traffic rules check, web API request port forwards are
+	// not interrupted when MaxTunnelProtocolBytes is reached.
+
+	var limitedConn net.Conn
+	if !isWebServerPortForward {
+		limitedConn = fwdConn
 	}
+	updater := sshClient.newPortForwardActivityUpdater(limitedConn, IP)
 
-	fwdConn, err = common.NewActivityMonitoredConn(
+	idleTimeout := sshClient.idleTCPPortForwardTimeout()
+
+	activityConn, err := common.NewActivityMonitoredConn(
 		fwdConn,
-		sshClient.idleTCPPortForwardTimeout(),
+		idleTimeout,
 		true,
 		updater,
 		lruEntry)
@@ -2981,6 +3934,10 @@ func (sshClient *sshClient) handleTCPChannel(
 		log.WithContextFields(LogFields{"error": err}).Error("NewActivityMonitoredConn failed")
 		return
 	}
+	fwdConn = activityConn
+
+	sshClient.sshServer.idlePortForwardReaper.add(activityConn, idleTimeout)
+	defer sshClient.sshServer.idlePortForwardReaper.remove(activityConn)
 
 	// Relay channel to forwarded connection.
 
@@ -2994,9 +3951,8 @@ func (sshClient *sshClient) handleTCPChannel(
 		// io.Copy allocates a 32K temporary buffer, and each port forward relay uses
 		// two of these buffers; using io.CopyBuffer with a smaller buffer reduces the
 		// overall memory footprint.
-		bytes, err := io.CopyBuffer(
+		_, err := io.CopyBuffer(
 			fwdChannel, fwdConn, make([]byte, SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE))
-		atomic.AddInt64(&bytesDown, bytes)
 		if err != nil && err != io.EOF {
 			// Debug since errors such as "connection reset by peer" occur during normal operation
 			log.WithContextFields(LogFields{"error": err}).Debug("downstream TCP relay failed")
@@ -3007,9 +3963,8 @@ func (sshClient *sshClient) handleTCPChannel(
 		// be flowing?
 		fwdChannel.Close()
 	}()
-	bytes, err := io.CopyBuffer(
+	_, err = io.CopyBuffer(
 		fwdConn, fwdChannel, make([]byte, SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE))
-	atomic.AddInt64(&bytesUp, bytes)
 	if err != nil && err != io.EOF {
 		log.WithContextFields(LogFields{"error": err}).Debug("upstream TCP relay failed")
 	}
@@ -3024,6 +3979,6 @@ func (sshClient *sshClient) handleTCPChannel(
 	log.WithContextFields(
 		LogFields{
 			"remoteAddr": remoteAddr,
-			"bytesUp":    atomic.LoadInt64(&bytesUp),
-			"bytesDown":  atomic.LoadInt64(&bytesDown)}).Debug("exiting")
+			"bytesUp":    countingConn.BytesWritten(),
+			"bytesDown":  countingConn.BytesRead()}).Debug("exiting")
 }
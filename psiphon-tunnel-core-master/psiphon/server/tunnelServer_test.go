@@ -0,0 +1,865 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/marusama/semaphore"
+)
+
+func TestListenerAcceptBackpressure(t *testing.T) {
+
+	maxPendingAccepts := 2
+	connectionCount := 5
+
+	config := &Config{
+		TunnelProtocolPorts:          map[string]int{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 0},
+		MaxConcurrentSSHHandshakes:   1,
+		MaxPendingAcceptsPerListener: maxPendingAccepts,
+	}
+
+	geoIPService, err := NewGeoIPService(config)
+	if err != nil {
+		t.Fatalf("NewGeoIPService failed: %s", err)
+	}
+
+	shutdownBroadcast := make(chan struct{})
+
+	sshServer := &sshServer{
+		support: &SupportServices{
+			Config:          config,
+			GeoIPService:    geoIPService,
+			TrafficRulesSet: newTestTrafficRulesSet(t, "{}"),
+		},
+		establishTunnels:        1,
+		concurrentSSHHandshakes: semaphore.New(1),
+		shutdownBroadcast:       shutdownBroadcast,
+		acceptedClientCounts:    make(map[string]map[string]int64),
+		listenerAcceptCounts: map[string]*listenerAcceptCounts{
+			protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: {},
+		},
+	}
+
+	// Hold the only SSH handshake slot, so that accepted connections remain
+	// pending until SSH_BEGIN_HANDSHAKE_TIMEOUT.
+
+	err = sshServer.concurrentSSHHandshakes.Acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Acquire failed: %s", err)
+	}
+	defer sshServer.concurrentSSHHandshakes.Release(1)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	listenerError := make(chan error, 1)
+	listenerDone := make(chan struct{})
+	go func() {
+		sshServer.runListener(
+			listener, listenerError, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+		close(listenerDone)
+	}()
+
+	defer func() {
+		close(shutdownBroadcast)
+		listener.Close()
+		<-listenerDone
+	}()
+
+	for i := 0; i < connectionCount; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		defer conn.Close()
+	}
+
+	waitForCounts := func(check func(counts map[string]int64) bool) map[string]int64 {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			counts := sshServer.getListenerAcceptCounts()[protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH]
+			if check(counts) {
+				return counts
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected listener accept counts: %+v", counts)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	counts := waitForCounts(func(counts map[string]int64) bool {
+		return counts["accepted"]+counts["dropped"] == int64(connectionCount)
+	})
+
+	if counts["accepted"] != int64(maxPendingAccepts) ||
+		counts["dropped"] != int64(connectionCount-maxPendingAccepts) ||
+		counts["pending"] != int64(maxPendingAccepts) {
+
+		t.Fatalf("unexpected listener accept counts: %+v", counts)
+	}
+
+	// Test: pending accepts are released when the SSH handshake is abandoned
+
+	waitForCounts(func(counts map[string]int64) bool {
+		return counts["pending"] == 0
+	})
+
+	select {
+	case err := <-listenerError:
+		t.Fatalf("unexpected listener error: %s", err)
+	default:
+	}
+}
+
+func TestListenTCPAcceptors(t *testing.T) {
+
+	testCases := []struct {
+		description  string
+		useReusePort bool
+	}{
+		{"shared listener", false},
+		{"SO_REUSEPORT", true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			if testCase.useReusePort && !isReusePortSupported() {
+				t.Skip("SO_REUSEPORT not supported")
+			}
+
+			acceptorCount := 4
+
+			listeners, err := listenTCPAcceptors(
+				"127.0.0.1:0", acceptorCount, testCase.useReusePort)
+			if err != nil {
+				t.Fatalf("listenTCPAcceptors failed: %s", err)
+			}
+
+			if len(listeners) != acceptorCount {
+				t.Fatalf("unexpected listener count: %d", len(listeners))
+			}
+
+			distinctListeners := make(map[net.Listener]bool)
+			for _, listener := range listeners {
+				defer listener.Close()
+				distinctListeners[listener] = true
+				if listener.Addr().String() != listeners[0].Addr().String() {
+					t.Fatalf("unexpected listener address: %s", listener.Addr())
+				}
+			}
+
+			expectedDistinctListeners := 1
+			if testCase.useReusePort {
+				expectedDistinctListeners = acceptorCount
+			}
+
+			if len(distinctListeners) != expectedDistinctListeners {
+				t.Fatalf("unexpected distinct listener count: %d", len(distinctListeners))
+			}
+		})
+	}
+}
+
+func TestDrainableListener(t *testing.T) {
+
+	testCases := []struct {
+		description  string
+		useReusePort bool
+	}{
+		{"shared listener", false},
+		{"SO_REUSEPORT", true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			if testCase.useReusePort && !isReusePortSupported() {
+				t.Skip("SO_REUSEPORT not supported")
+			}
+
+			acceptorCount := 2
+
+			listeners, err := listenTCPAcceptors(
+				"127.0.0.1:0", acceptorCount, testCase.useReusePort)
+			if err != nil {
+				t.Fatalf("listenTCPAcceptors failed: %s", err)
+			}
+
+			address := listeners[0].Addr().String()
+
+			acceptedConns := make(chan net.Conn, 10)
+			acceptorsDone := new(sync.WaitGroup)
+
+			for _, listener := range listeners {
+				acceptorsDone.Add(1)
+				go func(listener net.Listener) {
+					defer acceptorsDone.Done()
+					for {
+						conn, err := listener.Accept()
+						if err != nil {
+							return
+						}
+						acceptedConns <- conn
+					}
+				}(listener)
+			}
+
+			setDrained := func(drained bool) {
+				for _, listener := range listeners {
+					err := listener.setDrained(drained)
+					if err != nil {
+						t.Fatalf("setDrained failed: %s", err)
+					}
+				}
+			}
+
+			checkAccepted := func() {
+				conn, err := net.Dial("tcp", address)
+				if err != nil {
+					t.Fatalf("Dial failed: %s", err)
+				}
+				conn.Close()
+				select {
+				case acceptedConn := <-acceptedConns:
+					acceptedConn.Close()
+				case <-time.After(5 * time.Second):
+					t.Fatalf("connection not accepted")
+				}
+			}
+
+			// Test: connections are accepted before draining
+
+			checkAccepted()
+
+			// Test: connections are refused while drained
+
+			setDrained(true)
+
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+				t.Fatalf("unexpected Dial success")
+			}
+
+			if listeners[0].Addr().String() != address {
+				t.Fatalf("unexpected listener address: %s", listeners[0].Addr())
+			}
+
+			// Test: connections are accepted after resuming
+
+			setDrained(false)
+
+			checkAccepted()
+
+			// Test: closing drained listeners stops the acceptors
+
+			setDrained(true)
+
+			for _, listener := range listeners {
+				listener.Close()
+			}
+
+			acceptorsDone.Wait()
+		})
+	}
+}
+
+func BenchmarkListenerAccept(b *testing.B) {
+
+	run := func(b *testing.B, acceptorCount int, useReusePort bool) {
+
+		if useReusePort && !isReusePortSupported() {
+			b.Skip("SO_REUSEPORT not supported")
+		}
+
+		listeners, err := listenTCPAcceptors("127.0.0.1:0", acceptorCount, useReusePort)
+		if err != nil {
+			b.Fatalf("listenTCPAcceptors failed: %s", err)
+		}
+
+		for _, listener := range listeners {
+			go func(listener net.Listener) {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}(listener)
+		}
+
+		defer func() {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+		}()
+
+		address := listeners[0].Addr().String()
+
+		b.ResetTimer()
+
+		b.RunParallel(func(pb *testing.PB) {
+			buffer := make([]byte, 1)
+			for pb.Next() {
+				conn, err := net.Dial("tcp", address)
+				if err != nil {
+					b.Errorf("Dial failed: %s", err)
+					return
+				}
+				// Wait for the acceptor to close the connection.
+				conn.Read(buffer)
+				conn.Close()
+			}
+		})
+	}
+
+	b.Run("single acceptor", func(b *testing.B) { run(b, 1, false) })
+	b.Run("shared listener, 4 acceptors", func(b *testing.B) { run(b, 4, false) })
+	b.Run("SO_REUSEPORT, 4 acceptors", func(b *testing.B) { run(b, 4, true) })
+}
+
+func TestTunnelProtocolDrain(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-tunnel-server-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	filename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	err = ioutil.WriteFile(
+		filename, []byte(`{"DrainTunnelProtocols" : ["OSSH"]}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	trafficRulesSet, err := NewTrafficRulesSet(filename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	shutdownBroadcast := make(chan struct{})
+
+	server := &TunnelServer{
+		sshServer: &sshServer{
+			support: &SupportServices{
+				Config: &Config{
+					TunnelProtocolPorts: map[string]int{
+						protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 0,
+						protocol.TUNNEL_PROTOCOL_SSH:            0,
+					},
+				},
+				TrafficRulesSet: trafficRulesSet,
+			},
+			establishTunnels:  1,
+			shutdownBroadcast: shutdownBroadcast,
+			clients: map[string]*sshClient{
+				"1": {tunnelProtocol: protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+				"2": {tunnelProtocol: protocol.TUNNEL_PROTOCOL_SSH},
+			},
+			listenerAcceptCounts: map[string]*listenerAcceptCounts{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: {},
+			},
+		},
+	}
+
+	checkStatus := func(expectedStatus map[string]string) {
+		status := server.GetTunnelProtocolDrainStatus()
+		if !reflect.DeepEqual(status, expectedStatus) {
+			t.Fatalf("unexpected drain status: %+v", status)
+		}
+	}
+
+	// Test: drained protocol with existing tunnels is draining
+
+	checkStatus(map[string]string{
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: TUNNEL_PROTOCOL_DRAINING,
+		protocol.TUNNEL_PROTOCOL_SSH:            TUNNEL_PROTOCOL_ACTIVE,
+	})
+
+	// Test: new connections to a drained protocol are closed
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	listenerDone := make(chan struct{})
+	go func() {
+		server.sshServer.runListener(
+			listener, make(chan error, 1), protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+		close(listenerDone)
+	}()
+
+	defer func() {
+		close(shutdownBroadcast)
+		listener.Close()
+		<-listenerDone
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatalf("unexpected Read success")
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatalf("connection not closed")
+	}
+
+	// Test: drained protocol without tunnels is drained
+
+	server.sshServer.clientsMutex.Lock()
+	delete(server.sshServer.clients, "1")
+	server.sshServer.clientsMutex.Unlock()
+
+	checkStatus(map[string]string{
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: TUNNEL_PROTOCOL_DRAINED,
+		protocol.TUNNEL_PROTOCOL_SSH:            TUNNEL_PROTOCOL_ACTIVE,
+	})
+
+	// Test: hot reload re-enables the drained protocol
+
+	err = ioutil.WriteFile(filename, []byte(`{}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	_, err = trafficRulesSet.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+
+	checkStatus(map[string]string{
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: TUNNEL_PROTOCOL_ACTIVE,
+		protocol.TUNNEL_PROTOCOL_SSH:            TUNNEL_PROTOCOL_ACTIVE,
+	})
+}
+
+func TestUDPAssociationLimit(t *testing.T) {
+
+	testCases := []struct {
+		description      string
+		maxAssociations  int
+		allocateCount    int
+		expectedAccepted int
+	}{
+		{"unlimited", 0, 100, 100},
+		{"under limit", 10, 5, 5},
+		{"at limit", 10, 10, 10},
+		{"over limit", 10, 15, 10},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			sshServer := &sshServer{
+				support: &SupportServices{
+					Config: &Config{
+						MaxConcurrentUDPAssociations: testCase.maxAssociations,
+					},
+				},
+			}
+
+			accepted := 0
+			for i := 0; i < testCase.allocateCount; i++ {
+				if sshServer.allocateUDPAssociation() {
+					accepted += 1
+				}
+			}
+
+			expectedStats := map[string]int64{
+				"current":  int64(testCase.expectedAccepted),
+				"max":      int64(testCase.maxAssociations),
+				"rejected": int64(testCase.allocateCount - testCase.expectedAccepted),
+			}
+
+			stats := sshServer.getUDPAssociationStats()
+			if accepted != testCase.expectedAccepted ||
+				!reflect.DeepEqual(stats, expectedStats) {
+
+				t.Fatalf("unexpected UDP association stats: %d, %+v", accepted, stats)
+			}
+
+			// Test: released associations may be reallocated
+
+			sshServer.releaseUDPAssociation()
+
+			if !sshServer.allocateUDPAssociation() {
+				t.Fatalf("allocateUDPAssociation failed after release")
+			}
+		})
+	}
+}
+
+func TestAggregateTCPPortForwardLimit(t *testing.T) {
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" :  {
+            "MaxTCPPortForwardCount" : 10
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {
+                    "Regions" : ["XX"]
+                },
+                "Rules" : {
+                    "MaxAggregateTCPPortForwardCount" : 5
+                }
+            }
+        ]
+    }
+    `
+
+	set := newTestTrafficRulesSet(t, trafficRulesJSON)
+
+	sshServer := &sshServer{
+		aggregateTCPPortForwards: make(map[string]int64),
+	}
+
+	newClient := func(region string) *sshClient {
+		return &sshClient{
+			sshServer: sshServer,
+			trafficRules: set.GetTrafficRules(
+				true, "OSSH", GeoIPData{Country: region}, handshakeState{}),
+		}
+	}
+
+	// Test: clients matching the same rule share one pool
+
+	var clients []*sshClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, newClient("XX"))
+	}
+
+	var keys []string
+	accepted := 0
+	for i := 0; i < 9; i++ {
+		key, ok := clients[i%len(clients)].allocateAggregateTCPPortForward()
+		if ok {
+			keys = append(keys, key)
+			accepted += 1
+		}
+	}
+
+	if accepted != 5 {
+		t.Fatalf("unexpected accepted port forwards: %d", accepted)
+	}
+
+	// Test: a new client matching the rule is at the shared limit
+
+	otherClient := newClient("XX")
+
+	_, ok := otherClient.allocateAggregateTCPPortForward()
+	if ok {
+		t.Fatalf("allocateAggregateTCPPortForward unexpected success")
+	}
+
+	// Test: released slots may be reallocated by any client in the pool
+
+	clients[0].releaseAggregateTCPPortForward(keys[0])
+
+	key, ok := otherClient.allocateAggregateTCPPortForward()
+	if !ok {
+		t.Fatalf("allocateAggregateTCPPortForward failed after release")
+	}
+	keys[0] = key
+
+	// Test: clients selecting other rules are not limited
+
+	for i := 0; i < 20; i++ {
+		key, ok := newClient("YY").allocateAggregateTCPPortForward()
+		if !ok || key != "" {
+			t.Fatalf("unexpected aggregate limit: %s", key)
+		}
+	}
+
+	// Test: releasing all slots clears the shared counter
+
+	for _, key := range keys {
+		otherClient.releaseAggregateTCPPortForward(key)
+	}
+
+	if len(sshServer.aggregateTCPPortForwards) != 0 {
+		t.Fatalf(
+			"unexpected aggregate counters: %+v", sshServer.aggregateTCPPortForwards)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+
+	testCases := []struct {
+		description          string
+		maxDurationMillis    int
+		elapsed              time.Duration
+		expectedMaxRemaining time.Duration
+		expectTimedOut       bool
+	}{
+		{"default", 0, 0, SSH_HANDSHAKE_TIMEOUT, false},
+		{"default excludes elapsed", 0, SSH_HANDSHAKE_TIMEOUT + time.Second, SSH_HANDSHAKE_TIMEOUT, false},
+		{"configured", 5000, 0, 5 * time.Second, false},
+		{"configured partially elapsed", 5000, 2 * time.Second, 3 * time.Second, false},
+		{"configured elapsed", 5000, 6 * time.Second, 0, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			sshServer := &sshServer{
+				support: &SupportServices{
+					Config: &Config{
+						MaxHandshakeDurationMilliseconds: testCase.maxDurationMillis,
+					},
+				},
+			}
+
+			remaining := sshServer.getHandshakeTimeout(
+				time.Now().Add(-testCase.elapsed))
+
+			if testCase.expectTimedOut {
+				if remaining > 0 {
+					t.Fatalf("unexpected remaining handshake time: %s", remaining)
+				}
+				return
+			}
+
+			// Allow for time elapsed while running the test.
+			if remaining > testCase.expectedMaxRemaining ||
+				remaining < testCase.expectedMaxRemaining-time.Second {
+
+				t.Fatalf("unexpected remaining handshake time: %s", remaining)
+			}
+		})
+	}
+}
+
+func TestExhaustedRequest(t *testing.T) {
+
+	type testSSHConn struct {
+		ssh.Conn
+	}
+
+	exhaust := func(sshClient *sshClient) bool {
+		sshClient.Lock()
+		defer sshClient.Unlock()
+		sshClient.exhaustedRequestPending = true
+		return sshClient.takeExhaustedRequest()
+	}
+
+	handshake := func(sshClient *sshClient) bool {
+		sshClient.Lock()
+		defer sshClient.Unlock()
+		sshClient.sshConn = &testSSHConn{}
+		return sshClient.takeExhaustedRequest()
+	}
+
+	// Test: exhausted after the handshake, request sent immediately
+
+	client := &sshClient{supportsServerRequests: true}
+
+	if handshake(client) {
+		t.Fatalf("unexpected exhausted request before exhaustion")
+	}
+
+	if !exhaust(client) {
+		t.Fatalf("exhausted request not sent")
+	}
+
+	// Test: a grace period restarted by SetLimits doesn't resend the request
+
+	if exhaust(client) {
+		t.Fatalf("unexpected repeated exhausted request")
+	}
+
+	// Test: exhausted during the handshake, request sent once the handshake
+	// completes
+
+	client = &sshClient{supportsServerRequests: true}
+
+	if exhaust(client) {
+		t.Fatalf("unexpected exhausted request before handshake")
+	}
+
+	if !handshake(client) {
+		t.Fatalf("pending exhausted request not sent")
+	}
+
+	if exhaust(client) {
+		t.Fatalf("unexpected repeated exhausted request")
+	}
+
+	// Test: client doesn't support server requests
+
+	client = &sshClient{}
+
+	if exhaust(client) || handshake(client) {
+		t.Fatalf("unexpected exhausted request")
+	}
+}
+
+func TestListenerBindFailures(t *testing.T) {
+
+	// Occupy a port so that binding the OSSH listener fails.
+	occupiedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer occupiedListener.Close()
+	occupiedPort := occupiedListener.Addr().(*net.TCPAddr).Port
+
+	freeListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	freePort := freeListener.Addr().(*net.TCPAddr).Port
+	freeListener.Close()
+
+	testCases := []struct {
+		description                  string
+		tolerate                     bool
+		tunnelProtocolPorts          map[string]int
+		expectError                  bool
+		expectedListenerCount        int
+		expectedListenerBindFailures map[string]int64
+	}{
+		{
+			"fatal partial bind failure",
+			false,
+			map[string]int{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: occupiedPort,
+				protocol.TUNNEL_PROTOCOL_SSH:            freePort,
+			},
+			true,
+			0,
+			nil,
+		},
+		{
+			"tolerated partial bind failure",
+			true,
+			map[string]int{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: occupiedPort,
+				protocol.TUNNEL_PROTOCOL_SSH:            freePort,
+			},
+			false,
+			1,
+			map[string]int64{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: 1},
+		},
+		{
+			"tolerated complete bind failure",
+			true,
+			map[string]int{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH: occupiedPort,
+			},
+			true,
+			0,
+			nil,
+		},
+		{
+			"no bind failure",
+			true,
+			map[string]int{
+				protocol.TUNNEL_PROTOCOL_SSH: freePort,
+			},
+			false,
+			1,
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			server := &TunnelServer{
+				sshServer: &sshServer{
+					support: &SupportServices{
+						Config: &Config{
+							ServerIPAddress:              "127.0.0.1",
+							TunnelProtocolPorts:          testCase.tunnelProtocolPorts,
+							TolerateListenerBindFailures: testCase.tolerate,
+						},
+						TrafficRulesSet: newTestTrafficRulesSet(t, `{}`),
+					},
+					clients:              make(map[string]*sshClient),
+					listenerAcceptCounts: make(map[string]*listenerAcceptCounts),
+				},
+			}
+
+			listeners, err := server.bindListeners()
+			for _, listener := range listeners {
+				listener.Close()
+			}
+
+			if testCase.expectError {
+				if err == nil {
+					t.Fatalf("bindListeners unexpectedly succeeded")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("bindListeners failed: %s", err)
+			}
+
+			if len(listeners) != testCase.expectedListenerCount {
+				t.Fatalf("unexpected listener count: %d", len(listeners))
+			}
+
+			bindFailures, ok := server.GetMetrics()["listener_bind_failures"]
+			if testCase.expectedListenerBindFailures == nil {
+				if ok {
+					t.Fatalf("unexpected listener bind failures: %+v", bindFailures)
+				}
+			} else if !reflect.DeepEqual(bindFailures, testCase.expectedListenerBindFailures) {
+				t.Fatalf("unexpected listener bind failures: %+v", bindFailures)
+			}
+
+			// Tunnel protocols which failed to bind aren't reported as active.
+
+			drainStatus := server.GetTunnelProtocolDrainStatus()
+			if len(drainStatus) != 1 ||
+				drainStatus[protocol.TUNNEL_PROTOCOL_SSH] != TUNNEL_PROTOCOL_ACTIVE {
+				t.Fatalf("unexpected drain status: %+v", drainStatus)
+			}
+		})
+	}
+}
@@ -153,12 +153,27 @@ func (mux *udpPortForwardMultiplexer) run() {
 				dialPort = DNS_RESOLVER_PORT
 
 			} else if !mux.sshClient.isPortForwardPermitted(
-				portForwardTypeUDP, dialIP, int(message.remotePort)) {
+				portForwardTypeUDP, "", dialIP, int(message.remotePort)) {
 				// The udpgw protocol has no error response, so
 				// we just discard the message and read another.
 				continue
 			}
 
+			// Enforce the server-wide UDP association limit. As above, the
+			// udpgw protocol has no error response, so the message is
+			// discarded.
+
+			if !mux.sshClient.sshServer.allocateUDPAssociation() {
+				log.WithContextFields(
+					LogFields{
+						"connID": message.connID,
+						"reason": "server UDP association limit exceeded",
+					}).Debug("UDP port forward rejected")
+				continue
+			}
+			// Can't defer sshServer.releaseUDPAssociation() here;
+			// relayDownstream will call sshServer.releaseUDPAssociation()
+
 			// Note: UDP port forward counting has no dialing phase
 
 			// establishedPortForward increments the concurrent UDP port
@@ -178,6 +193,7 @@ func (mux *udpPortForwardMultiplexer) run() {
 				"udp", nil, &net.UDPAddr{IP: dialIP, Port: dialPort})
 			if err != nil {
 				mux.sshClient.closedPortForward(portForwardTypeUDP, 0, 0)
+				mux.sshClient.sshServer.releaseUDPAssociation()
 
 				// Monitor for low resource error conditions
 				mux.sshClient.sshServer.monitorPortForwardDialError(err)
@@ -196,22 +212,20 @@ func (mux *udpPortForwardMultiplexer) run() {
 			// forward if both reads and writes have been idle for the specified
 			// duration.
 
-			// Ensure nil interface if newClientSeedPortForward returns nil
-			var updater common.ActivityUpdater
-			seedUpdater := mux.sshClient.newClientSeedPortForward(dialIP)
-			if seedUpdater != nil {
-				updater = seedUpdater
-			}
+			updater := mux.sshClient.newPortForwardActivityUpdater(udpConn, dialIP)
+
+			idleTimeout := mux.sshClient.idleUDPPortForwardTimeout()
 
 			conn, err := common.NewActivityMonitoredConn(
 				udpConn,
-				mux.sshClient.idleUDPPortForwardTimeout(),
+				idleTimeout,
 				true,
 				updater,
 				lruEntry)
 			if err != nil {
 				lruEntry.Remove()
 				mux.sshClient.closedPortForward(portForwardTypeUDP, 0, 0)
+				mux.sshClient.sshServer.releaseUDPAssociation()
 				log.WithContextFields(LogFields{"error": err}).Error("NewActivityMonitoredConn failed")
 				continue
 			}
@@ -231,6 +245,8 @@ func (mux *udpPortForwardMultiplexer) run() {
 			mux.portForwards[portForward.connID] = portForward
 			mux.portForwardsMutex.Unlock()
 
+			mux.sshClient.sshServer.idlePortForwardReaper.add(conn, idleTimeout)
+
 			mux.relayWaitGroup.Add(1)
 			go portForward.relayDownstream()
 		}
@@ -277,7 +293,7 @@ type udpPortForward struct {
 	preambleSize int
 	remoteIP     []byte
 	remotePort   uint16
-	conn         net.Conn
+	conn         *common.ActivityMonitoredConn
 	lruEntry     *common.LRUConnsEntry
 	mux          *udpPortForwardMultiplexer
 }
@@ -345,9 +361,12 @@ func (portForward *udpPortForward) relayDownstream() {
 
 	portForward.conn.Close()
 
+	portForward.mux.sshClient.sshServer.idlePortForwardReaper.remove(portForward.conn)
+
 	bytesUp := atomic.LoadInt64(&portForward.bytesUp)
 	bytesDown := atomic.LoadInt64(&portForward.bytesDown)
 	portForward.mux.sshClient.closedPortForward(portForwardTypeUDP, bytesUp, bytesDown)
+	portForward.mux.sshClient.sshServer.releaseUDPAssociation()
 
 	log.WithContextFields(
 		LogFields{
@@ -470,6 +489,10 @@ func readUdpgwMessage(
 	}
 }
 
+// writeUdpgwPreamble writes a udpgw message header and address to buffer.
+// remoteIP must be a 4 byte IPv4 or 16 byte IPv6 address; for IPv6
+// addresses, udpgwProtocolFlagIPv6 is added to flags so that the reader
+// expects the 18 byte address form.
 func writeUdpgwPreamble(
 	preambleSize int,
 	flags uint8,
@@ -479,6 +502,14 @@ func writeUdpgwPreamble(
 	packetSize uint16,
 	buffer []byte) error {
 
+	switch len(remoteIP) {
+	case 4:
+	case 16:
+		flags |= udpgwProtocolFlagIPv6
+	default:
+		return common.ContextError(errors.New("invalid udpgw remote IP size"))
+	}
+
 	if preambleSize != 7+len(remoteIP) {
 		return common.ContextError(errors.New("invalid udpgw preamble size"))
 	}
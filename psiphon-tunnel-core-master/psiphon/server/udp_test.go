@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestUdpgwPreamble(t *testing.T) {
+
+	testCases := []struct {
+		description   string
+		remoteIP      net.IP
+		flags         uint8
+		expectSuccess bool
+	}{
+		{"IPv4", net.ParseIP("192.0.2.1").To4(), 0, true},
+		{"IPv6", net.ParseIP("2001:db8::1"), 0, true},
+		{"IPv6 DNS", net.ParseIP("2001:db8::53"), udpgwProtocolFlagDNS, true},
+		{"invalid address size", make([]byte, 5), 0, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			connID := uint16(1234)
+			remotePort := uint16(5678)
+			packet := []byte("packet")
+
+			preambleSize := 7 + len(testCase.remoteIP)
+			buffer := make([]byte, udpgwProtocolMaxMessageSize)
+			copy(buffer[preambleSize:], packet)
+
+			err := writeUdpgwPreamble(
+				preambleSize,
+				testCase.flags,
+				connID,
+				testCase.remoteIP,
+				remotePort,
+				uint16(len(packet)),
+				buffer)
+
+			if !testCase.expectSuccess {
+				if err == nil {
+					t.Fatalf("writeUdpgwPreamble unexpected success")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("writeUdpgwPreamble failed: %s", err)
+			}
+
+			message, err := readUdpgwMessage(
+				bytes.NewReader(buffer[0:preambleSize+len(packet)]),
+				make([]byte, udpgwProtocolMaxMessageSize))
+			if err != nil {
+				t.Fatalf("readUdpgwMessage failed: %s", err)
+			}
+
+			if message.connID != connID ||
+				message.preambleSize != preambleSize ||
+				!net.IP(message.remoteIP).Equal(testCase.remoteIP) ||
+				len(message.remoteIP) != len(testCase.remoteIP) ||
+				message.remotePort != remotePort ||
+				message.forwardDNS != (testCase.flags&udpgwProtocolFlagDNS != 0) ||
+				!bytes.Equal(message.packet, packet) {
+
+				t.Fatalf("unexpected udpgw message: %+v", message)
+			}
+		})
+	}
+}
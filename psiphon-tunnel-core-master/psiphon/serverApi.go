@@ -35,6 +35,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
@@ -254,6 +255,10 @@ func (serverContext *ServerContext) doHandshakeRequest(
 
 	NoticeActiveAuthorizationIDs(handshakeResponse.ActiveAuthorizationIDs)
 
+	NoticeUnthrottledBytesRemaining(
+		handshakeResponse.ReadUnthrottledBytesRemaining,
+		handshakeResponse.WriteUnthrottledBytesRemaining)
+
 	if doTactics && handshakeResponse.TacticsPayload != nil &&
 		networkID == serverContext.tunnel.config.GetNetworkID() {
 
@@ -800,6 +805,11 @@ func getBaseAPIParameters(
 		params["tls_profile"] = dialParams.TLSProfile
 	}
 
+	TLSVersion := dialParams.TLSVersion.Load().(string)
+	if TLSVersion != "" {
+		params["tls_version"] = TLSVersion
+	}
+
 	if dialParams.ServerEntry.Region != "" {
 		params["server_entry_region"] = dialParams.ServerEntry.Region
 	}
@@ -957,11 +967,32 @@ func HandleServerRequest(
 	switch name {
 	case protocol.PSIPHON_API_OSL_REQUEST_NAME:
 		return HandleOSLRequest(tunnelOwner, tunnel, payload)
+	case protocol.PSIPHON_API_EXHAUSTED_REQUEST_NAME:
+		return HandleExhaustedRequest(tunnel, payload)
 	}
 
 	return common.ContextError(fmt.Errorf("invalid request name: %s", name))
 }
 
+// HandleExhaustedRequest handles a server notification that the tunnel's
+// traffic rules byte budget is exhausted and that the server will close the
+// tunnel after the specified grace period.
+func HandleExhaustedRequest(
+	tunnel *Tunnel, payload []byte) error {
+
+	var exhaustedRequest protocol.ExhaustedRequest
+	err := json.Unmarshal(payload, &exhaustedRequest)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	NoticeTunnelExhausted(
+		tunnel.dialParams.ServerEntry.IpAddress,
+		time.Duration(exhaustedRequest.GraceMilliseconds)*time.Millisecond)
+
+	return nil
+}
+
 func HandleOSLRequest(
 	tunnelOwner TunnelOwner, tunnel *Tunnel, payload []byte) error {
 
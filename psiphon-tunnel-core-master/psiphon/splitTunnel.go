@@ -174,8 +174,17 @@ func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool
 		return cachedClassification.isUntunneled
 	}
 
+	p := classifier.clientParameters.Get()
+	resolveIPTimeout := p.Duration(parameters.ResolveIPTimeout)
+	resolveIPRetryCount := p.Int(parameters.ResolveIPRetryCount)
+	p = nil
+
 	ipAddr, ttl, err := tunneledLookupIP(
-		dnsServerAddress, classifier.dnsTunneler, targetAddress)
+		dnsServerAddress,
+		classifier.dnsTunneler,
+		targetAddress,
+		resolveIPTimeout,
+		resolveIPRetryCount)
 	if err != nil {
 		NoticeAlert("failed to resolve address for split tunnel classification: %s", err)
 		return false
@@ -382,9 +391,14 @@ func (classifier *SplitTunnelClassifier) ipAddressInRoutes(ipAddr net.IP) bool {
 }
 
 // tunneledLookupIP resolves a split tunnel candidate hostname with a tunneled
-// DNS request.
+// DNS request. Each request attempt is bounded by resolveIPTimeout, and
+// failed attempts are retried up to resolveIPRetryCount times.
 func tunneledLookupIP(
-	dnsServerAddress string, dnsTunneler Tunneler, host string) (addr net.IP, ttl time.Duration, err error) {
+	dnsServerAddress string,
+	dnsTunneler Tunneler,
+	host string,
+	resolveIPTimeout time.Duration,
+	resolveIPRetryCount int) (addr net.IP, ttl time.Duration, err error) {
 
 	ipAddr := net.ParseIP(host)
 	if ipAddr != nil {
@@ -401,16 +415,31 @@ func tunneledLookupIP(
 	// Dial's alwaysTunnel is set to true to ensure this connection
 	// is tunneled (also ensures this code path isn't circular).
 	// Assumes tunnel dialer conn configures timeouts and interruptibility.
+	//
+	// The DNS request is sent over a TCP port forward, where resending a
+	// query on the same conn doesn't recover from a lost request or
+	// response. So each attempt dials a fresh port forward. Dial failures
+	// indicate a tunnel failure and aren't retried.
 
-	conn, err := dnsTunneler.Dial(fmt.Sprintf(
-		"%s:%d", dnsServerAddress, DNS_PORT), true, nil)
-	if err != nil {
-		return nil, 0, common.ContextError(err)
-	}
+	var ipAddrs []net.IP
+	var ttls []time.Duration
 
-	ipAddrs, ttls, err := ResolveIP(host, conn)
-	if err != nil {
-		return nil, 0, common.ContextError(err)
+	for attempt := 0; ; attempt++ {
+
+		conn, err := dnsTunneler.Dial(fmt.Sprintf(
+			"%s:%d", dnsServerAddress, DNS_PORT), true, nil)
+		if err != nil {
+			return nil, 0, common.ContextError(err)
+		}
+
+		ipAddrs, ttls, err = ResolveIPWithRetry(host, conn, resolveIPTimeout, 0)
+		if err == nil {
+			break
+		}
+
+		if attempt >= resolveIPRetryCount {
+			return nil, 0, common.ContextError(err)
+		}
 	}
 	if len(ipAddrs) < 1 {
 		return nil, 0, common.ContextError(errors.New("no IP address"))
@@ -53,13 +53,20 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package psiphon
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -85,6 +92,20 @@ type CustomTLSConfig struct {
 	// DialAddr overrides the "addr" input to Dial when specified
 	DialAddr string
 
+	// HTTPConnectProxyAddress specifies an HTTP proxy, "host:port", through
+	// which to establish the TLS session. When set, Dial is used to connect
+	// to the proxy, an HTTP CONNECT request is issued for the dial address,
+	// and TLS is layered on top of the resulting tunnel. Any response status
+	// other than 200 fails the dial. Proxy authentication is not supported.
+	HTTPConnectProxyAddress string
+
+	// HandshakeTimeout, when > 0, bounds the TLS handshake, including
+	// certificate verification, with a deadline set on the underlying
+	// network connection. The deadline is cleared once the handshake
+	// completes. This is in addition to, and applies regardless of, any
+	// deadline in the dial context.
+	HandshakeTimeout time.Duration
+
 	// UseDialAddrSNI specifies whether to always use the dial "addr"
 	// host name in the SNI server_name field. When DialAddr is set,
 	// its host name is used.
@@ -106,6 +127,16 @@ type CustomTLSConfig struct {
 	// specified certificate. SNI is disbled when this is set.
 	VerifyLegacyCertificate *x509.Certificate
 
+	// PinnedSPKISHA256 is a list of SHA-256 digests of certificate
+	// SubjectPublicKeyInfo values. When set, and SkipVerify is false, a
+	// verified certificate chain must include a certificate, either the
+	// leaf or any issuer up to and including the root, with a
+	// SubjectPublicKeyInfo digest in the list. Certificates sent by the
+	// server which are not part of a verified chain are not considered.
+	// Pinning is applied after, and does not replace, the normal
+	// certificate verification.
+	PinnedSPKISHA256 [][]byte
+
 	// TLSProfile specifies a particular indistinguishable TLS profile to use
 	// for the TLS dial. When TLSProfile is "", a profile is selected at
 	// random. Setting TLSProfile allows the caller to pin the selection so
@@ -125,10 +156,32 @@ type CustomTLSConfig struct {
 	// CA certs. See Config.TrustedCACertificatesFilename.
 	TrustedCACertificatesFilename string
 
+	// TrustedCACertificatesPEM specifies PEM encoded trusted CA certs. When
+	// set, TrustedCACertificatesPEM is used instead of reading
+	// TrustedCACertificatesFilename, for deployments which embed certs
+	// rather than shipping a file. As with TrustedCACertificatesFilename,
+	// TrustedCACertificatesPEM is ignored when SkipVerify or
+	// VerifyLegacyCertificate is set.
+	TrustedCACertificatesPEM []byte
+
 	// ObfuscatedSessionTicketKey enables obfuscated session tickets
 	// using the specified key.
+	//
+	// The forged session ticket is a TLS 1.2 ticket, which is opaque to
+	// observers and contains no timestamps, so there is no apparent ticket
+	// age or lifetime to configure on the client side. The only lifetime
+	// on the wire is the server's NewSessionTicket lifetime hint, which the
+	// server already randomizes.
 	ObfuscatedSessionTicketKey string
 
+	// OnClientHello, when set, is called with the selected TLS profile and
+	// the ClientHello handshake message bytes, as sent to the server,
+	// during the handshake and before the ClientHello is written to the
+	// network. This is intended for instrumentation, such as capturing
+	// ClientHellos for offline fingerprint analysis. OnClientHello is
+	// best-effort: any panic in the callback is recovered and ignored.
+	OnClientHello func(tlsProfile string, clientHelloBytes []byte)
+
 	utlsClientSessionCache utls.ClientSessionCache
 	trisClientSessionCache tris.ClientSessionCache
 }
@@ -137,12 +190,18 @@ type CustomTLSConfig struct {
 // tickets, enabling TLS session resumability across multiple
 // CustomTLSDial calls or dialers using the same CustomTLSConfig.
 //
-// TLSProfile must be set or will be auto-set via SelectTLSProfile.
+// TLSProfile must be set or will be auto-set via SelectTLSProfile. An error
+// is returned when a set TLSProfile fails ValidateTLSProfile.
 func (config *CustomTLSConfig) EnableClientSessionCache(
-	clientParameters *parameters.ClientParameters) {
+	clientParameters *parameters.ClientParameters) error {
 
 	if config.TLSProfile == "" {
 		config.TLSProfile = SelectTLSProfile(config.ClientParameters.Get())
+	} else {
+		err := ValidateTLSProfile(config.TLSProfile)
+		if err != nil {
+			return common.ContextError(err)
+		}
 	}
 
 	if useUTLS(config.TLSProfile) {
@@ -150,9 +209,29 @@ func (config *CustomTLSConfig) EnableClientSessionCache(
 	} else {
 		config.trisClientSessionCache = tris.NewLRUClientSessionCache(0)
 	}
+
+	return nil
+}
+
+// ValidateTLSProfile checks that tlsProfile is a known TLS profile which
+// this build is capable of dialing. utls profiles must map to a parroted
+// utls ClientHello, and not fall through to the stock Go ClientHello; TLS
+// 1.3 profiles require tris, which is always included in this build.
+func ValidateTLSProfile(tlsProfile string) error {
+
+	if !common.Contains(protocol.SupportedTLSProfiles, tlsProfile) {
+		return common.ContextError(fmt.Errorf("unknown TLS profile: %s", tlsProfile))
+	}
+
+	if useUTLS(tlsProfile) && getUTLSClientHelloID(tlsProfile) == utls.HelloGolang {
+		return common.ContextError(fmt.Errorf("unsupported TLS profile: %s", tlsProfile))
+	}
+
+	return nil
 }
 
 // SelectTLSProfile picks a random TLS profile from the available candidates.
+// The selection is weighted by the TLSProfileSelectionWeights parameter, if set.
 func SelectTLSProfile(
 	p *parameters.ClientParametersSnapshot) string {
 
@@ -174,15 +253,36 @@ func SelectTLSProfile(
 		return ""
 	}
 
-	choice := prng.Intn(len(tlsProfiles))
-
-	return tlsProfiles[choice]
+	return p.TLSProfileWeights(parameters.TLSProfileSelectionWeights).Select(tlsProfiles)
 }
 
 func useUTLS(tlsProfile string) bool {
 	return tlsProfile != protocol.TLS_PROFILE_TLS13_RANDOMIZED
 }
 
+// getTLS13CurvePreferences selects the tris CurvePreferences for the
+// TLS 1.3 randomized profile. tris sends a single key_share entry, for the
+// first preferred curve, and does not support HelloRetryRequest, so the
+// first curve is limited to X25519 and P-256, which all TLS 1.3 servers are
+// expected to support. The selection varies with the randomized TLS
+// profile seed, as utls varies curves for its randomized profile, and
+// identical seeds yield identical selections.
+func getTLS13CurvePreferences(randomizedTLSProfileSeed *prng.Seed) ([]tris.CurveID, error) {
+
+	PRNG, err := prng.NewPRNGWithSaltedSeed(
+		randomizedTLSProfileSeed, "tls13-curve-preferences")
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	curvePreferences := []tris.CurveID{tris.X25519, tris.CurveP256}
+	if PRNG.FlipCoin() {
+		curvePreferences[0], curvePreferences[1] = curvePreferences[1], curvePreferences[0]
+	}
+
+	return append(curvePreferences, tris.CurveP384, tris.CurveP521), nil
+}
+
 func getUTLSClientHelloID(tlsProfile string) utls.ClientHelloID {
 	switch tlsProfile {
 	case protocol.TLS_PROFILE_IOS_1131:
@@ -211,7 +311,9 @@ type tlsConn interface {
 	net.Conn
 	Handshake() error
 	GetPeerCertificates() []*x509.Certificate
+	GetVerifiedChains() [][]*x509.Certificate
 	IsHTTP2() bool
+	GetNegotiatedTLSVersion() uint16
 }
 
 type utlsConn struct {
@@ -222,12 +324,20 @@ func (conn *utlsConn) GetPeerCertificates() []*x509.Certificate {
 	return conn.UConn.ConnectionState().PeerCertificates
 }
 
+func (conn *utlsConn) GetVerifiedChains() [][]*x509.Certificate {
+	return conn.UConn.ConnectionState().VerifiedChains
+}
+
 func (conn *utlsConn) IsHTTP2() bool {
 	state := conn.UConn.ConnectionState()
 	return state.NegotiatedProtocolIsMutual &&
 		state.NegotiatedProtocol == "h2"
 }
 
+func (conn *utlsConn) GetNegotiatedTLSVersion() uint16 {
+	return conn.UConn.ConnectionState().Version
+}
+
 type trisConn struct {
 	*tris.Conn
 }
@@ -236,12 +346,20 @@ func (conn *trisConn) GetPeerCertificates() []*x509.Certificate {
 	return conn.Conn.ConnectionState().PeerCertificates
 }
 
+func (conn *trisConn) GetVerifiedChains() [][]*x509.Certificate {
+	return conn.Conn.ConnectionState().VerifiedChains
+}
+
 func (conn *trisConn) IsHTTP2() bool {
 	state := conn.Conn.ConnectionState()
 	return state.NegotiatedProtocolIsMutual &&
 		state.NegotiatedProtocol == "h2"
 }
 
+func (conn *trisConn) GetNegotiatedTLSVersion() uint16 {
+	return conn.Conn.ConnectionState().Version
+}
+
 func IsTLSConnUsingHTTP2(conn net.Conn) bool {
 	if c, ok := conn.(tlsConn); ok {
 		return c.IsHTTP2()
@@ -249,6 +367,33 @@ func IsTLSConnUsingHTTP2(conn net.Conn) bool {
 	return false
 }
 
+// GetTLSConnNegotiatedVersion returns the TLS version, such as
+// tris.VersionTLS13, negotiated for conn, or 0 when conn is not a
+// CustomTLSDial conn.
+func GetTLSConnNegotiatedVersion(conn net.Conn) uint16 {
+	if c, ok := conn.(tlsConn); ok {
+		return c.GetNegotiatedTLSVersion()
+	}
+	return 0
+}
+
+// TLSVersionName returns a name, such as "TLSv1.3", for the TLS version
+// value returned by GetTLSConnNegotiatedVersion. Unrecognized versions are
+// named by their hex value.
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tris.VersionTLS10:
+		return "TLSv1.0"
+	case tris.VersionTLS11:
+		return "TLSv1.1"
+	case tris.VersionTLS12:
+		return "TLSv1.2"
+	case tris.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
 // NewCustomTLSDialer creates a new dialer based on CustomTLSDial.
 func NewCustomTLSDialer(config *CustomTLSConfig) Dialer {
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -271,12 +416,57 @@ func CustomTLSDial(
 	network, addr string,
 	config *CustomTLSConfig) (net.Conn, error) {
 
+	if config.TLSProfile != "" {
+		err := ValidateTLSProfile(config.TLSProfile)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
 	dialAddr := addr
 	if config.DialAddr != "" {
 		dialAddr = config.DialAddr
 	}
 
-	rawConn, err := config.Dial(ctx, network, dialAddr)
+	var err error
+
+	// The trusted CA certificates are loaded before dialing so that a
+	// misconfiguration fails without establishing a connection.
+
+	var tlsRootCAs *x509.CertPool
+
+	if !config.SkipVerify &&
+		config.VerifyLegacyCertificate == nil &&
+		(len(config.TrustedCACertificatesPEM) > 0 ||
+			config.TrustedCACertificatesFilename != "") {
+
+		certData := config.TrustedCACertificatesPEM
+		if len(certData) == 0 {
+			certData, err = ioutil.ReadFile(config.TrustedCACertificatesFilename)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+		}
+		tlsRootCAs = x509.NewCertPool()
+		if !tlsRootCAs.AppendCertsFromPEM(certData) {
+			return nil, common.ContextError(
+				errors.New("no trusted CA certificates"))
+		}
+	}
+
+	var rawConn net.Conn
+
+	if config.HTTPConnectProxyAddress != "" {
+		rawConn, err = config.Dial(ctx, network, config.HTTPConnectProxyAddress)
+		if err == nil {
+			err = httpConnect(ctx, rawConn, dialAddr)
+			if err != nil {
+				rawConn.Close()
+			}
+		}
+	} else {
+		rawConn, err = config.Dial(ctx, network, dialAddr)
+	}
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -331,20 +521,6 @@ func CustomTLSDial(
 		copy(obfuscatedSessionTicketKey[:], key)
 	}
 
-	var tlsRootCAs *x509.CertPool
-
-	if !config.SkipVerify &&
-		config.VerifyLegacyCertificate == nil &&
-		config.TrustedCACertificatesFilename != "" {
-
-		tlsRootCAs = x509.NewCertPool()
-		certData, err := ioutil.ReadFile(config.TrustedCACertificatesFilename)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
-		tlsRootCAs.AppendCertsFromPEM(certData)
-	}
-
 	randomizedTLSProfileSeed := config.RandomizedTLSProfileSeed
 
 	if protocol.TLSProfileIsRandomized(selectedTLSProfile) &&
@@ -356,6 +532,15 @@ func CustomTLSDial(
 		}
 	}
 
+	tlsRawConn := rawConn
+	if config.OnClientHello != nil {
+		tlsRawConn = &clientHelloRecorderConn{
+			Conn:          rawConn,
+			tlsProfile:    selectedTLSProfile,
+			onClientHello: config.OnClientHello,
+		}
+	}
+
 	// Depending on the selected TLS profile, the TLS provider will be tris
 	// (TLS 1.3) or utls (all other profiles).
 
@@ -376,7 +561,7 @@ func CustomTLSDial(
 		}
 
 		uconn := utls.UClient(
-			rawConn,
+			tlsRawConn,
 			tlsConfig,
 			getUTLSClientHelloID(selectedTLSProfile),
 			randomizedTLSProfileSeed)
@@ -414,6 +599,12 @@ func CustomTLSDial(
 			return nil, common.ContextError(errors.New("TLS profile is not TLS 1.3"))
 		}
 
+		curvePreferences, err := getTLS13CurvePreferences(randomizedTLSProfileSeed)
+		if err != nil {
+			rawConn.Close()
+			return nil, common.ContextError(err)
+		}
+
 		tlsConfig := &tris.Config{
 			RootCAs:                 tlsRootCAs,
 			InsecureSkipVerify:      tlsConfigInsecureSkipVerify,
@@ -421,14 +612,23 @@ func CustomTLSDial(
 			ClientSessionCache:      clientSessionCache,
 			UseExtendedMasterSecret: true,
 			ClientHelloPRNGSeed:     randomizedTLSProfileSeed,
+			CurvePreferences:        curvePreferences,
 		}
 
 		conn = &trisConn{
-			Conn: tris.Client(rawConn, tlsConfig),
+			Conn: tris.Client(tlsRawConn, tlsConfig),
 		}
 
 	}
 
+	if config.HandshakeTimeout > 0 {
+		err = rawConn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+		if err != nil {
+			rawConn.Close()
+			return nil, common.ContextError(err)
+		}
+	}
+
 	resultChannel := make(chan error)
 
 	go func() {
@@ -444,16 +644,39 @@ func CustomTLSDial(
 		<-resultChannel
 	}
 
-	if err == nil && !config.SkipVerify && tlsConfigInsecureSkipVerify {
+	// verifiedChains are the certificate chains which passed verification,
+	// either in the handshake or manually, below. Pinning is checked against
+	// only these chains, and not all certificates sent by the server, as any
+	// server may send additional, unverified certificates.
+	var verifiedChains [][]*x509.Certificate
+
+	if err == nil && !config.SkipVerify {
+
+		if tlsConfigInsecureSkipVerify {
+
+			if config.VerifyLegacyCertificate != nil {
+				err = verifyLegacyCertificate(conn, config.VerifyLegacyCertificate)
+				if err == nil {
+					verifiedChains = [][]*x509.Certificate{{config.VerifyLegacyCertificate}}
+				}
+			} else {
+				// Manually verify certificates
+				verifiedChains, err = verifyServerCerts(conn, hostname)
+			}
 
-		if config.VerifyLegacyCertificate != nil {
-			err = verifyLegacyCertificate(conn, config.VerifyLegacyCertificate)
 		} else {
-			// Manually verify certificates
-			err = verifyServerCerts(conn, hostname)
+			verifiedChains = conn.GetVerifiedChains()
 		}
 	}
 
+	if err == nil && !config.SkipVerify && len(config.PinnedSPKISHA256) > 0 {
+		err = verifyPinnedSPKI(verifiedChains, config.PinnedSPKISHA256)
+	}
+
+	if err == nil && config.HandshakeTimeout > 0 {
+		err = rawConn.SetDeadline(time.Time{})
+	}
+
 	if err != nil {
 		rawConn.Close()
 		return nil, common.ContextError(err)
@@ -462,6 +685,120 @@ func CustomTLSDial(
 	return conn, nil
 }
 
+// httpConnect issues an HTTP CONNECT request for addr over conn, an
+// established connection to an HTTP proxy, and reads the proxy response.
+// On success, conn is a tunnel to addr.
+func httpConnect(ctx context.Context, conn net.Conn, addr string) error {
+
+	resultChannel := make(chan error)
+
+	go func() {
+
+		request := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+
+		err := request.Write(conn)
+		if err != nil {
+			resultChannel <- common.ContextError(err)
+			return
+		}
+
+		// The proxy response is read one byte at a time, with no read
+		// buffering, so that no bytes sent by the destination after the
+		// response are consumed.
+
+		response, err := http.ReadResponse(
+			bufio.NewReaderSize(&oneByteReader{reader: conn}, 16), request)
+		if err != nil {
+			resultChannel <- common.ContextError(err)
+			return
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			resultChannel <- common.ContextError(
+				fmt.Errorf("HTTP CONNECT failed: %s", response.Status))
+			return
+		}
+
+		resultChannel <- nil
+	}()
+
+	var err error
+
+	select {
+	case err = <-resultChannel:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// Interrupt the goroutine
+		conn.Close()
+		<-resultChannel
+	}
+
+	return err
+}
+
+// oneByteReader limits each Read to a single byte.
+type oneByteReader struct {
+	reader io.Reader
+}
+
+func (r *oneByteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.reader.Read(b)
+}
+
+// clientHelloRecorderConn invokes the OnClientHello callback with the
+// ClientHello handshake message contained in the first TLS record written.
+type clientHelloRecorderConn struct {
+	net.Conn
+	tlsProfile    string
+	onClientHello func(string, []byte)
+	recordOnce    sync.Once
+}
+
+func (conn *clientHelloRecorderConn) Write(b []byte) (int, error) {
+	conn.recordOnce.Do(func() {
+		conn.recordClientHello(b)
+	})
+	return conn.Conn.Write(b)
+}
+
+func (conn *clientHelloRecorderConn) recordClientHello(record []byte) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			NoticeAlert("OnClientHello panic: %v", r)
+		}
+	}()
+
+	// The record must be a TLS handshake record, type 22, containing a
+	// ClientHello handshake message, type 1.
+
+	const recordHeaderLength = 5
+
+	if len(record) < recordHeaderLength+1 ||
+		record[0] != 22 ||
+		record[recordHeaderLength] != 1 {
+		return
+	}
+
+	length := int(record[3])<<8 | int(record[4])
+	if len(record) < recordHeaderLength+length {
+		return
+	}
+
+	conn.onClientHello(
+		conn.tlsProfile,
+		append([]byte(nil), record[recordHeaderLength:recordHeaderLength+length]...))
+}
+
 func verifyLegacyCertificate(conn tlsConn, expectedCertificate *x509.Certificate) error {
 	certs := conn.GetPeerCertificates()
 	if len(certs) < 1 {
@@ -473,7 +810,23 @@ func verifyLegacyCertificate(conn tlsConn, expectedCertificate *x509.Certificate
 	return nil
 }
 
-func verifyServerCerts(conn tlsConn, hostname string) error {
+func verifyPinnedSPKI(
+	verifiedChains [][]*x509.Certificate, pinnedSPKISHA256 [][]byte) error {
+
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pinnedSPKISHA256 {
+				if bytes.Equal(digest[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return common.ContextError(errors.New("no pinned certificate public key"))
+}
+
+func verifyServerCerts(conn tlsConn, hostname string) ([][]*x509.Certificate, error) {
 	certs := conn.GetPeerCertificates()
 
 	opts := x509.VerifyOptions{
@@ -490,9 +843,9 @@ func verifyServerCerts(conn tlsConn, hostname string) error {
 		opts.Intermediates.AddCert(cert)
 	}
 
-	_, err := certs[0].Verify(opts)
+	verifiedChains, err := certs[0].Verify(opts)
 	if err != nil {
-		return common.ContextError(err)
+		return nil, common.ContextError(err)
 	}
-	return nil
+	return verifiedChains, nil
 }
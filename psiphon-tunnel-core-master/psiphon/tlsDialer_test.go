@@ -0,0 +1,924 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	tris "github.com/Psiphon-Labs/tls-tris"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+
+	// The test server accepts TCP connections but never responds.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}(conn)
+		}
+	}()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	for _, tlsProfile := range []string{
+		protocol.TLS_PROFILE_CHROME_58,
+		protocol.TLS_PROFILE_TLS13_RANDOMIZED} {
+
+		t.Run(tlsProfile, func(t *testing.T) {
+
+			handshakeTimeout := 500 * time.Millisecond
+
+			config := &CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					d := &net.Dialer{}
+					return d.DialContext(ctx, network, address)
+				},
+				SkipVerify:       true,
+				TLSProfile:       tlsProfile,
+				HandshakeTimeout: handshakeTimeout,
+			}
+
+			// The context has no deadline, so only HandshakeTimeout can
+			// end the stalled handshake.
+
+			startTime := time.Now()
+
+			resultChannel := make(chan error, 1)
+			go func() {
+				conn, err := CustomTLSDial(context.Background(), "tcp", listener.Addr().String(), config)
+				if conn != nil {
+					conn.Close()
+				}
+				resultChannel <- err
+			}()
+
+			select {
+			case err = <-resultChannel:
+			case <-time.After(10 * handshakeTimeout):
+				t.Fatalf("CustomTLSDial did not time out")
+			}
+
+			if err == nil {
+				t.Fatalf("unexpected CustomTLSDial success")
+			}
+
+			if !strings.Contains(err.Error(), "timeout") {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if time.Since(startTime) < handshakeTimeout {
+				t.Fatalf("unexpected early timeout")
+			}
+		})
+	}
+}
+
+func TestValidateTLSProfile(t *testing.T) {
+
+	testCases := []struct {
+		description   string
+		tlsProfile    string
+		expectedValid bool
+	}{
+		{"utls profile", protocol.TLS_PROFILE_CHROME_58, true},
+		{"randomized profile", protocol.TLS_PROFILE_RANDOMIZED, true},
+		{"TLS 1.3 profile", protocol.TLS_PROFILE_TLS13_RANDOMIZED, true},
+		{"unknown profile", "Chrome-1", false},
+		{"empty profile", "", false},
+	}
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			err := ValidateTLSProfile(testCase.tlsProfile)
+			if (err == nil) != testCase.expectedValid {
+				t.Fatalf("unexpected ValidateTLSProfile result: %v", err)
+			}
+
+			if testCase.tlsProfile == "" {
+				return
+			}
+
+			config := &CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return nil, errors.New("unexpected dial")
+				},
+				TLSProfile: testCase.tlsProfile,
+			}
+
+			err = config.EnableClientSessionCache(clientParameters)
+			if (err == nil) != testCase.expectedValid {
+				t.Fatalf("unexpected EnableClientSessionCache result: %v", err)
+			}
+
+			// An invalid TLS profile must fail before dialing.
+
+			if !testCase.expectedValid {
+				_, err = CustomTLSDial(context.Background(), "tcp", "127.0.0.1:443", config)
+				if err == nil || strings.Contains(err.Error(), "unexpected dial") {
+					t.Fatalf("unexpected CustomTLSDial result: %v", err)
+				}
+			}
+		})
+	}
+
+	for _, tlsProfile := range protocol.SupportedTLSProfiles {
+		err := ValidateTLSProfile(tlsProfile)
+		if err != nil {
+			t.Fatalf("ValidateTLSProfile failed for %s: %s", tlsProfile, err)
+		}
+	}
+}
+
+func TestSelectTLSProfileWeights(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	// With LimitTLSProfiles restricting the candidates to two profiles, a
+	// 9:1 weighting should select the heavily weighted profile ~90% of the
+	// time.
+
+	_, err = clientParameters.Set(
+		"",
+		false,
+		map[string]interface{}{
+			parameters.LimitTLSProfiles: protocol.TLSProfiles{
+				protocol.TLS_PROFILE_CHROME_58,
+				protocol.TLS_PROFILE_RANDOMIZED,
+			},
+			parameters.TLSProfileSelectionWeights: parameters.TLSProfileWeights{
+				protocol.TLS_PROFILE_CHROME_58: 9,
+			},
+		})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	iterations := 10000
+	counts := make(map[string]int)
+	for i := 0; i < iterations; i++ {
+		counts[SelectTLSProfile(clientParameters.Get())] += 1
+	}
+
+	if len(counts) != 2 {
+		t.Fatalf("unexpected selected TLS profiles: %+v", counts)
+	}
+
+	proportion := float64(counts[protocol.TLS_PROFILE_CHROME_58]) / float64(iterations)
+	if proportion < 0.85 || proportion > 0.95 {
+		t.Fatalf("unexpected weighted proportion: %f", proportion)
+	}
+}
+
+func TestTLS13CurvePreferences(t *testing.T) {
+
+	// Test: identical seeds produce identical curve preferences, and the
+	// key_share curve varies across seeds.
+
+	keyShareCurves := make(map[tris.CurveID]bool)
+
+	for i := 0; i < 100; i++ {
+
+		seed, err := prng.NewSeed()
+		if err != nil {
+			t.Fatalf("prng.NewSeed failed: %s", err)
+		}
+
+		curvePreferences, err := getTLS13CurvePreferences(seed)
+		if err != nil {
+			t.Fatalf("getTLS13CurvePreferences failed: %s", err)
+		}
+
+		replayCurvePreferences, err := getTLS13CurvePreferences(seed)
+		if err != nil {
+			t.Fatalf("getTLS13CurvePreferences failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(curvePreferences, replayCurvePreferences) {
+			t.Fatalf("unexpected curve preferences: %v", replayCurvePreferences)
+		}
+
+		if curvePreferences[0] != tris.X25519 && curvePreferences[0] != tris.CurveP256 {
+			t.Fatalf("unexpected key_share curve: %v", curvePreferences[0])
+		}
+
+		keyShareCurves[curvePreferences[0]] = true
+	}
+
+	if len(keyShareCurves) != 2 {
+		t.Fatalf("unexpected key_share curves: %v", keyShareCurves)
+	}
+
+	// Test: TLS 1.3 handshakes with a tris server succeed with each key_share
+	// curve.
+
+	serverAddress, _, stopServer := startTestTLSServer(t)
+	defer stopServer()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	keyShareCurves = make(map[tris.CurveID]bool)
+
+	for len(keyShareCurves) < 2 {
+
+		seed, err := prng.NewSeed()
+		if err != nil {
+			t.Fatalf("prng.NewSeed failed: %s", err)
+		}
+
+		curvePreferences, err := getTLS13CurvePreferences(seed)
+		if err != nil {
+			t.Fatalf("getTLS13CurvePreferences failed: %s", err)
+		}
+
+		if keyShareCurves[curvePreferences[0]] {
+			continue
+		}
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+
+		conn, err := CustomTLSDial(
+			ctx,
+			"tcp",
+			serverAddress,
+			&CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					d := &net.Dialer{}
+					return d.DialContext(ctx, network, address)
+				},
+				SkipVerify:               true,
+				TLSProfile:               protocol.TLS_PROFILE_TLS13_RANDOMIZED,
+				RandomizedTLSProfileSeed: seed,
+			})
+
+		cancelFunc()
+
+		if err != nil {
+			t.Fatalf("CustomTLSDial with key_share curve %v failed: %s", curvePreferences[0], err)
+		}
+
+		conn.Close()
+
+		keyShareCurves[curvePreferences[0]] = true
+	}
+}
+
+func TestPinnedSPKI(t *testing.T) {
+
+	serverAddress, certificate, stopServer := startTestTLSServer(t)
+	defer stopServer()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	pin := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	otherPin := sha256.Sum256([]byte("other"))
+
+	testCases := []struct {
+		description   string
+		pins          [][]byte
+		skipVerify    bool
+		expectSuccess bool
+	}{
+		{"no pins", nil, false, true},
+		{"matching pin", [][]byte{otherPin[:], pin[:]}, false, true},
+		{"non-matching pin", [][]byte{otherPin[:]}, false, false},
+		{"non-matching pin with skip verify", [][]byte{otherPin[:]}, true, true},
+	}
+
+	for _, testCase := range testCases {
+		for _, tlsProfile := range []string{
+			protocol.TLS_PROFILE_CHROME_58, protocol.TLS_PROFILE_TLS13_RANDOMIZED} {
+
+			t.Run(testCase.description+" "+tlsProfile, func(t *testing.T) {
+
+				config := &CustomTLSConfig{
+					ClientParameters: clientParameters,
+					Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+						d := &net.Dialer{}
+						return d.DialContext(ctx, network, address)
+					},
+					SkipVerify:       testCase.skipVerify,
+					PinnedSPKISHA256: testCase.pins,
+					TLSProfile:       tlsProfile,
+				}
+				if !testCase.skipVerify {
+					config.VerifyLegacyCertificate = certificate
+				}
+
+				ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancelFunc()
+
+				conn, err := CustomTLSDial(ctx, "tcp", serverAddress, config)
+				if err == nil {
+					conn.Close()
+				}
+
+				if (err == nil) != testCase.expectSuccess {
+					t.Fatalf("unexpected CustomTLSDial result: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestPinnedSPKIVerifiedChain(t *testing.T) {
+
+	serverName := "www.example.org"
+
+	caPEM, tlsCertificate := makeTestCASignedCertificate(t, serverName)
+
+	// The pinned certificate is public, so a server with any other valid
+	// certificate chain may also send it. Pinning must not be satisfied by
+	// a certificate which is not part of the verified chain.
+
+	_, pinnedTLSCertificate := makeTestCASignedCertificate(t, serverName)
+	pinnedDER := pinnedTLSCertificate.Certificate[0]
+
+	tlsCertificate.Certificate = append(tlsCertificate.Certificate, pinnedDER)
+
+	serverAddress, stopServer := startTestTLSServerWithCertificate(t, tlsCertificate)
+	defer stopServer()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	getPin := func(der []byte) []byte {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("ParseCertificate failed: %s", err)
+		}
+		pin := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		return pin[:]
+	}
+
+	testCases := []struct {
+		description   string
+		pin           []byte
+		expectSuccess bool
+	}{
+		{"leaf pin", getPin(tlsCertificate.Certificate[0]), true},
+		{"CA pin", getPin(tlsCertificate.Certificate[1]), true},
+		{"unverified certificate pin", getPin(pinnedDER), false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			config := &CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					d := &net.Dialer{}
+					return d.DialContext(ctx, network, address)
+				},
+				SNIServerName:            serverName,
+				TrustedCACertificatesPEM: caPEM,
+				PinnedSPKISHA256:         [][]byte{testCase.pin},
+				TLSProfile:               protocol.TLS_PROFILE_CHROME_58,
+			}
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelFunc()
+
+			conn, err := CustomTLSDial(ctx, "tcp", serverAddress, config)
+			if err == nil {
+				conn.Close()
+			}
+
+			if (err == nil) != testCase.expectSuccess {
+				t.Fatalf("unexpected CustomTLSDial result: %v", err)
+			}
+		})
+	}
+}
+
+func TestTrustedCACertificatesPEM(t *testing.T) {
+
+	serverName := "www.example.org"
+
+	caPEM, tlsCertificate := makeTestCASignedCertificate(t, serverName)
+	otherCAPEM, _ := makeTestCASignedCertificate(t, serverName)
+
+	serverAddress, stopServer := startTestTLSServerWithCertificate(t, tlsCertificate)
+	defer stopServer()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	testCases := []struct {
+		description   string
+		caPEM         []byte
+		caFilename    string
+		expectSuccess bool
+	}{
+		{"signing CA", caPEM, "", true},
+		{"other CA", otherCAPEM, "", false},
+		{"signing CA ignores filename", caPEM, "/nonexistent/ca.pem", true},
+		{"filename fallback", nil, "/nonexistent/ca.pem", false},
+		{"invalid PEM", []byte("invalid"), "", false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			// Every dialed conn must be closed when CustomTLSDial fails.
+			var openConns int32
+
+			config := &CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					d := &net.Dialer{}
+					conn, err := d.DialContext(ctx, network, address)
+					if err != nil {
+						return nil, err
+					}
+					atomic.AddInt32(&openConns, 1)
+					return &testCloseNotifyConn{
+						Conn:    conn,
+						onClose: func() { atomic.AddInt32(&openConns, -1) },
+					}, nil
+				},
+				SNIServerName:                 serverName,
+				TrustedCACertificatesPEM:      testCase.caPEM,
+				TrustedCACertificatesFilename: testCase.caFilename,
+				TLSProfile:                    protocol.TLS_PROFILE_CHROME_58,
+			}
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelFunc()
+
+			conn, err := CustomTLSDial(ctx, "tcp", serverAddress, config)
+			if err == nil {
+				conn.Close()
+			}
+
+			if (err == nil) != testCase.expectSuccess {
+				t.Fatalf("unexpected CustomTLSDial result: %v", err)
+			}
+
+			if atomic.LoadInt32(&openConns) != 0 {
+				t.Fatalf("unexpected open conns: %d", openConns)
+			}
+		})
+	}
+}
+
+// testCloseNotifyConn invokes onClose once when the conn is closed.
+type testCloseNotifyConn struct {
+	net.Conn
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (conn *testCloseNotifyConn) Close() error {
+	conn.closeOnce.Do(conn.onClose)
+	return conn.Conn.Close()
+}
+
+// makeTestCASignedCertificate generates a new CA and a server certificate,
+// for serverName, signed by that CA. The PEM encoded CA certificate and the
+// server certificate chain are returned.
+func makeTestCASignedCertificate(
+	t *testing.T, serverName string) ([]byte, tris.Certificate) {
+
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(24 * time.Hour)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDER, err := x509.CreateCertificate(
+		rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err)
+	}
+
+	caCertificate, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %s", err)
+	}
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	serverDER, err := x509.CreateCertificate(
+		rand.Reader, serverTemplate, caCertificate, serverKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err)
+	}
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	tlsCertificate := tris.Certificate{
+		Certificate: [][]byte{serverDER, caDER},
+		PrivateKey:  serverKey,
+	}
+
+	return caPEM, tlsCertificate
+}
+
+func TestGetTLSConnNegotiatedVersion(t *testing.T) {
+
+	serverAddress, certificate, stopServer := startTestTLSServer(t)
+	defer stopServer()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	testCases := []struct {
+		tlsProfile          string
+		expectedVersion     uint16
+		expectedVersionName string
+	}{
+		{protocol.TLS_PROFILE_TLS13_RANDOMIZED, tris.VersionTLS13, "TLSv1.3"},
+		{protocol.TLS_PROFILE_CHROME_58, tris.VersionTLS12, "TLSv1.2"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.tlsProfile, func(t *testing.T) {
+
+			config := &CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					d := &net.Dialer{}
+					return d.DialContext(ctx, network, address)
+				},
+				VerifyLegacyCertificate: certificate,
+				TLSProfile:              testCase.tlsProfile,
+			}
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelFunc()
+
+			conn, err := CustomTLSDial(ctx, "tcp", serverAddress, config)
+			if err != nil {
+				t.Fatalf("CustomTLSDial failed: %s", err)
+			}
+			defer conn.Close()
+
+			version := GetTLSConnNegotiatedVersion(conn)
+			if version != testCase.expectedVersion {
+				t.Fatalf("unexpected TLS version: 0x%04x", version)
+			}
+
+			versionName := TLSVersionName(version)
+			if versionName != testCase.expectedVersionName {
+				t.Fatalf("unexpected TLS version name: %s", versionName)
+			}
+		})
+	}
+
+	// Test: a conn not dialed by CustomTLSDial reports no version
+
+	conn, err := net.Dial("tcp", serverAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	if GetTLSConnNegotiatedVersion(conn) != 0 {
+		t.Fatalf("unexpected TLS version for non-TLS conn")
+	}
+}
+
+func TestOnClientHello(t *testing.T) {
+
+	serverAddress, _, stopServer := startTestTLSServer(t)
+	defer stopServer()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	for _, tlsProfile := range []string{
+		protocol.TLS_PROFILE_CHROME_58,
+		protocol.TLS_PROFILE_RANDOMIZED,
+		protocol.TLS_PROFILE_TLS13_RANDOMIZED} {
+
+		for _, doPanic := range []bool{false, true} {
+
+			t.Run(fmt.Sprintf("%s panic %v", tlsProfile, doPanic), func(t *testing.T) {
+
+				callbackCount := 0
+				var callbackTLSProfile string
+				var callbackClientHello []byte
+
+				config := &CustomTLSConfig{
+					ClientParameters: clientParameters,
+					Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+						d := &net.Dialer{}
+						return d.DialContext(ctx, network, address)
+					},
+					SkipVerify: true,
+					TLSProfile: tlsProfile,
+					OnClientHello: func(tlsProfile string, clientHelloBytes []byte) {
+						callbackCount += 1
+						callbackTLSProfile = tlsProfile
+						callbackClientHello = clientHelloBytes
+						if doPanic {
+							panic("OnClientHello")
+						}
+					},
+				}
+
+				ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancelFunc()
+
+				conn, err := CustomTLSDial(ctx, "tcp", serverAddress, config)
+				if err != nil {
+					t.Fatalf("CustomTLSDial failed: %s", err)
+				}
+				conn.Close()
+
+				if callbackCount != 1 {
+					t.Fatalf("unexpected callback count: %d", callbackCount)
+				}
+
+				if callbackTLSProfile != tlsProfile {
+					t.Fatalf("unexpected TLS profile: %s", callbackTLSProfile)
+				}
+
+				// The handshake message type is ClientHello, 1, followed by
+				// the 3 byte message length.
+				if len(callbackClientHello) < 4 ||
+					callbackClientHello[0] != 1 ||
+					int(callbackClientHello[1])<<16|int(callbackClientHello[2])<<8|int(callbackClientHello[3]) !=
+						len(callbackClientHello)-4 {
+					t.Fatalf("unexpected ClientHello: %x", callbackClientHello)
+				}
+			})
+		}
+	}
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+
+	serverAddress, _, stopServer := startTestTLSServer(t)
+	defer stopServer()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	for _, rejectConnect := range []bool{false, true} {
+
+		t.Run(fmt.Sprintf("reject %v", rejectConnect), func(t *testing.T) {
+
+			proxyAddress, connectTargets, stopProxy := startTestHTTPConnectProxy(t, rejectConnect)
+			defer stopProxy()
+
+			config := &CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					d := &net.Dialer{}
+					return d.DialContext(ctx, network, address)
+				},
+				HTTPConnectProxyAddress: proxyAddress,
+				SkipVerify:              true,
+				TLSProfile:              protocol.TLS_PROFILE_CHROME_58,
+			}
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelFunc()
+
+			conn, err := CustomTLSDial(ctx, "tcp", serverAddress, config)
+
+			if rejectConnect {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("unexpected CustomTLSDial success")
+				}
+				if !strings.Contains(err.Error(), "407") {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("CustomTLSDial failed: %s", err)
+				}
+				conn.Close()
+			}
+
+			select {
+			case target := <-connectTargets:
+				if target != serverAddress {
+					t.Fatalf("unexpected CONNECT target: %s", target)
+				}
+			default:
+				t.Fatalf("missing CONNECT request")
+			}
+		})
+	}
+}
+
+// startTestHTTPConnectProxy runs a mock HTTP CONNECT proxy which reports
+// each CONNECT target and either rejects the request with a 407 response or
+// relays to the target.
+func startTestHTTPConnectProxy(
+	t *testing.T, rejectConnect bool) (string, chan string, func()) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	connectTargets := make(chan string, 16)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				request, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || request.Method != "CONNECT" {
+					return
+				}
+
+				connectTargets <- request.Host
+
+				if rejectConnect {
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+
+				targetConn, err := net.Dial("tcp", request.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer targetConn.Close()
+
+				conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+
+				go io.Copy(targetConn, conn)
+				io.Copy(conn, targetConn)
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String(), connectTargets, func() { listener.Close() }
+}
+
+// startTestTLSServer runs a tris TLS server, with a self-signed certificate,
+// that accepts and completes handshakes.
+func startTestTLSServer(t *testing.T) (string, *x509.Certificate, func()) {
+
+	certificate, privateKey, err := common.GenerateWebServerCertificate(common.GenerateHostName())
+	if err != nil {
+		t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+	}
+
+	tlsCertificate, err := tris.X509KeyPair([]byte(certificate), []byte(privateKey))
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %s", err)
+	}
+
+	x509Certificate, err := x509.ParseCertificate(tlsCertificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %s", err)
+	}
+
+	serverAddress, stopServer := startTestTLSServerWithCertificate(t, tlsCertificate)
+
+	return serverAddress, x509Certificate, stopServer
+}
+
+func startTestTLSServerWithCertificate(
+	t *testing.T, tlsCertificate tris.Certificate) (string, func()) {
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	tlsListener := tris.NewListener(
+		tcpListener,
+		&tris.Config{
+			Certificates:            []tris.Certificate{tlsCertificate},
+			MinVersion:              tris.VersionTLS10,
+			MaxVersion:              tris.VersionTLS13,
+			UseExtendedMasterSecret: true,
+		})
+
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tris.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	return tlsListener.Addr().String(), func() { tlsListener.Close() }
+}
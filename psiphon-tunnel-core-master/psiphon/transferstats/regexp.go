@@ -24,6 +24,12 @@ import (
 	"regexp"
 )
 
+const (
+	MAX_REGEX_LENGTH    = 1024
+	MAX_REPLACE_LENGTH  = 256
+	MAX_HOSTNAME_LENGTH = 255
+)
+
 type regexpReplace struct {
 	regexp  *regexp.Regexp
 	replace string
@@ -35,6 +41,13 @@ type Regexps []regexpReplace
 
 // MakeRegexps takes the raw string-map form of the regex-replace pairs
 // returned by the server handshake and turns them into a usable object.
+//
+// The regexes are compiled once, here, and then applied to each new
+// connection by regexHostname. Regexes longer than MAX_REGEX_LENGTH and
+// replace strings longer than MAX_REPLACE_LENGTH are discarded. Go regexes
+// are evaluated in time linear in the size of the input, without
+// backtracking, so, along with the regexHostname input size limit, these
+// limits bound the cost of applying server-supplied regexes.
 func MakeRegexps(pageViewRegexes, httpsRequestRegexes []map[string]string) (regexps *Regexps, notices []string) {
 	regexpsSlice := make(Regexps, 0)
 	notices = make([]string, 0)
@@ -53,6 +66,16 @@ func MakeRegexps(pageViewRegexes, httpsRequestRegexes []map[string]string) (rege
 			continue
 		}
 
+		if len(regexString) > MAX_REGEX_LENGTH {
+			notices = append(notices, "MakeRegexps: regex exceeds maximum length")
+			continue
+		}
+
+		if len(replace) > MAX_REPLACE_LENGTH {
+			notices = append(notices, "MakeRegexps: replace exceeds maximum length")
+			continue
+		}
+
 		regex, err := regexp.Compile(regexString)
 		if err != nil {
 			notices = append(notices, fmt.Sprintf("MakeRegexps: failed to compile regex: %s: %s", regexString, err))
@@ -68,10 +91,11 @@ func MakeRegexps(pageViewRegexes, httpsRequestRegexes []map[string]string) (rege
 }
 
 // regexHostname processes hostname through the given regexps and returns the
-// string that should be used for stats.
+// string that should be used for stats. Hostnames longer than
+// MAX_HOSTNAME_LENGTH, which are not valid DNS names, are not processed.
 func regexHostname(hostname string, regexps *Regexps) (statsHostname string) {
 	statsHostname = "(OTHER)"
-	if regexps != nil {
+	if regexps != nil && len(hostname) <= MAX_HOSTNAME_LENGTH {
 		for _, rr := range *regexps {
 			if rr.regexp.MatchString(hostname) {
 				statsHostname = rr.regexp.ReplaceAllString(hostname, rr.replace)
@@ -26,7 +26,9 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	mapset "github.com/deckarep/golang-set"
 	"github.com/stretchr/testify/suite"
@@ -219,6 +221,46 @@ func (suite *StatsTestSuite) Test_MakeRegexps() {
 	suite.Len(notices, 1, "should have returned one notice")
 }
 
+func (suite *StatsTestSuite) Test_RegexBounds() {
+	pageViewRegexes := make([]map[string]string, 0)
+
+	// Regexes and replace strings exceeding the maximum lengths are discarded
+
+	httpsRequestRegexes := []map[string]string{make(map[string]string), make(map[string]string)}
+	httpsRequestRegexes[0]["regex"] = "^" + strings.Repeat("a", MAX_REGEX_LENGTH) + "$"
+	httpsRequestRegexes[0]["replace"] = "$1"
+	httpsRequestRegexes[1]["regex"] = `^(example\.com)$`
+	httpsRequestRegexes[1]["replace"] = strings.Repeat("a", MAX_REPLACE_LENGTH+1)
+	regexps, notices := MakeRegexps(pageViewRegexes, httpsRequestRegexes)
+	suite.Len(*regexps, 0, "should have discarded both regexps")
+	suite.Len(notices, 2, "should have returned two notices")
+
+	// Catastrophic backtracking patterns are evaluated in linear time
+
+	httpsRequestRegexes = []map[string]string{
+		{"regex": `^(a+)+$`, "replace": "nested"},
+		{"regex": `^(a|a)*$`, "replace": "alternation"},
+		{"regex": `^(a|aa)+$`, "replace": "overlapping"},
+	}
+	regexps, notices = MakeRegexps(pageViewRegexes, httpsRequestRegexes)
+	suite.Len(*regexps, 3, "should have processed all regexps")
+	suite.Len(notices, 0, "should return no notices")
+
+	hostname := strings.Repeat("a", MAX_HOSTNAME_LENGTH-1) + "!"
+
+	startTime := time.Now()
+	for i := 0; i < 100; i++ {
+		suite.Equal("(OTHER)", regexHostname(hostname, regexps))
+	}
+	suite.True(time.Since(startTime) < 5*time.Second, "regex evaluation should be bounded")
+
+	suite.Equal("nested", regexHostname(strings.Repeat("a", MAX_HOSTNAME_LENGTH), regexps))
+
+	// Hostnames exceeding the maximum length are not processed
+
+	suite.Equal("(OTHER)", regexHostname(strings.Repeat("a", MAX_HOSTNAME_LENGTH+1), regexps))
+}
+
 func (suite *StatsTestSuite) Test_Regex() {
 	// We'll make a new client with actual regexps.
 	pageViewRegexes := make([]map[string]string, 0)
@@ -76,6 +76,7 @@ type Tunneler interface {
 type TunnelOwner interface {
 	SignalSeededNewSLOK()
 	SignalTunnelFailure(tunnel *Tunnel)
+	SignalBytesTransferred(sent, received int64)
 }
 
 // Tunnel is a connection to a Psiphon server. An established
@@ -510,6 +511,26 @@ type dialResult struct {
 	sshRequests   <-chan *ssh.Request
 }
 
+// GetBuildCapabilities returns the server entry capabilities corresponding
+// to the tunnel protocols supported by this client build. Protocols which
+// require optional build tags, such as Marionette and TapDance, are omitted
+// when not enabled. The result may be passed to
+// protocol.ServerEntry.GetUsableProtocols.
+func GetBuildCapabilities() []string {
+	buildCapabilities := make([]string, 0)
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+		if protocol.TunnelProtocolUsesMarionette(tunnelProtocol) && !marionette.Enabled() {
+			continue
+		}
+		if protocol.TunnelProtocolUsesTapdance(tunnelProtocol) && !tapdance.Enabled() {
+			continue
+		}
+		buildCapabilities = append(
+			buildCapabilities, protocol.GetCapability(tunnelProtocol))
+	}
+	return buildCapabilities
+}
+
 // dialTunnel is a helper that builds the transport layers and establishes the
 // SSH connection. When additional dial configuration is used, dial metrics
 // are recorded and returned.
@@ -531,7 +552,10 @@ func dialTunnel(
 	}
 
 	p := config.clientParameters.Get()
-	timeout := p.Duration(parameters.TunnelConnectTimeout)
+	timeout := p.TunnelProtocolDuration(
+		parameters.TunnelConnectTimeouts,
+		dialParams.TunnelProtocol,
+		parameters.TunnelConnectTimeout)
 	rateLimits := p.RateLimits(parameters.TunnelRateLimits)
 	obfuscatedSSHMinPadding := p.Int(parameters.ObfuscatedSSHMinPadding)
 	obfuscatedSSHMaxPadding := p.Int(parameters.ObfuscatedSSHMaxPadding)
@@ -815,8 +839,8 @@ func dialTunnel(
 				// candidate before selecting a successful tunnel.
 				//
 				// Note that the liveness test is subject to the
-				// TunnelConnectTimeout, which should be adjusted
-				// accordinging.
+				// TunnelConnectTimeout, or any TunnelConnectTimeouts
+				// override, which should be adjusted accordinging.
 
 				var metrics *livenessTestMetrics
 				metrics, err = performLivenessTest(
@@ -1093,6 +1117,10 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			totalSent += sent
 			totalReceived += received
 
+			if sent > 0 || received > 0 {
+				tunnelOwner.SignalBytesTransferred(sent, received)
+			}
+
 			p := clientParameters.Get()
 			noticePeriod := p.Duration(parameters.TotalBytesTransferredNoticePeriod)
 			replayTargetUpstreamBytes := p.Int(parameters.ReplayTargetUpstreamBytes)